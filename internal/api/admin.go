@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sr-backend-home-assessment/internal/cache"
+	"strconv"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	adminProducer = "admin-api"
+
+	defaultCachePageSize = 100
+	maxCachePageSize     = 1000
+)
+
+type deviceCache interface {
+	Get(string) (cache.DeviceState, bool)
+	Set(string, cache.DeviceState)
+	Delete(string)
+	List(context.Context, string, int) ([]cache.Entry, string, error)
+}
+
+func (a *API) GetCacheEntry(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	state, exists := a.Cache.Get(deviceID)
+	if !exists {
+		http.Error(w, "device not in cache", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertCacheEntry(deviceID, state))
+}
+
+func (a *API) ListCache(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCachePageSize
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxCachePageSize {
+			http.Error(w, "invalid limit query param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, next, err := a.Cache.List(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, cache.ErrInvalidCursor) {
+		http.Error(w, "invalid cursor query param", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListCacheResponse{
+		Devices:    make([]CacheEntry, 0, len(entries)),
+		NextCursor: next,
+	}
+	for _, e := range entries {
+		resp.Devices = append(resp.Devices, convertCacheEntry(e.DeviceID, e.State))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// PutCacheEntry sets the state of a device. The state is first written to the compacted topic as
+// a record, so the correction survives restarts, then set in the cache. The record is a correction
+// of the current state of the device, so the visit history built by the Packer is kept
+func (a *API) PutCacheEntry(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	var req SetCacheEntryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.LastEvent != k.DeviceEnter && req.LastEvent != k.DeviceExit {
+		http.Error(w, "invalid lastEvent, must be device_enter or device_exit", http.StatusBadRequest)
+		return
+	}
+	timestamp, err := time.Parse(time.RFC3339, req.LastTimestampSeen)
+	if err != nil {
+		http.Error(w, "invalid lastTimestampSeen", http.StatusBadRequest)
+		return
+	}
+
+	current, _ := a.States.State(deviceID)
+	record, err := k.NewStateRecord(adminProducer, current.Correct(k.DeviceEvent{
+		DeviceID:  deviceID,
+		EventType: req.LastEvent,
+		Timestamp: timestamp.UnixMilli(),
+	}), req.LastEventID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	md, ok := k.ParseMetadata(record.Headers)
+	if !ok {
+		http.Error(w, "state record has no metadata headers", http.StatusInternalServerError)
+		return
+	}
+	if err := a.Compacted.WriteMessages(r.Context(), record); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The same state hydration will read back from the record
+	state := cache.DeviceState{
+		LastEvent:         req.LastEvent,
+		LastTimestampSeen: timestamp.UnixMilli(),
+		LastEventID:       md.EventID,
+	}
+	a.Cache.Set(deviceID, state)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertCacheEntry(deviceID, state))
+}
+
+// DeleteCacheEntry removes a device from the cache, and writes a tombstone for it to the compacted
+// topic so it is not restored on restart
+func (a *API) DeleteCacheEntry(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	if err := a.Compacted.WriteMessages(r.Context(), k.NewTombstone(deviceID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Cache.Delete(deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetStorageStats returns the size of every chunk of the events hypertable, its compression ratio,
+// and the compression and retention policies applied to it
+func (a *API) GetStorageStats(w http.ResponseWriter, r *http.Request) {
+	policies, err := a.DB.LoadStoragePolicies(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chunks, err := a.DB.LoadChunkStats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := StorageStatsResponse{
+		CompressAfter: policies.CompressAfter.String(),
+		RetainFor:     policies.RetainFor.String(),
+		Chunks:        make([]ChunkStats, 0, len(chunks)),
+	}
+	var before, after int64
+	for _, c := range chunks {
+		resp.Chunks = append(resp.Chunks, ChunkStats{
+			Name:                   c.Name,
+			RangeStart:             time.UnixMilli(c.RangeStart).UTC().Format(time.RFC3339),
+			RangeEnd:               time.UnixMilli(c.RangeEnd).UTC().Format(time.RFC3339),
+			Compressed:             c.Compressed,
+			TotalBytes:             c.TotalBytes,
+			BeforeCompressionBytes: c.BeforeCompressionBytes,
+			AfterCompressionBytes:  c.AfterCompressionBytes,
+		})
+		resp.TotalBytes += c.TotalBytes
+		if c.Compressed && c.BeforeCompressionBytes != nil && c.AfterCompressionBytes != nil {
+			before += *c.BeforeCompressionBytes
+			after += *c.AfterCompressionBytes
+		}
+	}
+	if after > 0 {
+		resp.CompressionRatio = float64(before) / float64(after)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func convertCacheEntry(deviceID string, state cache.DeviceState) CacheEntry {
+	return CacheEntry{
+		DeviceID:          deviceID,
+		LastEvent:         state.LastEvent,
+		LastTimestampSeen: time.UnixMilli(state.LastTimestampSeen).UTC().Format(time.RFC3339),
+		LastEventID:       state.LastEventID,
+	}
+}
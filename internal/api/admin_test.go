@@ -0,0 +1,400 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sr-backend-home-assessment/internal/cache"
+	"sr-backend-home-assessment/internal/db"
+	"testing"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func withDeviceID(req *http.Request, deviceID string) *http.Request {
+	ctx := chi.NewRouteContext()
+	ctx.URLParams.Add("device_id", deviceID)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+}
+
+func Test_GetCacheEntry(t *testing.T) {
+	cases := []struct {
+		name           string
+		setupCache     func() deviceCache
+		expectedStatus int
+		expectedEntry  CacheEntry
+	}{
+		{
+			name: "happy path",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{
+					LastEvent:         "device_enter",
+					LastTimestampSeen: 1696118400000,
+					LastEventID:       "event123",
+				}, true)
+				return c
+			},
+			expectedStatus: http.StatusOK,
+			expectedEntry: CacheEntry{
+				DeviceID:          "device123",
+				LastEvent:         "device_enter",
+				LastTimestampSeen: "2023-10-01T00:00:00Z",
+				LastEventID:       "event123",
+			},
+		},
+		{
+			name: "device not in cache",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false)
+				return c
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{Cache: tt.setupCache()})
+			req := withDeviceID(httptest.NewRequest(http.MethodGet, "https://test.com/admin/cache/device123", nil), "device123")
+			w := httptest.NewRecorder()
+			api.GetCacheEntry(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				var entry CacheEntry
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&entry))
+				assert.Equal(t, tt.expectedEntry, entry)
+			}
+		})
+	}
+}
+
+func Test_ListCache(t *testing.T) {
+	cases := []struct {
+		name             string
+		setupCache       func() deviceCache
+		inputQuery       string
+		expectedStatus   int
+		expectedResponse ListCacheResponse
+	}{
+		{
+			name: "happy path - default limit",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().List(mock.Anything, "", defaultCachePageSize).Return([]cache.Entry{
+					{DeviceID: "a", State: cache.DeviceState{LastEvent: "device_exit", LastTimestampSeen: 1696118400000}},
+				}, "", nil)
+				return c
+			},
+			inputQuery:     "",
+			expectedStatus: http.StatusOK,
+			expectedResponse: ListCacheResponse{
+				Devices: []CacheEntry{
+					{DeviceID: "a", LastEvent: "device_exit", LastTimestampSeen: "2023-10-01T00:00:00Z"},
+				},
+			},
+		},
+		{
+			name: "happy path - cursor and limit",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().List(mock.Anything, "a", 1).Return([]cache.Entry{
+					{DeviceID: "b", State: cache.DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1696118400000}},
+				}, "b", nil)
+				return c
+			},
+			inputQuery:     "cursor=a&limit=1",
+			expectedStatus: http.StatusOK,
+			expectedResponse: ListCacheResponse{
+				Devices: []CacheEntry{
+					{DeviceID: "b", LastEvent: "device_enter", LastTimestampSeen: "2023-10-01T00:00:00Z"},
+				},
+				NextCursor: "b",
+			},
+		},
+		{
+			name:           "invalid limit",
+			setupCache:     func() deviceCache { return NewMockdeviceCache(t) },
+			inputQuery:     "limit=0",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "invalid cursor",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().List(mock.Anything, "bad", defaultCachePageSize).Return(nil, "", cache.ErrInvalidCursor)
+				return c
+			},
+			inputQuery:     "cursor=bad",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "cache error",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().List(mock.Anything, "", defaultCachePageSize).Return(nil, "", errors.New("failed"))
+				return c
+			},
+			inputQuery:     "",
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{Cache: tt.setupCache()})
+			req := httptest.NewRequest(http.MethodGet, "https://test.com/admin/cache?"+tt.inputQuery, nil)
+			w := httptest.NewRecorder()
+			api.ListCache(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				var resp ListCacheResponse
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.expectedResponse, resp)
+			}
+		})
+	}
+}
+
+func Test_PutCacheEntry(t *testing.T) {
+	expectedState := cache.DeviceState{
+		LastEvent:         "device_exit",
+		LastTimestampSeen: 1696118400000,
+		LastEventID:       "event123",
+	}
+	isRecord := mock.MatchedBy(func(msgs []kafka.Message) bool {
+		if len(msgs) != 1 || string(msgs[0].Key) != "device123" {
+			return false
+		}
+		state, err := k.DecodeState(msgs[0].Value)
+		if err != nil {
+			return false
+		}
+		md, ok := k.ParseMetadata(msgs[0].Headers)
+		return ok && md.EventID == "event123" && state.DeviceID == "device123" && !state.Present &&
+			state.LastEvent == "device_exit" && state.LastTimestamp == 1696118400000 &&
+			state.TotalVisits == 3 && state.DwellMillis == 5000
+	})
+	setupStates := func() stateView {
+		s := NewMockstateView(t)
+		s.EXPECT().State("device123").Return(k.DeviceState{
+			DeviceID:      "device123",
+			Present:       true,
+			LastEvent:     "device_enter",
+			LastTimestamp: 1696114800000,
+			TotalVisits:   3,
+			DwellMillis:   5000,
+		}, true)
+		return s
+	}
+
+	cases := []struct {
+		name           string
+		setupCache     func() deviceCache
+		setupWriter    func() k.Writer
+		setupStates    func() stateView
+		payload        string
+		expectedStatus int
+	}{
+		{
+			name: "happy path",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Set("device123", expectedState).Return()
+				return c
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, isRecord).Return(nil)
+				return w
+			},
+			setupStates:    setupStates,
+			payload:        `{"lastEvent":"device_exit","lastTimestampSeen":"2023-10-01T00:00:00Z","lastEventID":"event123"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "invalid request body",
+			setupCache:     func() deviceCache { return NewMockdeviceCache(t) },
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			setupStates:    func() stateView { return NewMockstateView(t) },
+			payload:        `not-a-json`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid event",
+			setupCache:     func() deviceCache { return NewMockdeviceCache(t) },
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			setupStates:    func() stateView { return NewMockstateView(t) },
+			payload:        `{"lastEvent":"heartbeat","lastTimestampSeen":"2023-10-01T00:00:00Z"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid timestamp",
+			setupCache:     func() deviceCache { return NewMockdeviceCache(t) },
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			setupStates:    func() stateView { return NewMockstateView(t) },
+			payload:        `{"lastEvent":"device_exit","lastTimestampSeen":"not-a-timestamp"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "write failed - cache unchanged",
+			setupCache: func() deviceCache {
+				return NewMockdeviceCache(t)
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, isRecord).Return(errors.New("failed"))
+				return w
+			},
+			setupStates:    setupStates,
+			payload:        `{"lastEvent":"device_exit","lastTimestampSeen":"2023-10-01T00:00:00Z","lastEventID":"event123"}`,
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{Cache: tt.setupCache(), Compacted: tt.setupWriter(), States: tt.setupStates()})
+			req := withDeviceID(httptest.NewRequest(http.MethodPut, "https://test.com/admin/cache/device123", bytes.NewBufferString(tt.payload)), "device123")
+			w := httptest.NewRecorder()
+			api.PutCacheEntry(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func Test_DeleteCacheEntry(t *testing.T) {
+	tombstone := []kafka.Message{{Key: []byte("device123")}}
+
+	cases := []struct {
+		name           string
+		setupCache     func() deviceCache
+		setupWriter    func() k.Writer
+		expectedStatus int
+	}{
+		{
+			name: "happy path",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Delete("device123").Return()
+				return c
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, tombstone).Return(nil)
+				return w
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:       "write failed - cache unchanged",
+			setupCache: func() deviceCache { return NewMockdeviceCache(t) },
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, tombstone).Return(errors.New("failed"))
+				return w
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{Cache: tt.setupCache(), Compacted: tt.setupWriter()})
+			req := withDeviceID(httptest.NewRequest(http.MethodDelete, "https://test.com/admin/cache/device123", nil), "device123")
+			w := httptest.NewRecorder()
+			api.DeleteCacheEntry(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func Test_GetStorageStats(t *testing.T) {
+	before, after := int64(8000), int64(1000)
+	policies := db.StoragePolicies{CompressAfter: 7 * 24 * time.Hour, RetainFor: 365 * 24 * time.Hour}
+
+	cases := []struct {
+		name           string
+		setupDB        func() repository
+		expectedStatus int
+		expectedBody   *StorageStatsResponse
+	}{
+		{
+			name: "compressed and uncompressed chunks",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().LoadStoragePolicies(mock.Anything).Return(policies, nil)
+				d.EXPECT().LoadChunkStats(mock.Anything).Return([]db.ChunkStats{
+					{Name: "_hyper_1_1_chunk", RangeStart: 0, RangeEnd: 86_400_000, Compressed: true, TotalBytes: 1000,
+						BeforeCompressionBytes: &before, AfterCompressionBytes: &after},
+					{Name: "_hyper_1_2_chunk", RangeStart: 86_400_000, RangeEnd: 172_800_000, TotalBytes: 4000},
+				}, nil)
+				return d
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody: &StorageStatsResponse{
+				CompressAfter: "168h0m0s",
+				RetainFor:     "8760h0m0s",
+				Chunks: []ChunkStats{
+					{Name: "_hyper_1_1_chunk", RangeStart: "1970-01-01T00:00:00Z", RangeEnd: "1970-01-02T00:00:00Z",
+						Compressed: true, TotalBytes: 1000, BeforeCompressionBytes: &before, AfterCompressionBytes: &after},
+					{Name: "_hyper_1_2_chunk", RangeStart: "1970-01-02T00:00:00Z", RangeEnd: "1970-01-03T00:00:00Z",
+						TotalBytes: 4000},
+				},
+				TotalBytes:       5000,
+				CompressionRatio: 8,
+			},
+		},
+		{
+			name: "no chunks",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().LoadStoragePolicies(mock.Anything).Return(db.StoragePolicies{}, nil)
+				d.EXPECT().LoadChunkStats(mock.Anything).Return([]db.ChunkStats{}, nil)
+				return d
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   &StorageStatsResponse{CompressAfter: "0s", RetainFor: "0s", Chunks: []ChunkStats{}},
+		},
+		{
+			name: "DB failed",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().LoadStoragePolicies(mock.Anything).Return(policies, nil)
+				d.EXPECT().LoadChunkStats(mock.Anything).Return(nil, errors.New("db down"))
+				return d
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{DB: tt.setupDB()})
+			req := httptest.NewRequest(http.MethodGet, "https://test.com/admin/storage", nil)
+			w := httptest.NewRecorder()
+			api.GetStorageStats(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != nil {
+				var got StorageStatsResponse
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+				assert.Equal(t, *tt.expectedBody, got)
+			}
+		})
+	}
+}
@@ -3,12 +3,16 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sr-backend-home-assessment/internal/db"
+	"strconv"
 	"time"
 
+	k "sr-backend-home-assessment/internal/kafka"
+
 	"github.com/go-chi/chi/v5"
 )
 
@@ -16,61 +20,180 @@ var (
 	ErrInvalidTimestamp = fmt.Errorf("invalid timestamp")
 )
 
+const (
+	defaultTimelinePageSize = 1000
+	maxTimelinePageSize     = 10000
+)
+
+// conflictPolicies maps the onConflict values of a CreateDeviceEventsRequest to DB policies
+var conflictPolicies = map[string]db.ConflictPolicy{
+	"":          db.ConflictReject,
+	"reject":    db.ConflictReject,
+	"ignore":    db.ConflictIgnore,
+	"overwrite": db.ConflictOverwrite,
+}
+
 type repository interface {
-	CreateTimeline(context.Context, []db.DeviceEvent) error
-	LoadEventsBetween(context.Context, string, int64, int64) ([]db.DeviceEvent, error)
+	CreateTimeline(context.Context, []db.DeviceEvent, db.ConflictPolicy) ([]db.EventStatus, error)
+	LoadEventsPage(context.Context, string, int64, int64, db.Page) ([]db.DeviceEvent, string, error)
+	LoadSessionsBetween(context.Context, string, int64, int64) ([]db.DeviceSession, error)
+	LoadStats(context.Context, string, db.StatsBucket, int64, int64) ([]db.DeviceStats, error)
+	LoadStoragePolicies(context.Context) (db.StoragePolicies, error)
+	LoadChunkStats(context.Context) ([]db.ChunkStats, error)
+	RetireDevice(context.Context, string) error
+	RegisterDevice(context.Context, string) error
 }
 
 type API struct {
-	DB repository
+	DB    repository
+	Cache deviceCache
+	// States is the current state of every device, as published to the compacted topic
+	States stateView
+	// Compacted writes corrected device state to the compacted topic
+	Compacted k.Writer
+	// Cleaned writes to the cleaned topic, from which the Packer forwards to the compacted topic
+	Cleaned k.Writer
 }
 
 type Config struct {
-	DB repository
+	DB        repository
+	Cache     deviceCache
+	States    stateView
+	Compacted k.Writer
+	Cleaned   k.Writer
 }
 
 func New(cfg Config) *API {
-	return &API{DB: cfg.DB}
+	return &API{
+		DB:        cfg.DB,
+		Cache:     cfg.Cache,
+		States:    cfg.States,
+		Compacted: cfg.Compacted,
+		Cleaned:   cfg.Cleaned,
+	}
 }
 
 func (a *API) GetDeviceTimeline(w http.ResponseWriter, r *http.Request) {
 	deviceID := chi.URLParam(r, "device_id")
-	startStr, err := url.QueryUnescape(r.URL.Query().Get("start"))
-	if err != nil {
-		http.Error(w, "invalid start query param", http.StatusBadRequest)
+	startTimeUnix, endTimeUnix, ok := parseTimeRange(w, r)
+	if !ok {
 		return
 	}
-	endStr, err := url.QueryUnescape(r.URL.Query().Get("end"))
-	if err != nil {
-		http.Error(w, "invalid end query param", http.StatusBadRequest)
+
+	page := db.Page{
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  defaultTimelinePageSize,
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		page.Limit, err = strconv.Atoi(limitStr)
+		if err != nil || page.Limit <= 0 || page.Limit > maxTimelinePageSize {
+			http.Error(w, "invalid limit query param", http.StatusBadRequest)
+			return
+		}
+	}
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		http.Error(w, "invalid order query param, must be asc or desc", http.StatusBadRequest)
 		return
 	}
 
-	startTime, err := time.Parse(time.RFC3339, startStr)
+	events, next, err := a.DB.LoadEventsPage(r.Context(), deviceID, startTimeUnix, endTimeUnix, page)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		http.Error(w, "invalid cursor query param", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "invalid start timestamp", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	startTimeUnix := startTime.UnixMilli()
-	endTime, err := time.Parse(time.RFC3339, endStr)
+
+	resp := GetDeviceTimelineResponse{NextCursor: next}
+	for _, event := range events {
+		resp.Events = append(resp.Events, DeviceEvent{
+			DeviceID:        event.DeviceID,
+			EventType:       event.EventType,
+			Timestamp:       time.UnixMilli(event.Timestamp).UTC().Format(time.RFC3339),
+			EventID:         event.EventID,
+			SourceTopic:     event.SourceTopic,
+			SourcePartition: event.SourcePartition,
+			SourceOffset:    event.SourceOffset,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetDeviceSessions returns the sessions of a device that started between the start and end query
+// params, the open session included
+func (a *API) GetDeviceSessions(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	startTimeUnix, endTimeUnix, ok := parseTimeRange(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := a.DB.LoadSessionsBetween(r.Context(), deviceID, startTimeUnix, endTimeUnix)
 	if err != nil {
-		http.Error(w, "invalid end timestamp", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	endTimeUnix := endTime.UnixMilli()
 
-	events, err := a.DB.LoadEventsBetween(r.Context(), deviceID, startTimeUnix, endTimeUnix)
+	resp := GetDeviceSessionsResponse{Sessions: []DeviceSession{}}
+	for _, session := range sessions {
+		s := DeviceSession{
+			DeviceID:       session.DeviceID,
+			Start:          time.UnixMilli(session.Start).UTC().Format(time.RFC3339),
+			DurationMillis: session.DurationMillis,
+		}
+		if session.End != nil {
+			end := time.UnixMilli(*session.End).UTC().Format(time.RFC3339)
+			s.End = &end
+		}
+		resp.Sessions = append(resp.Sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetDeviceStats returns the enter and exit counts of a device per bucket, 1h by default or 1d,
+// for the buckets beginning between the start and end query params
+func (a *API) GetDeviceStats(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	startTimeUnix, endTimeUnix, ok := parseTimeRange(w, r)
+	if !ok {
+		return
+	}
+	bucket := db.StatsBucket(r.URL.Query().Get("bucket"))
+	if bucket == "" {
+		bucket = db.StatsHourly
+	}
+	if bucket != db.StatsHourly && bucket != db.StatsDaily {
+		http.Error(w, "invalid bucket query param, must be 1h or 1d", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := a.DB.LoadStats(r.Context(), deviceID, bucket, startTimeUnix, endTimeUnix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var resp GetDeviceTimelineResponse
-	for _, event := range events {
-		resp.Events = append(resp.Events, DeviceEvent{
-			DeviceID:  event.DeviceID,
-			EventType: event.EventType,
-			Timestamp: time.UnixMilli(event.Timestamp).Format(time.RFC3339),
+	resp := GetDeviceStatsResponse{
+		DeviceID: deviceID,
+		Bucket:   string(bucket),
+		Stats:    make([]DeviceStats, 0, len(stats)),
+	}
+	for _, s := range stats {
+		resp.Stats = append(resp.Stats, DeviceStats{
+			Start:  time.UnixMilli(s.Bucket).UTC().Format(time.RFC3339),
+			Enters: s.Enters,
+			Exits:  s.Exits,
 		})
 	}
 
@@ -85,17 +208,65 @@ func (a *API) CreateDeviceTimeline(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	policy, ok := conflictPolicies[timeline.OnConflict]
+	if !ok {
+		http.Error(w, "invalid onConflict, must be reject, ignore or overwrite", http.StatusBadRequest)
+		return
+	}
 	dbEvents, err := convertEventsToDB(timeline.Events)
 	if err != nil {
 		http.Error(w, "invalid data in request body", http.StatusBadRequest)
 		return
 	}
 
-	if err := a.DB.CreateTimeline(r.Context(), dbEvents); err != nil {
+	statuses, err := a.DB.CreateTimeline(r.Context(), dbEvents, policy)
+	if errors.Is(err, db.ErrDuplicateEvent) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	resp := CreateDeviceEventsResponse{Results: make([]EventResult, 0, len(statuses))}
+	for i, status := range statuses {
+		resp.Results = append(resp.Results, EventResult{
+			DeviceID:  timeline.Events[i].DeviceID,
+			Timestamp: timeline.Events[i].Timestamp,
+			Status:    string(status),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseTimeRange parses the start and end RFC3339 query params into Unix epoch milliseconds. On
+// failure, a bad request is written and ok is false
+func parseTimeRange(w http.ResponseWriter, r *http.Request) (start, end int64, ok bool) {
+	startStr, err := url.QueryUnescape(r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "invalid start query param", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	endStr, err := url.QueryUnescape(r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "invalid end query param", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	startTime, err := time.Parse(time.RFC3339, startStr)
+	if err != nil {
+		http.Error(w, "invalid start timestamp", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	endTime, err := time.Parse(time.RFC3339, endStr)
+	if err != nil {
+		http.Error(w, "invalid end timestamp", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return startTime.UnixMilli(), endTime.UnixMilli(), true
 }
 
 func convertEventsToDB(events []DeviceEvent) ([]db.DeviceEvent, error) {
@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"sr-backend-home-assessment/internal/db"
 	"testing"
 	"time"
@@ -16,72 +18,130 @@ import (
 )
 
 func Test_GetDeviceTimeline(t *testing.T) {
+	start := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	end := time.Date(2023, 10, 2, 0, 0, 0, 0, time.UTC).UnixMilli()
+
 	cases := []struct {
 		name           string
-		setupDB        func(string, string, string) repository
-		inputDeviceID  string
+		setupDB        func() repository
 		inputStartTime string
 		inputEndTime   string
+		inputQuery     string
 		expectedStatus int
+		expectedBody   *GetDeviceTimelineResponse
 	}{
 		{
 			name: "valid request",
-			setupDB: func(inputDeviceID, inputStartTime, inputEndTime string) repository {
-				inputStartTimeRFC, _ := time.Parse(time.RFC3339, inputStartTime)
-				inputStartTimeMilli := inputStartTimeRFC.UnixMilli()
-				inputEndTimeRFC, _ := time.Parse(time.RFC3339, inputEndTime)
-				inputEndTimeMilli := inputEndTimeRFC.UnixMilli()
+			setupDB: func() repository {
+				mockRepo := &Mockrepository{}
+				mockRepo.EXPECT().LoadEventsPage(
+					mock.Anything,
+					"device123",
+					start,
+					end,
+					db.Page{Limit: defaultTimelinePageSize},
+				).Return([]db.DeviceEvent{}, "", nil)
+				return mockRepo
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			inputEndTime:   "2023-10-02T00:00:00Z",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "page with next cursor",
+			setupDB: func() repository {
 				mockRepo := &Mockrepository{}
-				mockRepo.EXPECT().LoadEventsBetween(
+				mockRepo.EXPECT().LoadEventsPage(
 					mock.Anything,
-					inputDeviceID,
-					inputStartTimeMilli,
-					inputEndTimeMilli,
-				).Return([]db.DeviceEvent{}, nil)
+					"device123",
+					start,
+					end,
+					db.Page{Cursor: "prev", Limit: 1, Descending: true},
+				).Return([]db.DeviceEvent{
+					{DeviceID: "device123", EventType: "device_exit", Timestamp: start + 60_000},
+				}, "next", nil)
 				return mockRepo
 			},
-			inputDeviceID:  "device123",
 			inputStartTime: "2023-10-01T00:00:00Z",
 			inputEndTime:   "2023-10-02T00:00:00Z",
+			inputQuery:     "&limit=1&order=desc&cursor=prev",
 			expectedStatus: http.StatusOK,
+			expectedBody: &GetDeviceTimelineResponse{
+				Events: []DeviceEvent{
+					{DeviceID: "device123", EventType: "device_exit", Timestamp: "2023-10-01T00:01:00Z"},
+				},
+				NextCursor: "next",
+			},
+		},
+		{
+			name: "invalid cursor",
+			setupDB: func() repository {
+				mockRepo := &Mockrepository{}
+				mockRepo.EXPECT().LoadEventsPage(
+					mock.Anything,
+					"device123",
+					start,
+					end,
+					db.Page{Cursor: "bad", Limit: defaultTimelinePageSize},
+				).Return(nil, "", fmt.Errorf("DB:LoadEventsPage:%w", db.ErrInvalidCursor))
+				return mockRepo
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			inputEndTime:   "2023-10-02T00:00:00Z",
+			inputQuery:     "&cursor=bad",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "invalid limit",
+			setupDB: func() repository {
+				return &Mockrepository{}
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			inputEndTime:   "2023-10-02T00:00:00Z",
+			inputQuery:     "&limit=0",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "invalid order",
+			setupDB: func() repository {
+				return &Mockrepository{}
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			inputEndTime:   "2023-10-02T00:00:00Z",
+			inputQuery:     "&order=sideways",
+			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name: "invalid start time",
-			setupDB: func(inputDeviceID, inputStartTime, inputEndTime string) repository {
+			setupDB: func() repository {
 				return &Mockrepository{}
 			},
-			inputDeviceID:  "device123",
 			inputStartTime: "bad",
 			inputEndTime:   "2023-10-02T00:00:00Z",
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name: "invalid end time",
-			setupDB: func(inputDeviceID, inputStartTime, inputEndTime string) repository {
+			setupDB: func() repository {
 				return &Mockrepository{}
 			},
-			inputDeviceID:  "device123",
 			inputStartTime: "2023-10-01T00:00:00Z",
 			inputEndTime:   "bad",
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name: "database error",
-			setupDB: func(inputDeviceID, inputStartTime, inputEndTime string) repository {
-				inputStartTimeRFC, _ := time.Parse(time.RFC3339, inputStartTime)
-				inputStartTimeMilli := inputStartTimeRFC.UnixMilli()
-				inputEndTimeRFC, _ := time.Parse(time.RFC3339, inputEndTime)
-				inputEndTimeMilli := inputEndTimeRFC.UnixMilli()
+			setupDB: func() repository {
 				mockRepo := &Mockrepository{}
-				mockRepo.EXPECT().LoadEventsBetween(
+				mockRepo.EXPECT().LoadEventsPage(
 					mock.Anything,
-					inputDeviceID,
-					inputStartTimeMilli,
-					inputEndTimeMilli,
-				).Return(nil, errors.New("database error"))
+					"device123",
+					start,
+					end,
+					db.Page{Limit: defaultTimelinePageSize},
+				).Return(nil, "", errors.New("database error"))
 				return mockRepo
 			},
-			inputDeviceID:  "device123",
 			inputStartTime: "2023-10-01T00:00:00Z",
 			inputEndTime:   "2023-10-02T00:00:00Z",
 			expectedStatus: http.StatusInternalServerError,
@@ -91,33 +151,239 @@ func Test_GetDeviceTimeline(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			api := New(Config{
-				DB: tt.setupDB(tt.inputDeviceID, tt.inputStartTime, tt.inputEndTime),
+				DB: tt.setupDB(),
 			})
 
-			req := httptest.NewRequest(http.MethodGet, "https://test.com/timeline/"+tt.inputDeviceID, nil)
+			req := httptest.NewRequest(http.MethodGet, "https://test.com/timeline/device123", nil)
 			ctx := chi.NewRouteContext()
-			ctx.URLParams.Add("device_id", tt.inputDeviceID)
-			req.URL.RawQuery = "start=" + tt.inputStartTime + "&end=" + tt.inputEndTime
+			ctx.URLParams.Add("device_id", "device123")
+			req.URL.RawQuery = "start=" + tt.inputStartTime + "&end=" + tt.inputEndTime + tt.inputQuery
 			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
 
-			w := &httptest.ResponseRecorder{}
+			w := httptest.NewRecorder()
 			api.GetDeviceTimeline(w, req)
 
 			if w.Code != tt.expectedStatus {
-				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedBody != nil {
+				var got GetDeviceTimelineResponse
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("invalid response body: %v", err)
+				}
+				if !reflect.DeepEqual(got, *tt.expectedBody) {
+					t.Errorf("expected body %+v, got %+v", *tt.expectedBody, got)
+				}
 			}
 		})
 	}
+}
+
+func Test_GetDeviceSessions(t *testing.T) {
+	start := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	end := time.Date(2023, 10, 2, 0, 0, 0, 0, time.UTC).UnixMilli()
+	closedEnd, duration := start+90_000, int64(60_000)
+	closedEndRFC := time.UnixMilli(closedEnd).UTC().Format(time.RFC3339)
+
+	cases := []struct {
+		name           string
+		setupDB        func() repository
+		inputStartTime string
+		expectedStatus int
+		expectedBody   *GetDeviceSessionsResponse
+	}{
+		{
+			name: "closed and open sessions",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadSessionsBetween(mock.Anything, "device123", start, end).Return([]db.DeviceSession{
+					{DeviceID: "device123", Start: start + 30_000, End: &closedEnd, DurationMillis: &duration},
+					{DeviceID: "device123", Start: start + 120_000},
+				}, nil)
+				return mockRepo
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			expectedStatus: http.StatusOK,
+			expectedBody: &GetDeviceSessionsResponse{Sessions: []DeviceSession{
+				{
+					DeviceID:       "device123",
+					Start:          time.UnixMilli(start + 30_000).UTC().Format(time.RFC3339),
+					End:            &closedEndRFC,
+					DurationMillis: &duration,
+				},
+				{
+					DeviceID: "device123",
+					Start:    time.UnixMilli(start + 120_000).UTC().Format(time.RFC3339),
+				},
+			}},
+		},
+		{
+			name: "no sessions",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadSessionsBetween(mock.Anything, "device123", start, end).Return(nil, nil)
+				return mockRepo
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			expectedStatus: http.StatusOK,
+			expectedBody:   &GetDeviceSessionsResponse{Sessions: []DeviceSession{}},
+		},
+		{
+			name:           "invalid start time",
+			setupDB:        func() repository { return NewMockrepository(t) },
+			inputStartTime: "bad",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "database error",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadSessionsBetween(mock.Anything, "device123", start, end).Return(nil, errors.New("database error"))
+				return mockRepo
+			},
+			inputStartTime: "2023-10-01T00:00:00Z",
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{DB: tt.setupDB()})
+
+			req := httptest.NewRequest(http.MethodGet, "https://test.com/timeline/device123/sessions", nil)
+			ctx := chi.NewRouteContext()
+			ctx.URLParams.Add("device_id", "device123")
+			req.URL.RawQuery = "start=" + tt.inputStartTime + "&end=2023-10-02T00:00:00Z"
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+			w := httptest.NewRecorder()
+			api.GetDeviceSessions(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedBody != nil {
+				var got GetDeviceSessionsResponse
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("invalid response body: %v", err)
+				}
+				if !reflect.DeepEqual(got, *tt.expectedBody) {
+					t.Errorf("expected body %+v, got %+v", *tt.expectedBody, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_GetDeviceStats(t *testing.T) {
+	start := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	end := time.Date(2023, 10, 2, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+	cases := []struct {
+		name           string
+		setupDB        func() repository
+		inputQuery     string
+		expectedStatus int
+		expectedBody   *GetDeviceStatsResponse
+	}{
+		{
+			name: "hourly by default",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadStats(mock.Anything, "device123", db.StatsHourly, start, end).Return([]db.DeviceStats{
+					{DeviceID: "device123", Bucket: start, Enters: 3, Exits: 2},
+					{DeviceID: "device123", Bucket: start + 3_600_000, Enters: 1, Exits: 0},
+				}, nil)
+				return mockRepo
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody: &GetDeviceStatsResponse{
+				DeviceID: "device123",
+				Bucket:   "1h",
+				Stats: []DeviceStats{
+					{Start: time.UnixMilli(start).UTC().Format(time.RFC3339), Enters: 3, Exits: 2},
+					{Start: time.UnixMilli(start + 3_600_000).UTC().Format(time.RFC3339), Enters: 1, Exits: 0},
+				},
+			},
+		},
+		{
+			name: "daily without stats",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadStats(mock.Anything, "device123", db.StatsDaily, start, end).Return([]db.DeviceStats{}, nil)
+				return mockRepo
+			},
+			inputQuery:     "&bucket=1d",
+			expectedStatus: http.StatusOK,
+			expectedBody:   &GetDeviceStatsResponse{DeviceID: "device123", Bucket: "1d", Stats: []DeviceStats{}},
+		},
+		{
+			name:           "invalid bucket",
+			setupDB:        func() repository { return NewMockrepository(t) },
+			inputQuery:     "&bucket=1w",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "database error",
+			setupDB: func() repository {
+				mockRepo := NewMockrepository(t)
+				mockRepo.EXPECT().LoadStats(mock.Anything, "device123", db.StatsHourly, start, end).Return(nil, errors.New("database error"))
+				return mockRepo
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{DB: tt.setupDB()})
+
+			req := httptest.NewRequest(http.MethodGet, "https://test.com/stats/device123", nil)
+			ctx := chi.NewRouteContext()
+			ctx.URLParams.Add("device_id", "device123")
+			req.URL.RawQuery = "start=2023-10-01T00:00:00Z&end=2023-10-02T00:00:00Z" + tt.inputQuery
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, ctx))
+
+			w := httptest.NewRecorder()
+			api.GetDeviceStats(w, req)
 
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedBody != nil {
+				var got GetDeviceStatsResponse
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("invalid response body: %v", err)
+				}
+				if !reflect.DeepEqual(got, *tt.expectedBody) {
+					t.Errorf("expected body %+v, got %+v", *tt.expectedBody, got)
+				}
+			}
+		})
+	}
 }
 
 func Test_CreateDeviceTimeline(t *testing.T) {
+	payload := func(onConflict string) func() string {
+		return func() string {
+			req := CreateDeviceEventsRequest{
+				Events: []DeviceEvent{
+					{DeviceID: "device123", EventType: "on", Timestamp: "2023-10-01T00:00:00Z"},
+					{DeviceID: "device123", EventType: "off", Timestamp: "2023-10-01T01:00:00Z"},
+				},
+				OnConflict: onConflict,
+			}
+			data, _ := json.Marshal(req)
+			return string(data)
+		}
+	}
 
 	cases := []struct {
 		name           string
 		setupDB        func([]db.DeviceEvent) repository
 		payload        func() string
 		expectedStatus int
+		expectedBody   *CreateDeviceEventsResponse
 	}{
 		{
 			name: "happy path",
@@ -126,19 +392,74 @@ func Test_CreateDeviceTimeline(t *testing.T) {
 				mockRepo.EXPECT().CreateTimeline(
 					mock.Anything,
 					events,
-				).Return(nil)
+					db.ConflictReject,
+				).Return([]db.EventStatus{db.EventInserted, db.EventInserted}, nil)
 				return mockRepo
 			},
-			payload: func() string {
-				req := CreateDeviceEventsRequest{
-					Events: []DeviceEvent{
-						{DeviceID: "device123", EventType: "on", Timestamp: "2023-10-01T00:00:00Z"},
-					},
-				}
-				data, _ := json.Marshal(req)
-				return string(data)
+			payload:        payload(""),
+			expectedStatus: http.StatusCreated,
+			expectedBody: &CreateDeviceEventsResponse{Results: []EventResult{
+				{DeviceID: "device123", Timestamp: "2023-10-01T00:00:00Z", Status: "inserted"},
+				{DeviceID: "device123", Timestamp: "2023-10-01T01:00:00Z", Status: "inserted"},
+			}},
+		},
+		{
+			name: "duplicate ignored",
+			setupDB: func(events []db.DeviceEvent) repository {
+				mockRepo := &Mockrepository{}
+				mockRepo.EXPECT().CreateTimeline(
+					mock.Anything,
+					events,
+					db.ConflictIgnore,
+				).Return([]db.EventStatus{db.EventDuplicate, db.EventInserted}, nil)
+				return mockRepo
 			},
+			payload:        payload("ignore"),
 			expectedStatus: http.StatusCreated,
+			expectedBody: &CreateDeviceEventsResponse{Results: []EventResult{
+				{DeviceID: "device123", Timestamp: "2023-10-01T00:00:00Z", Status: "duplicate"},
+				{DeviceID: "device123", Timestamp: "2023-10-01T01:00:00Z", Status: "inserted"},
+			}},
+		},
+		{
+			name: "duplicate overwritten",
+			setupDB: func(events []db.DeviceEvent) repository {
+				mockRepo := &Mockrepository{}
+				mockRepo.EXPECT().CreateTimeline(
+					mock.Anything,
+					events,
+					db.ConflictOverwrite,
+				).Return([]db.EventStatus{db.EventOverwritten, db.EventInserted}, nil)
+				return mockRepo
+			},
+			payload:        payload("overwrite"),
+			expectedStatus: http.StatusCreated,
+			expectedBody: &CreateDeviceEventsResponse{Results: []EventResult{
+				{DeviceID: "device123", Timestamp: "2023-10-01T00:00:00Z", Status: "overwritten"},
+				{DeviceID: "device123", Timestamp: "2023-10-01T01:00:00Z", Status: "inserted"},
+			}},
+		},
+		{
+			name: "duplicate rejected",
+			setupDB: func(events []db.DeviceEvent) repository {
+				mockRepo := &Mockrepository{}
+				mockRepo.EXPECT().CreateTimeline(
+					mock.Anything,
+					events,
+					db.ConflictReject,
+				).Return(nil, fmt.Errorf("DB:CreateTimeline:%w", db.ErrDuplicateEvent))
+				return mockRepo
+			},
+			payload:        payload("reject"),
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "invalid conflict policy",
+			setupDB: func(events []db.DeviceEvent) repository {
+				return &Mockrepository{}
+			},
+			payload:        payload("replace"),
+			expectedStatus: http.StatusBadRequest,
 		},
 		{
 			name: "invalid request body",
@@ -171,18 +492,11 @@ func Test_CreateDeviceTimeline(t *testing.T) {
 				mockRepo.EXPECT().CreateTimeline(
 					mock.Anything,
 					events,
-				).Return(errors.New("database error"))
+					db.ConflictReject,
+				).Return(nil, errors.New("database error"))
 				return mockRepo
 			},
-			payload: func() string {
-				req := CreateDeviceEventsRequest{
-					Events: []DeviceEvent{
-						{DeviceID: "device123", EventType: "on", Timestamp: "2023-10-01T00:00:00Z"},
-					},
-				}
-				data, _ := json.Marshal(req)
-				return string(data)
-			},
+			payload:        payload(""),
 			expectedStatus: http.StatusInternalServerError,
 		},
 	}
@@ -198,11 +512,20 @@ func Test_CreateDeviceTimeline(t *testing.T) {
 
 			reqBody := bytes.NewBufferString(tt.payload())
 			r := httptest.NewRequest(http.MethodPost, "https://test.com/timeline", reqBody)
-			w := &httptest.ResponseRecorder{}
+			w := httptest.NewRecorder()
 			api.CreateDeviceTimeline(w, r)
 
 			if w.Code != tt.expectedStatus {
-				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedBody != nil {
+				var got CreateDeviceEventsResponse
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("invalid response body: %v", err)
+				}
+				if !reflect.DeepEqual(got, *tt.expectedBody) {
+					t.Errorf("expected body %+v, got %+v", *tt.expectedBody, got)
+				}
 			}
 		})
 	}
@@ -4,12 +4,125 @@ type DeviceEvent struct {
 	DeviceID  string `json:"deviceID"`
 	EventType string `json:"eventType"`
 	Timestamp string `json:"timestamp"`
+
+	// Lineage, only returned for events that came through the pipeline
+	EventID         *string `json:"eventID,omitempty"`
+	SourceTopic     *string `json:"sourceTopic,omitempty"`
+	SourcePartition *int32  `json:"sourcePartition,omitempty"`
+	SourceOffset    *int64  `json:"sourceOffset,omitempty"`
 }
 
 type CreateDeviceEventsRequest struct {
 	Events []DeviceEvent `json:"events"`
+	// OnConflict is what to do with an event already stored for its device and timestamp: "reject",
+	// the default, fails the whole request, "ignore" keeps the stored event, and "overwrite"
+	// replaces it
+	OnConflict string `json:"onConflict,omitempty"`
+}
+
+// EventResult is the outcome of writing one event: "inserted", "duplicate" if it was skipped, or
+// "overwritten"
+type EventResult struct {
+	DeviceID  string `json:"deviceID"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+}
+
+type CreateDeviceEventsResponse struct {
+	Results []EventResult `json:"results"`
 }
 
 type GetDeviceTimelineResponse struct {
 	Events []DeviceEvent `json:"events"`
+	// NextCursor is passed as the cursor query param, with the same order, to get the next page,
+	// empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// DeviceSession is the time a device spent present, from a device_enter to the following
+// device_exit
+type DeviceSession struct {
+	DeviceID string `json:"deviceID"`
+	Start    string `json:"start"`
+	// End and DurationMillis are only returned once the session is closed
+	End            *string `json:"end,omitempty"`
+	DurationMillis *int64  `json:"durationMs,omitempty"`
+}
+
+type GetDeviceSessionsResponse struct {
+	Sessions []DeviceSession `json:"sessions"`
+}
+
+// DeviceStats is the number of enters and exits of a device in the bucket beginning at Start
+type DeviceStats struct {
+	Start  string `json:"start"`
+	Enters int64  `json:"enters"`
+	Exits  int64  `json:"exits"`
+}
+
+type GetDeviceStatsResponse struct {
+	DeviceID string `json:"deviceID"`
+	// Bucket is the width of the buckets, 1h or 1d
+	Bucket string        `json:"bucket"`
+	Stats  []DeviceStats `json:"stats"`
+}
+
+// CacheEntry is the cached state of a device
+type CacheEntry struct {
+	DeviceID          string `json:"deviceID"`
+	LastEvent         string `json:"lastEvent"`
+	LastTimestampSeen string `json:"lastTimestampSeen"`
+	LastEventID       string `json:"lastEventID,omitempty"`
+}
+
+type ListCacheResponse struct {
+	Devices []CacheEntry `json:"devices"`
+	// NextCursor is passed as the cursor query param to get the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type SetCacheEntryRequest struct {
+	LastEvent         string `json:"lastEvent"`
+	LastTimestampSeen string `json:"lastTimestampSeen"`
+	LastEventID       string `json:"lastEventID,omitempty"`
+}
+
+// DeviceStateResponse is the current state of a device, built from every event of the device
+type DeviceStateResponse struct {
+	DeviceID      string `json:"deviceID"`
+	Present       bool   `json:"present"`
+	LastEvent     string `json:"lastEvent"`
+	LastTimestamp string `json:"lastTimestamp"`
+	// EnteredAt is the enter of the current visit, only returned while the device is present
+	EnteredAt *string `json:"enteredAt,omitempty"`
+	// LastExitAt is the exit of the last completed visit
+	LastExitAt  *string `json:"lastExitAt,omitempty"`
+	TotalVisits int64   `json:"totalVisits"`
+	// DwellSeconds is the time spent present over every completed visit
+	DwellSeconds int64 `json:"dwellSeconds"`
+}
+
+// ChunkStats is the size of one chunk of the events hypertable, holding the events from RangeStart
+// to RangeEnd
+type ChunkStats struct {
+	Name       string `json:"name"`
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+	Compressed bool   `json:"compressed"`
+	TotalBytes int64  `json:"totalBytes"`
+	// BeforeCompressionBytes and AfterCompressionBytes are only returned for compressed chunks
+	BeforeCompressionBytes *int64 `json:"beforeCompressionBytes,omitempty"`
+	AfterCompressionBytes  *int64 `json:"afterCompressionBytes,omitempty"`
+}
+
+// StorageStatsResponse is the storage of the events hypertable, to tune its policies
+type StorageStatsResponse struct {
+	// CompressAfter and RetainFor are the current policies, as durations, 0s if disabled
+	CompressAfter string       `json:"compressAfter"`
+	RetainFor     string       `json:"retainFor"`
+	Chunks        []ChunkStats `json:"chunks"`
+	TotalBytes    int64        `json:"totalBytes"`
+	// CompressionRatio is the size of the compressed chunks before compression over their size
+	// after, 0 if no chunk is compressed
+	CompressionRatio float64 `json:"compressionRatio"`
 }
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type stateView interface {
+	State(string) (k.DeviceState, bool)
+}
+
+func (a *API) GetDeviceState(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	state, exists := a.States.State(deviceID)
+	if !exists {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(convertDeviceState(state))
+}
+
+// DeleteDevice decommissions a device. It is first marked as retired, so every Cleaner replica
+// rejects its events once its last registry check expires, then removed from the local cache, and
+// a tombstone is published to the cleaned topic, which the Packer forwards to remove the device
+// from the compacted topic. Every step is idempotent, so a failed request can be retried
+func (a *API) DeleteDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	if err := a.DB.RetireDevice(r.Context(), deviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.Cache.Delete(deviceID)
+	if err := a.Cleaned.WriteMessages(r.Context(), k.NewTombstone(deviceID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterDevice registers a device, so that the events of a retired device are accepted again
+func (a *API) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := chi.URLParam(r, "device_id")
+	if err := a.DB.RegisterDevice(r.Context(), deviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func convertDeviceState(state k.DeviceState) DeviceStateResponse {
+	format := func(timestamp *int64) *string {
+		if timestamp == nil {
+			return nil
+		}
+		formatted := time.UnixMilli(*timestamp).UTC().Format(time.RFC3339)
+		return &formatted
+	}
+	return DeviceStateResponse{
+		DeviceID:      state.DeviceID,
+		Present:       state.Present,
+		LastEvent:     state.LastEvent,
+		LastTimestamp: time.UnixMilli(state.LastTimestamp).UTC().Format(time.RFC3339),
+		EnteredAt:     format(state.EnteredAt),
+		LastExitAt:    format(state.LastExitAt),
+		TotalVisits:   state.TotalVisits,
+		DwellSeconds:  state.DwellMillis / 1000,
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_GetDeviceState(t *testing.T) {
+	enteredAt, lastExitAt := int64(1696118400000), int64(1696114800000)
+
+	cases := []struct {
+		name             string
+		setupStates      func() stateView
+		expectedStatus   int
+		expectedResponse DeviceStateResponse
+	}{
+		{
+			name: "happy path",
+			setupStates: func() stateView {
+				s := NewMockstateView(t)
+				s.EXPECT().State("device123").Return(k.DeviceState{
+					DeviceID:      "device123",
+					Present:       true,
+					LastEvent:     "device_enter",
+					LastTimestamp: enteredAt,
+					EnteredAt:     &enteredAt,
+					LastExitAt:    &lastExitAt,
+					TotalVisits:   4,
+					DwellMillis:   90_500,
+				}, true)
+				return s
+			},
+			expectedStatus: http.StatusOK,
+			expectedResponse: DeviceStateResponse{
+				DeviceID:      "device123",
+				Present:       true,
+				LastEvent:     "device_enter",
+				LastTimestamp: "2023-10-01T00:00:00Z",
+				EnteredAt:     func() *string { s := "2023-10-01T00:00:00Z"; return &s }(),
+				LastExitAt:    func() *string { s := "2023-09-30T23:00:00Z"; return &s }(),
+				TotalVisits:   4,
+				DwellSeconds:  90,
+			},
+		},
+		{
+			name: "device not found",
+			setupStates: func() stateView {
+				s := NewMockstateView(t)
+				s.EXPECT().State("device123").Return(k.DeviceState{}, false)
+				return s
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{States: tt.setupStates()})
+			req := withDeviceID(httptest.NewRequest(http.MethodGet, "https://test.com/devices/device123/state", nil), "device123")
+			w := httptest.NewRecorder()
+			api.GetDeviceState(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				var resp DeviceStateResponse
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equal(t, tt.expectedResponse, resp)
+			}
+		})
+	}
+}
+
+func Test_DeleteDevice(t *testing.T) {
+	tombstone := []kafka.Message{{Key: []byte("device123")}}
+
+	cases := []struct {
+		name           string
+		setupDB        func() repository
+		setupCache     func() deviceCache
+		setupWriter    func() k.Writer
+		expectedStatus int
+	}{
+		{
+			name: "happy path",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().RetireDevice(mock.Anything, "device123").Return(nil)
+				return d
+			},
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Delete("device123").Return()
+				return c
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, tombstone).Return(nil)
+				return w
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name: "retire failed - cache unchanged",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().RetireDevice(mock.Anything, "device123").Return(errors.New("failed"))
+				return d
+			},
+			setupCache:     func() deviceCache { return NewMockdeviceCache(t) },
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "tombstone write failed",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().RetireDevice(mock.Anything, "device123").Return(nil)
+				return d
+			},
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Delete("device123").Return()
+				return c
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, tombstone).Return(errors.New("failed"))
+				return w
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{DB: tt.setupDB(), Cache: tt.setupCache(), Cleaned: tt.setupWriter()})
+			req := withDeviceID(httptest.NewRequest(http.MethodDelete, "https://test.com/devices/device123", nil), "device123")
+			w := httptest.NewRecorder()
+			api.DeleteDevice(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func Test_RegisterDevice(t *testing.T) {
+	cases := []struct {
+		name           string
+		setupDB        func() repository
+		expectedStatus int
+	}{
+		{
+			name: "happy path",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().RegisterDevice(mock.Anything, "device123").Return(nil)
+				return d
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name: "register failed",
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().RegisterDevice(mock.Anything, "device123").Return(errors.New("failed"))
+				return d
+			},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(Config{DB: tt.setupDB()})
+			req := withDeviceID(httptest.NewRequest(http.MethodPut, "https://test.com/devices/device123", nil), "device123")
+			w := httptest.NewRecorder()
+			api.RegisterDevice(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
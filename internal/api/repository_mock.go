@@ -39,20 +39,31 @@ func (_m *Mockrepository) EXPECT() *Mockrepository_Expecter {
 }
 
 // CreateTimeline provides a mock function for the type Mockrepository
-func (_mock *Mockrepository) CreateTimeline(context1 context.Context, deviceEvents []db.DeviceEvent) error {
-	ret := _mock.Called(context1, deviceEvents)
+func (_mock *Mockrepository) CreateTimeline(context1 context.Context, deviceEvents []db.DeviceEvent, conflictPolicy db.ConflictPolicy) ([]db.EventStatus, error) {
+	ret := _mock.Called(context1, deviceEvents, conflictPolicy)
 
 	if len(ret) == 0 {
 		panic("no return value specified for CreateTimeline")
 	}
 
-	var r0 error
-	if returnFunc, ok := ret.Get(0).(func(context.Context, []db.DeviceEvent) error); ok {
-		r0 = returnFunc(context1, deviceEvents)
+	var r0 []db.EventStatus
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []db.DeviceEvent, db.ConflictPolicy) ([]db.EventStatus, error)); ok {
+		return returnFunc(context1, deviceEvents, conflictPolicy)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context, []db.DeviceEvent, db.ConflictPolicy) []db.EventStatus); ok {
+		r0 = returnFunc(context1, deviceEvents, conflictPolicy)
 	} else {
-		r0 = ret.Error(0)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]db.EventStatus)
+		}
 	}
-	return r0
+	if returnFunc, ok := ret.Get(1).(func(context.Context, []db.DeviceEvent, db.ConflictPolicy) error); ok {
+		r1 = returnFunc(context1, deviceEvents, conflictPolicy)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
 }
 
 // Mockrepository_CreateTimeline_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CreateTimeline'
@@ -63,11 +74,12 @@ type Mockrepository_CreateTimeline_Call struct {
 // CreateTimeline is a helper method to define mock.On call
 //   - context1 context.Context
 //   - deviceEvents []db.DeviceEvent
-func (_e *Mockrepository_Expecter) CreateTimeline(context1 interface{}, deviceEvents interface{}) *Mockrepository_CreateTimeline_Call {
-	return &Mockrepository_CreateTimeline_Call{Call: _e.mock.On("CreateTimeline", context1, deviceEvents)}
+//   - conflictPolicy db.ConflictPolicy
+func (_e *Mockrepository_Expecter) CreateTimeline(context1 interface{}, deviceEvents interface{}, conflictPolicy interface{}) *Mockrepository_CreateTimeline_Call {
+	return &Mockrepository_CreateTimeline_Call{Call: _e.mock.On("CreateTimeline", context1, deviceEvents, conflictPolicy)}
 }
 
-func (_c *Mockrepository_CreateTimeline_Call) Run(run func(context1 context.Context, deviceEvents []db.DeviceEvent)) *Mockrepository_CreateTimeline_Call {
+func (_c *Mockrepository_CreateTimeline_Call) Run(run func(context1 context.Context, deviceEvents []db.DeviceEvent, conflictPolicy db.ConflictPolicy)) *Mockrepository_CreateTimeline_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		var arg0 context.Context
 		if args[0] != nil {
@@ -77,42 +89,201 @@ func (_c *Mockrepository_CreateTimeline_Call) Run(run func(context1 context.Cont
 		if args[1] != nil {
 			arg1 = args[1].([]db.DeviceEvent)
 		}
+		var arg2 db.ConflictPolicy
+		if args[2] != nil {
+			arg2 = args[2].(db.ConflictPolicy)
+		}
 		run(
 			arg0,
 			arg1,
+			arg2,
 		)
 	})
 	return _c
 }
 
-func (_c *Mockrepository_CreateTimeline_Call) Return(err error) *Mockrepository_CreateTimeline_Call {
-	_c.Call.Return(err)
+func (_c *Mockrepository_CreateTimeline_Call) Return(eventStatuss []db.EventStatus, err error) *Mockrepository_CreateTimeline_Call {
+	_c.Call.Return(eventStatuss, err)
 	return _c
 }
 
-func (_c *Mockrepository_CreateTimeline_Call) RunAndReturn(run func(context1 context.Context, deviceEvents []db.DeviceEvent) error) *Mockrepository_CreateTimeline_Call {
+func (_c *Mockrepository_CreateTimeline_Call) RunAndReturn(run func(context1 context.Context, deviceEvents []db.DeviceEvent, conflictPolicy db.ConflictPolicy) ([]db.EventStatus, error)) *Mockrepository_CreateTimeline_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
-// LoadEventsBetween provides a mock function for the type Mockrepository
-func (_mock *Mockrepository) LoadEventsBetween(context1 context.Context, s string, n int64, n1 int64) ([]db.DeviceEvent, error) {
-	ret := _mock.Called(context1, s, n, n1)
+// LoadChunkStats provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) LoadChunkStats(context1 context.Context) ([]db.ChunkStats, error) {
+	ret := _mock.Called(context1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadChunkStats")
+	}
+
+	var r0 []db.ChunkStats
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context) ([]db.ChunkStats, error)); ok {
+		return returnFunc(context1)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context) []db.ChunkStats); ok {
+		r0 = returnFunc(context1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]db.ChunkStats)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = returnFunc(context1)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Mockrepository_LoadChunkStats_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadChunkStats'
+type Mockrepository_LoadChunkStats_Call struct {
+	*mock.Call
+}
+
+// LoadChunkStats is a helper method to define mock.On call
+//   - context1 context.Context
+func (_e *Mockrepository_Expecter) LoadChunkStats(context1 interface{}) *Mockrepository_LoadChunkStats_Call {
+	return &Mockrepository_LoadChunkStats_Call{Call: _e.mock.On("LoadChunkStats", context1)}
+}
+
+func (_c *Mockrepository_LoadChunkStats_Call) Run(run func(context1 context.Context)) *Mockrepository_LoadChunkStats_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_LoadChunkStats_Call) Return(chunkStatss []db.ChunkStats, err error) *Mockrepository_LoadChunkStats_Call {
+	_c.Call.Return(chunkStatss, err)
+	return _c
+}
+
+func (_c *Mockrepository_LoadChunkStats_Call) RunAndReturn(run func(context1 context.Context) ([]db.ChunkStats, error)) *Mockrepository_LoadChunkStats_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// LoadEventsPage provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) LoadEventsPage(context1 context.Context, s string, n int64, n1 int64, page db.Page) ([]db.DeviceEvent, string, error) {
+	ret := _mock.Called(context1, s, n, n1, page)
 
 	if len(ret) == 0 {
-		panic("no return value specified for LoadEventsBetween")
+		panic("no return value specified for LoadEventsPage")
 	}
 
 	var r0 []db.DeviceEvent
+	var r1 string
+	var r2 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64, db.Page) ([]db.DeviceEvent, string, error)); ok {
+		return returnFunc(context1, s, n, n1, page)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64, db.Page) []db.DeviceEvent); ok {
+		r0 = returnFunc(context1, s, n, n1, page)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]db.DeviceEvent)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context, string, int64, int64, db.Page) string); ok {
+		r1 = returnFunc(context1, s, n, n1, page)
+	} else {
+		r1 = ret.Get(1).(string)
+	}
+	if returnFunc, ok := ret.Get(2).(func(context.Context, string, int64, int64, db.Page) error); ok {
+		r2 = returnFunc(context1, s, n, n1, page)
+	} else {
+		r2 = ret.Error(2)
+	}
+	return r0, r1, r2
+}
+
+// Mockrepository_LoadEventsPage_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadEventsPage'
+type Mockrepository_LoadEventsPage_Call struct {
+	*mock.Call
+}
+
+// LoadEventsPage is a helper method to define mock.On call
+//   - context1 context.Context
+//   - s string
+//   - n int64
+//   - n1 int64
+//   - page db.Page
+func (_e *Mockrepository_Expecter) LoadEventsPage(context1 interface{}, s interface{}, n interface{}, n1 interface{}, page interface{}) *Mockrepository_LoadEventsPage_Call {
+	return &Mockrepository_LoadEventsPage_Call{Call: _e.mock.On("LoadEventsPage", context1, s, n, n1, page)}
+}
+
+func (_c *Mockrepository_LoadEventsPage_Call) Run(run func(context1 context.Context, s string, n int64, n1 int64, page db.Page)) *Mockrepository_LoadEventsPage_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 string
+		if args[1] != nil {
+			arg1 = args[1].(string)
+		}
+		var arg2 int64
+		if args[2] != nil {
+			arg2 = args[2].(int64)
+		}
+		var arg3 int64
+		if args[3] != nil {
+			arg3 = args[3].(int64)
+		}
+		var arg4 db.Page
+		if args[4] != nil {
+			arg4 = args[4].(db.Page)
+		}
+		run(
+			arg0,
+			arg1,
+			arg2,
+			arg3,
+			arg4,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_LoadEventsPage_Call) Return(deviceEvents []db.DeviceEvent, s string, err error) *Mockrepository_LoadEventsPage_Call {
+	_c.Call.Return(deviceEvents, s, err)
+	return _c
+}
+
+func (_c *Mockrepository_LoadEventsPage_Call) RunAndReturn(run func(context1 context.Context, s string, n int64, n1 int64, page db.Page) ([]db.DeviceEvent, string, error)) *Mockrepository_LoadEventsPage_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// LoadSessionsBetween provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) LoadSessionsBetween(context1 context.Context, s string, n int64, n1 int64) ([]db.DeviceSession, error) {
+	ret := _mock.Called(context1, s, n, n1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadSessionsBetween")
+	}
+
+	var r0 []db.DeviceSession
 	var r1 error
-	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64) ([]db.DeviceEvent, error)); ok {
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64) ([]db.DeviceSession, error)); ok {
 		return returnFunc(context1, s, n, n1)
 	}
-	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64) []db.DeviceEvent); ok {
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, int64, int64) []db.DeviceSession); ok {
 		r0 = returnFunc(context1, s, n, n1)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]db.DeviceEvent)
+			r0 = ret.Get(0).([]db.DeviceSession)
 		}
 	}
 	if returnFunc, ok := ret.Get(1).(func(context.Context, string, int64, int64) error); ok {
@@ -123,21 +294,21 @@ func (_mock *Mockrepository) LoadEventsBetween(context1 context.Context, s strin
 	return r0, r1
 }
 
-// Mockrepository_LoadEventsBetween_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadEventsBetween'
-type Mockrepository_LoadEventsBetween_Call struct {
+// Mockrepository_LoadSessionsBetween_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadSessionsBetween'
+type Mockrepository_LoadSessionsBetween_Call struct {
 	*mock.Call
 }
 
-// LoadEventsBetween is a helper method to define mock.On call
+// LoadSessionsBetween is a helper method to define mock.On call
 //   - context1 context.Context
 //   - s string
 //   - n int64
 //   - n1 int64
-func (_e *Mockrepository_Expecter) LoadEventsBetween(context1 interface{}, s interface{}, n interface{}, n1 interface{}) *Mockrepository_LoadEventsBetween_Call {
-	return &Mockrepository_LoadEventsBetween_Call{Call: _e.mock.On("LoadEventsBetween", context1, s, n, n1)}
+func (_e *Mockrepository_Expecter) LoadSessionsBetween(context1 interface{}, s interface{}, n interface{}, n1 interface{}) *Mockrepository_LoadSessionsBetween_Call {
+	return &Mockrepository_LoadSessionsBetween_Call{Call: _e.mock.On("LoadSessionsBetween", context1, s, n, n1)}
 }
 
-func (_c *Mockrepository_LoadEventsBetween_Call) Run(run func(context1 context.Context, s string, n int64, n1 int64)) *Mockrepository_LoadEventsBetween_Call {
+func (_c *Mockrepository_LoadSessionsBetween_Call) Run(run func(context1 context.Context, s string, n int64, n1 int64)) *Mockrepository_LoadSessionsBetween_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		var arg0 context.Context
 		if args[0] != nil {
@@ -165,12 +336,272 @@ func (_c *Mockrepository_LoadEventsBetween_Call) Run(run func(context1 context.C
 	return _c
 }
 
-func (_c *Mockrepository_LoadEventsBetween_Call) Return(deviceEvents []db.DeviceEvent, err error) *Mockrepository_LoadEventsBetween_Call {
-	_c.Call.Return(deviceEvents, err)
+func (_c *Mockrepository_LoadSessionsBetween_Call) Return(deviceSessions []db.DeviceSession, err error) *Mockrepository_LoadSessionsBetween_Call {
+	_c.Call.Return(deviceSessions, err)
+	return _c
+}
+
+func (_c *Mockrepository_LoadSessionsBetween_Call) RunAndReturn(run func(context1 context.Context, s string, n int64, n1 int64) ([]db.DeviceSession, error)) *Mockrepository_LoadSessionsBetween_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// LoadStats provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) LoadStats(context1 context.Context, s string, statsBucket db.StatsBucket, n int64, n1 int64) ([]db.DeviceStats, error) {
+	ret := _mock.Called(context1, s, statsBucket, n, n1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadStats")
+	}
+
+	var r0 []db.DeviceStats
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, db.StatsBucket, int64, int64) ([]db.DeviceStats, error)); ok {
+		return returnFunc(context1, s, statsBucket, n, n1)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string, db.StatsBucket, int64, int64) []db.DeviceStats); ok {
+		r0 = returnFunc(context1, s, statsBucket, n, n1)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]db.DeviceStats)
+		}
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context, string, db.StatsBucket, int64, int64) error); ok {
+		r1 = returnFunc(context1, s, statsBucket, n, n1)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Mockrepository_LoadStats_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadStats'
+type Mockrepository_LoadStats_Call struct {
+	*mock.Call
+}
+
+// LoadStats is a helper method to define mock.On call
+//   - context1 context.Context
+//   - s string
+//   - statsBucket db.StatsBucket
+//   - n int64
+//   - n1 int64
+func (_e *Mockrepository_Expecter) LoadStats(context1 interface{}, s interface{}, statsBucket interface{}, n interface{}, n1 interface{}) *Mockrepository_LoadStats_Call {
+	return &Mockrepository_LoadStats_Call{Call: _e.mock.On("LoadStats", context1, s, statsBucket, n, n1)}
+}
+
+func (_c *Mockrepository_LoadStats_Call) Run(run func(context1 context.Context, s string, statsBucket db.StatsBucket, n int64, n1 int64)) *Mockrepository_LoadStats_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 string
+		if args[1] != nil {
+			arg1 = args[1].(string)
+		}
+		var arg2 db.StatsBucket
+		if args[2] != nil {
+			arg2 = args[2].(db.StatsBucket)
+		}
+		var arg3 int64
+		if args[3] != nil {
+			arg3 = args[3].(int64)
+		}
+		var arg4 int64
+		if args[4] != nil {
+			arg4 = args[4].(int64)
+		}
+		run(
+			arg0,
+			arg1,
+			arg2,
+			arg3,
+			arg4,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_LoadStats_Call) Return(deviceStatss []db.DeviceStats, err error) *Mockrepository_LoadStats_Call {
+	_c.Call.Return(deviceStatss, err)
+	return _c
+}
+
+func (_c *Mockrepository_LoadStats_Call) RunAndReturn(run func(context1 context.Context, s string, statsBucket db.StatsBucket, n int64, n1 int64) ([]db.DeviceStats, error)) *Mockrepository_LoadStats_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// LoadStoragePolicies provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) LoadStoragePolicies(context1 context.Context) (db.StoragePolicies, error) {
+	ret := _mock.Called(context1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadStoragePolicies")
+	}
+
+	var r0 db.StoragePolicies
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context) (db.StoragePolicies, error)); ok {
+		return returnFunc(context1)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context) db.StoragePolicies); ok {
+		r0 = returnFunc(context1)
+	} else {
+		r0 = ret.Get(0).(db.StoragePolicies)
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = returnFunc(context1)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// Mockrepository_LoadStoragePolicies_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'LoadStoragePolicies'
+type Mockrepository_LoadStoragePolicies_Call struct {
+	*mock.Call
+}
+
+// LoadStoragePolicies is a helper method to define mock.On call
+//   - context1 context.Context
+func (_e *Mockrepository_Expecter) LoadStoragePolicies(context1 interface{}) *Mockrepository_LoadStoragePolicies_Call {
+	return &Mockrepository_LoadStoragePolicies_Call{Call: _e.mock.On("LoadStoragePolicies", context1)}
+}
+
+func (_c *Mockrepository_LoadStoragePolicies_Call) Run(run func(context1 context.Context)) *Mockrepository_LoadStoragePolicies_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_LoadStoragePolicies_Call) Return(storagePolicies db.StoragePolicies, err error) *Mockrepository_LoadStoragePolicies_Call {
+	_c.Call.Return(storagePolicies, err)
+	return _c
+}
+
+func (_c *Mockrepository_LoadStoragePolicies_Call) RunAndReturn(run func(context1 context.Context) (db.StoragePolicies, error)) *Mockrepository_LoadStoragePolicies_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// RegisterDevice provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) RegisterDevice(context1 context.Context, s string) error {
+	ret := _mock.Called(context1, s)
+
+	if len(ret) == 0 {
+		panic("no return value specified for RegisterDevice")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = returnFunc(context1, s)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// Mockrepository_RegisterDevice_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RegisterDevice'
+type Mockrepository_RegisterDevice_Call struct {
+	*mock.Call
+}
+
+// RegisterDevice is a helper method to define mock.On call
+//   - context1 context.Context
+//   - s string
+func (_e *Mockrepository_Expecter) RegisterDevice(context1 interface{}, s interface{}) *Mockrepository_RegisterDevice_Call {
+	return &Mockrepository_RegisterDevice_Call{Call: _e.mock.On("RegisterDevice", context1, s)}
+}
+
+func (_c *Mockrepository_RegisterDevice_Call) Run(run func(context1 context.Context, s string)) *Mockrepository_RegisterDevice_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 string
+		if args[1] != nil {
+			arg1 = args[1].(string)
+		}
+		run(
+			arg0,
+			arg1,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_RegisterDevice_Call) Return(err error) *Mockrepository_RegisterDevice_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *Mockrepository_RegisterDevice_Call) RunAndReturn(run func(context1 context.Context, s string) error) *Mockrepository_RegisterDevice_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// RetireDevice provides a mock function for the type Mockrepository
+func (_mock *Mockrepository) RetireDevice(context1 context.Context, s string) error {
+	ret := _mock.Called(context1, s)
+
+	if len(ret) == 0 {
+		panic("no return value specified for RetireDevice")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = returnFunc(context1, s)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// Mockrepository_RetireDevice_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RetireDevice'
+type Mockrepository_RetireDevice_Call struct {
+	*mock.Call
+}
+
+// RetireDevice is a helper method to define mock.On call
+//   - context1 context.Context
+//   - s string
+func (_e *Mockrepository_Expecter) RetireDevice(context1 interface{}, s interface{}) *Mockrepository_RetireDevice_Call {
+	return &Mockrepository_RetireDevice_Call{Call: _e.mock.On("RetireDevice", context1, s)}
+}
+
+func (_c *Mockrepository_RetireDevice_Call) Run(run func(context1 context.Context, s string)) *Mockrepository_RetireDevice_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 string
+		if args[1] != nil {
+			arg1 = args[1].(string)
+		}
+		run(
+			arg0,
+			arg1,
+		)
+	})
+	return _c
+}
+
+func (_c *Mockrepository_RetireDevice_Call) Return(err error) *Mockrepository_RetireDevice_Call {
+	_c.Call.Return(err)
 	return _c
 }
 
-func (_c *Mockrepository_LoadEventsBetween_Call) RunAndReturn(run func(context1 context.Context, s string, n int64, n1 int64) ([]db.DeviceEvent, error)) *Mockrepository_LoadEventsBetween_Call {
+func (_c *Mockrepository_RetireDevice_Call) RunAndReturn(run func(context1 context.Context, s string) error) *Mockrepository_RetireDevice_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -2,10 +2,14 @@ package cache
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	k "sr-backend-home-assessment/internal/kafka"
@@ -14,146 +18,477 @@ import (
 )
 
 var (
-	ErrBrokerUnreachable = errors.New("broker unreachable")
-	ErrReadMessage       = errors.New("error reading message")
-	ErrParseMessage      = errors.New("error parsing JSON")
+	ErrBrokerUnreachable   = errors.New("broker unreachable")
+	ErrReadMessage         = errors.New("error reading message")
+	ErrParseMessage        = errors.New("error parsing JSON")
+	ErrHydrationIncomplete = errors.New("hydration incomplete")
+	ErrInvalidCursor       = errors.New("invalid cursor")
 )
 
+const (
+	// idleTimeout is how long hydration waits for the next message of a partition that has not
+	// reached its end offset before giving up
+	idleTimeout = time.Second * 30
+	// progressInterval is how often hydration logs its progress
+	progressInterval = time.Second * 5
+)
+
+// hydrationStats reports the last hydration from the compacted topic, served at /debug/vars
+var hydrationStats = expvar.NewMap("cache_hydration")
+
 type DeviceState struct {
-	LastEvent         string
-	LastTimestampSeen int64
+	LastEvent         string `json:"last_event"`
+	LastTimestampSeen int64  `json:"last_timestamp_seen"`
+	// LastEventID is the ID of the last accepted event, from its metadata headers
+	LastEventID string `json:"last_event_id,omitempty"`
+}
+
+// Entry is a device and its state, as listed by List
+type Entry struct {
+	DeviceID string
+	State    DeviceState
 }
 
 type Config struct {
 	Brokers       string
 	ConsumerTopic string
+	// SnapshotPath is the file the cache is snapshotted to, snapshots are disabled if empty
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// PartitionAware caches only the devices of the partitions assigned to this instance, which
+	// are hydrated and dropped by PartitionsAssigned and PartitionsRevoked instead of Hydrate
+	PartitionAware bool
+	// EvictionTTL is how long a device may go without an accepted event before it is evicted,
+	// and skipped by hydration, eviction is disabled if zero
+	EvictionTTL      time.Duration
+	EvictionInterval time.Duration
 }
 
+// shardCount is the number of shards the cache is split into. Devices are assigned to a shard by
+// a hash of their ID, so operations on devices in different shards never contend on a lock
+const shardCount = 32
+
+type shard struct {
+	mu    sync.RWMutex
+	store map[string]DeviceState
+	// reserved holds the devices with reservations in flight, see Reserve
+	reserved map[string]reservation
+}
+
+// reservation is the state of a device before its oldest reservation still in flight, which is
+// the last state known to be published, and the number of reservations in flight
+type reservation struct {
+	committed DeviceState
+	inFlight  int
+}
+
+// StateCache is safe for concurrent use
 type StateCache struct {
-	brokers string
-	store   map[string]DeviceState
-	reader  k.Reader
+	topic   string
+	shards  []*shard
+	offsets k.OffsetLister
+	// newReader returns a reader of one partition of the compacted topic, starting at offset
+	newReader   func(partition int, offset int64) k.Reader
+	idleTimeout time.Duration
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+
+	// partitionCount is the number of partitions of the compacted topic, as of the last hydration
+	partitionCount atomic.Int64
+	ownedMu        sync.Mutex
+	// owned is the set of partitions whose devices are cached, nil if every partition is
+	owned map[int]bool
+
+	// writer writes tombstones of evicted devices to the compacted topic
+	writer           k.Writer
+	evictionTTL      time.Duration
+	evictionInterval time.Duration
+	// onEvict, if set, is called with the devices removed by every eviction sweep
+	onEvict func(deviceIDs []string)
+	now     func() time.Time
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			store:    make(map[string]DeviceState),
+			reserved: make(map[string]reservation),
+		}
+	}
+	return shards
 }
 
 func New(cfg Config) *StateCache {
 	cache := &StateCache{
-		store: make(map[string]DeviceState),
-		reader: kafka.NewReader(kafka.ReaderConfig{
-			Brokers:     []string{cfg.Brokers},
-			Topic:       cfg.ConsumerTopic,
-			StartOffset: kafka.FirstOffset,
-			// No consumer group for one-time read
+		topic:   cfg.ConsumerTopic,
+		shards:  newShards(),
+		offsets: k.NewClient(cfg.Brokers),
+		newReader: func(partition int, offset int64) k.Reader {
+			reader := kafka.NewReader(kafka.ReaderConfig{
+				Brokers:   []string{cfg.Brokers},
+				Topic:     cfg.ConsumerTopic,
+				Partition: partition,
+				// No consumer group for one-time read
+			})
+			reader.SetOffset(offset)
+			return reader
+		},
+		idleTimeout:      idleTimeout,
+		snapshotPath:     cfg.SnapshotPath,
+		snapshotInterval: cfg.SnapshotInterval,
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{cfg.Brokers},
+			Topic:    cfg.ConsumerTopic,
+			Balancer: k.KeyBalancer,
 		}),
-		brokers: cfg.Brokers,
+		evictionTTL:      cfg.EvictionTTL,
+		evictionInterval: cfg.EvictionInterval,
+		now:              time.Now,
+	}
+	if cfg.PartitionAware {
+		cache.owned = make(map[int]bool)
+	}
+	if cache.snapshotInterval <= 0 {
+		cache.snapshotInterval = time.Minute
+	}
+	if cache.evictionInterval <= 0 {
+		cache.evictionInterval = time.Hour
 	}
 
 	return cache
 }
 
+func (c *StateCache) shard(deviceID string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
 func (c *StateCache) Get(deviceID string) (DeviceState, bool) {
-	state, exists := c.store[deviceID]
+	s := c.shard(deviceID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, exists := s.store[deviceID]
 	return state, exists
 }
 
 func (c *StateCache) Set(deviceID string, state DeviceState) {
-	c.store[deviceID] = state
+	s := c.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store[deviceID] = state
 }
 
 func (c *StateCache) Delete(deviceID string) {
-	delete(c.store, deviceID)
+	s := c.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.store, deviceID)
+	delete(s.reserved, deviceID)
+}
+
+// CompareAndSet sets the state of a device to new, only if its current state is old. The zero
+// DeviceState stands for a device that is not in the cache, both as old and as new. Returns
+// false if the current state is not old, in which case the cache is unchanged
+func (c *StateCache) CompareAndSet(deviceID string, old, new DeviceState) bool {
+	s := c.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store[deviceID] != old {
+		return false
+	}
+	if new == (DeviceState{}) {
+		delete(s.store, deviceID)
+	} else {
+		s.store[deviceID] = new
+	}
+	return true
+}
+
+// Reserve is CompareAndSet for a state that is not published yet, such as an event the Cleaner
+// accepted but has not written to the cleaned topic. Until Settle is called, snapshots keep the
+// state of the device from before the reservation, so a reservation released after a failed
+// publish is never persisted
+func (c *StateCache) Reserve(deviceID string, old, new DeviceState) bool {
+	s := c.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store[deviceID] != old {
+		return false
+	}
+	r, exists := s.reserved[deviceID]
+	if !exists {
+		r.committed = old
+	}
+	r.inFlight++
+	s.reserved[deviceID] = r
+	if new == (DeviceState{}) {
+		delete(s.store, deviceID)
+	} else {
+		s.store[deviceID] = new
+	}
+	return true
+}
+
+// Settle ends a reservation of a device, once its state is published or released. Once every
+// reservation of the device is settled, its state in the cache is the one snapshotted
+func (c *StateCache) Settle(deviceID string) {
+	s := c.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, exists := s.reserved[deviceID]
+	if !exists {
+		return
+	}
+	r.inFlight--
+	if r.inFlight <= 0 {
+		delete(s.reserved, deviceID)
+	} else {
+		s.reserved[deviceID] = r
+	}
+}
+
+// Snapshot returns a copy of the state of every device in the cache
+func (c *StateCache) Snapshot() map[string]DeviceState {
+	states := make(map[string]DeviceState)
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for deviceID, state := range s.store {
+			states[deviceID] = state
+		}
+		s.mu.RUnlock()
+	}
+	return states
+}
+
+// committedSnapshot is Snapshot without the reservations in flight: a device with reservations
+// in flight has its state from before them, and is left out if it was not cached then
+func (c *StateCache) committedSnapshot() map[string]DeviceState {
+	states := make(map[string]DeviceState)
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for deviceID, state := range s.store {
+			states[deviceID] = state
+		}
+		for deviceID, r := range s.reserved {
+			if r.committed == (DeviceState{}) {
+				delete(states, deviceID)
+			} else {
+				states[deviceID] = r.committed
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return states
+}
+
+// List returns up to limit devices, in device ID order, starting after cursor. The returned cursor
+// is the last device ID listed, and is empty once there are no more devices
+func (c *StateCache) List(ctx context.Context, cursor string, limit int) ([]Entry, string, error) {
+	var entries []Entry
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for deviceID, state := range s.store {
+			if deviceID > cursor {
+				entries = append(entries, Entry{DeviceID: deviceID, State: state})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeviceID < entries[j].DeviceID
+	})
+	if len(entries) <= limit {
+		return entries, "", nil
+	}
+	entries = entries[:limit]
+	return entries, entries[limit-1].DeviceID, nil
 }
 
 func (c *StateCache) Dump() {
-	for deviceID, state := range c.store {
-		slog.Info("Cache Dump", "deviceID", deviceID, "state", state)
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for deviceID, state := range s.store {
+			slog.Info("Cache Dump", "deviceID", deviceID, "state", state)
+		}
+		s.mu.RUnlock()
 	}
 }
 
-// waitForBroker pings the broker until it is reachable or maxWait is exceeded. This is necessary
-// because the Kafka container may not be ready when the main application is ready
-func (c *StateCache) waitForBroker(ctx context.Context, maxWait time.Duration, interval time.Duration) error {
-	const fn = "StateCache:waitForBroker"
+// waitForOffsets lists the offsets of the compacted topic until the broker answers or maxWait is
+// exceeded. This is necessary because the Kafka container may not be ready when the main
+// application is ready
+func (c *StateCache) waitForOffsets(ctx context.Context, maxWait time.Duration, interval time.Duration) ([]k.PartitionOffsets, error) {
+	const fn = "StateCache:waitForOffsets"
 	deadline := time.Now().Add(maxWait)
 	for time.Now().Before(deadline) {
-		dialCtx, cancel := context.WithTimeout(ctx, interval)
-		conn, err := kafka.DialContext(dialCtx, "tcp", c.brokers)
+		listCtx, cancel := context.WithTimeout(ctx, interval)
+		offsets, err := c.offsets.ListPartitionOffsets(listCtx, c.topic)
 		cancel()
 		if err == nil {
-			conn.Close()
-			slog.InfoContext(ctx, "Broker is ready", "broker", c.brokers)
-			return nil
+			return offsets, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s:%w", fn, ctx.Err())
 		}
-		slog.InfoContext(ctx, "Broker not ready", "broker", c.brokers, "error", err)
+		slog.InfoContext(ctx, "Broker not ready", "topic", c.topic, "error", err)
 		time.Sleep(interval)
 	}
-	return fmt.Errorf("%s:%w", fn, ErrBrokerUnreachable)
+	return nil, fmt.Errorf("%s:%w", fn, ErrBrokerUnreachable)
 }
 
-// Hydrate reads all messages from the compacted Kafka topic and populates the cache.
+// Hydrate reads the compacted Kafka topic and populates the cache. The high watermark of every
+// partition is listed first, and each partition is read up to it, so hydration neither waits on
+// an empty topic nor stops before it has read every message that existed when it started. If a
+// snapshot is configured and valid, it is loaded first and only the records after its offsets
+// are replayed.
 // Blocking operation
 func (c *StateCache) Hydrate(ctx context.Context) error {
 	const fn = "StateCache:Hydrate"
-	defer c.reader.Close()
-
-	slog.InfoContext(ctx, "Pinging broker to ensure connectivity...")
-	if err := c.waitForBroker(ctx, time.Second*30, time.Second*5); err != nil {
+	if err := c.hydrate(ctx, nil); err != nil {
 		return fmt.Errorf("%s:%w", fn, err)
 	}
+	return nil
+}
 
-	slog.InfoContext(ctx, "Starting cache hydration...")
+// hydrate reads the given partitions of the compacted topic, or every partition if nil
+func (c *StateCache) hydrate(ctx context.Context, only []int) error {
+	start := time.Now()
 
-	for {
-		select {
-		case <-ctx.Done():
-			slog.InfoContext(ctx, "Cache hydrate stopped...")
-			return nil
-		default:
+	slog.InfoContext(ctx, "Listing compacted topic offsets...", "topic", c.topic)
+	partitions, err := c.waitForOffsets(ctx, time.Second*30, time.Second*5)
+	if err != nil {
+		return err
+	}
+	c.partitionCount.Store(int64(len(partitions)))
+	if only != nil {
+		partitions, err = selectPartitions(partitions, only)
+		if err != nil {
+			return err
+		}
+	}
+
+	ends := make(map[int]int64, len(partitions))
+	for _, p := range partitions {
+		ends[p.Partition] = p.End
+	}
+	starts := c.loadSnapshot(ctx, ends, only != nil)
 
-			done, err := c.ReadMessage(ctx)
+	slog.InfoContext(ctx, "Starting cache hydration...", "topic", c.topic, "partitions", len(partitions))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     []error
+		messages atomic.Int64
+	)
+	for _, p := range partitions {
+		// Records before the first offset have been compacted away, and were superseded by
+		// records that are still in the topic
+		start := max(starts[p.Partition], p.First)
+		if p.End <= start {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := c.hydratePartition(ctx, p, start)
+			messages.Add(n)
 			if err != nil {
-				return fmt.Errorf("%s:%w", fn, err)
-			}
-			if done {
-				return nil
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
 			}
-		}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
 	}
+
+	duration := time.Since(start)
+	setStat("duration_ms", duration.Milliseconds())
+	setStat("messages", messages.Load())
+	setStat("partitions", int64(len(partitions)))
+	slog.InfoContext(ctx, "Cache hydration complete",
+		"topic", c.topic,
+		"partitions", len(partitions),
+		"messages", messages.Load(),
+		"duration", duration,
+	)
+	return nil
 }
 
-// ReadMessage will attempt to read a message from Kafka and update the cache.
-// ReadMessage will end if it times out reading a message (in the case that there are no
-// messages to read in the topic initially), or if the lag is zero. The reader can
-// only measure the lag if it successfully reads a message
-func (c *StateCache) ReadMessage(ctx context.Context) (bool, error) {
-	const fn = "StateCache:ReadMessage"
-	readMessageTimeoutCtx, cancel := context.WithTimeout(ctx, time.Second*5)
-	m, err := c.reader.ReadMessage(readMessageTimeoutCtx)
-	if err != nil {
+// hydratePartition reads one partition from start until it reaches its end offset.
+// Returns the number of messages read. A partition that stays idle before its end offset is
+// reached fails hydration, rather than leaving the cache partially populated
+func (c *StateCache) hydratePartition(ctx context.Context, p k.PartitionOffsets, start int64) (int64, error) {
+	const fn = "StateCache:hydratePartition"
+	reader := c.newReader(p.Partition, start)
+	defer reader.Close()
+
+	read := int64(0)
+	lastProgress := time.Now()
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, c.idleTimeout)
+		m, err := reader.ReadMessage(readCtx)
 		cancel()
-		if errors.Is(err, context.DeadlineExceeded) {
-			slog.InfoContext(ctx, "Cache hydration complete - No messages in cache")
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return read, fmt.Errorf("%s:%w:partition %d idle after %d messages from %d of %d", fn, ErrHydrationIncomplete, p.Partition, read, start, p.End)
+			}
+			return read, fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+		}
+		if err := c.applyMessage(m); err != nil {
+			return read, fmt.Errorf("%s:%w", fn, err)
+		}
+		read++
 
-			return true, nil
+		if m.Offset+1 >= p.End {
+			return read, nil
+		}
+		if time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			slog.InfoContext(ctx, "Cache hydration progress",
+				"partition", p.Partition,
+				"offset", m.Offset,
+				"end_offset", p.End,
+				"messages", read,
+			)
 		}
-		return false, fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
 	}
-	cancel()
+}
 
-	var record k.StructuredConnectRecord
-	if err := json.Unmarshal(m.Value, &record); err != nil {
-		return false, fmt.Errorf("%s:%w:%w", fn, ErrParseMessage, err)
+// applyMessage sets the state of a device from a compacted topic record. A tombstone, a record
+// with a null value, removes the device, as does a record of a device that expired
+func (c *StateCache) applyMessage(m kafka.Message) error {
+	if m.Value == nil {
+		c.Delete(string(m.Key))
+		return nil
+	}
+	record, err := k.DecodeState(m.Value)
+	if err != nil {
+		return fmt.Errorf("%w:%w", ErrParseMessage, err)
 	}
 
 	deviceState := DeviceState{
-		LastEvent:         record.Payload.EventType,
-		LastTimestampSeen: record.Payload.Timestamp,
+		LastEvent:         record.LastEvent,
+		LastTimestampSeen: record.LastTimestamp,
 	}
-	c.Set(record.Payload.DeviceID, deviceState)
-
-	lag := c.reader.Lag()
-	if lag == 0 {
-		slog.InfoContext(ctx, "Cache hydration complete - Lag is zero")
-		return true, nil
+	if md, ok := k.ParseMetadata(m.Headers); ok {
+		deviceState.LastEventID = md.EventID
+	}
+	if c.expired(deviceState) {
+		c.Delete(record.DeviceID)
+		return nil
 	}
-	return false, nil
+	c.Set(record.DeviceID, deviceState)
+	return nil
+}
+
+func setStat(key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	hydrationStats.Set(key, v)
 }
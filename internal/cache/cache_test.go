@@ -4,129 +4,528 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	k "sr-backend-home-assessment/internal/kafka"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
-func Test_ReadMessage(t *testing.T) {
+func recordMessage(deviceID string, eventType string, timestamp int64, offset int64) kafka.Message {
+	record := k.StateFromEvent(k.DeviceEvent{
+		DeviceID:  deviceID,
+		Timestamp: timestamp,
+		EventType: eventType,
+	})
+	recordBytes, _ := json.Marshal(record)
+	return kafka.Message{
+		Key:    []byte(deviceID),
+		Value:  recordBytes,
+		Offset: offset,
+	}
+}
+
+func Test_hydratePartition(t *testing.T) {
 	cases := []struct {
 		name          string
-		setupReader   func(kafka.Message) k.Reader
-		inputDeviceID string
-		outputMessage func(string) kafka.Message
+		setupReader   func() k.Reader
+		inputOffsets  k.PartitionOffsets
 		expectedError error
-		expectedDone  bool
-		expectedState DeviceState
+		expectedRead  int64
+		expectedState map[string]DeviceState
 	}{
 		{
-			name: "happy path - read timeout",
-			setupReader: func(outputMessage kafka.Message) k.Reader {
+			name: "happy path - reads until end offset",
+			setupReader: func() k.Reader {
 				reader := k.NewMockReader(t)
-				reader.EXPECT().ReadMessage(mock.Anything).Return(
-					outputMessage,
-					context.DeadlineExceeded,
-				)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("a", "device_enter", 1, 3), nil).Once()
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("b", "device_enter", 2, 5), nil).Once()
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("a", "device_exit", 3, 6), nil).Once()
+				reader.EXPECT().Close().Return(nil)
 				return reader
 			},
-			inputDeviceID: "test123",
-			outputMessage: func(deviceID string) kafka.Message {
-				return kafka.Message{}
+			// Compaction leaves gaps in offsets, the end offset is reached by the last message
+			inputOffsets: k.PartitionOffsets{Partition: 0, First: 3, End: 7},
+			expectedRead: 3,
+			expectedState: map[string]DeviceState{
+				"a": {LastEvent: "device_exit", LastTimestampSeen: 3},
+				"b": {LastEvent: "device_enter", LastTimestampSeen: 2},
 			},
-			expectedError: nil,
-			expectedDone:  true,
-			expectedState: DeviceState{},
 		},
 		{
-			name: "happy path - lag is zero",
-			setupReader: func(outputMessage kafka.Message) k.Reader {
+			name: "happy path - record of the last event, written before state records",
+			setupReader: func() k.Reader {
 				reader := k.NewMockReader(t)
-				reader.EXPECT().ReadMessage(mock.Anything).Return(
-					outputMessage,
-					nil,
-				)
-				reader.EXPECT().Lag().Return(int64(0))
+				legacy, _ := json.Marshal(k.StructuredConnectRecord{
+					Schema:  k.StructuredSchema,
+					Payload: k.DeviceEvent{DeviceID: "a", EventType: "device_enter", Timestamp: 1},
+				})
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{Key: []byte("a"), Value: legacy, Offset: 0}, nil).Once()
+				reader.EXPECT().Close().Return(nil)
 				return reader
 			},
-			inputDeviceID: "test123",
-			outputMessage: func(deviceID string) kafka.Message {
-				record := k.StructuredConnectRecord{
-					Payload: k.DeviceEvent{
-						DeviceID:  deviceID,
-						Timestamp: 12,
-						EventType: "on",
-					},
-				}
-				recordBytes, _ := json.Marshal(record)
-				msg := kafka.Message{
-					Key:   []byte(deviceID),
-					Value: recordBytes,
-				}
-				return msg
+			inputOffsets: k.PartitionOffsets{Partition: 0, First: 0, End: 1},
+			expectedRead: 1,
+			expectedState: map[string]DeviceState{
+				"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
 			},
-			expectedError: nil,
-			expectedDone:  true,
-			expectedState: DeviceState{
-				LastTimestampSeen: 12,
-				LastEvent:         "on",
+		},
+		{
+			name: "happy path - tombstone removes device",
+			setupReader: func() k.Reader {
+				reader := k.NewMockReader(t)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("a", "device_enter", 1, 0), nil).Once()
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("b", "device_enter", 2, 1), nil).Once()
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{Key: []byte("a"), Offset: 2}, nil).Once()
+				reader.EXPECT().Close().Return(nil)
+				return reader
+			},
+			inputOffsets: k.PartitionOffsets{Partition: 0, First: 0, End: 3},
+			expectedRead: 3,
+			expectedState: map[string]DeviceState{
+				"b": {LastEvent: "device_enter", LastTimestampSeen: 2},
 			},
 		},
 		{
-			name: "json unmarshal failed",
-			setupReader: func(outputMessage kafka.Message) k.Reader {
+			name: "idle before end offset",
+			setupReader: func() k.Reader {
 				reader := k.NewMockReader(t)
-				reader.EXPECT().ReadMessage(mock.Anything).Return(
-					outputMessage,
-					nil,
-				)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("a", "device_enter", 1, 0), nil).Once()
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{}, context.DeadlineExceeded).Once()
+				reader.EXPECT().Close().Return(nil)
 				return reader
 			},
-			inputDeviceID: "test123",
-			outputMessage: func(deviceID string) kafka.Message {
-				msg := kafka.Message{
-					Key:   []byte(deviceID),
-					Value: []byte("not-a-json"),
-				}
-				return msg
+			inputOffsets:  k.PartitionOffsets{Partition: 0, First: 0, End: 2},
+			expectedError: ErrHydrationIncomplete,
+			expectedRead:  1,
+			expectedState: map[string]DeviceState{
+				"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
 			},
+		},
+		{
+			name: "json unmarshal failed",
+			setupReader: func() k.Reader {
+				reader := k.NewMockReader(t)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{Value: []byte("not-a-json")}, nil).Once()
+				reader.EXPECT().Close().Return(nil)
+				return reader
+			},
+			inputOffsets:  k.PartitionOffsets{Partition: 0, First: 0, End: 1},
 			expectedError: ErrParseMessage,
-			expectedDone:  false,
-			expectedState: DeviceState{},
+			expectedState: map[string]DeviceState{},
 		},
 		{
 			name: "read message failed",
-			setupReader: func(outputMessage kafka.Message) k.Reader {
+			setupReader: func() k.Reader {
 				reader := k.NewMockReader(t)
-				reader.EXPECT().ReadMessage(mock.Anything).Return(
-					outputMessage,
-					errors.New("failed"),
-				)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{}, errors.New("failed")).Once()
+				reader.EXPECT().Close().Return(nil)
 				return reader
 			},
-			outputMessage: func(deviceID string) kafka.Message {
-				return kafka.Message{}
+			inputOffsets:  k.PartitionOffsets{Partition: 0, First: 0, End: 1},
+			expectedError: ErrReadMessage,
+			expectedState: map[string]DeviceState{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := tt.setupReader()
+			cache := &StateCache{
+				shards: newShards(),
+				newReader: func(partition int, offset int64) k.Reader {
+					assert.Equal(t, tt.inputOffsets.Partition, partition)
+					assert.Equal(t, tt.inputOffsets.First, offset)
+					return reader
+				},
+				idleTimeout: time.Second,
+			}
+			read, err := cache.hydratePartition(context.Background(), tt.inputOffsets, tt.inputOffsets.First)
+			assert.ErrorIs(t, err, tt.expectedError)
+			assert.Equal(t, tt.expectedRead, read)
+			assert.Equal(t, tt.expectedState, cache.Snapshot())
+		})
+	}
+}
+
+func Test_Hydrate(t *testing.T) {
+	cases := []struct {
+		name          string
+		setupOffsets  func() k.OffsetLister
+		setupReaders  func() map[int]k.Reader
+		expectedError error
+		expectedState map[string]DeviceState
+	}{
+		{
+			name: "happy path - empty topic returns without reading",
+			setupOffsets: func() k.OffsetLister {
+				offsets := k.NewMockOffsetLister(t)
+				offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+					{Partition: 0, First: 0, End: 0},
+					{Partition: 1, First: 4, End: 4},
+				}, nil)
+				return offsets
+			},
+			setupReaders: func() map[int]k.Reader {
+				return map[int]k.Reader{}
+			},
+			expectedState: map[string]DeviceState{},
+		},
+		{
+			name: "happy path - reads every non-empty partition",
+			setupOffsets: func() k.OffsetLister {
+				offsets := k.NewMockOffsetLister(t)
+				offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+					{Partition: 0, First: 0, End: 1},
+					{Partition: 1, First: 0, End: 0},
+					{Partition: 2, First: 2, End: 3},
+				}, nil)
+				return offsets
+			},
+			setupReaders: func() map[int]k.Reader {
+				reader0 := k.NewMockReader(t)
+				reader0.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("a", "device_enter", 1, 0), nil).Once()
+				reader0.EXPECT().Close().Return(nil)
+				reader2 := k.NewMockReader(t)
+				reader2.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("b", "device_exit", 2, 2), nil).Once()
+				reader2.EXPECT().Close().Return(nil)
+				return map[int]k.Reader{0: reader0, 2: reader2}
+			},
+			expectedState: map[string]DeviceState{
+				"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
+				"b": {LastEvent: "device_exit", LastTimestampSeen: 2},
+			},
+		},
+		{
+			name: "partition failed",
+			setupOffsets: func() k.OffsetLister {
+				offsets := k.NewMockOffsetLister(t)
+				offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+					{Partition: 0, First: 0, End: 1},
+				}, nil)
+				return offsets
+			},
+			setupReaders: func() map[int]k.Reader {
+				reader := k.NewMockReader(t)
+				reader.EXPECT().ReadMessage(mock.Anything).Return(kafka.Message{}, errors.New("failed")).Once()
+				reader.EXPECT().Close().Return(nil)
+				return map[int]k.Reader{0: reader}
 			},
 			expectedError: ErrReadMessage,
-			expectedDone:  false,
-			expectedState: DeviceState{},
+			expectedState: map[string]DeviceState{},
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
+			readers := tt.setupReaders()
 			cache := &StateCache{
-				reader: tt.setupReader(tt.outputMessage(tt.inputDeviceID)),
-				store:  make(map[string]DeviceState),
+				topic:   "topic",
+				shards:  newShards(),
+				offsets: tt.setupOffsets(),
+				newReader: func(partition int, offset int64) k.Reader {
+					return readers[partition]
+				},
+				idleTimeout: time.Second,
 			}
-			done, err := cache.ReadMessage(context.Background())
+			err := cache.Hydrate(context.Background())
 			assert.ErrorIs(t, err, tt.expectedError)
-			assert.Equal(t, tt.expectedDone, done)
+			assert.Equal(t, tt.expectedState, cache.Snapshot())
+		})
+	}
+}
+
+func Test_CompareAndSet(t *testing.T) {
+	enter := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1}
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 2}
+
+	cases := []struct {
+		name          string
+		initialState  *DeviceState
+		inputOld      DeviceState
+		inputNew      DeviceState
+		expectedOK    bool
+		expectedState DeviceState
+		expectedExist bool
+	}{
+		{
+			name:          "absent device - set",
+			initialState:  nil,
+			inputOld:      DeviceState{},
+			inputNew:      enter,
+			expectedOK:    true,
+			expectedState: enter,
+			expectedExist: true,
+		},
+		{
+			name:          "absent device - old mismatch",
+			initialState:  nil,
+			inputOld:      enter,
+			inputNew:      exit,
+			expectedOK:    false,
+			expectedState: DeviceState{},
+			expectedExist: false,
+		},
+		{
+			name:          "present device - set",
+			initialState:  &enter,
+			inputOld:      enter,
+			inputNew:      exit,
+			expectedOK:    true,
+			expectedState: exit,
+			expectedExist: true,
+		},
+		{
+			name:          "present device - old mismatch",
+			initialState:  &enter,
+			inputOld:      exit,
+			inputNew:      enter,
+			expectedOK:    false,
+			expectedState: enter,
+			expectedExist: true,
+		},
+		{
+			name:          "present device - deleted by zero new",
+			initialState:  &enter,
+			inputOld:      enter,
+			inputNew:      DeviceState{},
+			expectedOK:    true,
+			expectedState: DeviceState{},
+			expectedExist: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{shards: newShards()}
+			if tt.initialState != nil {
+				cache.Set("device123", *tt.initialState)
+			}
+			ok := cache.CompareAndSet("device123", tt.inputOld, tt.inputNew)
+			assert.Equal(t, tt.expectedOK, ok)
 
-			state, _ := cache.Get(tt.inputDeviceID)
+			state, exists := cache.Get("device123")
 			assert.Equal(t, tt.expectedState, state)
+			assert.Equal(t, tt.expectedExist, exists)
+		})
+	}
+}
+
+func Test_committedSnapshot(t *testing.T) {
+	enter := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1}
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 2}
+	enterAgain := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 3}
+
+	cases := []struct {
+		name          string
+		setup         func(*StateCache)
+		expectedState map[string]DeviceState
+	}{
+		{
+			name: "reservation in flight - state before it",
+			setup: func(c *StateCache) {
+				c.Set("device123", enter)
+				c.Reserve("device123", enter, exit)
+			},
+			expectedState: map[string]DeviceState{"device123": enter},
+		},
+		{
+			name: "reservation of an unknown device in flight - left out",
+			setup: func(c *StateCache) {
+				c.Reserve("device123", DeviceState{}, enter)
+			},
+			expectedState: map[string]DeviceState{},
+		},
+		{
+			name: "reservation settled - reserved state",
+			setup: func(c *StateCache) {
+				c.Set("device123", enter)
+				c.Reserve("device123", enter, exit)
+				c.Settle("device123")
+			},
+			expectedState: map[string]DeviceState{"device123": exit},
+		},
+		{
+			name: "reservation released - state before it",
+			setup: func(c *StateCache) {
+				c.Set("device123", enter)
+				c.Reserve("device123", enter, exit)
+				c.CompareAndSet("device123", exit, enter)
+				c.Settle("device123")
+			},
+			expectedState: map[string]DeviceState{"device123": enter},
+		},
+		{
+			name: "one of two reservations settled - state before the first",
+			setup: func(c *StateCache) {
+				c.Set("device123", enter)
+				c.Reserve("device123", enter, exit)
+				c.Reserve("device123", exit, enterAgain)
+				c.Settle("device123")
+			},
+			expectedState: map[string]DeviceState{"device123": enter},
+		},
+		{
+			name: "device deleted with a reservation in flight - left out",
+			setup: func(c *StateCache) {
+				c.Set("device123", enter)
+				c.Reserve("device123", enter, exit)
+				c.Delete("device123")
+			},
+			expectedState: map[string]DeviceState{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{shards: newShards()}
+			tt.setup(cache)
+			assert.Equal(t, tt.expectedState, cache.committedSnapshot())
+		})
+	}
+}
+
+// Run with -race to detect unsynchronized access
+func Test_StateCache_Concurrent(t *testing.T) {
+	cache := &StateCache{shards: newShards()}
+	wg := sync.WaitGroup{}
+	for i := range 16 {
+		wg.Go(func() {
+			for j := range 1000 {
+				deviceID := fmt.Sprintf("device%d", j%100)
+				switch (i + j) % 3 {
+				case 0:
+					cache.Set(deviceID, DeviceState{LastEvent: "device_enter", LastTimestampSeen: int64(j)})
+				case 1:
+					cache.Get(deviceID)
+				case 2:
+					cache.Delete(deviceID)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// Concurrent transitions of the same device from the same state must have exactly one winner
+func Test_CompareAndSet_Concurrent(t *testing.T) {
+	cache := &StateCache{shards: newShards()}
+	exit := DeviceState{LastEvent: "device_exit"}
+	cache.Set("device123", exit)
+
+	var wins atomic.Int64
+	wg := sync.WaitGroup{}
+	for i := range 64 {
+		wg.Go(func() {
+			if cache.CompareAndSet("device123", exit, DeviceState{LastEvent: "device_enter", LastTimestampSeen: int64(i + 1)}) {
+				wins.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), wins.Load())
+}
+
+func BenchmarkStateCache_Get(b *testing.B) {
+	cache := &StateCache{shards: newShards()}
+	for i := range 10000 {
+		cache.Set(fmt.Sprintf("device%d", i), DeviceState{LastEvent: "device_enter"})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Get(fmt.Sprintf("device%d", i%10000))
+			i++
+		}
+	})
+}
+
+func BenchmarkStateCache_Set(b *testing.B) {
+	cache := &StateCache{shards: newShards()}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cache.Set(fmt.Sprintf("device%d", i%10000), DeviceState{LastEvent: "device_enter"})
+			i++
+		}
+	})
+}
+
+func BenchmarkStateCache_CompareAndSet(b *testing.B) {
+	cache := &StateCache{shards: newShards()}
+	enter := DeviceState{LastEvent: "device_enter"}
+	exit := DeviceState{LastEvent: "device_exit"}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			deviceID := fmt.Sprintf("device%d", i%10000)
+			if !cache.CompareAndSet(deviceID, exit, enter) {
+				cache.CompareAndSet(deviceID, enter, exit)
+			}
+			i++
+		}
+	})
+}
+
+func Test_List(t *testing.T) {
+	cache := &StateCache{shards: newShards()}
+	for _, deviceID := range []string{"d", "b", "a", "c", "e"} {
+		cache.Set(deviceID, DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1})
+	}
+
+	cases := []struct {
+		name            string
+		inputCursor     string
+		inputLimit      int
+		expectedDevices []string
+		expectedCursor  string
+	}{
+		{
+			name:            "first page",
+			inputCursor:     "",
+			inputLimit:      2,
+			expectedDevices: []string{"a", "b"},
+			expectedCursor:  "b",
+		},
+		{
+			name:            "middle page",
+			inputCursor:     "b",
+			inputLimit:      2,
+			expectedDevices: []string{"c", "d"},
+			expectedCursor:  "d",
+		},
+		{
+			name:            "last page",
+			inputCursor:     "d",
+			inputLimit:      2,
+			expectedDevices: []string{"e"},
+			expectedCursor:  "",
+		},
+		{
+			name:            "exact fit",
+			inputCursor:     "",
+			inputLimit:      5,
+			expectedDevices: []string{"a", "b", "c", "d", "e"},
+			expectedCursor:  "",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, cursor, err := cache.List(context.Background(), tt.inputCursor, tt.inputLimit)
+			assert.NoError(t, err)
+			var devices []string
+			for _, e := range entries {
+				devices = append(devices, e.DeviceID)
+			}
+			assert.Equal(t, tt.expectedDevices, devices)
+			assert.Equal(t, tt.expectedCursor, cursor)
 		})
 	}
 }
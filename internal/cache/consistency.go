@@ -0,0 +1,361 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrConsistencyCheck = errors.New("error checking consistency")
+	ErrRepair           = errors.New("error repairing mismatches")
+)
+
+const (
+	repairProducer = "consistency-check"
+	// checkPageSize is the number of devices listed from the cache at a time
+	checkPageSize = 1000
+)
+
+// consistencyStats reports the consistency checks, served at /debug/vars
+var consistencyStats = expvar.NewMap("cache_consistency")
+
+// checkedCache is a cache whose state is checked, and repaired, by a Checker
+type checkedCache interface {
+	Set(string, DeviceState)
+	Delete(string)
+	List(context.Context, string, int) ([]Entry, string, error)
+}
+
+// stateView is the current state of every device, with its visit history, as published to the
+// compacted topic by the Packer
+type stateView interface {
+	State(string) (k.DeviceState, bool)
+}
+
+type CheckerConfig struct {
+	Brokers        string
+	CompactedTopic string
+	// Cache is the cache to check, only the compacted topic and the DB are checked if nil
+	Cache checkedCache
+	DB    eventStore
+	// Repair sets every mismatched device to its state in the DB, or removes it if it is not in
+	// the DB, in both the compacted topic and the cache
+	Repair bool
+	// States, if set, is the state of every device the repaired records start from, so a repair
+	// keeps the visit history of the device
+	States   stateView
+	Interval time.Duration
+	// Grace skips devices with a state more recent than this in any source, as their latest event
+	// may still be on its way through the pipeline
+	Grace time.Duration
+	// EvictionTTL skips devices that are missing from the cache and were last seen before it, as
+	// they were evicted from the cache
+	EvictionTTL time.Duration
+}
+
+// Mismatch is a device whose state differs between the cache, the compacted topic, and the DB.
+// A nil state is a device missing from that source
+type Mismatch struct {
+	DeviceID string       `json:"device_id"`
+	Cache    *DeviceState `json:"cache,omitempty"`
+	Topic    *DeviceState `json:"topic,omitempty"`
+	DB       *DeviceState `json:"db,omitempty"`
+}
+
+// ConsistencyReport is the result of one consistency check
+type ConsistencyReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// CacheChecked is false if only the compacted topic and the DB were compared
+	CacheChecked bool `json:"cache_checked"`
+	Devices      int  `json:"devices"`
+	// Skipped is the number of devices not compared, see CheckerConfig.Grace and EvictionTTL
+	Skipped    int        `json:"skipped"`
+	Mismatches []Mismatch `json:"mismatches"`
+	Repaired   int        `json:"repaired"`
+}
+
+// Checker compares the latest state of every device across the cache, the compacted topic, and
+// the latest row per device in the DB
+type Checker struct {
+	cache  checkedCache
+	db     eventStore
+	states stateView
+	// loadTopic reads the state of every device from the compacted topic
+	loadTopic   func(ctx context.Context) (map[string]DeviceState, error)
+	writer      k.Writer
+	repair      bool
+	interval    time.Duration
+	grace       time.Duration
+	evictionTTL time.Duration
+	now         func() time.Time
+}
+
+func NewChecker(cfg CheckerConfig) *Checker {
+	checker := &Checker{
+		cache:  cfg.Cache,
+		db:     cfg.DB,
+		states: cfg.States,
+		loadTopic: func(ctx context.Context) (map[string]DeviceState, error) {
+			topic := New(Config{
+				Brokers:       cfg.Brokers,
+				ConsumerTopic: cfg.CompactedTopic,
+			})
+			if err := topic.Hydrate(ctx); err != nil {
+				return nil, err
+			}
+			return topic.Snapshot(), nil
+		},
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{cfg.Brokers},
+			Topic:    cfg.CompactedTopic,
+			Balancer: k.KeyBalancer,
+		}),
+		repair:      cfg.Repair,
+		interval:    cfg.Interval,
+		grace:       cfg.Grace,
+		evictionTTL: cfg.EvictionTTL,
+		now:         time.Now,
+	}
+	if checker.interval <= 0 {
+		checker.interval = time.Hour
+	}
+	return checker
+}
+
+// Run checks consistency every interval.
+// Blocking operation
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.Check(ctx); err != nil {
+				slog.ErrorContext(ctx, "Error checking cache consistency", "error", err)
+			}
+		}
+	}
+}
+
+// Check compares every source and returns the devices where they disagree, sorted by device ID.
+// Sources agree on a device if they hold the same event and timestamp; event IDs are not compared,
+// as the DB does not have them for events sunk by Kafka Connect. If repair is enabled, the DB is
+// taken as the source of truth: its state is written to the compacted topic and then set in the
+// cache, and devices missing from it are tombstoned and removed from the cache
+func (c *Checker) Check(ctx context.Context) (ConsistencyReport, error) {
+	const fn = "Checker:Check"
+	report := ConsistencyReport{
+		CheckedAt:    c.now().UTC(),
+		CacheChecked: c.cache != nil,
+	}
+	consistencyStats.Add("checks", 1)
+
+	// Events reach the cache first, so it is listed first, and any event that arrives while the
+	// other sources are read is newer than the grace period
+	var cacheStates map[string]DeviceState
+	if c.cache != nil {
+		var err error
+		cacheStates, err = listAll(ctx, c.cache)
+		if err != nil {
+			consistencyStats.Add("errors", 1)
+			return report, fmt.Errorf("%s:%w:%w", fn, ErrConsistencyCheck, err)
+		}
+	}
+	topicStates, err := c.loadTopic(ctx)
+	if err != nil {
+		consistencyStats.Add("errors", 1)
+		return report, fmt.Errorf("%s:%w:%w", fn, ErrConsistencyCheck, err)
+	}
+	dbStates, err := loadDBStates(ctx, c.db)
+	if err != nil {
+		consistencyStats.Add("errors", 1)
+		return report, fmt.Errorf("%s:%w:%w", fn, ErrConsistencyCheck, err)
+	}
+
+	c.compare(&report, cacheStates, topicStates, dbStates)
+	setConsistencyStat("mismatches", int64(len(report.Mismatches)))
+	for _, m := range report.Mismatches {
+		slog.WarnContext(ctx, "Cache consistency mismatch",
+			"device_id", m.DeviceID,
+			"cache_state", m.Cache,
+			"topic_state", m.Topic,
+			"db_state", m.DB,
+		)
+	}
+
+	if c.repair && len(report.Mismatches) > 0 {
+		if err := c.repairMismatches(ctx, report.Mismatches); err != nil {
+			consistencyStats.Add("errors", 1)
+			return report, fmt.Errorf("%s:%w", fn, err)
+		}
+		report.Repaired = len(report.Mismatches)
+		consistencyStats.Add("repaired", int64(report.Repaired))
+	}
+	slog.InfoContext(ctx, "Cache consistency check complete",
+		"devices", report.Devices,
+		"skipped", report.Skipped,
+		"mismatches", len(report.Mismatches),
+		"repaired", report.Repaired,
+	)
+	return report, nil
+}
+
+// compare fills the report with every device of the given sources. cacheStates is ignored if the
+// report does not check the cache
+func (c *Checker) compare(report *ConsistencyReport, cacheStates, topicStates, dbStates map[string]DeviceState) {
+	devices := make(map[string]bool, len(dbStates))
+	for _, states := range []map[string]DeviceState{cacheStates, topicStates, dbStates} {
+		for deviceID := range states {
+			devices[deviceID] = true
+		}
+	}
+	report.Devices = len(devices)
+
+	now := c.now()
+	for deviceID := range devices {
+		m := Mismatch{
+			DeviceID: deviceID,
+			Topic:    lookup(topicStates, deviceID),
+			DB:       lookup(dbStates, deviceID),
+		}
+		if report.CacheChecked {
+			m.Cache = lookup(cacheStates, deviceID)
+		}
+		if c.inFlight(now, m) || c.evicted(now, m) {
+			report.Skipped++
+			continue
+		}
+		if sameState(m.Topic, m.DB) && (!report.CacheChecked || sameState(m.Cache, m.DB)) {
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		return report.Mismatches[i].DeviceID < report.Mismatches[j].DeviceID
+	})
+}
+
+// inFlight is true if any source has a state of the device within the grace period
+func (c *Checker) inFlight(now time.Time, m Mismatch) bool {
+	if c.grace <= 0 {
+		return false
+	}
+	cutoff := now.Add(-c.grace).UnixMilli()
+	for _, state := range []*DeviceState{m.Cache, m.Topic, m.DB} {
+		if state != nil && state.LastTimestampSeen > cutoff {
+			return true
+		}
+	}
+	return false
+}
+
+// evicted is true if the device is missing from the cache, agrees between the compacted topic
+// and the DB if it is in the topic, and was last seen before the eviction TTL. Evicted devices are
+// tombstoned, and missing from the topic too, unless they expired while no cache was sweeping
+func (c *Checker) evicted(now time.Time, m Mismatch) bool {
+	if c.evictionTTL <= 0 || m.Cache != nil || m.DB == nil {
+		return false
+	}
+	if m.Topic != nil && !sameState(m.Topic, m.DB) {
+		return false
+	}
+	return m.DB.LastTimestampSeen < now.Add(-c.evictionTTL).UnixMilli()
+}
+
+// repairMismatches writes the DB state of every mismatched device to the compacted topic, as a
+// correction of its current state, then sets it in the cache. The cache is left unchanged if the
+// records cannot be written
+func (c *Checker) repairMismatches(ctx context.Context, mismatches []Mismatch) error {
+	records := make([]kafka.Message, 0, len(mismatches))
+	for _, m := range mismatches {
+		if m.DB == nil {
+			records = append(records, k.NewTombstone(m.DeviceID))
+			continue
+		}
+		var current k.DeviceState
+		if c.states != nil {
+			current, _ = c.states.State(m.DeviceID)
+		}
+		record, err := k.NewStateRecord(repairProducer, current.Correct(k.DeviceEvent{
+			DeviceID:  m.DeviceID,
+			EventType: m.DB.LastEvent,
+			Timestamp: m.DB.LastTimestampSeen,
+		}), m.DB.LastEventID)
+		if err != nil {
+			return fmt.Errorf("%w:%w", ErrRepair, err)
+		}
+		records = append(records, record)
+	}
+	if err := c.writer.WriteMessages(ctx, records...); err != nil {
+		return fmt.Errorf("%w:%w", ErrRepair, err)
+	}
+
+	if c.cache == nil {
+		return nil
+	}
+	for _, m := range mismatches {
+		if m.DB == nil {
+			c.cache.Delete(m.DeviceID)
+		} else {
+			c.cache.Set(m.DeviceID, *m.DB)
+		}
+	}
+	slog.InfoContext(ctx, "Repaired cache consistency mismatches from DB", "devices", len(mismatches))
+	return nil
+}
+
+func (c *Checker) Close() error {
+	return c.writer.Close()
+}
+
+// listAll lists every device of the cache, a page at a time
+func listAll(ctx context.Context, cache checkedCache) (map[string]DeviceState, error) {
+	states := make(map[string]DeviceState)
+	cursor := ""
+	for {
+		entries, next, err := cache.List(ctx, cursor, checkPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			states[e.DeviceID] = e.State
+		}
+		if next == "" {
+			return states, nil
+		}
+		cursor = next
+	}
+}
+
+func lookup(states map[string]DeviceState, deviceID string) *DeviceState {
+	state, ok := states[deviceID]
+	if !ok {
+		return nil
+	}
+	return &state
+}
+
+// sameState compares the event and timestamp of two states, nil being a missing device
+func sameState(a, b *DeviceState) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.LastEvent == b.LastEvent && a.LastTimestampSeen == b.LastTimestampSeen
+}
+
+func setConsistencyStat(key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	consistencyStats.Set(key, v)
+}
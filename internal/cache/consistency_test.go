@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sr-backend-home-assessment/internal/db"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Checker_compare(t *testing.T) {
+	now := time.UnixMilli(100_000_000)
+	at := func(eventType string, age time.Duration) *DeviceState {
+		return &DeviceState{LastEvent: eventType, LastTimestampSeen: now.Add(-age).UnixMilli()}
+	}
+	states := func(devices map[string]*DeviceState) map[string]DeviceState {
+		out := make(map[string]DeviceState, len(devices))
+		for deviceID, state := range devices {
+			out[deviceID] = *state
+		}
+		return out
+	}
+
+	cases := []struct {
+		name               string
+		inputCacheChecked  bool
+		inputCache         map[string]*DeviceState
+		inputTopic         map[string]*DeviceState
+		inputDB            map[string]*DeviceState
+		expectedSkipped    int
+		expectedMismatches []Mismatch
+	}{
+		{
+			name:              "sources agree",
+			inputCacheChecked: true,
+			inputCache:        map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			inputTopic:        map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			inputDB:           map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+		},
+		{
+			name:              "event IDs are not compared",
+			inputCacheChecked: true,
+			inputCache: map[string]*DeviceState{"a": {
+				LastEvent:         "device_exit",
+				LastTimestampSeen: now.Add(-time.Hour).UnixMilli(),
+				LastEventID:       "event123",
+			}},
+			inputTopic: map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			inputDB:    map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+		},
+		{
+			name:              "cache differs",
+			inputCacheChecked: true,
+			inputCache:        map[string]*DeviceState{"a": at("device_enter", time.Hour)},
+			inputTopic:        map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			inputDB:           map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			expectedMismatches: []Mismatch{{
+				DeviceID: "a",
+				Cache:    at("device_enter", time.Hour),
+				Topic:    at("device_exit", time.Hour),
+				DB:       at("device_exit", time.Hour),
+			}},
+		},
+		{
+			name:              "missing from sources, sorted by device ID",
+			inputCacheChecked: true,
+			inputCache:        map[string]*DeviceState{"b": at("device_enter", time.Hour)},
+			inputTopic:        map[string]*DeviceState{"b": at("device_enter", time.Hour)},
+			inputDB:           map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			expectedMismatches: []Mismatch{
+				{DeviceID: "a", DB: at("device_exit", time.Hour)},
+				{DeviceID: "b", Cache: at("device_enter", time.Hour), Topic: at("device_enter", time.Hour)},
+			},
+		},
+		{
+			name:              "cache not checked",
+			inputCacheChecked: false,
+			inputCache:        map[string]*DeviceState{"a": at("device_enter", time.Hour)},
+			inputTopic:        map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+			inputDB:           map[string]*DeviceState{"a": at("device_exit", time.Hour)},
+		},
+		{
+			name:              "recent state skipped",
+			inputCacheChecked: true,
+			inputCache:        map[string]*DeviceState{"a": at("device_exit", time.Second)},
+			inputTopic:        map[string]*DeviceState{"a": at("device_enter", time.Hour)},
+			inputDB:           map[string]*DeviceState{"a": at("device_enter", time.Hour)},
+			expectedSkipped:   1,
+		},
+		{
+			name:              "evicted device skipped",
+			inputCacheChecked: true,
+			inputTopic: map[string]*DeviceState{
+				"evicted":  at("device_exit", 48*time.Hour),
+				"diverged": at("device_enter", 48*time.Hour),
+			},
+			inputDB: map[string]*DeviceState{
+				"evicted":    at("device_exit", 48*time.Hour),
+				"tombstoned": at("device_exit", 48*time.Hour),
+				"diverged":   at("device_exit", 48*time.Hour),
+				"lost":       at("device_exit", time.Hour),
+			},
+			expectedSkipped: 2,
+			expectedMismatches: []Mismatch{
+				{DeviceID: "diverged", Topic: at("device_enter", 48*time.Hour), DB: at("device_exit", 48*time.Hour)},
+				{DeviceID: "lost", DB: at("device_exit", time.Hour)},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &Checker{
+				grace:       time.Minute,
+				evictionTTL: 24 * time.Hour,
+				now:         func() time.Time { return now },
+			}
+			report := ConsistencyReport{CacheChecked: tt.inputCacheChecked}
+			checker.compare(&report, states(tt.inputCache), states(tt.inputTopic), states(tt.inputDB))
+			assert.Equal(t, tt.expectedSkipped, report.Skipped)
+			assert.Equal(t, tt.expectedMismatches, report.Mismatches)
+		})
+	}
+}
+
+func Test_Checker_Check(t *testing.T) {
+	eventID := "event123"
+	enter := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 10}
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 20, LastEventID: eventID}
+	isRepair := mock.MatchedBy(func(msgs []kafka.Message) bool {
+		if len(msgs) != 2 {
+			return false
+		}
+		// "a" is set to its DB state, keeping its visit history, "b" is not in the DB and is
+		// tombstoned
+		md, ok := k.ParseMetadata(msgs[0].Headers)
+		state, err := k.DecodeState(msgs[0].Value)
+		return string(msgs[0].Key) == "a" && err == nil && ok && md.EventID == eventID &&
+			state.LastEvent == "device_exit" && state.LastTimestamp == 20 && state.TotalVisits == 4 &&
+			string(msgs[1].Key) == "b" && msgs[1].Value == nil
+	})
+
+	cases := []struct {
+		name               string
+		inputRepair        bool
+		setupWriter        func() k.Writer
+		expectedError      error
+		expectedMismatches int
+		expectedRepaired   int
+		expectedCache      map[string]DeviceState
+	}{
+		{
+			name:               "report only",
+			inputRepair:        false,
+			setupWriter:        func() k.Writer { return k.NewMockWriter(t) },
+			expectedMismatches: 2,
+			expectedCache:      map[string]DeviceState{"a": enter, "b": enter},
+		},
+		{
+			name:        "repaired from DB",
+			inputRepair: true,
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, isRepair).Return(nil)
+				return w
+			},
+			expectedMismatches: 2,
+			expectedRepaired:   2,
+			expectedCache:      map[string]DeviceState{"a": exit},
+		},
+		{
+			name:        "repair write failed - cache unchanged",
+			inputRepair: true,
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, isRepair).Return(errors.New("failed"))
+				return w
+			},
+			expectedError:      ErrRepair,
+			expectedMismatches: 2,
+			expectedCache:      map[string]DeviceState{"a": enter, "b": enter},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{shards: newShards()}
+			cache.Set("a", enter)
+			cache.Set("b", enter)
+			store := NewMockeventStore(t)
+			store.EXPECT().LoadLatestEvents(mock.Anything).Return([]db.DeviceEvent{
+				{DeviceID: "a", EventType: "device_exit", Timestamp: 20, EventID: &eventID},
+			}, nil)
+			states := NewMockstateView(t)
+			if tt.inputRepair {
+				states.EXPECT().State("a").Return(k.DeviceState{
+					DeviceID:      "a",
+					Present:       true,
+					LastEvent:     "device_enter",
+					LastTimestamp: 10,
+					TotalVisits:   4,
+				}, true)
+			}
+			checker := &Checker{
+				cache:  cache,
+				db:     store,
+				states: states,
+				loadTopic: func(ctx context.Context) (map[string]DeviceState, error) {
+					return map[string]DeviceState{"a": exit}, nil
+				},
+				writer: tt.setupWriter(),
+				repair: tt.inputRepair,
+				now:    time.Now,
+			}
+
+			report, err := checker.Check(context.Background())
+			if tt.expectedError != nil {
+				assert.ErrorIs(t, err, tt.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.True(t, report.CacheChecked)
+			assert.Equal(t, 2, report.Devices)
+			assert.Len(t, report.Mismatches, tt.expectedMismatches)
+			assert.Equal(t, tt.expectedRepaired, report.Repaired)
+			assert.Equal(t, tt.expectedCache, cache.Snapshot())
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrWriteTombstone = errors.New("error writing tombstone")
+)
+
+// evictionStats counts evicted devices, served at /debug/vars
+var evictionStats = expvar.NewMap("cache_eviction")
+
+// RunEviction evicts inactive devices every eviction interval. Does nothing if no TTL is
+// configured.
+// Blocking operation
+func (c *StateCache) RunEviction(ctx context.Context) {
+	if c.evictionTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.evictionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.Evict(ctx); err != nil {
+				slog.ErrorContext(ctx, "Error evicting inactive devices", "error", err)
+			}
+		}
+	}
+}
+
+// OnEvict sets a function called with the devices removed by every eviction sweep, so the state
+// kept for them outside the cache is dropped too. Must be called before RunEviction
+func (c *StateCache) OnEvict(fn func(deviceIDs []string)) {
+	c.onEvict = fn
+}
+
+// Evict removes every device whose last accepted event is older than the eviction TTL, and writes
+// a tombstone for it to the compacted topic, so that compaction drops the device, later
+// hydrations do not restore it, and the Packer, which follows the topic, drops its state too. A
+// device updated while the sweep runs is kept. If the tombstones cannot be written, the devices
+// are put back and evicted again by the next sweep. Returns the number of devices evicted
+func (c *StateCache) Evict(ctx context.Context) (int, error) {
+	const fn = "StateCache:Evict"
+	expired := make(map[string]DeviceState)
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for deviceID, state := range s.store {
+			if c.expired(state) {
+				expired[deviceID] = state
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	evicted := make(map[string]DeviceState, len(expired))
+	tombstones := make([]kafka.Message, 0, len(expired))
+	for deviceID, state := range expired {
+		if c.CompareAndSet(deviceID, state, DeviceState{}) {
+			evicted[deviceID] = state
+			tombstones = append(tombstones, k.NewTombstone(deviceID))
+		}
+	}
+	if len(tombstones) == 0 {
+		return 0, nil
+	}
+
+	if err := c.writer.WriteMessages(ctx, tombstones...); err != nil {
+		for deviceID, state := range evicted {
+			c.CompareAndSet(deviceID, DeviceState{}, state)
+		}
+		evictionStats.Add("tombstone_errors", 1)
+		return 0, fmt.Errorf("%s:%w:%w", fn, ErrWriteTombstone, err)
+	}
+	if c.onEvict != nil {
+		deviceIDs := make([]string, 0, len(evicted))
+		for deviceID := range evicted {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		c.onEvict(deviceIDs)
+	}
+	evictionStats.Add("evicted", int64(len(evicted)))
+	slog.InfoContext(ctx, "Evicted inactive devices", "devices", len(evicted), "ttl", c.evictionTTL)
+	return len(evicted), nil
+}
+
+// expired is true if the last accepted event of the device is older than the eviction TTL. Never
+// true if eviction is disabled
+func (c *StateCache) expired(state DeviceState) bool {
+	if c.evictionTTL <= 0 {
+		return false
+	}
+	return state.LastTimestampSeen < c.now().Add(-c.evictionTTL).UnixMilli()
+}
+
+func (c *StateCache) Close() error {
+	return c.writer.Close()
+}
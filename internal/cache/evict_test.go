@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Evict(t *testing.T) {
+	now := time.UnixMilli(10_000_000)
+	stale := DeviceState{LastEvent: "device_exit", LastTimestampSeen: now.Add(-2 * time.Hour).UnixMilli()}
+	fresh := DeviceState{LastEvent: "device_enter", LastTimestampSeen: now.Add(-time.Minute).UnixMilli()}
+
+	cases := []struct {
+		name            string
+		setupWriter     func() k.Writer
+		initialState    map[string]DeviceState
+		expectedEvicted int
+		expectedErr     error
+		expectedState   map[string]DeviceState
+		// expectedNotified are the devices handed to OnEvict
+		expectedNotified []string
+	}{
+		{
+			name: "happy path - stale device evicted and tombstoned",
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, []kafka.Message{k.NewTombstone("stale")}).Return(nil)
+				return w
+			},
+			initialState:     map[string]DeviceState{"stale": stale, "fresh": fresh},
+			expectedEvicted:  1,
+			expectedState:    map[string]DeviceState{"fresh": fresh},
+			expectedNotified: []string{"stale"},
+		},
+		{
+			name:            "happy path - nothing to evict",
+			setupWriter:     func() k.Writer { return k.NewMockWriter(t) },
+			initialState:    map[string]DeviceState{"fresh": fresh},
+			expectedEvicted: 0,
+			expectedState:   map[string]DeviceState{"fresh": fresh},
+		},
+		{
+			name: "tombstone failed - device kept",
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, []kafka.Message{k.NewTombstone("stale")}).Return(errors.New("failed to write"))
+				return w
+			},
+			initialState:    map[string]DeviceState{"stale": stale, "fresh": fresh},
+			expectedEvicted: 0,
+			expectedErr:     ErrWriteTombstone,
+			expectedState:   map[string]DeviceState{"stale": stale, "fresh": fresh},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{
+				shards:      newShards(),
+				writer:      tt.setupWriter(),
+				evictionTTL: time.Hour,
+				now:         func() time.Time { return now },
+			}
+			var notified []string
+			cache.OnEvict(func(deviceIDs []string) { notified = append(notified, deviceIDs...) })
+			for deviceID, state := range tt.initialState {
+				cache.Set(deviceID, state)
+			}
+			evicted, err := cache.Evict(context.Background())
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedEvicted, evicted)
+			assert.Equal(t, tt.expectedState, cache.Snapshot())
+			assert.Equal(t, tt.expectedNotified, notified)
+		})
+	}
+}
+
+// Devices that expired while no cache was sweeping are still in the compacted topic, so hydration
+// must not restore them
+func Test_applyMessage_Expired(t *testing.T) {
+	now := time.UnixMilli(10_000_000)
+	record := func(deviceID string, age time.Duration) kafka.Message {
+		value, _ := json.Marshal(k.DeviceState{
+			DeviceID:      deviceID,
+			LastEvent:     "device_exit",
+			LastTimestamp: now.Add(-age).UnixMilli(),
+		})
+		return kafka.Message{Key: []byte(deviceID), Value: value}
+	}
+	cache := &StateCache{
+		shards:      newShards(),
+		evictionTTL: time.Hour,
+		now:         func() time.Time { return now },
+	}
+	// A newer record of an expired device supersedes the older one
+	cache.Set("stale", DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1})
+
+	require.NoError(t, cache.applyMessage(record("stale", 2*time.Hour)))
+	require.NoError(t, cache.applyMessage(record("fresh", time.Minute)))
+
+	assert.Equal(t, map[string]DeviceState{
+		"fresh": {LastEvent: "device_exit", LastTimestampSeen: now.Add(-time.Minute).UnixMilli()},
+	}, cache.Snapshot())
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sr-backend-home-assessment/internal/db"
+)
+
+const (
+	HydrationSourceKafka = "kafka"
+	HydrationSourceDB    = "db"
+	HydrationSourceBoth  = "both"
+)
+
+var (
+	ErrUnknownHydrationSource = errors.New("unknown hydration source")
+	ErrLoadLatestEvents       = errors.New("error loading latest events")
+)
+
+type eventStore interface {
+	LoadLatestEvents(context.Context) ([]db.DeviceEvent, error)
+}
+
+// Discrepancy is a device whose state differs between the compacted topic and the DB
+type Discrepancy struct {
+	DeviceID string
+	Kafka    DeviceState
+	InKafka  bool
+	DB       DeviceState
+	InDB     bool
+}
+
+// HydrateFrom populates the cache from the given source: the compacted topic, the latest event of
+// each device in the DB, or both reconciled. store may be nil for the Kafka source.
+// Blocking operation
+func (c *StateCache) HydrateFrom(ctx context.Context, source string, store eventStore) error {
+	const fn = "StateCache:HydrateFrom"
+	var err error
+	switch source {
+	case HydrationSourceKafka, "":
+		err = c.Hydrate(ctx)
+	case HydrationSourceDB:
+		err = c.HydrateFromDB(ctx, store)
+	case HydrationSourceBoth:
+		_, err = c.HydrateReconciled(ctx, store)
+	default:
+		err = fmt.Errorf("%w:%q", ErrUnknownHydrationSource, source)
+	}
+	if err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	return nil
+}
+
+// HydrateFromDB populates the cache with the latest event of each device in the DB
+func (c *StateCache) HydrateFromDB(ctx context.Context, store eventStore) error {
+	const fn = "StateCache:HydrateFromDB"
+	slog.InfoContext(ctx, "Starting cache hydration from DB...")
+	states, err := loadDBStates(ctx, store)
+	if err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	for deviceID, state := range states {
+		c.Set(deviceID, state)
+	}
+	slog.InfoContext(ctx, "Cache hydration from DB complete", "devices", len(states))
+	return nil
+}
+
+// HydrateReconciled populates the cache from both the compacted topic and the DB. Where they
+// disagree, the state with the most recent timestamp wins, and the difference is reported
+func (c *StateCache) HydrateReconciled(ctx context.Context, store eventStore) ([]Discrepancy, error) {
+	const fn = "StateCache:HydrateReconciled"
+	if err := c.Hydrate(ctx); err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+	dbStates, err := loadDBStates(ctx, store)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+
+	merged, discrepancies := reconcile(c.Snapshot(), dbStates)
+	for deviceID, state := range merged {
+		c.Set(deviceID, state)
+	}
+	for _, d := range discrepancies {
+		slog.WarnContext(ctx, "Hydration sources disagree",
+			"device_id", d.DeviceID,
+			"kafka_state", d.Kafka,
+			"in_kafka", d.InKafka,
+			"db_state", d.DB,
+			"in_db", d.InDB,
+		)
+	}
+	slog.InfoContext(ctx, "Cache hydration from Kafka and DB complete",
+		"devices", len(merged),
+		"discrepancies", len(discrepancies),
+	)
+	return discrepancies, nil
+}
+
+func loadDBStates(ctx context.Context, store eventStore) (map[string]DeviceState, error) {
+	events, err := store.LoadLatestEvents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrLoadLatestEvents, err)
+	}
+	states := make(map[string]DeviceState, len(events))
+	for _, event := range events {
+		state := DeviceState{
+			LastEvent:         event.EventType,
+			LastTimestampSeen: event.Timestamp,
+		}
+		if event.EventID != nil {
+			state.LastEventID = *event.EventID
+		}
+		states[event.DeviceID] = state
+	}
+	return states, nil
+}
+
+// reconcile merges device states from the compacted topic and the DB. A device missing from one
+// source takes its state from the other, and where both have it, the most recent state wins.
+// Devices where the sources differ in event or timestamp are returned sorted by device ID
+func reconcile(kafkaStates, dbStates map[string]DeviceState) (map[string]DeviceState, []Discrepancy) {
+	merged := make(map[string]DeviceState, len(kafkaStates))
+	var discrepancies []Discrepancy
+	for deviceID, kafkaState := range kafkaStates {
+		dbState, inDB := dbStates[deviceID]
+		merged[deviceID] = kafkaState
+		if !inDB {
+			discrepancies = append(discrepancies, Discrepancy{DeviceID: deviceID, Kafka: kafkaState, InKafka: true})
+			continue
+		}
+		if dbState.LastEvent == kafkaState.LastEvent && dbState.LastTimestampSeen == kafkaState.LastTimestampSeen {
+			continue
+		}
+		discrepancies = append(discrepancies, Discrepancy{
+			DeviceID: deviceID,
+			Kafka:    kafkaState,
+			InKafka:  true,
+			DB:       dbState,
+			InDB:     true,
+		})
+		if dbState.LastTimestampSeen > kafkaState.LastTimestampSeen {
+			merged[deviceID] = dbState
+		}
+	}
+	for deviceID, dbState := range dbStates {
+		if _, inKafka := kafkaStates[deviceID]; inKafka {
+			continue
+		}
+		merged[deviceID] = dbState
+		discrepancies = append(discrepancies, Discrepancy{DeviceID: deviceID, DB: dbState, InDB: true})
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		return discrepancies[i].DeviceID < discrepancies[j].DeviceID
+	})
+	return merged, discrepancies
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sr-backend-home-assessment/internal/db"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_reconcile(t *testing.T) {
+	enter := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 10}
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 20}
+
+	cases := []struct {
+		name                  string
+		kafkaStates           map[string]DeviceState
+		dbStates              map[string]DeviceState
+		expectedMerged        map[string]DeviceState
+		expectedDiscrepancies []Discrepancy
+	}{
+		{
+			name:           "sources agree",
+			kafkaStates:    map[string]DeviceState{"device1": enter},
+			dbStates:       map[string]DeviceState{"device1": enter},
+			expectedMerged: map[string]DeviceState{"device1": enter},
+		},
+		{
+			name:           "DB newer",
+			kafkaStates:    map[string]DeviceState{"device1": enter},
+			dbStates:       map[string]DeviceState{"device1": exit},
+			expectedMerged: map[string]DeviceState{"device1": exit},
+			expectedDiscrepancies: []Discrepancy{
+				{DeviceID: "device1", Kafka: enter, InKafka: true, DB: exit, InDB: true},
+			},
+		},
+		{
+			name:           "Kafka newer",
+			kafkaStates:    map[string]DeviceState{"device1": exit},
+			dbStates:       map[string]DeviceState{"device1": enter},
+			expectedMerged: map[string]DeviceState{"device1": exit},
+			expectedDiscrepancies: []Discrepancy{
+				{DeviceID: "device1", Kafka: exit, InKafka: true, DB: enter, InDB: true},
+			},
+		},
+		{
+			name:           "device missing from one source",
+			kafkaStates:    map[string]DeviceState{"device1": enter},
+			dbStates:       map[string]DeviceState{"device2": exit},
+			expectedMerged: map[string]DeviceState{"device1": enter, "device2": exit},
+			expectedDiscrepancies: []Discrepancy{
+				{DeviceID: "device1", Kafka: enter, InKafka: true},
+				{DeviceID: "device2", DB: exit, InDB: true},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, discrepancies := reconcile(tt.kafkaStates, tt.dbStates)
+			assert.Equal(t, tt.expectedMerged, merged)
+			assert.Equal(t, tt.expectedDiscrepancies, discrepancies)
+		})
+	}
+}
+
+func Test_HydrateFromDB(t *testing.T) {
+	eventID := "event123"
+	cases := []struct {
+		name           string
+		setupStore     func() eventStore
+		expectedErr    error
+		expectedStates map[string]DeviceState
+	}{
+		{
+			name: "happy path",
+			setupStore: func() eventStore {
+				s := NewMockeventStore(t)
+				s.EXPECT().LoadLatestEvents(mock.Anything).Return([]db.DeviceEvent{
+					{DeviceID: "device1", EventType: "device_enter", Timestamp: 10, EventID: &eventID},
+					{DeviceID: "device2", EventType: "device_exit", Timestamp: 20},
+				}, nil)
+				return s
+			},
+			expectedStates: map[string]DeviceState{
+				"device1": {LastEvent: "device_enter", LastTimestampSeen: 10, LastEventID: "event123"},
+				"device2": {LastEvent: "device_exit", LastTimestampSeen: 20},
+			},
+		},
+		{
+			name: "DB error",
+			setupStore: func() eventStore {
+				s := NewMockeventStore(t)
+				s.EXPECT().LoadLatestEvents(mock.Anything).Return(nil, errors.New("failed"))
+				return s
+			},
+			expectedErr:    ErrLoadLatestEvents,
+			expectedStates: map[string]DeviceState{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{shards: newShards()}
+			err := cache.HydrateFrom(context.Background(), HydrationSourceDB, tt.setupStore())
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedStates, cache.Snapshot())
+		})
+	}
+}
+
+func Test_HydrateFrom_UnknownSource(t *testing.T) {
+	cache := &StateCache{shards: newShards()}
+	err := cache.HydrateFrom(context.Background(), "carrier-pigeon", nil)
+	assert.ErrorIs(t, err, ErrUnknownHydrationSource)
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	k "sr-backend-home-assessment/internal/kafka"
+)
+
+var (
+	ErrUnknownPartition = errors.New("partition not in compacted topic")
+)
+
+// PartitionsAssigned hydrates the devices of newly assigned partitions of the raw topic. A device
+// is on the same partition of the raw and the compacted topic, as long as both are keyed by
+// device ID with k.KeyBalancer and have the same number of partitions
+func (c *StateCache) PartitionsAssigned(ctx context.Context, partitions []int) error {
+	const fn = "StateCache:PartitionsAssigned"
+	if err := c.hydrate(ctx, partitions); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	c.ownedMu.Lock()
+	for _, partition := range partitions {
+		c.owned[partition] = true
+	}
+	c.ownedMu.Unlock()
+	return nil
+}
+
+// PartitionsRevoked drops the devices of revoked partitions, as their events are now validated by
+// another instance
+func (c *StateCache) PartitionsRevoked(ctx context.Context, partitions []int) {
+	c.ownedMu.Lock()
+	for _, partition := range partitions {
+		delete(c.owned, partition)
+	}
+	c.ownedMu.Unlock()
+
+	count := int(c.partitionCount.Load())
+	if count == 0 {
+		return
+	}
+	revoked := make(map[int]bool, len(partitions))
+	for _, partition := range partitions {
+		revoked[partition] = true
+	}
+	dropped := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for deviceID := range s.store {
+			if revoked[k.PartitionFor(deviceID, count)] {
+				delete(s.store, deviceID)
+				delete(s.reserved, deviceID)
+				dropped++
+			}
+		}
+		s.mu.Unlock()
+	}
+	slog.InfoContext(ctx, "Dropped devices of revoked partitions", "partitions", partitions, "devices", dropped)
+}
+
+// ownedPartitions returns the set of partitions whose devices are cached, or all as true if the
+// cache is not partition aware
+func (c *StateCache) ownedPartitions() (owned map[int]bool, all bool) {
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+	if c.owned == nil {
+		return nil, true
+	}
+	owned = make(map[int]bool, len(c.owned))
+	for partition := range c.owned {
+		owned[partition] = true
+	}
+	return owned, false
+}
+
+// selectPartitions returns the offsets of the given partitions
+func selectPartitions(offsets []k.PartitionOffsets, partitions []int) ([]k.PartitionOffsets, error) {
+	byPartition := make(map[int]k.PartitionOffsets, len(offsets))
+	for _, p := range offsets {
+		byPartition[p.Partition] = p
+	}
+	selected := make([]k.PartitionOffsets, 0, len(partitions))
+	for _, partition := range partitions {
+		p, ok := byPartition[partition]
+		if !ok {
+			return nil, fmt.Errorf("%w:%d", ErrUnknownPartition, partition)
+		}
+		selected = append(selected, p)
+	}
+	return selected, nil
+}
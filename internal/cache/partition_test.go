@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTopic is a compacted topic held in memory, partitioned with k.KeyBalancer
+type fakeTopic struct {
+	partitions [][]kafka.Message
+}
+
+func newFakeTopic(count int) *fakeTopic {
+	return &fakeTopic{partitions: make([][]kafka.Message, count)}
+}
+
+func (f *fakeTopic) produce(deviceID string, eventType string, timestamp int64) {
+	partition := k.PartitionFor(deviceID, len(f.partitions))
+	m := recordMessage(deviceID, eventType, timestamp, int64(len(f.partitions[partition])))
+	m.Partition = partition
+	f.partitions[partition] = append(f.partitions[partition], m)
+}
+
+func (f *fakeTopic) ListPartitionOffsets(ctx context.Context, topic string) ([]k.PartitionOffsets, error) {
+	offsets := make([]k.PartitionOffsets, len(f.partitions))
+	for i, messages := range f.partitions {
+		offsets[i] = k.PartitionOffsets{Partition: i, End: int64(len(messages))}
+	}
+	return offsets, nil
+}
+
+// fakeReader reads one partition of a fakeTopic, blocking once it reaches the end
+type fakeReader struct {
+	messages []kafka.Message
+	next     int64
+}
+
+func (f *fakeTopic) reader(partition int, offset int64) k.Reader {
+	return &fakeReader{messages: f.partitions[partition], next: offset}
+}
+
+func (r *fakeReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	return r.FetchMessage(ctx)
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.next >= int64(len(r.messages)) {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	m := r.messages[r.next]
+	r.next++
+	return m, nil
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	return nil
+}
+
+func (r *fakeReader) Lag() int64 {
+	return int64(len(r.messages)) - r.next
+}
+
+// devicesByPartition returns a device ID on each partition of a topic of count partitions
+func devicesByPartition(count int) []string {
+	devices := make([]string, count)
+	found := 0
+	for i := 0; found < count; i++ {
+		deviceID := fmt.Sprintf("device-%d", i)
+		partition := k.PartitionFor(deviceID, count)
+		if devices[partition] == "" {
+			devices[partition] = deviceID
+			found++
+		}
+	}
+	return devices
+}
+
+func Test_PartitionAssignment(t *testing.T) {
+	devices := devicesByPartition(3)
+	topic := newFakeTopic(3)
+	for i, deviceID := range devices {
+		topic.produce(deviceID, "device_enter", int64(i+1))
+		topic.produce(deviceID, "device_exit", int64(i+10))
+	}
+	exited := func(partition int) DeviceState {
+		return DeviceState{LastEvent: "device_exit", LastTimestampSeen: int64(partition + 10)}
+	}
+
+	cases := []struct {
+		name          string
+		inputChanges  func(context.Context, *StateCache) error
+		expectedState map[string]DeviceState
+		expectedOwned map[int]bool
+	}{
+		{
+			name: "assigned partitions only",
+			inputChanges: func(ctx context.Context, c *StateCache) error {
+				return c.PartitionsAssigned(ctx, []int{0, 2})
+			},
+			expectedState: map[string]DeviceState{
+				devices[0]: exited(0),
+				devices[2]: exited(2),
+			},
+			expectedOwned: map[int]bool{0: true, 2: true},
+		},
+		{
+			name: "partition revoked",
+			inputChanges: func(ctx context.Context, c *StateCache) error {
+				if err := c.PartitionsAssigned(ctx, []int{0, 1, 2}); err != nil {
+					return err
+				}
+				c.PartitionsRevoked(ctx, []int{1})
+				return nil
+			},
+			expectedState: map[string]DeviceState{
+				devices[0]: exited(0),
+				devices[2]: exited(2),
+			},
+			expectedOwned: map[int]bool{0: true, 2: true},
+		},
+		{
+			name: "partition moved to this instance",
+			inputChanges: func(ctx context.Context, c *StateCache) error {
+				if err := c.PartitionsAssigned(ctx, []int{0}); err != nil {
+					return err
+				}
+				c.PartitionsRevoked(ctx, []int{0})
+				return c.PartitionsAssigned(ctx, []int{1})
+			},
+			expectedState: map[string]DeviceState{
+				devices[1]: exited(1),
+			},
+			expectedOwned: map[int]bool{1: true},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &StateCache{
+				topic:       "topic",
+				shards:      newShards(),
+				offsets:     topic,
+				newReader:   topic.reader,
+				idleTimeout: time.Second,
+				owned:       make(map[int]bool),
+			}
+			require.NoError(t, tt.inputChanges(context.Background(), cache))
+			assert.Equal(t, tt.expectedState, cache.Snapshot())
+			owned, all := cache.ownedPartitions()
+			assert.False(t, all)
+			assert.Equal(t, tt.expectedOwned, owned)
+		})
+	}
+}
+
+func Test_PartitionsAssigned_UnknownPartition(t *testing.T) {
+	topic := newFakeTopic(2)
+	cache := &StateCache{
+		topic:       "topic",
+		shards:      newShards(),
+		offsets:     topic,
+		newReader:   topic.reader,
+		idleTimeout: time.Second,
+		owned:       make(map[int]bool),
+	}
+	// The raw topic has more partitions than the compacted topic
+	err := cache.PartitionsAssigned(context.Background(), []int{2})
+	assert.ErrorIs(t, err, ErrUnknownPartition)
+}
+
+func Test_PartitionsAssigned_Snapshot(t *testing.T) {
+	devices := devicesByPartition(2)
+	topic := newFakeTopic(2)
+	topic.produce(devices[0], "device_enter", 1)
+	topic.produce(devices[1], "device_enter", 2)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	writer := &StateCache{
+		topic:        "topic",
+		shards:       newShards(),
+		offsets:      topic,
+		owned:        map[int]bool{0: true},
+		snapshotPath: path,
+	}
+	writer.Set(devices[0], DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1})
+	require.NoError(t, writer.WriteSnapshot(context.Background()))
+
+	topic.produce(devices[0], "device_exit", 3)
+	topic.produce(devices[1], "device_exit", 4)
+
+	// Partition 0 is replayed from the snapshot, partition 1 is not in it and is replayed in full
+	cache := &StateCache{
+		topic:        "topic",
+		shards:       newShards(),
+		offsets:      topic,
+		newReader:    topic.reader,
+		idleTimeout:  time.Second,
+		owned:        make(map[int]bool),
+		snapshotPath: path,
+	}
+	require.NoError(t, cache.PartitionsAssigned(context.Background(), []int{0, 1}))
+	assert.Equal(t, map[string]DeviceState{
+		devices[0]: {LastEvent: "device_exit", LastTimestampSeen: 3},
+		devices[1]: {LastEvent: "device_exit", LastTimestampSeen: 4},
+	}, cache.Snapshot())
+}
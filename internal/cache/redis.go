@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	fieldLastEvent         = "last_event"
+	fieldLastTimestampSeen = "last_timestamp_seen"
+	fieldLastEventID       = "last_event_id"
+)
+
+var (
+	ErrRedisCommand = errors.New("redis command failed")
+)
+
+// compareAndSetScript atomically replaces the hash of a device if it matches the expected state.
+// An empty expected event means the device must not exist, an empty new event deletes it.
+// KEYS[1] device key
+// ARGV old event, old timestamp, old event ID, new event, new timestamp, new event ID
+var compareAndSetScript = redis.NewScript(`
+local current = redis.call("HMGET", KEYS[1], "last_event", "last_timestamp_seen", "last_event_id")
+if ARGV[1] == "" then
+	if redis.call("EXISTS", KEYS[1]) == 1 then
+		return 0
+	end
+elseif current[1] ~= ARGV[1] or current[2] ~= ARGV[2] or (current[3] or "") ~= ARGV[3] then
+	return 0
+end
+if ARGV[4] == "" then
+	redis.call("DEL", KEYS[1])
+else
+	redis.call("HSET", KEYS[1], "last_event", ARGV[4], "last_timestamp_seen", ARGV[5], "last_event_id", ARGV[6])
+end
+return 1
+`)
+
+// setIfNewerScript sets the hash of a device unless it already holds a state at least as recent.
+// Used to hydrate Redis without overwriting state written by a running replica
+// KEYS[1] device key
+// ARGV event, timestamp, event ID
+var setIfNewerScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], "last_timestamp_seen")
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], "last_event", ARGV[1], "last_timestamp_seen", ARGV[2], "last_event_id", ARGV[3])
+return 1
+`)
+
+type RedisConfig struct {
+	Addr      string
+	KeyPrefix string
+	Timeout   time.Duration
+	// BatchSize is the number of commands per pipeline when loading many devices
+	BatchSize int
+}
+
+// RedisCache keeps device state in Redis, one hash per device, so that it can be shared by
+// multiple Cleaner replicas. Updates go through CompareAndSet, which is a Lua script and so
+// atomic across replicas
+type RedisCache struct {
+	client    redis.UniversalClient
+	keyPrefix string
+	timeout   time.Duration
+	batchSize int
+}
+
+func NewRedis(cfg RedisConfig) *RedisCache {
+	return newRedis(redis.NewClient(&redis.Options{Addr: cfg.Addr}), cfg)
+}
+
+func newRedis(client redis.UniversalClient, cfg RedisConfig) *RedisCache {
+	c := &RedisCache{
+		client:    client,
+		keyPrefix: cfg.KeyPrefix,
+		timeout:   cfg.Timeout,
+		batchSize: cfg.BatchSize,
+	}
+	if c.keyPrefix == "" {
+		c.keyPrefix = "device:"
+	}
+	if c.timeout <= 0 {
+		c.timeout = time.Second
+	}
+	if c.batchSize <= 0 {
+		c.batchSize = 500
+	}
+	return c
+}
+
+func (c *RedisCache) key(deviceID string) string {
+	return c.keyPrefix + deviceID
+}
+
+// Get returns the state of a device. Redis errors are logged and reported as a missing device;
+// CompareAndSet checks the actual state, so a failed Get cannot let an invalid event through
+func (c *RedisCache) Get(deviceID string) (DeviceState, bool) {
+	const fn = "RedisCache:Get"
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	fields, err := c.client.HGetAll(ctx, c.key(deviceID)).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting device state", "fn", fn, "device_id", deviceID, "error", err)
+		return DeviceState{}, false
+	}
+	if len(fields) == 0 {
+		return DeviceState{}, false
+	}
+	return parseRedisState(fields), true
+}
+
+func (c *RedisCache) Set(deviceID string, state DeviceState) {
+	const fn = "RedisCache:Set"
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := c.client.HSet(ctx, c.key(deviceID),
+		fieldLastEvent, state.LastEvent,
+		fieldLastTimestampSeen, state.LastTimestampSeen,
+		fieldLastEventID, state.LastEventID,
+	).Err()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error setting device state", "fn", fn, "device_id", deviceID, "error", err)
+	}
+}
+
+func (c *RedisCache) Delete(deviceID string) {
+	const fn = "RedisCache:Delete"
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.client.Del(ctx, c.key(deviceID)).Err(); err != nil {
+		slog.ErrorContext(ctx, "Error deleting device state", "fn", fn, "device_id", deviceID, "error", err)
+	}
+}
+
+// CompareAndSet sets the state of a device to new, only if its current state is old, with the
+// same semantics as StateCache.CompareAndSet. Redis errors are logged and reported as a mismatch
+func (c *RedisCache) CompareAndSet(deviceID string, old, new DeviceState) bool {
+	const fn = "RedisCache:CompareAndSet"
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	args := append(redisStateArgs(old), redisStateArgs(new)...)
+	ok, err := compareAndSetScript.Run(ctx, c.client, []string{c.key(deviceID)}, args...).Int()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error comparing and setting device state", "fn", fn, "device_id", deviceID, "error", err)
+		return false
+	}
+	return ok == 1
+}
+
+// Reserve is CompareAndSet. Redis is not snapshotted, so reservations need no tracking
+func (c *RedisCache) Reserve(deviceID string, old, new DeviceState) bool {
+	return c.CompareAndSet(deviceID, old, new)
+}
+
+// Settle does nothing, see Reserve
+func (c *RedisCache) Settle(string) {}
+
+// Load writes many device states to Redis in pipelined batches, keeping any state in Redis that
+// is at least as recent. Used to hydrate Redis from the compacted topic
+func (c *RedisCache) Load(ctx context.Context, states map[string]DeviceState) error {
+	const fn = "RedisCache:Load"
+	if err := setIfNewerScript.Load(ctx, c.client).Err(); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrRedisCommand, err)
+	}
+
+	pipe := c.client.Pipeline()
+	flush := func() error {
+		if pipe.Len() == 0 {
+			return nil
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrRedisCommand, err)
+		}
+		return nil
+	}
+	for deviceID, state := range states {
+		args := redisStateArgs(state)
+		setIfNewerScript.EvalSha(ctx, pipe, []string{c.key(deviceID)}, args...)
+		if pipe.Len() >= c.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// List returns the devices of one SCAN iteration, starting at cursor, an opaque Redis cursor.
+// limit is passed to SCAN as a hint, so a page may hold more or fewer devices, or none while
+// more remain. The returned cursor is empty once the scan is complete
+func (c *RedisCache) List(ctx context.Context, cursor string, limit int) ([]Entry, string, error) {
+	const fn = "RedisCache:List"
+	var scanCursor uint64
+	if cursor != "" {
+		var err error
+		scanCursor, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s:%w:%w", fn, ErrInvalidCursor, err)
+		}
+	}
+	keys, next, err := c.client.Scan(ctx, scanCursor, c.keyPrefix+"*", int64(limit)).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("%s:%w:%w", fn, ErrRedisCommand, err)
+	}
+
+	pipe := c.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(ctx, key)
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, "", fmt.Errorf("%s:%w:%w", fn, ErrRedisCommand, err)
+		}
+	}
+	entries := make([]Entry, 0, len(keys))
+	for i, key := range keys {
+		fields := cmds[i].Val()
+		// Deleted between the scan and the read
+		if len(fields) == 0 {
+			continue
+		}
+		entries = append(entries, Entry{
+			DeviceID: strings.TrimPrefix(key, c.keyPrefix),
+			State:    parseRedisState(fields),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeviceID < entries[j].DeviceID
+	})
+
+	nextCursor := ""
+	if next != 0 {
+		nextCursor = strconv.FormatUint(next, 10)
+	}
+	return entries, nextCursor, nil
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+func redisStateArgs(state DeviceState) []any {
+	if state == (DeviceState{}) {
+		return []any{"", "", ""}
+	}
+	return []any{state.LastEvent, strconv.FormatInt(state.LastTimestampSeen, 10), state.LastEventID}
+}
+
+func parseRedisState(fields map[string]string) DeviceState {
+	ts, _ := strconv.ParseInt(fields[fieldLastTimestampSeen], 10, 64)
+	return DeviceState{
+		LastEvent:         fields[fieldLastEvent],
+		LastTimestampSeen: ts,
+		LastEventID:       fields[fieldLastEventID],
+	}
+}
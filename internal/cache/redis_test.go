@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *RedisCache) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, newRedis(client, RedisConfig{BatchSize: 2})
+}
+
+func Test_RedisCache_GetSetDelete(t *testing.T) {
+	server, cache := newTestRedis(t)
+	state := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 12, LastEventID: "event123"}
+
+	_, exists := cache.Get("device123")
+	assert.False(t, exists)
+
+	cache.Set("device123", state)
+	got, exists := cache.Get("device123")
+	assert.True(t, exists)
+	assert.Equal(t, state, got)
+	assert.Equal(t, "device_enter", server.HGet("device:device123", fieldLastEvent))
+
+	cache.Delete("device123")
+	_, exists = cache.Get("device123")
+	assert.False(t, exists)
+}
+
+func Test_RedisCache_CompareAndSet(t *testing.T) {
+	enter := DeviceState{LastEvent: "device_enter", LastTimestampSeen: 1}
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 2, LastEventID: "event123"}
+
+	cases := []struct {
+		name          string
+		initialState  *DeviceState
+		inputOld      DeviceState
+		inputNew      DeviceState
+		expectedOK    bool
+		expectedState DeviceState
+		expectedExist bool
+	}{
+		{
+			name:          "absent device - set",
+			inputOld:      DeviceState{},
+			inputNew:      enter,
+			expectedOK:    true,
+			expectedState: enter,
+			expectedExist: true,
+		},
+		{
+			name:          "absent device - old mismatch",
+			inputOld:      enter,
+			inputNew:      exit,
+			expectedOK:    false,
+			expectedExist: false,
+		},
+		{
+			name:          "present device - set",
+			initialState:  &enter,
+			inputOld:      enter,
+			inputNew:      exit,
+			expectedOK:    true,
+			expectedState: exit,
+			expectedExist: true,
+		},
+		{
+			name:          "present device - expected absent",
+			initialState:  &enter,
+			inputOld:      DeviceState{},
+			inputNew:      exit,
+			expectedOK:    false,
+			expectedState: enter,
+			expectedExist: true,
+		},
+		{
+			name:          "present device - event ID mismatch",
+			initialState:  &exit,
+			inputOld:      DeviceState{LastEvent: "device_exit", LastTimestampSeen: 2},
+			inputNew:      enter,
+			expectedOK:    false,
+			expectedState: exit,
+			expectedExist: true,
+		},
+		{
+			name:          "present device - deleted by zero new",
+			initialState:  &exit,
+			inputOld:      exit,
+			inputNew:      DeviceState{},
+			expectedOK:    true,
+			expectedExist: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cache := newTestRedis(t)
+			if tt.initialState != nil {
+				cache.Set("device123", *tt.initialState)
+			}
+			ok := cache.CompareAndSet("device123", tt.inputOld, tt.inputNew)
+			assert.Equal(t, tt.expectedOK, ok)
+
+			state, exists := cache.Get("device123")
+			assert.Equal(t, tt.expectedState, state)
+			assert.Equal(t, tt.expectedExist, exists)
+		})
+	}
+}
+
+// Replicas sharing Redis racing to move a device from the same state must have exactly one winner
+func Test_RedisCache_CompareAndSet_Replicas(t *testing.T) {
+	server, replica1 := newTestRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	replica2 := newRedis(client, RedisConfig{})
+
+	exit := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 1}
+	replica1.Set("device123", exit)
+
+	var wins atomic.Int64
+	wg := sync.WaitGroup{}
+	for i := range 32 {
+		replica := replica1
+		if i%2 == 1 {
+			replica = replica2
+		}
+		wg.Go(func() {
+			if replica.CompareAndSet("device123", exit, DeviceState{LastEvent: "device_enter", LastTimestampSeen: int64(i + 2)}) {
+				wins.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), wins.Load())
+}
+
+func Test_RedisCache_Load(t *testing.T) {
+	_, cache := newTestRedis(t)
+	newer := DeviceState{LastEvent: "device_exit", LastTimestampSeen: 20}
+	cache.Set("device1", newer)
+
+	err := cache.Load(context.Background(), map[string]DeviceState{
+		"device1": {LastEvent: "device_enter", LastTimestampSeen: 10},
+		"device2": {LastEvent: "device_enter", LastTimestampSeen: 10},
+		"device3": {LastEvent: "device_exit", LastTimestampSeen: 11},
+	})
+	assert.NoError(t, err)
+
+	// State written by a running replica is newer than the compacted topic, and is kept
+	state, _ := cache.Get("device1")
+	assert.Equal(t, newer, state)
+	state, _ = cache.Get("device2")
+	assert.Equal(t, DeviceState{LastEvent: "device_enter", LastTimestampSeen: 10}, state)
+	state, _ = cache.Get("device3")
+	assert.Equal(t, DeviceState{LastEvent: "device_exit", LastTimestampSeen: 11}, state)
+}
+
+func Test_RedisCache_Unavailable(t *testing.T) {
+	server, cache := newTestRedis(t)
+	server.Close()
+
+	_, exists := cache.Get("device123")
+	assert.False(t, exists)
+	assert.False(t, cache.CompareAndSet("device123", DeviceState{}, DeviceState{LastEvent: "device_enter"}))
+	assert.ErrorIs(t, cache.Load(context.Background(), map[string]DeviceState{"device123": {LastEvent: "device_enter"}}), ErrRedisCommand)
+}
+
+func Test_RedisCache_List(t *testing.T) {
+	_, cache := newTestRedis(t)
+	expected := make(map[string]DeviceState)
+	for i := range 25 {
+		deviceID := fmt.Sprintf("device%02d", i)
+		state := DeviceState{LastEvent: "device_enter", LastTimestampSeen: int64(i)}
+		cache.Set(deviceID, state)
+		expected[deviceID] = state
+	}
+
+	listed := make(map[string]DeviceState)
+	cursor := ""
+	for {
+		entries, next, err := cache.List(context.Background(), cursor, 10)
+		assert.NoError(t, err)
+		for _, e := range entries {
+			listed[e.DeviceID] = e.State
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, expected, listed)
+
+	_, _, err := cache.List(context.Background(), "not-a-cursor", 10)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
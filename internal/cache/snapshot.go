@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+)
+
+var (
+	ErrWriteSnapshot    = errors.New("error writing snapshot")
+	ErrReadSnapshot     = errors.New("error reading snapshot")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// snapshotFile is the on-disk form of a snapshot. Checksum is the hex SHA-256 of Data, so a
+// truncated or edited file is detected before any of it is loaded
+type snapshotFile struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// snapshot is the state of every device, as of the compacted topic offsets it reflects. Offsets
+// maps each partition to the next offset to replay from
+type snapshot struct {
+	Topic   string                 `json:"topic"`
+	TakenAt time.Time              `json:"taken_at"`
+	Offsets map[int]int64          `json:"offsets"`
+	Devices map[string]DeviceState `json:"devices"`
+}
+
+// RunSnapshots writes a snapshot every interval, and once more when ctx is done, so that a clean
+// shutdown restarts from an up to date snapshot. Does nothing if no snapshot path is configured.
+// Blocking operation
+func (c *StateCache) RunSnapshots(ctx context.Context) {
+	if c.snapshotPath == "" {
+		return
+	}
+	ticker := time.NewTicker(c.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is done, give the final snapshot its own deadline
+			finalCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			if err := c.WriteSnapshot(finalCtx); err != nil {
+				slog.ErrorContext(ctx, "Error writing final cache snapshot", "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := c.WriteSnapshot(ctx); err != nil {
+				slog.ErrorContext(ctx, "Error writing cache snapshot", "error", err)
+			}
+		}
+	}
+}
+
+// WriteSnapshot writes the state of every device to the snapshot file, along with the end offsets
+// of the compacted topic. The offsets are listed before the devices are copied, so every record
+// after them is replayed on restart. Reservations in flight are left out, see Reserve. The file is written to a temporary file and renamed, so a
+// crash mid-write leaves the previous snapshot intact
+func (c *StateCache) WriteSnapshot(ctx context.Context) error {
+	const fn = "StateCache:WriteSnapshot"
+	partitions, err := c.offsets.ListPartitionOffsets(ctx, c.topic)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrWriteSnapshot, err)
+	}
+	snap := snapshot{
+		Topic:   c.topic,
+		TakenAt: time.Now().UTC(),
+		Offsets: make(map[int]int64, len(partitions)),
+	}
+	owned, all := c.ownedPartitions()
+	for _, p := range partitions {
+		if all || owned[p.Partition] {
+			snap.Offsets[p.Partition] = p.End
+		}
+	}
+	snap.Devices = c.committedSnapshot()
+
+	if err := writeSnapshotFile(c.snapshotPath, snap); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrWriteSnapshot, err)
+	}
+	slog.InfoContext(ctx, "Wrote cache snapshot", "path", c.snapshotPath, "devices", len(snap.Devices))
+	return nil
+}
+
+func writeSnapshotFile(path string, snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	out, err := json.Marshal(snapshotFile{
+		Checksum: hex.EncodeToString(sum[:]),
+		Data:     data,
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readSnapshot reads and verifies the snapshot file. Returns os.ErrNotExist if there is none
+func readSnapshot(path string) (snapshot, error) {
+	const fn = "readSnapshot"
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot{}, fmt.Errorf("%s:%w:%w", fn, ErrReadSnapshot, err)
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return snapshot{}, fmt.Errorf("%s:%w:%w", fn, ErrReadSnapshot, err)
+	}
+	sum := sha256.Sum256(file.Data)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return snapshot{}, fmt.Errorf("%s:%w", fn, ErrSnapshotChecksum)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(file.Data, &snap); err != nil {
+		return snapshot{}, fmt.Errorf("%s:%w:%w", fn, ErrReadSnapshot, err)
+	}
+	return snap, nil
+}
+
+// loadSnapshot loads the snapshot into the cache and returns the offset to replay each partition
+// from. Returns nil, leaving the cache untouched, if there is no usable snapshot, in which case
+// every partition is replayed in full. partitions maps the partitions being hydrated to their end
+// offsets; if partial, only the devices of those partitions are loaded
+func (c *StateCache) loadSnapshot(ctx context.Context, partitions map[int]int64, partial bool) map[int]int64 {
+	if c.snapshotPath == "" {
+		return nil
+	}
+	snap, err := readSnapshot(c.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.InfoContext(ctx, "No cache snapshot, replaying compacted topic in full", "path", c.snapshotPath)
+		return nil
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Corrupt cache snapshot, replaying compacted topic in full", "path", c.snapshotPath, "error", err)
+		return nil
+	}
+	if snap.Topic != c.topic {
+		slog.WarnContext(ctx, "Cache snapshot is of another topic, replaying compacted topic in full",
+			"path", c.snapshotPath,
+			"snapshot_topic", snap.Topic,
+		)
+		return nil
+	}
+	// A snapshot ahead of the topic means the topic was recreated since
+	for partition, offset := range snap.Offsets {
+		end, ok := partitions[partition]
+		if !ok && partial {
+			continue
+		}
+		if !ok || offset > end {
+			slog.WarnContext(ctx, "Cache snapshot is ahead of compacted topic, replaying compacted topic in full",
+				"path", c.snapshotPath,
+				"partition", partition,
+				"snapshot_offset", offset,
+			)
+			return nil
+		}
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for partition := range partitions {
+		if offset, ok := snap.Offsets[partition]; ok {
+			offsets[partition] = offset
+		}
+	}
+	count := int(c.partitionCount.Load())
+	loaded := 0
+	for deviceID, state := range snap.Devices {
+		if partial {
+			// Devices of partitions without a snapshot offset are replayed in full
+			if _, ok := offsets[k.PartitionFor(deviceID, count)]; !ok {
+				continue
+			}
+		}
+		if c.expired(state) {
+			continue
+		}
+		c.Set(deviceID, state)
+		loaded++
+	}
+	slog.InfoContext(ctx, "Loaded cache snapshot",
+		"path", c.snapshotPath,
+		"taken_at", snap.TakenAt,
+		"devices", loaded,
+	)
+	return offsets
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	k "sr-backend-home-assessment/internal/kafka"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_readSnapshot(t *testing.T) {
+	snap := snapshot{
+		Topic:   "topic",
+		TakenAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Offsets: map[int]int64{0: 10, 1: 4},
+		Devices: map[string]DeviceState{
+			"a": {LastEvent: "device_enter", LastTimestampSeen: 1, LastEventID: "id-1"},
+		},
+	}
+
+	cases := []struct {
+		name             string
+		setupFile        func(string)
+		expectedError    error
+		expectedSnapshot snapshot
+	}{
+		{
+			name: "happy path",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snap))
+			},
+			expectedSnapshot: snap,
+		},
+		{
+			name:          "missing file",
+			setupFile:     func(path string) {},
+			expectedError: os.ErrNotExist,
+		},
+		{
+			name: "checksum mismatch",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snap))
+				raw, err := os.ReadFile(path)
+				require.NoError(t, err)
+				// Change a device timestamp without updating the checksum
+				raw = []byte(strings.Replace(string(raw), `"last_timestamp_seen":1`, `"last_timestamp_seen":2`, 1))
+				require.NoError(t, os.WriteFile(path, raw, 0o644))
+			},
+			expectedError: ErrSnapshotChecksum,
+		},
+		{
+			name: "truncated file",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snap))
+				raw, err := os.ReadFile(path)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(path, raw[:len(raw)/2], 0o644))
+			},
+			expectedError: ErrReadSnapshot,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			tt.setupFile(path)
+			got, err := readSnapshot(path)
+			assert.ErrorIs(t, err, tt.expectedError)
+			assert.Equal(t, tt.expectedSnapshot, got)
+		})
+	}
+}
+
+func Test_WriteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data", "snapshot.json")
+	offsets := k.NewMockOffsetLister(t)
+	offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+		{Partition: 0, First: 2, End: 7},
+		{Partition: 1, First: 0, End: 3},
+	}, nil)
+	cache := &StateCache{
+		topic:        "topic",
+		shards:       newShards(),
+		offsets:      offsets,
+		snapshotPath: path,
+	}
+	cache.Set("a", DeviceState{LastEvent: "device_exit", LastTimestampSeen: 5})
+
+	require.NoError(t, cache.WriteSnapshot(context.Background()))
+
+	snap, err := readSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, "topic", snap.Topic)
+	assert.Equal(t, map[int]int64{0: 7, 1: 3}, snap.Offsets)
+	assert.Equal(t, map[string]DeviceState{"a": {LastEvent: "device_exit", LastTimestampSeen: 5}}, snap.Devices)
+
+	// Only the snapshot is left behind, the temporary file was renamed
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func Test_Hydrate_Snapshot(t *testing.T) {
+	partitions := []k.PartitionOffsets{
+		{Partition: 0, First: 0, End: 10},
+	}
+
+	cases := []struct {
+		name          string
+		setupFile     func(string)
+		expectedStart int64
+		expectedState map[string]DeviceState
+	}{
+		{
+			name: "happy path - replays from snapshot offsets",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snapshot{
+					Topic:   "topic",
+					Offsets: map[int]int64{0: 9},
+					Devices: map[string]DeviceState{
+						"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
+					},
+				}))
+			},
+			expectedStart: 9,
+			expectedState: map[string]DeviceState{
+				"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
+				"b": {LastEvent: "device_exit", LastTimestampSeen: 9},
+			},
+		},
+		{
+			name: "corrupt snapshot - full replay",
+			setupFile: func(path string) {
+				require.NoError(t, os.WriteFile(path, []byte(`{"checksum":"00","data":{}}`), 0o644))
+			},
+			expectedStart: 0,
+			expectedState: map[string]DeviceState{
+				"b": {LastEvent: "device_exit", LastTimestampSeen: 9},
+			},
+		},
+		{
+			name: "snapshot ahead of topic - full replay",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snapshot{
+					Topic:   "topic",
+					Offsets: map[int]int64{0: 50},
+					Devices: map[string]DeviceState{
+						"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
+					},
+				}))
+			},
+			expectedStart: 0,
+			expectedState: map[string]DeviceState{
+				"b": {LastEvent: "device_exit", LastTimestampSeen: 9},
+			},
+		},
+		{
+			name: "snapshot of another topic - full replay",
+			setupFile: func(path string) {
+				require.NoError(t, writeSnapshotFile(path, snapshot{
+					Topic:   "other",
+					Offsets: map[int]int64{0: 9},
+					Devices: map[string]DeviceState{
+						"a": {LastEvent: "device_enter", LastTimestampSeen: 1},
+					},
+				}))
+			},
+			expectedStart: 0,
+			expectedState: map[string]DeviceState{
+				"b": {LastEvent: "device_exit", LastTimestampSeen: 9},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			tt.setupFile(path)
+
+			offsets := k.NewMockOffsetLister(t)
+			offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return(partitions, nil)
+			reader := k.NewMockReader(t)
+			reader.EXPECT().ReadMessage(mock.Anything).Return(recordMessage("b", "device_exit", 9, 9), nil).Once()
+			reader.EXPECT().Close().Return(nil)
+
+			cache := &StateCache{
+				topic:   "topic",
+				shards:  newShards(),
+				offsets: offsets,
+				newReader: func(partition int, offset int64) k.Reader {
+					assert.Equal(t, tt.expectedStart, offset)
+					return reader
+				},
+				idleTimeout:  time.Second,
+				snapshotPath: path,
+			}
+			require.NoError(t, cache.Hydrate(context.Background()))
+			assert.Equal(t, tt.expectedState, cache.Snapshot())
+		})
+	}
+}
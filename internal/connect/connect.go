@@ -0,0 +1,372 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StateRunning    = "RUNNING"
+	StateFailed     = "FAILED"
+	StatePaused     = "PAUSED"
+	StateUnassigned = "UNASSIGNED"
+	StateRestarting = "RESTARTING"
+)
+
+var (
+	ErrConnectUnreachable  = errors.New("kafka connect unreachable")
+	ErrRequestFailed       = errors.New("kafka connect request failed")
+	ErrUnexpectedStatus    = errors.New("unexpected kafka connect response status")
+	ErrLoadConnectorConfig = errors.New("error loading connector config")
+	ErrConnectorNotFound   = errors.New("connector not found")
+)
+
+// ConnectorDefinition is the desired connector, in the same shape as the body accepted by
+// POST /connectors
+type ConnectorDefinition struct {
+	Name   string            `json:"name"`
+	Config map[string]string `json:"config"`
+}
+
+type ConnectorState struct {
+	State    string `json:"state"`
+	WorkerID string `json:"worker_id"`
+	Trace    string `json:"trace,omitempty"`
+}
+
+type TaskStatus struct {
+	ID       int    `json:"id"`
+	State    string `json:"state"`
+	WorkerID string `json:"worker_id"`
+	Trace    string `json:"trace,omitempty"`
+}
+
+type ConnectorStatus struct {
+	Name      string         `json:"name"`
+	Connector ConnectorState `json:"connector"`
+	Tasks     []TaskStatus   `json:"tasks"`
+	Type      string         `json:"type"`
+}
+
+// Healthy reports whether the connector and all of its tasks are running
+func (s ConnectorStatus) Healthy() bool {
+	if s.Connector.State != StateRunning || len(s.Tasks) == 0 {
+		return false
+	}
+	for _, task := range s.Tasks {
+		if task.State != StateRunning {
+			return false
+		}
+	}
+	return true
+}
+
+type Config struct {
+	URL               string
+	Connector         ConnectorDefinition
+	ReconcileInterval time.Duration
+	HTTPClient        *http.Client
+}
+
+// Client is a Kafka Connect REST admin client that keeps a single connector registered with
+// the desired config, and restarts the connector or its tasks when they fail
+type Client struct {
+	url       string
+	connector ConnectorDefinition
+	interval  time.Duration
+	http      *http.Client
+
+	mu      sync.RWMutex
+	status  ConnectorStatus
+	lastErr error
+}
+
+func New(cfg Config) *Client {
+	client := &Client{
+		url:       cfg.URL,
+		connector: cfg.Connector,
+		interval:  cfg.ReconcileInterval,
+		http:      cfg.HTTPClient,
+		lastErr:   ErrConnectUnreachable,
+	}
+	if client.interval == 0 {
+		client.interval = 30 * time.Second
+	}
+	if client.http == nil {
+		client.http = &http.Client{Timeout: 10 * time.Second}
+	}
+	return client
+}
+
+// LoadConnectorDefinition reads a connector definition from a JSON file
+func LoadConnectorDefinition(path string) (ConnectorDefinition, error) {
+	const fn = "LoadConnectorDefinition"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ConnectorDefinition{}, fmt.Errorf("%s:%w:%w", fn, ErrLoadConnectorConfig, err)
+	}
+	var def ConnectorDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return ConnectorDefinition{}, fmt.Errorf("%s:%w:%w", fn, ErrLoadConnectorConfig, err)
+	}
+	if def.Name == "" {
+		return ConnectorDefinition{}, fmt.Errorf("%s:%w:missing connector name", fn, ErrLoadConnectorConfig)
+	}
+	return def, nil
+}
+
+// Run waits for Kafka Connect to come up, then reconciles the connector every interval until
+// the context is cancelled. Blocking operation
+func (c *Client) Run(ctx context.Context) {
+	slog.InfoContext(ctx, "Connector reconciler started...", "connector", c.connector.Name)
+	if err := c.waitForConnect(ctx, time.Minute*2, time.Second*5); err != nil {
+		slog.ErrorContext(ctx, "Kafka Connect not ready", "error", err)
+		c.setStatus(ConnectorStatus{}, err)
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error reconciling connector", "connector", c.connector.Name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "Connector reconciler stopped...", "connector", c.connector.Name)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForConnect pings the Connect REST API until it responds or maxWait is exceeded. This is
+// necessary because the Connect container takes a while to load its plugins
+func (c *Client) waitForConnect(ctx context.Context, maxWait time.Duration, interval time.Duration) error {
+	const fn = "Client:waitForConnect"
+	deadline := time.Now().Add(maxWait)
+	for time.Now().Before(deadline) {
+		_, err := c.do(ctx, http.MethodGet, "/", nil, nil)
+		if err == nil {
+			slog.InfoContext(ctx, "Kafka Connect is ready", "url", c.url)
+			return nil
+		}
+		slog.InfoContext(ctx, "Kafka Connect not ready", "url", c.url, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s:%w:%w", fn, ErrConnectUnreachable, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+	return fmt.Errorf("%s:%w", fn, ErrConnectUnreachable)
+}
+
+// Reconcile puts the desired connector config if the connector is missing or its config has
+// drifted, then restarts the connector and any of its tasks that have failed
+func (c *Client) Reconcile(ctx context.Context) error {
+	const fn = "Client:Reconcile"
+	err := c.reconcile(ctx)
+	if err != nil {
+		err = fmt.Errorf("%s:%w", fn, err)
+		c.setStatus(ConnectorStatus{}, err)
+	}
+	return err
+}
+
+func (c *Client) reconcile(ctx context.Context) error {
+	current, err := c.GetConnectorConfig(ctx)
+	if err != nil && !errors.Is(err, ErrConnectorNotFound) {
+		return err
+	}
+	created := errors.Is(err, ErrConnectorNotFound)
+	if !configEqual(current, c.connector.Config) {
+		slog.InfoContext(ctx, "Connector config missing or drifted, applying desired config", "connector", c.connector.Name)
+		if err := c.PutConnectorConfig(ctx); err != nil {
+			return err
+		}
+	}
+
+	status, err := c.GetConnectorStatus(ctx)
+	// A connector just created has no status until a worker starts it, which is checked on the
+	// next reconcile
+	if created && errors.Is(err, ErrConnectorNotFound) {
+		slog.InfoContext(ctx, "Connector created, waiting for it to start", "connector", c.connector.Name)
+		c.setStatus(ConnectorStatus{
+			Name:      c.connector.Name,
+			Connector: ConnectorState{State: StateUnassigned},
+		}, nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status.Connector.State == StateFailed {
+		slog.WarnContext(ctx, "Connector failed, restarting", "connector", c.connector.Name, "trace", status.Connector.Trace)
+		if err := c.RestartConnector(ctx); err != nil {
+			return err
+		}
+	}
+	for _, task := range status.Tasks {
+		if task.State != StateFailed {
+			continue
+		}
+		slog.WarnContext(ctx, "Connector task failed, restarting", "connector", c.connector.Name, "task", task.ID, "trace", task.Trace)
+		if err := c.RestartTask(ctx, task.ID); err != nil {
+			return err
+		}
+	}
+	c.setStatus(status, nil)
+	return nil
+}
+
+// GetConnectorConfig returns the config currently registered for the connector
+func (c *Client) GetConnectorConfig(ctx context.Context) (map[string]string, error) {
+	const fn = "Client:GetConnectorConfig"
+	var config map[string]string
+	code, err := c.do(ctx, http.MethodGet, "/connectors/"+url.PathEscape(c.connector.Name)+"/config", nil, &config)
+	if code == http.StatusNotFound {
+		return nil, fmt.Errorf("%s:%w", fn, ErrConnectorNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+	return config, nil
+}
+
+// PutConnectorConfig creates the connector, or updates its config if it already exists
+func (c *Client) PutConnectorConfig(ctx context.Context) error {
+	const fn = "Client:PutConnectorConfig"
+	if _, err := c.do(ctx, http.MethodPut, "/connectors/"+url.PathEscape(c.connector.Name)+"/config", c.connector.Config, nil); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	return nil
+}
+
+func (c *Client) GetConnectorStatus(ctx context.Context) (ConnectorStatus, error) {
+	const fn = "Client:GetConnectorStatus"
+	var status ConnectorStatus
+	code, err := c.do(ctx, http.MethodGet, "/connectors/"+url.PathEscape(c.connector.Name)+"/status", nil, &status)
+	if code == http.StatusNotFound {
+		return ConnectorStatus{}, fmt.Errorf("%s:%w", fn, ErrConnectorNotFound)
+	}
+	if err != nil {
+		return ConnectorStatus{}, fmt.Errorf("%s:%w", fn, err)
+	}
+	return status, nil
+}
+
+func (c *Client) RestartConnector(ctx context.Context) error {
+	const fn = "Client:RestartConnector"
+	if _, err := c.do(ctx, http.MethodPost, "/connectors/"+url.PathEscape(c.connector.Name)+"/restart", nil, nil); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	return nil
+}
+
+func (c *Client) RestartTask(ctx context.Context, taskID int) error {
+	const fn = "Client:RestartTask"
+	path := fmt.Sprintf("/connectors/%s/tasks/%d/restart", url.PathEscape(c.connector.Name), taskID)
+	if _, err := c.do(ctx, http.MethodPost, path, nil, nil); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	return nil
+}
+
+// Status returns the connector status seen by the last reconcile, and the error of the last
+// reconcile if it failed
+func (c *Client) Status() (ConnectorStatus, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status, c.lastErr
+}
+
+func (c *Client) setStatus(status ConnectorStatus, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+	c.lastErr = err
+}
+
+// HealthCheck responds with the last seen connector status, and 503 if the connector or any
+// of its tasks is not running
+func (c *Client) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	status, err := c.Status()
+	resp := struct {
+		Healthy bool            `json:"healthy"`
+		Status  ConnectorStatus `json:"status"`
+		Error   string          `json:"error,omitempty"`
+	}{
+		Healthy: err == nil && status.Healthy(),
+		Status:  status,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// do sends a request to the Connect REST API and decodes the response into out. The response
+// status code is returned even if the request failed
+func (c *Client) do(ctx context.Context, method, path string, body any, out any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("%w:%w", ErrRequestFailed, err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("%w:%w", ErrRequestFailed, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w:%w", ErrRequestFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("%w:%s %s:%d:%s", ErrUnexpectedStatus, method, path, resp.StatusCode, msg)
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%w:%w", ErrRequestFailed, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// configEqual compares a registered connector config against the desired config. Connect adds
+// the connector name to the config it returns, so it is ignored
+func configEqual(current, desired map[string]string) bool {
+	if current == nil {
+		return false
+	}
+	a := maps.Clone(current)
+	b := maps.Clone(desired)
+	delete(a, "name")
+	delete(b, "name")
+	return maps.Equal(a, b)
+}
@@ -0,0 +1,253 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConnect is an in-memory fake of the Kafka Connect REST API
+type fakeConnect struct {
+	mu                sync.Mutex
+	configs           map[string]map[string]string
+	statuses          map[string]ConnectorStatus
+	puts              int
+	connectorRestarts int
+	taskRestarts      []int
+	failStatus        bool
+	// startLater leaves a created connector without a status, as before a worker starts it
+	startLater bool
+}
+
+func newFakeConnect() *fakeConnect {
+	return &fakeConnect{
+		configs:  make(map[string]map[string]string),
+		statuses: make(map[string]ConnectorStatus),
+	}
+}
+
+func (f *fakeConnect) router() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"version": "7.4.3"})
+	})
+	r.Get("/connectors/{name}/config", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		config, ok := f.configs[chi.URLParam(r, "name")]
+		if !ok {
+			http.Error(w, `{"error_code":404}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(config)
+	})
+	r.Put("/connectors/{name}/config", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		name := chi.URLParam(r, "name")
+		var config map[string]string
+		json.NewDecoder(r.Body).Decode(&config)
+		config["name"] = name
+		_, exists := f.configs[name]
+		f.configs[name] = config
+		f.puts++
+		if _, ok := f.statuses[name]; !ok && !f.startLater {
+			f.statuses[name] = ConnectorStatus{
+				Name:      name,
+				Connector: ConnectorState{State: StateRunning},
+				Tasks:     []TaskStatus{{ID: 0, State: StateRunning}},
+			}
+		}
+		if !exists {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(ConnectorDefinition{Name: name, Config: config})
+	})
+	r.Get("/connectors/{name}/status", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.failStatus {
+			http.Error(w, `{"error_code":500}`, http.StatusInternalServerError)
+			return
+		}
+		status, ok := f.statuses[chi.URLParam(r, "name")]
+		if !ok {
+			http.Error(w, `{"error_code":404}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+	r.Post("/connectors/{name}/restart", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.connectorRestarts++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.Post("/connectors/{name}/tasks/{id}/restart", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var id int
+		json.Unmarshal([]byte(chi.URLParam(r, "id")), &id)
+		f.taskRestarts = append(f.taskRestarts, id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return r
+}
+
+var testConnector = ConnectorDefinition{
+	Name: "device-events-postgres-sink",
+	Config: map[string]string{
+		"connector.class": "io.confluent.connect.jdbc.JdbcSinkConnector",
+		"tasks.max":       "1",
+		"topics":          "device_events_cleaned",
+	},
+}
+
+func Test_Reconcile(t *testing.T) {
+	cases := []struct {
+		name                      string
+		setupFake                 func(*fakeConnect)
+		expectedErr               error
+		expectedPuts              int
+		expectedConnectorRestarts int
+		expectedTaskRestarts      []int
+		expectedHealthy           bool
+	}{
+		{
+			name:            "connector missing - created",
+			setupFake:       func(f *fakeConnect) {},
+			expectedPuts:    1,
+			expectedHealthy: true,
+		},
+		{
+			name: "connector in sync - untouched",
+			setupFake: func(f *fakeConnect) {
+				config := map[string]string{"name": testConnector.Name}
+				for k, v := range testConnector.Config {
+					config[k] = v
+				}
+				f.configs[testConnector.Name] = config
+				f.statuses[testConnector.Name] = ConnectorStatus{
+					Name:      testConnector.Name,
+					Connector: ConnectorState{State: StateRunning},
+					Tasks:     []TaskStatus{{ID: 0, State: StateRunning}},
+				}
+			},
+			expectedPuts:    0,
+			expectedHealthy: true,
+		},
+		{
+			name: "connector config drifted - reapplied",
+			setupFake: func(f *fakeConnect) {
+				f.configs[testConnector.Name] = map[string]string{
+					"name":            testConnector.Name,
+					"connector.class": "io.confluent.connect.jdbc.JdbcSinkConnector",
+					"tasks.max":       "4",
+					"topics":          "device_events_cleaned",
+				}
+				f.statuses[testConnector.Name] = ConnectorStatus{
+					Name:      testConnector.Name,
+					Connector: ConnectorState{State: StateRunning},
+					Tasks:     []TaskStatus{{ID: 0, State: StateRunning}},
+				}
+			},
+			expectedPuts:    1,
+			expectedHealthy: true,
+		},
+		{
+			name: "failed connector and task - restarted",
+			setupFake: func(f *fakeConnect) {
+				config := map[string]string{"name": testConnector.Name}
+				for k, v := range testConnector.Config {
+					config[k] = v
+				}
+				f.configs[testConnector.Name] = config
+				f.statuses[testConnector.Name] = ConnectorStatus{
+					Name:      testConnector.Name,
+					Connector: ConnectorState{State: StateFailed},
+					Tasks: []TaskStatus{
+						{ID: 0, State: StateRunning},
+						{ID: 1, State: StateFailed, Trace: "boom"},
+					},
+				}
+			},
+			expectedPuts:              0,
+			expectedConnectorRestarts: 1,
+			expectedTaskRestarts:      []int{1},
+			expectedHealthy:           false,
+		},
+		{
+			name: "connector created - pending until started",
+			setupFake: func(f *fakeConnect) {
+				f.startLater = true
+			},
+			expectedPuts:    1,
+			expectedHealthy: false,
+		},
+		{
+			name: "existing connector without status",
+			setupFake: func(f *fakeConnect) {
+				config := map[string]string{"name": testConnector.Name}
+				for k, v := range testConnector.Config {
+					config[k] = v
+				}
+				f.configs[testConnector.Name] = config
+			},
+			expectedErr:     ErrConnectorNotFound,
+			expectedPuts:    0,
+			expectedHealthy: false,
+		},
+		{
+			name: "status request failed",
+			setupFake: func(f *fakeConnect) {
+				f.failStatus = true
+			},
+			expectedErr:     ErrUnexpectedStatus,
+			expectedPuts:    1,
+			expectedHealthy: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeConnect()
+			tt.setupFake(fake)
+			server := httptest.NewServer(fake.router())
+			defer server.Close()
+
+			client := New(Config{
+				URL:       server.URL,
+				Connector: testConnector,
+			})
+			err := client.Reconcile(context.Background())
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedPuts, fake.puts)
+			assert.Equal(t, tt.expectedConnectorRestarts, fake.connectorRestarts)
+			assert.Equal(t, tt.expectedTaskRestarts, fake.taskRestarts)
+
+			w := httptest.NewRecorder()
+			client.HealthCheck(w, httptest.NewRequest(http.MethodGet, "/health/connect", nil))
+			if tt.expectedHealthy {
+				assert.Equal(t, http.StatusOK, w.Code)
+			} else {
+				assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			}
+		})
+	}
+}
+
+func Test_LoadConnectorDefinition(t *testing.T) {
+	def, err := LoadConnectorDefinition("../../kafka-connect/connector-config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "device-events-postgres-sink", def.Name)
+	assert.Equal(t, "device_events_cleaned", def.Config["topics"])
+
+	_, err = LoadConnectorDefinition("does-not-exist.json")
+	assert.ErrorIs(t, err, ErrLoadConnectorConfig)
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/jackc/pgx/v4/pgxpool"
 
-	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 )
@@ -20,29 +19,59 @@ var (
 )
 
 type Config struct {
-	ConnString     string
+	ConnString string
+	// MigrationsPath loads the migrations from disk instead of the ones built into the binary
 	MigrationsPath string
+	// MigrationMode is MigrateUp, the default, or MigrateCheck
+	MigrationMode string
 }
 
 type DB struct {
 	connString     string
 	migrationsPath string
+	migrationMode  string
 	pool           *pgxpool.Pool
+	// staleStats are the stats buckets written below their refresh window, see RefreshStats
+	staleStats staleStats
 }
 
+// Migrate refuses to start against a dirty database or one ahead of the migrations, then runs the
+// pending migrations, or refuses to start if there are any in MigrateCheck mode. The checks and
+// the migrations run under the migration lock, so replicas starting at once do not race
 func (db *DB) Migrate(ctx context.Context) error {
 	const fn = "DB:Migrate"
-	slog.InfoContext(ctx, "Running database migrations...", "path", db.migrationsPath)
-	m, err := migrate.New(
-		"file://"+db.migrationsPath,
-		db.connString,
-	)
+	source := db.migrationsPath
+	if source == "" {
+		source = "embedded"
+	}
+	slog.InfoContext(ctx, "Checking database migrations...", "source", source, "mode", db.migrationMode)
+	mg, err := NewMigrator(Config{
+		ConnString:     db.connString,
+		MigrationsPath: db.migrationsPath,
+	})
 	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+		return fmt.Errorf("%s:%w", fn, err)
 	}
-	err = m.Up()
-	if err != nil && err != migrate.ErrNoChange {
-		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	defer mg.Close()
+
+	err = mg.Lock(ctx, func() error {
+		if err := mg.Check(); err != nil {
+			return err
+		}
+		if db.migrationMode != MigrateCheck {
+			return mg.Up(ctx)
+		}
+		version, _, err := mg.Version()
+		if err != nil {
+			return err
+		}
+		if version < mg.Latest() {
+			return fmt.Errorf("%w:version %d, latest %d", ErrPendingMigration, version, mg.Latest())
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
 	}
 	return nil
 }
@@ -70,8 +99,10 @@ func Init(ctx context.Context, cfg Config) (*DB, error) {
 		pool:           pool,
 		connString:     cfg.ConnString,
 		migrationsPath: cfg.MigrationsPath,
+		migrationMode:  cfg.MigrationMode,
 	}
 	if err := db.Migrate(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("%s:%w", fn, err)
 	}
 	return db, nil
@@ -0,0 +1,302 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"slices"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/jackc/pgx/v4"
+)
+
+// migrationsFS holds the migrations built into the binary, used unless Config.MigrationsPath is set
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+var (
+	ErrDirtyDatabase    = errors.New("database is dirty")
+	ErrDatabaseAhead    = errors.New("database is ahead of the migrations")
+	ErrPendingMigration = errors.New("database has pending migrations")
+	ErrUnknownVersion   = errors.New("unknown migration version")
+	ErrInvalidSteps     = errors.New("number of steps must be positive")
+	ErrMigrationLock    = errors.New("error holding migration lock")
+)
+
+const (
+	// MigrateUp runs the pending migrations at startup
+	MigrateUp = "up"
+	// MigrateCheck only checks at startup that the database is at the latest migration, for when
+	// migrations are run with the migrate subcommand
+	MigrateCheck = "check"
+
+	// migrationLockID is the Postgres advisory lock held while migrating, so replicas starting at
+	// once check and migrate the database one at a time
+	migrationLockID = 4_387_129_516
+)
+
+// Step is one migration script, run up or down
+type Step struct {
+	Version uint   `json:"version"`
+	Name    string `json:"name"`
+	Up      bool   `json:"up"`
+}
+
+func (s Step) String() string {
+	direction := "down"
+	if s.Up {
+		direction = "up"
+	}
+	return fmt.Sprintf("%s %d_%s", direction, s.Version, s.Name)
+}
+
+// Migrator runs and plans the migrations of a database, see NewMigrator
+type Migrator struct {
+	m          *migrate.Migrate
+	connString string
+	// versions are the versions of every migration, in ascending order
+	versions []uint
+	names    map[uint]string
+}
+
+// NewMigrator opens the migrations against the database at cfg.ConnString. The migrations built
+// into the binary are used, unless cfg.MigrationsPath is set to load them from disk instead, e.g.
+// for a hotfix. It does not run any migration
+func NewMigrator(cfg Config) (*Migrator, error) {
+	const fn = "NewMigrator"
+	var src source.Driver
+	var err error
+	if cfg.MigrationsPath != "" {
+		src, err = source.Open("file://" + cfg.MigrationsPath)
+	} else {
+		src, err = iofs.New(migrationsFS, "migrations")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	versions, names, err := listMigrations(src)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	m, err := migrate.NewWithSourceInstance("migrations", src, cfg.ConnString)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return &Migrator{
+		m:          m,
+		connString: cfg.ConnString,
+		versions:   versions,
+		names:      names,
+	}, nil
+}
+
+// listMigrations returns the version and name of every migration of src, in ascending order
+func listMigrations(src source.Driver) ([]uint, map[uint]string, error) {
+	var versions []uint
+	names := make(map[uint]string)
+	version, err := src.First()
+	for err == nil {
+		r, name, readErr := src.ReadUp(version)
+		if readErr != nil {
+			return nil, nil, readErr
+		}
+		r.Close()
+		versions = append(versions, version)
+		names[version] = name
+		version, err = src.Next(version)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	return versions, names, nil
+}
+
+// Version returns the current version of the database, 0 if no migration was run, and whether the
+// last migration failed half way
+func (mg *Migrator) Version() (uint, bool, error) {
+	const fn = "Migrator:Version"
+	version, dirty, err := mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return version, dirty, nil
+}
+
+// Latest returns the version of the last migration, 0 if there are none
+func (mg *Migrator) Latest() uint {
+	if len(mg.versions) == 0 {
+		return 0
+	}
+	return mg.versions[len(mg.versions)-1]
+}
+
+// Check returns an error if the database is dirty, or at a version this binary has no migration
+// for, as running the service against it may corrupt it
+func (mg *Migrator) Check() error {
+	const fn = "Migrator:Check"
+	version, dirty, err := mg.Version()
+	if err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	if dirty {
+		return fmt.Errorf("%s:%w:version %d, fix it and run migrate force", fn, ErrDirtyDatabase, version)
+	}
+	if version > mg.Latest() {
+		return fmt.Errorf("%s:%w:version %d, latest known %d", fn, ErrDatabaseAhead, version, mg.Latest())
+	}
+	if version != 0 && !slices.Contains(mg.versions, version) {
+		return fmt.Errorf("%s:%w:%d", fn, ErrUnknownVersion, version)
+	}
+	return nil
+}
+
+// Lock runs run while holding the migration lock, after waiting for any other holder to release it
+func (mg *Migrator) Lock(ctx context.Context, run func() error) error {
+	const fn = "Migrator:Lock"
+	conn, err := pgx.Connect(ctx, mg.connString)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrationLock, err)
+	}
+	// Closing the session releases the lock, whether it was unlocked or not
+	defer conn.Close(context.Background())
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockID).Scan(&locked); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrationLock, err)
+	}
+	if !locked {
+		slog.InfoContext(ctx, "Waiting for another instance to finish migrating...")
+		if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrMigrationLock, err)
+		}
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+	return run()
+}
+
+// Up runs every pending migration
+func (mg *Migrator) Up(ctx context.Context) error {
+	const fn = "Migrator:Up"
+	slog.InfoContext(ctx, "Running database migrations up...")
+	if err := mg.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return nil
+}
+
+// Down rolls back the last n migrations, n must be positive
+func (mg *Migrator) Down(ctx context.Context, n int) error {
+	const fn = "Migrator:Down"
+	if n <= 0 {
+		return fmt.Errorf("%s:%w:%d", fn, ErrInvalidSteps, n)
+	}
+	slog.InfoContext(ctx, "Rolling back database migrations...", "steps", n)
+	if err := mg.m.Steps(-n); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return nil
+}
+
+// Goto migrates up or down to version
+func (mg *Migrator) Goto(ctx context.Context, version uint) error {
+	const fn = "Migrator:Goto"
+	if !slices.Contains(mg.versions, version) {
+		return fmt.Errorf("%s:%w:%d", fn, ErrUnknownVersion, version)
+	}
+	slog.InfoContext(ctx, "Migrating database to version...", "version", version)
+	if err := mg.m.Migrate(version); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return nil
+}
+
+// Force sets the version of the database and clears its dirty flag, without running any
+// migration, after a failed migration was fixed by hand. A version of -1 means no migration
+func (mg *Migrator) Force(ctx context.Context, version int) error {
+	const fn = "Migrator:Force"
+	slog.InfoContext(ctx, "Forcing database version...", "version", version)
+	if err := mg.m.Force(version); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrateFailed, err)
+	}
+	return nil
+}
+
+// PlanUp returns the migrations Up would run
+func (mg *Migrator) PlanUp() ([]Step, error) {
+	return mg.plan(func(current uint) (uint, error) {
+		return mg.Latest(), nil
+	})
+}
+
+// PlanDown returns the migrations Down would roll back
+func (mg *Migrator) PlanDown(n int) ([]Step, error) {
+	return mg.plan(func(current uint) (uint, error) {
+		if n <= 0 {
+			return 0, fmt.Errorf("%w:%d", ErrInvalidSteps, n)
+		}
+		i := slices.Index(mg.versions, current)
+		if i-n < 0 {
+			return 0, nil
+		}
+		return mg.versions[i-n], nil
+	})
+}
+
+// PlanGoto returns the migrations Goto would run or roll back
+func (mg *Migrator) PlanGoto(version uint) ([]Step, error) {
+	return mg.plan(func(current uint) (uint, error) {
+		if !slices.Contains(mg.versions, version) {
+			return 0, fmt.Errorf("%w:%d", ErrUnknownVersion, version)
+		}
+		return version, nil
+	})
+}
+
+// plan returns the steps from the current version to the target version, up or down
+func (mg *Migrator) plan(target func(current uint) (uint, error)) ([]Step, error) {
+	const fn = "Migrator:plan"
+	if err := mg.Check(); err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+	current, _, err := mg.Version()
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+	to, err := target(current)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+
+	var steps []Step
+	if to >= current {
+		for _, v := range mg.versions {
+			if v > current && v <= to {
+				steps = append(steps, Step{Version: v, Name: mg.names[v], Up: true})
+			}
+		}
+		return steps, nil
+	}
+	for i := len(mg.versions) - 1; i >= 0; i-- {
+		v := mg.versions[i]
+		if v <= current && v > to {
+			steps = append(steps, Step{Version: v, Name: mg.names[v], Up: false})
+		}
+	}
+	return steps, nil
+}
+
+func (mg *Migrator) Close() error {
+	srcErr, dbErr := mg.m.Close()
+	return errors.Join(srcErr, dbErr)
+}
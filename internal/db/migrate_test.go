@@ -0,0 +1,255 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+// newTestDatabase creates an empty database with the TimescaleDB extension in the test container,
+// and returns its connection string
+func newTestDatabase(t *testing.T, name string) string {
+	ctx := context.Background()
+	if _, err := DBPool.pool.Exec(ctx, "CREATE DATABASE "+name); err != nil {
+		t.Fatalf("CREATE DATABASE failed: %v", err)
+	}
+	u, err := url.Parse(testConnString)
+	if err != nil {
+		t.Fatalf("invalid connection string: %v", err)
+	}
+	u.Path = "/" + name
+	conn, err := pgx.Connect(ctx, u.String())
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		t.Fatalf("CREATE EXTENSION failed: %v", err)
+	}
+	return u.String()
+}
+
+// schemaSnapshot describes every column, index and hypertable, with its compression, of the
+// database, except the migrations table
+func schemaSnapshot(t *testing.T, conn *pgx.Conn) []string {
+	var schema []string
+	err := pgxscan.Select(context.Background(), conn, &schema, `
+			SELECT format('column %s.%s %s %s', table_name, column_name, data_type, is_nullable)
+			FROM information_schema.columns
+			WHERE table_schema = 'public' AND table_name <> 'schema_migrations'
+			UNION ALL
+			SELECT format('index %s.%s', tablename, indexname)
+			FROM pg_indexes
+			WHERE schemaname = 'public' AND tablename <> 'schema_migrations'
+			UNION ALL
+			SELECT format('hypertable %s compression %s', hypertable_name, compression_enabled)
+			FROM timescaledb_information.hypertables
+			ORDER BY 1
+		`)
+	if err != nil {
+		t.Fatalf("schema snapshot failed: %v", err)
+	}
+	return schema
+}
+
+// Every down script must restore the schema its up script started from
+func TestMigrationsReversible(t *testing.T) {
+	ctx := context.Background()
+	connString := newTestDatabase(t, "migrations_reversible")
+	mg, err := NewMigrator(Config{ConnString: connString})
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	defer mg.Close()
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	for _, version := range mg.versions {
+		before := schemaSnapshot(t, conn)
+		if err := mg.m.Steps(1); err != nil {
+			t.Fatalf("up %d failed: %v", version, err)
+		}
+		if slices.Equal(before, schemaSnapshot(t, conn)) {
+			t.Fatalf("up %d did not change the schema", version)
+		}
+		if err := mg.m.Steps(-1); err != nil {
+			t.Fatalf("down %d failed: %v", version, err)
+		}
+		if reverted := schemaSnapshot(t, conn); !slices.Equal(before, reverted) {
+			t.Fatalf("down %d did not reverse up %d:\nbefore: %v\nafter:  %v", version, version, before, reverted)
+		}
+		if err := mg.m.Steps(1); err != nil {
+			t.Fatalf("up %d failed: %v", version, err)
+		}
+	}
+	version, dirty, err := mg.Version()
+	if err != nil || dirty || version != mg.Latest() {
+		t.Fatalf("expected clean latest version %d, got %d dirty %t: %v", mg.Latest(), version, dirty, err)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	connString := newTestDatabase(t, "migrator")
+	mg, err := NewMigrator(Config{ConnString: connString})
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	defer mg.Close()
+	if len(mg.versions) < 3 {
+		t.Fatalf("expected at least 3 migrations, got %v", mg.versions)
+	}
+	latest := mg.Latest()
+	previous := mg.versions[len(mg.versions)-2]
+
+	steps, err := mg.PlanUp()
+	if err != nil {
+		t.Fatalf("PlanUp failed: %v", err)
+	}
+	if len(steps) != len(mg.versions) || !steps[0].Up {
+		t.Fatalf("expected every migration up, got %v", steps)
+	}
+	if err := mg.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if steps, _ := mg.PlanUp(); len(steps) != 0 {
+		t.Fatalf("expected no pending migrations, got %v", steps)
+	}
+
+	steps, err = mg.PlanDown(2)
+	if err != nil {
+		t.Fatalf("PlanDown failed: %v", err)
+	}
+	if len(steps) != 2 || steps[0].Version != latest || steps[1].Version != previous || steps[0].Up {
+		t.Fatalf("expected the last two migrations down, got %v", steps)
+	}
+	if _, err := mg.PlanDown(-2); !errors.Is(err, ErrInvalidSteps) {
+		t.Fatalf("expected ErrInvalidSteps, got %v", err)
+	}
+	if err := mg.Down(ctx, 0); !errors.Is(err, ErrInvalidSteps) {
+		t.Fatalf("expected ErrInvalidSteps, got %v", err)
+	}
+	if err := mg.Goto(ctx, mg.versions[0]); err != nil {
+		t.Fatalf("Goto failed: %v", err)
+	}
+	steps, err = mg.PlanGoto(latest)
+	if err != nil {
+		t.Fatalf("PlanGoto failed: %v", err)
+	}
+	if len(steps) != len(mg.versions)-1 || steps[len(steps)-1].Version != latest {
+		t.Fatalf("expected every migration after the first up, got %v", steps)
+	}
+	if _, err := mg.PlanGoto(latest + 100); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	// The service refuses to start while migrations are pending in check mode
+	if _, err := Init(ctx, Config{ConnString: connString, MigrationMode: MigrateCheck}); !errors.Is(err, ErrPendingMigration) {
+		t.Fatalf("expected ErrPendingMigration, got %v", err)
+	}
+
+	// A database migrated by a newer binary is ahead
+	if err := mg.Force(ctx, int(latest+1)); err != nil {
+		t.Fatalf("Force failed: %v", err)
+	}
+	if _, err := Init(ctx, Config{ConnString: connString}); !errors.Is(err, ErrDatabaseAhead) {
+		t.Fatalf("expected ErrDatabaseAhead, got %v", err)
+	}
+
+	// A migration that failed half way leaves the database dirty
+	if err := mg.Force(ctx, int(mg.versions[0])); err != nil {
+		t.Fatalf("Force failed: %v", err)
+	}
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "UPDATE schema_migrations SET dirty = true"); err != nil {
+		t.Fatalf("UPDATE failed: %v", err)
+	}
+	if _, err := Init(ctx, Config{ConnString: connString}); !errors.Is(err, ErrDirtyDatabase) {
+		t.Fatalf("expected ErrDirtyDatabase, got %v", err)
+	}
+	if err := mg.Force(ctx, int(mg.versions[0])); err != nil {
+		t.Fatalf("Force failed: %v", err)
+	}
+	if err := mg.Check(); err != nil {
+		t.Fatalf("expected a clean database after force, got %v", err)
+	}
+}
+
+// The migrations built into the binary are the ones on disk, which override them if a path is set
+func TestMigrationsPathOverride(t *testing.T) {
+	embedded, err := NewMigrator(Config{ConnString: testConnString})
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	defer embedded.Close()
+	disk, err := NewMigrator(Config{ConnString: testConnString, MigrationsPath: "./migrations"})
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	defer disk.Close()
+	if !slices.Equal(embedded.versions, disk.versions) || len(embedded.versions) == 0 {
+		t.Fatalf("expected the same migrations, got %v embedded and %v on disk", embedded.versions, disk.versions)
+	}
+	if _, err := NewMigrator(Config{ConnString: testConnString, MigrationsPath: "./missing"}); !errors.Is(err, ErrMigrateFailed) {
+		t.Fatalf("expected ErrMigrateFailed for a missing path, got %v", err)
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	ctx := context.Background()
+	mg, err := NewMigrator(Config{ConnString: testConnString})
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	defer mg.Close()
+
+	// Another instance holds the lock
+	conn, err := pgx.Connect(ctx, testConnString)
+	if err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	ran := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- mg.Lock(ctx, func() error {
+			close(ran)
+			return nil
+		})
+	}()
+	select {
+	case <-ran:
+		t.Fatalf("ran while another instance held the lock")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("did not run once the lock was released")
+	}
+	<-ran
+}
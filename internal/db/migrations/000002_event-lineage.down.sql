@@ -0,0 +1,5 @@
+ALTER TABLE device_events_cleaned
+    DROP COLUMN IF EXISTS event_id,
+    DROP COLUMN IF EXISTS source_topic,
+    DROP COLUMN IF EXISTS source_partition,
+    DROP COLUMN IF EXISTS source_offset;
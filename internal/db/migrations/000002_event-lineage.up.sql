@@ -0,0 +1,7 @@
+-- Lineage of each event, from the metadata headers stamped by the pipeline. Nullable, as events
+-- created through the REST API or sunk by Kafka Connect have no lineage
+ALTER TABLE device_events_cleaned
+    ADD COLUMN IF NOT EXISTS event_id TEXT,
+    ADD COLUMN IF NOT EXISTS source_topic TEXT,
+    ADD COLUMN IF NOT EXISTS source_partition INTEGER,
+    ADD COLUMN IF NOT EXISTS source_offset BIGINT;
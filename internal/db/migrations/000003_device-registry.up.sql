@@ -0,0 +1,6 @@
+-- Registry of decommissioned devices. A device with retired_at set is retired, and its events are
+-- rejected by the Cleaner until it is registered again, which clears retired_at
+CREATE TABLE IF NOT EXISTS devices (
+    device_id TEXT PRIMARY KEY,
+    retired_at TIMESTAMPTZ
+);
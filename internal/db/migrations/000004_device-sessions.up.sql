@@ -0,0 +1,12 @@
+-- Sessions of each device, from a device_enter to the following device_exit, built by the
+-- Sessionizer. A session is open, with no end nor duration, until the exit is seen
+CREATE TABLE IF NOT EXISTS device_sessions (
+    device_id TEXT NOT NULL,
+    session_start BIGINT NOT NULL,
+    session_end BIGINT,
+    duration_ms BIGINT,
+    PRIMARY KEY (device_id, session_start)
+);
+
+-- Convert to hypertable (TimescaleDB), with one day chunks of millisecond timestamps
+SELECT create_hypertable('device_sessions', 'session_start', chunk_time_interval => 86400000, if_not_exists => TRUE);
@@ -0,0 +1,4 @@
+-- Dropping the continuous aggregates drops their refresh policies. unix_now_ms is kept, as it stays
+-- the integer now function of device_events_cleaned, which cannot be unset
+DROP MATERIALIZED VIEW IF EXISTS device_stats_daily;
+DROP MATERIALIZED VIEW IF EXISTS device_stats_hourly;
@@ -0,0 +1,46 @@
+-- Timestamps are Unix epoch milliseconds, so TimescaleDB needs the current time in milliseconds to
+-- place the refresh windows of the continuous aggregates
+CREATE OR REPLACE FUNCTION unix_now_ms() RETURNS BIGINT
+LANGUAGE SQL STABLE AS $$ SELECT (extract(epoch FROM now()) * 1000)::BIGINT $$;
+
+SELECT set_integer_now_func('device_events_cleaned', 'unix_now_ms', replace_if_exists => TRUE);
+
+-- Enters and exits of each device per hour. Real-time, so the buckets not yet materialized are
+-- computed from device_events_cleaned at query time
+CREATE MATERIALIZED VIEW IF NOT EXISTS device_stats_hourly
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+    device_id,
+    time_bucket(BIGINT '3600000', timestamp) AS bucket,
+    count(*) FILTER (WHERE event_type = 'device_enter') AS enters,
+    count(*) FILTER (WHERE event_type = 'device_exit') AS exits
+FROM device_events_cleaned
+GROUP BY device_id, bucket
+WITH NO DATA;
+
+-- Enters and exits of each device per day
+CREATE MATERIALIZED VIEW IF NOT EXISTS device_stats_daily
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT
+    device_id,
+    time_bucket(BIGINT '86400000', timestamp) AS bucket,
+    count(*) FILTER (WHERE event_type = 'device_enter') AS enters,
+    count(*) FILTER (WHERE event_type = 'device_exit') AS exits
+FROM device_events_cleaned
+GROUP BY device_id, bucket
+WITH NO DATA;
+
+-- Refresh the last 3 days of hours every 30 minutes, and the last 30 days every hour, leaving out
+-- the current bucket, which is still filling up. Events older than that when they are written,
+-- e.g. backfilled, are refreshed by the service after the write, see DB.refreshStats
+SELECT add_continuous_aggregate_policy('device_stats_hourly',
+    start_offset => BIGINT '259200000',
+    end_offset => BIGINT '3600000',
+    schedule_interval => INTERVAL '30 minutes',
+    if_not_exists => TRUE);
+
+SELECT add_continuous_aggregate_policy('device_stats_daily',
+    start_offset => BIGINT '2592000000',
+    end_offset => BIGINT '86400000',
+    schedule_interval => INTERVAL '1 hour',
+    if_not_exists => TRUE);
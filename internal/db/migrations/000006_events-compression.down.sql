@@ -0,0 +1,4 @@
+-- Compression cannot be disabled while a policy or a compressed chunk is left
+SELECT remove_compression_policy('device_events_cleaned', if_exists => TRUE);
+SELECT decompress_chunk(c, if_compressed => TRUE) FROM show_chunks('device_events_cleaned') c;
+ALTER TABLE device_events_cleaned SET (timescaledb.compress = FALSE);
@@ -0,0 +1,8 @@
+-- Compress the events of each device together, in timestamp order, which is how the timeline and
+-- the stats read them. The compression and retention policies are set at startup from the
+-- configuration, see DB.ApplyStoragePolicies
+ALTER TABLE device_events_cleaned SET (
+    timescaledb.compress,
+    timescaledb.compress_segmentby = 'device_id',
+    timescaledb.compress_orderby = 'timestamp'
+);
@@ -2,67 +2,563 @@ package db
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 )
 
 var (
-	ErrInsertFailed           = errors.New("insert operation failed")
-	ErrTransactionStartFailed = errors.New("transaction start failed")
-	ErrSelectFailed           = errors.New("select operation failed")
+	ErrInsertFailed            = errors.New("insert operation failed")
+	ErrTransactionStartFailed  = errors.New("transaction start failed")
+	ErrSelectFailed            = errors.New("select operation failed")
+	ErrTransactionCommitFailed = errors.New("transaction commit failed")
+	ErrDeleteFailed            = errors.New("delete operation failed")
+	ErrDuplicateEvent          = errors.New("event already stored for device and timestamp")
+	ErrInvalidCursor           = errors.New("invalid cursor")
+	ErrInvalidBucket           = errors.New("invalid stats bucket")
+	ErrRefreshStats            = errors.New("stats refresh failed")
 )
 
-func (db *DB) CreateTimeline(ctx context.Context, events []DeviceEvent) error {
+// uniqueViolation is the SQLSTATE of a unique constraint violation
+const uniqueViolation = "23505"
+
+// ConflictPolicy is what a write does with an event whose (device_id, timestamp) is already stored,
+// or repeated in the same write
+type ConflictPolicy int
+
+const (
+	// ConflictReject fails the whole write with ErrDuplicateEvent
+	ConflictReject ConflictPolicy = iota
+	// ConflictIgnore keeps the stored event and skips the new one
+	ConflictIgnore
+	// ConflictOverwrite replaces the stored event with the new one
+	ConflictOverwrite
+)
+
+// EventStatus is the outcome of writing one event
+type EventStatus string
+
+const (
+	EventInserted EventStatus = "inserted"
+	// EventDuplicate is an event skipped in favour of the stored event, or of another event of the
+	// same write
+	EventDuplicate EventStatus = "duplicate"
+	// EventOverwritten is an event that replaced the stored event
+	EventOverwritten EventStatus = "overwritten"
+)
+
+// eventKey is the primary key of device_events_cleaned
+type eventKey struct {
+	deviceID  string
+	timestamp int64
+}
+
+// eventColumns are the columns of device_events_cleaned written by copyEvents, in order
+var eventColumns = []string{
+	"device_id",
+	"event_type",
+	"timestamp",
+	"event_id",
+	"source_topic",
+	"source_partition",
+	"source_offset",
+}
+
+// CreateTimeline inserts events in a single transaction, handling events that are already stored
+// per policy. Returns the status of every event, in the order of events. With ConflictReject,
+// nothing is inserted if any event is already stored, and ErrDuplicateEvent is returned
+func (db *DB) CreateTimeline(ctx context.Context, events []DeviceEvent, policy ConflictPolicy) ([]EventStatus, error) {
 	const fn = "DB:CreateTimeline"
+	statuses, err := db.copyEvents(ctx, events, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", fn, err)
+	}
+	return statuses, nil
+}
+
+// InsertEvents inserts a batch of events in a single transaction. Events that already exist
+// for the same (device_id, timestamp) are skipped, so redelivered batches are idempotent.
+// Returns the number of events inserted
+func (db *DB) InsertEvents(ctx context.Context, events []DeviceEvent) (int64, error) {
+	const fn = "DB:InsertEvents"
+	statuses, err := db.copyEvents(ctx, events, ConflictIgnore)
+	if err != nil {
+		return 0, fmt.Errorf("%s:%w", fn, err)
+	}
+	var inserted int64
+	for _, status := range statuses {
+		if status == EventInserted {
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+// copyEvents bulk loads events with COPY into a staging table dropped at commit, then inserts them
+// into device_events_cleaned with a single statement, handling conflicts per policy. Returns the
+// status of every event. Of the events repeated in the write, the first is written, or the last
+// with ConflictOverwrite, and the others are duplicates
+func (db *DB) copyEvents(ctx context.Context, events []DeviceEvent, policy ConflictPolicy) ([]EventStatus, error) {
+	if len(events) == 0 {
+		return []EventStatus{}, nil
+	}
+	// written is the index of the event written for each key
+	written := make(map[eventKey]int, len(events))
+	for i, e := range events {
+		key := eventKey{e.DeviceID, e.Timestamp}
+		if _, ok := written[key]; !ok || policy == ConflictOverwrite {
+			written[key] = i
+		}
+	}
+	// Rows repeated in an insert are rejected as unique violations, and cannot be updated twice
+	// by one upsert, so only ConflictReject stages them all
+	staged := events
+	if policy != ConflictReject {
+		staged = make([]DeviceEvent, 0, len(written))
+		for i, e := range events {
+			if written[eventKey{e.DeviceID, e.Timestamp}] == i {
+				staged = append(staged, e)
+			}
+		}
+	}
+
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrTransactionStartFailed, err)
+		return nil, fmt.Errorf("%w:%w", ErrTransactionStartFailed, err)
 	}
-	defer func() {
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+			CREATE TEMP TABLE device_events_staging
+			(LIKE device_events_cleaned INCLUDING DEFAULTS)
+			ON COMMIT DROP
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrInsertFailed, err)
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"device_events_staging"}, eventColumns,
+		pgx.CopyFromSlice(len(staged), func(i int) ([]interface{}, error) {
+			e := staged[i]
+			return []interface{}{
+				e.DeviceID,
+				e.EventType,
+				e.Timestamp,
+				e.EventID,
+				e.SourceTopic,
+				e.SourcePartition,
+				e.SourceOffset,
+			}, nil
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrInsertFailed, err)
+	}
+
+	onConflict := ""
+	// overwritten holds the staged keys already stored, which an upsert overwrites
+	overwritten := make(map[eventKey]bool)
+	switch policy {
+	case ConflictIgnore:
+		onConflict = "ON CONFLICT (device_id, timestamp) DO NOTHING"
+	case ConflictOverwrite:
+		onConflict = `ON CONFLICT (device_id, timestamp) DO UPDATE SET
+				event_type = EXCLUDED.event_type,
+				event_id = EXCLUDED.event_id,
+				source_topic = EXCLUDED.source_topic,
+				source_partition = EXCLUDED.source_partition,
+				source_offset = EXCLUDED.source_offset`
+		keys, err := scanKeys(tx.Query(ctx, `
+			SELECT s.device_id, s.timestamp
+			FROM device_events_staging s
+			JOIN device_events_cleaned d USING (device_id, timestamp)
+		`))
 		if err != nil {
-			tx.Rollback(ctx)
-		} else {
-			tx.Commit(ctx)
+			return nil, fmt.Errorf("%w:%w", ErrSelectFailed, err)
 		}
-	}()
-
-	for _, event := range events {
-		_, err = tx.Exec(ctx, `
+		for _, key := range keys {
+			overwritten[key] = true
+		}
+	}
+	keys, err := scanKeys(tx.Query(ctx, `
 			INSERT INTO device_events_cleaned (
-				device_id, 
-				event_type, 
-				timestamp
-			) VALUES ($1, $2, $3)
-		`, event.DeviceID, event.EventType, event.Timestamp)
+				device_id,
+				event_type,
+				timestamp,
+				event_id,
+				source_topic,
+				source_partition,
+				source_offset
+			)
+			SELECT
+				device_id,
+				event_type,
+				timestamp,
+				event_id,
+				source_topic,
+				source_partition,
+				source_offset
+			FROM device_events_staging
+			`+onConflict+`
+			RETURNING device_id, timestamp
+		`))
+	if err != nil {
+		return nil, insertError(err)
+	}
+	stored := make(map[eventKey]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrTransactionCommitFailed, err)
+	}
+
+	statuses := make([]EventStatus, len(events))
+	for i, e := range events {
+		key := eventKey{e.DeviceID, e.Timestamp}
+		switch {
+		case written[key] != i || !stored[key]:
+			statuses[i] = EventDuplicate
+		case overwritten[key]:
+			statuses[i] = EventOverwritten
+		default:
+			statuses[i] = EventInserted
+		}
+	}
+	db.staleStats.queue(keys, time.Now().UnixMilli())
+	return statuses, nil
+}
+
+// scanKeys reads the (device_id, timestamp) rows of a query
+func scanKeys(rows pgx.Rows, err error) ([]eventKey, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []eventKey
+	for rows.Next() {
+		var key eventKey
+		if err := rows.Scan(&key.deviceID, &key.timestamp); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// insertError maps a unique violation onto ErrDuplicateEvent, and any other error onto
+// ErrInsertFailed
+func insertError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return fmt.Errorf("%w:%s", ErrDuplicateEvent, pgErr.Detail)
+	}
+	return fmt.Errorf("%w:%w", ErrInsertFailed, err)
+}
+
+// Page selects one page of a timeline: up to Limit events after the event of Cursor, in ascending
+// timestamp order or descending if Descending is set. An empty Cursor starts at the first page
+type Page struct {
+	Cursor     string
+	Limit      int
+	Descending bool
+}
+
+// LoadEventsPage returns one page of the events of a device between start and end, and the cursor
+// of the next page, empty on the last page. Pages are read with a keyset on the timestamp, unique
+// per device, so reading a page costs the same however deep it is, and events inserted while
+// paging do not shift the following pages
+func (db *DB) LoadEventsPage(ctx context.Context, deviceID string, start, end int64, page Page) ([]DeviceEvent, string, error) {
+	const fn = "DB:LoadEventsPage"
+	order, after := "ASC", ">"
+	if page.Descending {
+		order, after = "DESC", "<"
+	}
+	args := []any{deviceID, start, end, page.Limit + 1}
+	keyset := ""
+	if page.Cursor != "" {
+		last, err := decodeCursor(page.Cursor, page.Descending)
 		if err != nil {
-			return fmt.Errorf("%s:%w:%w", fn, ErrInsertFailed, err)
+			return nil, "", fmt.Errorf("%s:%w", fn, err)
 		}
+		keyset = "AND timestamp " + after + " $5"
+		args = append(args, last)
 	}
-	return nil
+
+	events := []DeviceEvent{}
+	// The limit is one more than the page, to know whether there is a next page
+	err := pgxscan.Select(ctx, db.pool, &events, `
+			SELECT
+				device_id,
+				event_type,
+				timestamp,
+				event_id,
+				source_topic,
+				source_partition,
+				source_offset
+			FROM device_events_cleaned
+			WHERE device_id = $1
+			AND timestamp >= $2
+			AND timestamp <= $3
+			`+keyset+`
+			ORDER BY timestamp `+order+`
+			LIMIT $4
+		`, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	if len(events) <= page.Limit {
+		return events, "", nil
+	}
+	events = events[:page.Limit]
+	return events, encodeCursor(events[len(events)-1].Timestamp, page.Descending), nil
+}
+
+// encodeCursor returns the opaque cursor of the page after the event at timestamp. The order is
+// part of the cursor, so it cannot be used to page in the other order
+func encodeCursor(timestamp int64, descending bool) string {
+	order := "asc"
+	if descending {
+		order = "desc"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(order + ":" + strconv.FormatInt(timestamp, 10)))
 }
 
-func (db *DB) LoadEventsBetween(ctx context.Context, deviceID string, start, end int64) ([]DeviceEvent, error) {
-	const fn = "DB:LoadEventsBetween"
+// decodeCursor returns the timestamp of the last event of the previous page
+func decodeCursor(cursor string, descending bool) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("%w:%w", ErrInvalidCursor, err)
+	}
+	order, last, ok := strings.Cut(string(data), ":")
+	if !ok || (order == "desc") != descending || (order != "asc" && order != "desc") {
+		return 0, fmt.Errorf("%w:%s", ErrInvalidCursor, cursor)
+	}
+	timestamp, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w:%w", ErrInvalidCursor, err)
+	}
+	return timestamp, nil
+}
+
+// LoadLatestEvents returns the latest event of every device that is not retired
+func (db *DB) LoadLatestEvents(ctx context.Context) ([]DeviceEvent, error) {
+	const fn = "DB:LoadLatestEvents"
 	var events []DeviceEvent
 	err := pgxscan.Select(ctx, db.pool, &events, `
-			SELECT 
+			SELECT DISTINCT ON (device_id)
 				device_id, 
 				event_type, 
-				timestamp
+				timestamp,
+				event_id,
+				source_topic,
+				source_partition,
+				source_offset
 			FROM device_events_cleaned
-			WHERE device_id = $1 
-			AND timestamp >= $2 
-			AND timestamp <= $3
-			ORDER BY timestamp ASC
-		`, deviceID, start, end)
+			WHERE device_id NOT IN (
+				SELECT device_id FROM devices WHERE retired_at IS NOT NULL
+			)
+			ORDER BY device_id, timestamp DESC
+		`)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return []DeviceEvent{}, nil
-		}
 		return nil, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
 	}
 	return events, nil
 }
+
+// RetireDevice marks a device as retired. Retiring a retired device keeps its original retirement
+// time
+func (db *DB) RetireDevice(ctx context.Context, deviceID string) error {
+	const fn = "DB:RetireDevice"
+	_, err := db.pool.Exec(ctx, `
+			INSERT INTO devices (device_id, retired_at)
+			VALUES ($1, now())
+			ON CONFLICT (device_id) DO UPDATE
+			SET retired_at = COALESCE(devices.retired_at, EXCLUDED.retired_at)
+		`, deviceID)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrInsertFailed, err)
+	}
+	return nil
+}
+
+// RegisterDevice registers a device, clearing its retirement if it was retired
+func (db *DB) RegisterDevice(ctx context.Context, deviceID string) error {
+	const fn = "DB:RegisterDevice"
+	_, err := db.pool.Exec(ctx, `
+			INSERT INTO devices (device_id, retired_at)
+			VALUES ($1, NULL)
+			ON CONFLICT (device_id) DO UPDATE
+			SET retired_at = NULL
+		`, deviceID)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrInsertFailed, err)
+	}
+	return nil
+}
+
+// IsRetired returns true if the device is retired. A device that was never registered is not
+func (db *DB) IsRetired(ctx context.Context, deviceID string) (bool, error) {
+	const fn = "DB:IsRetired"
+	var retired bool
+	err := db.pool.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM devices WHERE device_id = $1 AND retired_at IS NOT NULL
+			)
+		`, deviceID).Scan(&retired)
+	if err != nil {
+		return false, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return retired, nil
+}
+
+// OpenSession opens a session of a device. Other open sessions of the device are dropped, as their
+// exit was missed. Opening an open session is a no-op
+func (db *DB) OpenSession(ctx context.Context, deviceID string, start int64) error {
+	const fn = "DB:OpenSession"
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrTransactionStartFailed, err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+			DELETE FROM device_sessions
+			WHERE device_id = $1
+			AND session_end IS NULL
+			AND session_start <> $2
+		`, deviceID, start)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrDeleteFailed, err)
+	}
+	_, err = tx.Exec(ctx, `
+			INSERT INTO device_sessions (device_id, session_start)
+			VALUES ($1, $2)
+			ON CONFLICT (device_id, session_start) DO NOTHING
+		`, deviceID, start)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrInsertFailed, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrTransactionCommitFailed, err)
+	}
+	return nil
+}
+
+// CloseSession stores a completed session, closing it if it is open
+func (db *DB) CloseSession(ctx context.Context, session DeviceSession) error {
+	const fn = "DB:CloseSession"
+	_, err := db.pool.Exec(ctx, `
+			INSERT INTO device_sessions (device_id, session_start, session_end, duration_ms)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (device_id, session_start) DO UPDATE
+			SET session_end = EXCLUDED.session_end, duration_ms = EXCLUDED.duration_ms
+		`, session.DeviceID, session.Start, session.End, session.DurationMillis)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrInsertFailed, err)
+	}
+	return nil
+}
+
+// DropOpenSessions deletes the open sessions of a device. Completed sessions are kept
+func (db *DB) DropOpenSessions(ctx context.Context, deviceID string) error {
+	const fn = "DB:DropOpenSessions"
+	_, err := db.pool.Exec(ctx, `
+			DELETE FROM device_sessions
+			WHERE device_id = $1
+			AND session_end IS NULL
+		`, deviceID)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrDeleteFailed, err)
+	}
+	return nil
+}
+
+// LoadLatestSessions returns the latest session of every device, open or closed. A device has at
+// most one open session, and it is its latest
+func (db *DB) LoadLatestSessions(ctx context.Context) ([]DeviceSession, error) {
+	const fn = "DB:LoadLatestSessions"
+	var sessions []DeviceSession
+	err := pgxscan.Select(ctx, db.pool, &sessions, `
+			SELECT DISTINCT ON (device_id)
+				device_id,
+				session_start,
+				session_end,
+				duration_ms
+			FROM device_sessions
+			ORDER BY device_id, session_start DESC
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return sessions, nil
+}
+
+// LoadSessionsBetween returns the sessions of a device that started between start and end,
+// including the open one
+func (db *DB) LoadSessionsBetween(ctx context.Context, deviceID string, start, end int64) ([]DeviceSession, error) {
+	const fn = "DB:LoadSessionsBetween"
+	var sessions []DeviceSession
+	err := pgxscan.Select(ctx, db.pool, &sessions, `
+			SELECT
+				device_id,
+				session_start,
+				session_end,
+				duration_ms
+			FROM device_sessions
+			WHERE device_id = $1
+			AND session_start >= $2
+			AND session_start <= $3
+			ORDER BY session_start ASC
+		`, deviceID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return sessions, nil
+}
+
+// StatsBucket is the width of the buckets of device stats
+type StatsBucket string
+
+const (
+	StatsHourly StatsBucket = "1h"
+	StatsDaily  StatsBucket = "1d"
+)
+
+// statsViews are the continuous aggregates holding the stats of each bucket width
+var statsViews = map[StatsBucket]string{
+	StatsHourly: "device_stats_hourly",
+	StatsDaily:  "device_stats_daily",
+}
+
+// LoadStats returns the enter and exit counts of a device per bucket, for the buckets starting
+// between start and end, read from the continuous aggregates. Buckets without events are left out
+func (db *DB) LoadStats(ctx context.Context, deviceID string, bucket StatsBucket, start, end int64) ([]DeviceStats, error) {
+	const fn = "DB:LoadStats"
+	view, ok := statsViews[bucket]
+	if !ok {
+		return nil, fmt.Errorf("%s:%w:%s", fn, ErrInvalidBucket, bucket)
+	}
+	stats := []DeviceStats{}
+	err := pgxscan.Select(ctx, db.pool, &stats, `
+			SELECT
+				device_id,
+				bucket,
+				enters,
+				exits
+			FROM `+view+`
+			WHERE device_id = $1
+			AND bucket >= $2
+			AND bucket <= $3
+			ORDER BY bucket ASC
+		`, deviceID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return stats, nil
+}
@@ -2,6 +2,9 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"testing"
 
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
@@ -9,6 +12,9 @@ import (
 
 var DBPool *DB
 
+// testConnString is the connection string of the test database
+var testConnString string
+
 // Setup the testcontainer DB before running an dbOps tests
 func TestMain(m *testing.M) {
 	ctx := context.Background()
@@ -28,11 +34,11 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		panic(err)
 	}
-	migrationsPath := "./migrations"
+	testConnString = connStr
 
+	// Migrated with the migrations built into the package
 	DBPool, err = Init(ctx, Config{
-		ConnString:     connStr,
-		MigrationsPath: migrationsPath,
+		ConnString: connStr,
 	})
 	if err != nil {
 		panic(err)
@@ -52,14 +58,14 @@ func TestOps(t *testing.T) {
 		{DeviceID: "dev1", EventType: "off", Timestamp: now + 1},
 	}
 
-	err := DBPool.CreateTimeline(ctx, events)
+	_, err := DBPool.CreateTimeline(ctx, events, ConflictReject)
 	if err != nil {
 		t.Fatalf("CreateTimeline failed: %v", err)
 	}
 
-	got, err := DBPool.LoadEventsBetween(ctx, "dev1", now, now+1)
+	got, _, err := DBPool.LoadEventsPage(ctx, "dev1", now, now+1, Page{Limit: 10})
 	if err != nil {
-		t.Fatalf("LoadEventsBetween failed: %v", err)
+		t.Fatalf("LoadEventsPage failed: %v", err)
 	}
 	if len(got) != 2 {
 		t.Fatalf("expected 2 events, got %d", len(got))
@@ -68,3 +74,426 @@ func TestOps(t *testing.T) {
 		t.Fatalf("unexpected event types: %+v", got)
 	}
 }
+
+func TestLoadEventsPage(t *testing.T) {
+	ctx := context.Background()
+	now := int64(9000000)
+	var events []DeviceEvent
+	for i := int64(0); i < 5; i++ {
+		events = append(events, DeviceEvent{DeviceID: "dev9", EventType: "on", Timestamp: now + i})
+	}
+	if _, err := DBPool.CreateTimeline(ctx, events, ConflictReject); err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+
+	readAll := func(descending bool) []int64 {
+		var timestamps []int64
+		cursor := ""
+		for {
+			page, next, err := DBPool.LoadEventsPage(ctx, "dev9", now, now+4, Page{
+				Cursor:     cursor,
+				Limit:      2,
+				Descending: descending,
+			})
+			if err != nil {
+				t.Fatalf("LoadEventsPage failed: %v", err)
+			}
+			if len(page) > 2 {
+				t.Fatalf("expected at most 2 events, got %d", len(page))
+			}
+			for _, e := range page {
+				timestamps = append(timestamps, e.Timestamp)
+			}
+			if next == "" {
+				return timestamps
+			}
+			cursor = next
+		}
+	}
+
+	if got := readAll(false); !slices.Equal(got, []int64{now, now + 1, now + 2, now + 3, now + 4}) {
+		t.Fatalf("unexpected ascending timeline: %v", got)
+	}
+	if got := readAll(true); !slices.Equal(got, []int64{now + 4, now + 3, now + 2, now + 1, now}) {
+		t.Fatalf("unexpected descending timeline: %v", got)
+	}
+
+	// A full last page has no next cursor
+	_, next, err := DBPool.LoadEventsPage(ctx, "dev9", now, now+4, Page{Limit: 5})
+	if err != nil {
+		t.Fatalf("LoadEventsPage failed: %v", err)
+	}
+	if next != "" {
+		t.Fatalf("expected no next cursor, got %q", next)
+	}
+
+	_, next, err = DBPool.LoadEventsPage(ctx, "dev9", now, now+4, Page{Limit: 2})
+	if err != nil {
+		t.Fatalf("LoadEventsPage failed: %v", err)
+	}
+	for _, cursor := range []string{"not-a-cursor", next} {
+		_, _, err = DBPool.LoadEventsPage(ctx, "dev9", now, now+4, Page{Cursor: cursor, Limit: 2, Descending: true})
+		if !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("expected ErrInvalidCursor for %q, got %v", cursor, err)
+		}
+	}
+}
+
+func TestInsertEvents(t *testing.T) {
+	ctx := context.Background()
+	now := int64(2000000)
+	eventID, topic, partition, offset := "event123", "device-events", int32(0), int64(42)
+	events := []DeviceEvent{
+		{
+			DeviceID:        "dev2",
+			EventType:       "device_enter",
+			Timestamp:       now,
+			EventID:         &eventID,
+			SourceTopic:     &topic,
+			SourcePartition: &partition,
+			SourceOffset:    &offset,
+		},
+		{DeviceID: "dev2", EventType: "device_exit", Timestamp: now + 1},
+	}
+
+	inserted, err := DBPool.InsertEvents(ctx, events)
+	if err != nil {
+		t.Fatalf("InsertEvents failed: %v", err)
+	}
+	if inserted != 2 {
+		t.Fatalf("expected 2 events inserted, got %d", inserted)
+	}
+
+	// Redelivered batch with one new event, conflicts are skipped
+	events = append(events, DeviceEvent{DeviceID: "dev2", EventType: "device_enter", Timestamp: now + 2})
+	inserted, err = DBPool.InsertEvents(ctx, events)
+	if err != nil {
+		t.Fatalf("InsertEvents with conflicts failed: %v", err)
+	}
+	if inserted != 1 {
+		t.Fatalf("expected 1 event inserted, got %d", inserted)
+	}
+
+	got, _, err := DBPool.LoadEventsPage(ctx, "dev2", now, now+2, Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("LoadEventsPage failed: %v", err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(got))
+	}
+	if got[0].EventID == nil || *got[0].EventID != eventID || got[0].SourceOffset == nil || *got[0].SourceOffset != offset {
+		t.Fatalf("unexpected lineage: %+v", got[0])
+	}
+	if got[1].EventID != nil {
+		t.Fatalf("expected no lineage, got %+v", got[1])
+	}
+}
+
+func TestCreateTimelineConflict(t *testing.T) {
+	ctx := context.Background()
+	now := int64(5000000)
+	if _, err := DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev7", EventType: "device_enter", Timestamp: now},
+	}, ConflictReject); err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	timeline := []DeviceEvent{
+		{DeviceID: "dev7", EventType: "device_exit", Timestamp: now + 1},
+		{DeviceID: "dev7", EventType: "device_exit", Timestamp: now},
+	}
+
+	// One stored event fails the whole timeline
+	_, err := DBPool.CreateTimeline(ctx, timeline, ConflictReject)
+	if !errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("expected ErrDuplicateEvent, got %v", err)
+	}
+	got, _, err := DBPool.LoadEventsPage(ctx, "dev7", now, now+1, Page{Limit: 10})
+	if err != nil {
+		t.Fatalf("LoadEventsPage failed: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected the rejected timeline to insert nothing, got %+v", got)
+	}
+
+	statuses, err := DBPool.CreateTimeline(ctx, timeline, ConflictIgnore)
+	if err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	if !slices.Equal(statuses, []EventStatus{EventInserted, EventDuplicate}) {
+		t.Fatalf("unexpected statuses with ConflictIgnore: %v", statuses)
+	}
+	got, _, _ = DBPool.LoadEventsPage(ctx, "dev7", now, now, Page{Limit: 10})
+	if len(got) != 1 || got[0].EventType != "device_enter" {
+		t.Fatalf("expected the stored event to be kept, got %+v", got)
+	}
+
+	// The last of repeated events is written
+	statuses, err = DBPool.CreateTimeline(ctx, append(timeline, DeviceEvent{DeviceID: "dev7", EventType: "device_enter", Timestamp: now + 2}), ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	if !slices.Equal(statuses, []EventStatus{EventOverwritten, EventOverwritten, EventInserted}) {
+		t.Fatalf("unexpected statuses with ConflictOverwrite: %v", statuses)
+	}
+	got, _, _ = DBPool.LoadEventsPage(ctx, "dev7", now, now, Page{Limit: 10})
+	if len(got) != 1 || got[0].EventType != "device_exit" {
+		t.Fatalf("expected the stored event to be overwritten, got %+v", got)
+	}
+
+	statuses, err = DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev7", EventType: "device_enter", Timestamp: now + 3},
+		{DeviceID: "dev7", EventType: "device_exit", Timestamp: now + 3},
+	}, ConflictOverwrite)
+	if err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	if !slices.Equal(statuses, []EventStatus{EventDuplicate, EventInserted}) {
+		t.Fatalf("unexpected statuses for repeated events: %v", statuses)
+	}
+	if _, err := DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev7", EventType: "device_enter", Timestamp: now + 4},
+		{DeviceID: "dev7", EventType: "device_exit", Timestamp: now + 4},
+	}, ConflictReject); !errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("expected ErrDuplicateEvent for repeated events, got %v", err)
+	}
+}
+
+func TestLoadLatestEvents(t *testing.T) {
+	ctx := context.Background()
+	now := int64(3000000)
+	events := []DeviceEvent{
+		{DeviceID: "dev3", EventType: "device_enter", Timestamp: now},
+		{DeviceID: "dev3", EventType: "device_exit", Timestamp: now + 1},
+		{DeviceID: "dev4", EventType: "device_enter", Timestamp: now},
+	}
+	if _, err := DBPool.CreateTimeline(ctx, events, ConflictReject); err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+
+	got, err := DBPool.LoadLatestEvents(ctx)
+	if err != nil {
+		t.Fatalf("LoadLatestEvents failed: %v", err)
+	}
+	latest := make(map[string]DeviceEvent)
+	for _, event := range got {
+		if _, ok := latest[event.DeviceID]; ok {
+			t.Fatalf("expected one event per device, got two for %s", event.DeviceID)
+		}
+		latest[event.DeviceID] = event
+	}
+	if latest["dev3"].EventType != "device_exit" || latest["dev3"].Timestamp != now+1 {
+		t.Fatalf("unexpected latest event for dev3: %+v", latest["dev3"])
+	}
+	if latest["dev4"].EventType != "device_enter" {
+		t.Fatalf("unexpected latest event for dev4: %+v", latest["dev4"])
+	}
+}
+
+func TestRetireDevice(t *testing.T) {
+	ctx := context.Background()
+	now := int64(4000000)
+	if _, err := DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev5", EventType: "device_enter", Timestamp: now},
+	}, ConflictReject); err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+
+	retired, err := DBPool.IsRetired(ctx, "dev5")
+	if err != nil {
+		t.Fatalf("IsRetired failed: %v", err)
+	}
+	if retired {
+		t.Fatalf("expected unregistered device not to be retired")
+	}
+
+	if err := DBPool.RetireDevice(ctx, "dev5"); err != nil {
+		t.Fatalf("RetireDevice failed: %v", err)
+	}
+	retired, err = DBPool.IsRetired(ctx, "dev5")
+	if err != nil {
+		t.Fatalf("IsRetired failed: %v", err)
+	}
+	if !retired {
+		t.Fatalf("expected device to be retired")
+	}
+	latest, err := DBPool.LoadLatestEvents(ctx)
+	if err != nil {
+		t.Fatalf("LoadLatestEvents failed: %v", err)
+	}
+	for _, event := range latest {
+		if event.DeviceID == "dev5" {
+			t.Fatalf("expected retired device not to be loaded, got %+v", event)
+		}
+	}
+
+	if err := DBPool.RegisterDevice(ctx, "dev5"); err != nil {
+		t.Fatalf("RegisterDevice failed: %v", err)
+	}
+	retired, err = DBPool.IsRetired(ctx, "dev5")
+	if err != nil {
+		t.Fatalf("IsRetired failed: %v", err)
+	}
+	if retired {
+		t.Fatalf("expected re-registered device not to be retired")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	ctx := context.Background()
+	if err := DBPool.OpenSession(ctx, "dev6", 100); err != nil {
+		t.Fatalf("OpenSession failed: %v", err)
+	}
+	// The exit of the first session was missed, so it is dropped
+	if err := DBPool.OpenSession(ctx, "dev6", 200); err != nil {
+		t.Fatalf("OpenSession failed: %v", err)
+	}
+	latest := func() DeviceSession {
+		sessions, err := DBPool.LoadLatestSessions(ctx)
+		if err != nil {
+			t.Fatalf("LoadLatestSessions failed: %v", err)
+		}
+		for _, session := range sessions {
+			if session.DeviceID == "dev6" {
+				return session
+			}
+		}
+		t.Fatalf("expected a session for dev6")
+		return DeviceSession{}
+	}
+	if session := latest(); session.Start != 200 || session.End != nil {
+		t.Fatalf("unexpected open session: %+v", session)
+	}
+
+	end, duration := int64(350), int64(150)
+	if err := DBPool.CloseSession(ctx, DeviceSession{DeviceID: "dev6", Start: 200, End: &end, DurationMillis: &duration}); err != nil {
+		t.Fatalf("CloseSession failed: %v", err)
+	}
+	if session := latest(); session.Start != 200 || session.End == nil || *session.End != 350 {
+		t.Fatalf("unexpected closed session: %+v", session)
+	}
+	if err := DBPool.OpenSession(ctx, "dev6", 400); err != nil {
+		t.Fatalf("OpenSession failed: %v", err)
+	}
+	if err := DBPool.DropOpenSessions(ctx, "dev6"); err != nil {
+		t.Fatalf("DropOpenSessions failed: %v", err)
+	}
+	got, err := DBPool.LoadSessionsBetween(ctx, "dev6", 0, 1000)
+	if err != nil {
+		t.Fatalf("LoadSessionsBetween failed: %v", err)
+	}
+	if len(got) != 1 || got[0].Start != 200 || got[0].End == nil || *got[0].DurationMillis != 150 {
+		t.Fatalf("expected only the completed session, got %+v", got)
+	}
+}
+
+func TestLoadStats(t *testing.T) {
+	ctx := context.Background()
+	hour, day := int64(3_600_000), int64(86_400_000)
+	start := 10 * day
+	check := func(when string, hourly, daily []DeviceStats) {
+		got, err := DBPool.LoadStats(ctx, "dev10", StatsHourly, start, start+day)
+		if err != nil {
+			t.Fatalf("LoadStats failed: %v", err)
+		}
+		if !slices.Equal(got, hourly) {
+			t.Fatalf("unexpected hourly stats %s: %+v", when, got)
+		}
+		got, err = DBPool.LoadStats(ctx, "dev10", StatsDaily, start, start+day)
+		if err != nil {
+			t.Fatalf("LoadStats failed: %v", err)
+		}
+		if !slices.Equal(got, daily) {
+			t.Fatalf("unexpected daily stats %s: %+v", when, got)
+		}
+	}
+
+	// Events older than the refresh windows are materialized by the next refresh
+	_, err := DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev10", EventType: "device_enter", Timestamp: start},
+		{DeviceID: "dev10", EventType: "device_exit", Timestamp: start + 10},
+		{DeviceID: "dev10", EventType: "device_exit", Timestamp: start + day},
+	}, ConflictReject)
+	if err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	if err := DBPool.RefreshStats(ctx); err != nil {
+		t.Fatalf("RefreshStats failed: %v", err)
+	}
+	check("after the first write", []DeviceStats{
+		{DeviceID: "dev10", Bucket: start, Enters: 1, Exits: 1},
+		{DeviceID: "dev10", Bucket: start + day, Enters: 0, Exits: 1},
+	}, []DeviceStats{
+		{DeviceID: "dev10", Bucket: start, Enters: 1, Exits: 1},
+		{DeviceID: "dev10", Bucket: start + day, Enters: 0, Exits: 1},
+	})
+
+	// Backfilled into buckets already materialized, below the watermark
+	_, err = DBPool.CreateTimeline(ctx, []DeviceEvent{
+		{DeviceID: "dev10", EventType: "device_enter", Timestamp: start + 20},
+		{DeviceID: "dev10", EventType: "device_enter", Timestamp: start + 2*hour},
+	}, ConflictReject)
+	if err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+	if err := DBPool.RefreshStats(ctx); err != nil {
+		t.Fatalf("RefreshStats failed: %v", err)
+	}
+	check("after the backfill", []DeviceStats{
+		{DeviceID: "dev10", Bucket: start, Enters: 2, Exits: 1},
+		{DeviceID: "dev10", Bucket: start + 2*hour, Enters: 1, Exits: 0},
+		{DeviceID: "dev10", Bucket: start + day, Enters: 0, Exits: 1},
+	}, []DeviceStats{
+		{DeviceID: "dev10", Bucket: start, Enters: 3, Exits: 1},
+		{DeviceID: "dev10", Bucket: start + day, Enters: 0, Exits: 1},
+	})
+
+	if _, err := DBPool.LoadStats(ctx, "dev10", "1w", start, start+day); !errors.Is(err, ErrInvalidBucket) {
+		t.Fatalf("expected ErrInvalidBucket, got %v", err)
+	}
+}
+
+func Test_bucketRanges(t *testing.T) {
+	hour := int64(3_600_000)
+	cases := []struct {
+		name     string
+		buckets  []int64
+		expected []bucketRange
+	}{
+		{name: "no buckets", buckets: nil, expected: nil},
+		{name: "adjacent buckets merged", buckets: []int64{0, hour, 2 * hour}, expected: []bucketRange{{0, 3 * hour}}},
+		// A year-old bucket and a recent one are refreshed on their own, not with the year between
+		{name: "distant buckets apart", buckets: []int64{0, 8760 * hour}, expected: []bucketRange{{0, hour}, {8760 * hour, 8761 * hour}}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bucketRanges(tt.buckets, hour); !slices.Equal(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func BenchmarkCreateTimeline(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range []int{10_000, 100_000} {
+		b.Run(fmt.Sprintf("events=%d", size), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				// A device per run, so no event conflicts with a previous run
+				deviceID := fmt.Sprintf("bench-%d-%d", size, n)
+				events := make([]DeviceEvent, size)
+				for i := range events {
+					eventType := "device_enter"
+					if i%2 == 1 {
+						eventType = "device_exit"
+					}
+					events[i] = DeviceEvent{DeviceID: deviceID, EventType: eventType, Timestamp: int64(i)}
+				}
+				b.StartTimer()
+				if _, err := DBPool.CreateTimeline(ctx, events, ConflictReject); err != nil {
+					b.Fatalf("CreateTimeline failed: %v", err)
+				}
+			}
+		})
+	}
+}
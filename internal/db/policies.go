@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	ErrInvalidPolicy = errors.New("invalid storage policy")
+	ErrPolicyFailed  = errors.New("storage policy update failed")
+)
+
+// minRetention keeps events for a day longer than the refresh window of the daily stats, so a
+// refresh never recomputes a bucket whose events were dropped, which would erase its stats
+const minRetention = 31 * 24 * time.Hour
+
+// StoragePolicies are the TimescaleDB policies of device_events_cleaned. A zero duration disables
+// the policy
+type StoragePolicies struct {
+	// CompressAfter compresses the chunks whose events are all older than it, segmented by device
+	// and ordered by timestamp
+	CompressAfter time.Duration `json:"compress_after"`
+	// RetainFor drops the chunks whose events are all older than it
+	RetainFor time.Duration `json:"retain_for"`
+}
+
+// ChunkStats is the size of one chunk of device_events_cleaned, covering the events from
+// RangeStart, included, to RangeEnd, excluded, in Unix epoch milliseconds
+type ChunkStats struct {
+	Name       string `json:"name" db:"chunk_name"`
+	RangeStart int64  `json:"range_start" db:"range_start"`
+	RangeEnd   int64  `json:"range_end" db:"range_end"`
+	Compressed bool   `json:"compressed" db:"is_compressed"`
+	// TotalBytes is the current size of the chunk, with its indexes and TOAST
+	TotalBytes int64 `json:"total_bytes" db:"total_bytes"`
+	// BeforeCompressionBytes and AfterCompressionBytes are nil until the chunk is compressed
+	BeforeCompressionBytes *int64 `json:"before_compression_bytes" db:"before_compression_bytes"`
+	AfterCompressionBytes  *int64 `json:"after_compression_bytes" db:"after_compression_bytes"`
+}
+
+// storagePoliciesQuery returns the compress after and drop after of the policies of
+// device_events_cleaned, in milliseconds, 0 if the policy is not set
+const storagePoliciesQuery = `
+	SELECT
+		COALESCE((
+			SELECT (config->>'compress_after')::BIGINT
+			FROM timescaledb_information.jobs
+			WHERE hypertable_name = 'device_events_cleaned'
+			AND proc_name = 'policy_compression'
+		), 0),
+		COALESCE((
+			SELECT (config->>'drop_after')::BIGINT
+			FROM timescaledb_information.jobs
+			WHERE hypertable_name = 'device_events_cleaned'
+			AND proc_name = 'policy_retention'
+		), 0)
+`
+
+// LoadStoragePolicies returns the policies currently set on device_events_cleaned
+func (db *DB) LoadStoragePolicies(ctx context.Context) (StoragePolicies, error) {
+	const fn = "DB:LoadStoragePolicies"
+	policies, err := scanStoragePolicies(db.pool.QueryRow(ctx, storagePoliciesQuery))
+	if err != nil {
+		return StoragePolicies{}, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return policies, nil
+}
+
+func scanStoragePolicies(row pgx.Row) (StoragePolicies, error) {
+	var compressAfter, dropAfter int64
+	if err := row.Scan(&compressAfter, &dropAfter); err != nil {
+		return StoragePolicies{}, err
+	}
+	return StoragePolicies{
+		CompressAfter: time.Duration(compressAfter) * time.Millisecond,
+		RetainFor:     time.Duration(dropAfter) * time.Millisecond,
+	}, nil
+}
+
+// ApplyStoragePolicies reconciles the policies of device_events_cleaned with policies, replacing
+// only the policies that changed, so their schedule is kept across restarts. It holds the
+// migration lock, so it does not race with a migration or another replica starting up
+func (db *DB) ApplyStoragePolicies(ctx context.Context, policies StoragePolicies) error {
+	const fn = "DB:ApplyStoragePolicies"
+	if policies.CompressAfter < 0 {
+		return fmt.Errorf("%s:%w:negative compress after %s", fn, ErrInvalidPolicy, policies.CompressAfter)
+	}
+	if policies.RetainFor < 0 || (policies.RetainFor > 0 && policies.RetainFor < minRetention) {
+		return fmt.Errorf("%s:%w:retention %s, must be 0 or at least %s", fn, ErrInvalidPolicy, policies.RetainFor, minRetention)
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrTransactionStartFailed, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrMigrationLock, err)
+	}
+	current, err := scanStoragePolicies(tx.QueryRow(ctx, storagePoliciesQuery))
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+
+	if current.CompressAfter != policies.CompressAfter {
+		if _, err := tx.Exec(ctx, "SELECT remove_compression_policy('device_events_cleaned', if_exists => TRUE)"); err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrPolicyFailed, err)
+		}
+		if policies.CompressAfter > 0 {
+			_, err := tx.Exec(ctx, "SELECT add_compression_policy('device_events_cleaned', compress_after => $1::BIGINT)",
+				policies.CompressAfter.Milliseconds())
+			if err != nil {
+				return fmt.Errorf("%s:%w:%w", fn, ErrPolicyFailed, err)
+			}
+		}
+		slog.InfoContext(ctx, "Compression policy updated",
+			"from", current.CompressAfter.String(),
+			"to", policies.CompressAfter.String(),
+		)
+	}
+	if current.RetainFor != policies.RetainFor {
+		if _, err := tx.Exec(ctx, "SELECT remove_retention_policy('device_events_cleaned', if_exists => TRUE)"); err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrPolicyFailed, err)
+		}
+		if policies.RetainFor > 0 {
+			_, err := tx.Exec(ctx, "SELECT add_retention_policy('device_events_cleaned', drop_after => $1::BIGINT)",
+				policies.RetainFor.Milliseconds())
+			if err != nil {
+				return fmt.Errorf("%s:%w:%w", fn, ErrPolicyFailed, err)
+			}
+		}
+		slog.InfoContext(ctx, "Retention policy updated",
+			"from", current.RetainFor.String(),
+			"to", policies.RetainFor.String(),
+		)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrTransactionCommitFailed, err)
+	}
+	return nil
+}
+
+// LoadChunkStats returns the size of every chunk of device_events_cleaned, oldest first, and its
+// size before and after compression once compressed
+func (db *DB) LoadChunkStats(ctx context.Context) ([]ChunkStats, error) {
+	const fn = "DB:LoadChunkStats"
+	chunks := []ChunkStats{}
+	err := pgxscan.Select(ctx, db.pool, &chunks, `
+			SELECT
+				c.chunk_name,
+				c.range_start_integer AS range_start,
+				c.range_end_integer AS range_end,
+				c.is_compressed,
+				s.total_bytes,
+				cs.before_compression_total_bytes AS before_compression_bytes,
+				cs.after_compression_total_bytes AS after_compression_bytes
+			FROM timescaledb_information.chunks c
+			JOIN chunks_detailed_size('device_events_cleaned') s
+				ON s.chunk_schema = c.chunk_schema AND s.chunk_name = c.chunk_name
+			LEFT JOIN chunk_compression_stats('device_events_cleaned') cs
+				ON cs.chunk_schema = c.chunk_schema AND cs.chunk_name = c.chunk_name
+			WHERE c.hypertable_name = 'device_events_cleaned'
+			ORDER BY c.range_start_integer ASC
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrSelectFailed, err)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStoragePolicies(t *testing.T) {
+	ctx := context.Background()
+	// Its own database, so compressing chunks does not change the events of the other tests
+	policiesDB, err := Init(ctx, Config{ConnString: newTestDatabase(t, "storage_policies")})
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer policiesDB.Close()
+
+	day := 24 * time.Hour
+	for _, want := range []StoragePolicies{
+		{CompressAfter: 7 * day, RetainFor: 365 * day},
+		{CompressAfter: 7 * day, RetainFor: 365 * day},
+		{CompressAfter: 2 * day},
+		{},
+	} {
+		if err := policiesDB.ApplyStoragePolicies(ctx, want); err != nil {
+			t.Fatalf("ApplyStoragePolicies %+v failed: %v", want, err)
+		}
+		got, err := policiesDB.LoadStoragePolicies(ctx)
+		if err != nil {
+			t.Fatalf("LoadStoragePolicies failed: %v", err)
+		}
+		if got != want {
+			t.Fatalf("expected policies %+v, got %+v", want, got)
+		}
+	}
+
+	for _, invalid := range []StoragePolicies{
+		{CompressAfter: -day},
+		{RetainFor: 7 * day},
+	} {
+		if err := policiesDB.ApplyStoragePolicies(ctx, invalid); !errors.Is(err, ErrInvalidPolicy) {
+			t.Fatalf("expected ErrInvalidPolicy for %+v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestLoadChunkStats(t *testing.T) {
+	ctx := context.Background()
+	statsDB, err := Init(ctx, Config{ConnString: newTestDatabase(t, "chunk_stats")})
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer statsDB.Close()
+
+	events := make([]DeviceEvent, 1000)
+	for i := range events {
+		events[i] = DeviceEvent{DeviceID: "dev11", EventType: "device_enter", Timestamp: int64(i)}
+	}
+	if _, err := statsDB.CreateTimeline(ctx, events, ConflictReject); err != nil {
+		t.Fatalf("CreateTimeline failed: %v", err)
+	}
+
+	chunks, err := statsDB.LoadChunkStats(ctx)
+	if err != nil {
+		t.Fatalf("LoadChunkStats failed: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0].Compressed || chunks[0].TotalBytes == 0 || chunks[0].AfterCompressionBytes != nil {
+		t.Fatalf("expected one uncompressed chunk, got %+v", chunks)
+	}
+
+	if _, err := statsDB.pool.Exec(ctx, "SELECT compress_chunk(c) FROM show_chunks('device_events_cleaned') c"); err != nil {
+		t.Fatalf("compress_chunk failed: %v", err)
+	}
+	chunks, err = statsDB.LoadChunkStats(ctx)
+	if err != nil {
+		t.Fatalf("LoadChunkStats failed: %v", err)
+	}
+	if len(chunks) != 1 || !chunks[0].Compressed || chunks[0].BeforeCompressionBytes == nil || chunks[0].AfterCompressionBytes == nil {
+		t.Fatalf("expected one compressed chunk, got %+v", chunks)
+	}
+
+	// Compressed events are still read and written
+	got, _, err := statsDB.LoadEventsPage(ctx, "dev11", 0, 999, Page{Limit: 1000})
+	if err != nil || len(got) != 1000 {
+		t.Fatalf("expected 1000 events, got %d: %v", len(got), err)
+	}
+	statuses, err := statsDB.CreateTimeline(ctx, events[:1], ConflictIgnore)
+	if err != nil || statuses[0] != EventDuplicate {
+		t.Fatalf("expected a duplicate, got %v: %v", statuses, err)
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// statsRefreshInterval is how often the stats buckets of backfilled events are refreshed
+const statsRefreshInterval = time.Minute
+
+// statsRefreshWindows are the bucket width and the refresh window, the start_offset of the refresh
+// policy, of each stats view, in milliseconds
+var statsRefreshWindows = []struct {
+	view   string
+	bucket int64
+	window int64
+}{
+	{view: "device_stats_hourly", bucket: 3_600_000, window: 3 * 86_400_000},
+	{view: "device_stats_daily", bucket: 86_400_000, window: 30 * 86_400_000},
+}
+
+// staleStats holds the buckets of every stats view that events were written to below its refresh
+// window. The refresh policy of the view never materializes them again, and real-time aggregation
+// does not read them as they are below the materialized watermark, so they wait here for
+// RefreshStats. The zero value is ready to use
+type staleStats struct {
+	mu      sync.Mutex
+	buckets map[string]map[int64]bool
+}
+
+// queue adds the buckets of the written events that are older than the refresh window of each view
+func (s *staleStats) queue(written []eventKey, now int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range statsRefreshWindows {
+		for _, key := range written {
+			if key.timestamp >= now-r.window {
+				continue
+			}
+			s.add(r.view, key.timestamp-key.timestamp%r.bucket)
+		}
+	}
+}
+
+// add must be called with mu held
+func (s *staleStats) add(view string, bucket int64) {
+	if s.buckets == nil {
+		s.buckets = make(map[string]map[int64]bool)
+	}
+	if s.buckets[view] == nil {
+		s.buckets[view] = make(map[int64]bool)
+	}
+	s.buckets[view][bucket] = true
+}
+
+// take removes and returns the buckets of a view, sorted
+func (s *staleStats) take(view string) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets := make([]int64, 0, len(s.buckets[view]))
+	for bucket := range s.buckets[view] {
+		buckets = append(buckets, bucket)
+	}
+	delete(s.buckets, view)
+	slices.Sort(buckets)
+	return buckets
+}
+
+// requeue puts back the buckets of a range that could not be refreshed
+func (s *staleStats) requeue(view string, r bucketRange, width int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for bucket := r.start; bucket < r.end; bucket += width {
+		s.add(view, bucket)
+	}
+}
+
+// bucketRange is the time range [start, end) of consecutive buckets, in milliseconds
+type bucketRange struct {
+	start int64
+	end   int64
+}
+
+// bucketRanges merges sorted buckets of the given width into ranges, adjacent buckets sharing one
+// range, so only the buckets written to are refreshed, but in as few calls as possible
+func bucketRanges(buckets []int64, width int64) []bucketRange {
+	var ranges []bucketRange
+	for _, bucket := range buckets {
+		if n := len(ranges); n > 0 && ranges[n-1].end == bucket {
+			ranges[n-1].end = bucket + width
+			continue
+		}
+		ranges = append(ranges, bucketRange{start: bucket, end: bucket + width})
+	}
+	return ranges
+}
+
+// RunStatsRefresh refreshes the stale stats buckets every statsRefreshInterval, outside of the
+// writes that queued them.
+// Blocking operation
+func (db *DB) RunStatsRefresh(ctx context.Context) {
+	ticker := time.NewTicker(statsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.RefreshStats(ctx); err != nil {
+				slog.ErrorContext(ctx, "Error refreshing stats of backfilled events", "error", err)
+			}
+		}
+	}
+}
+
+// RefreshStats refreshes the stale buckets of every stats view. A range that fails to refresh is
+// queued again for the next run
+func (db *DB) RefreshStats(ctx context.Context) error {
+	const fn = "DB:RefreshStats"
+	var failed error
+	for _, r := range statsRefreshWindows {
+		for _, rg := range bucketRanges(db.staleStats.take(r.view), r.bucket) {
+			slog.InfoContext(ctx, "Refreshing stats of backfilled events", "view", r.view, "start", rg.start, "end", rg.end)
+			// Refreshing cannot run in a transaction, so it is sent on its own, as a simple query
+			_, err := db.pool.Exec(ctx, fmt.Sprintf("CALL refresh_continuous_aggregate('%s', %d::BIGINT, %d::BIGINT)", r.view, rg.start, rg.end))
+			if err != nil {
+				db.staleStats.requeue(r.view, rg, r.bucket)
+				failed = fmt.Errorf("%s:%w:%w", fn, ErrRefreshStats, err)
+			}
+		}
+	}
+	return failed
+}
@@ -4,4 +4,29 @@ type DeviceEvent struct {
 	DeviceID  string `json:"device_id"`
 	EventType string `json:"event_type"`
 	Timestamp int64  `json:"timestamp"`
+
+	// Lineage, nil if the event did not come through the pipeline
+	EventID         *string `json:"event_id"`
+	SourceTopic     *string `json:"source_topic"`
+	SourcePartition *int32  `json:"source_partition"`
+	SourceOffset    *int64  `json:"source_offset"`
+}
+
+// DeviceSession is the time a device spent present, from a device_enter to the following
+// device_exit. Timestamps are Unix epoch milliseconds
+type DeviceSession struct {
+	DeviceID string `json:"device_id" db:"device_id"`
+	Start    int64  `json:"start" db:"session_start"`
+	// End and DurationMillis are nil while the session is open
+	End            *int64 `json:"end" db:"session_end"`
+	DurationMillis *int64 `json:"duration_ms" db:"duration_ms"`
+}
+
+// DeviceStats is the number of enters and exits of a device in the bucket starting at Bucket, in
+// Unix epoch milliseconds
+type DeviceStats struct {
+	DeviceID string `json:"device_id" db:"device_id"`
+	Bucket   int64  `json:"bucket" db:"bucket"`
+	Enters   int64  `json:"enters" db:"enters"`
+	Exits    int64  `json:"exits" db:"exits"`
 }
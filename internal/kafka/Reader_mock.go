@@ -82,6 +82,132 @@ func (_c *MockReader_Close_Call) RunAndReturn(run func() error) *MockReader_Clos
 	return _c
 }
 
+// CommitMessages provides a mock function for the type MockReader
+func (_mock *MockReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	var tmpRet mock.Arguments
+	if len(msgs) > 0 {
+		tmpRet = _mock.Called(ctx, msgs)
+	} else {
+		tmpRet = _mock.Called(ctx)
+	}
+	ret := tmpRet
+
+	if len(ret) == 0 {
+		panic("no return value specified for CommitMessages")
+	}
+
+	var r0 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context, ...kafka.Message) error); ok {
+		r0 = returnFunc(ctx, msgs...)
+	} else {
+		r0 = ret.Error(0)
+	}
+	return r0
+}
+
+// MockReader_CommitMessages_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CommitMessages'
+type MockReader_CommitMessages_Call struct {
+	*mock.Call
+}
+
+// CommitMessages is a helper method to define mock.On call
+//   - ctx context.Context
+//   - msgs ...kafka.Message
+func (_e *MockReader_Expecter) CommitMessages(ctx interface{}, msgs ...interface{}) *MockReader_CommitMessages_Call {
+	return &MockReader_CommitMessages_Call{Call: _e.mock.On("CommitMessages",
+		append([]interface{}{ctx}, msgs...)...)}
+}
+
+func (_c *MockReader_CommitMessages_Call) Run(run func(ctx context.Context, msgs ...kafka.Message)) *MockReader_CommitMessages_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		var arg1 []kafka.Message
+		var variadicArgs []kafka.Message
+		if len(args) > 1 {
+			variadicArgs = args[1].([]kafka.Message)
+		}
+		arg1 = variadicArgs
+		run(
+			arg0,
+			arg1...,
+		)
+	})
+	return _c
+}
+
+func (_c *MockReader_CommitMessages_Call) Return(err error) *MockReader_CommitMessages_Call {
+	_c.Call.Return(err)
+	return _c
+}
+
+func (_c *MockReader_CommitMessages_Call) RunAndReturn(run func(ctx context.Context, msgs ...kafka.Message) error) *MockReader_CommitMessages_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// FetchMessage provides a mock function for the type MockReader
+func (_mock *MockReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	ret := _mock.Called(ctx)
+
+	if len(ret) == 0 {
+		panic("no return value specified for FetchMessage")
+	}
+
+	var r0 kafka.Message
+	var r1 error
+	if returnFunc, ok := ret.Get(0).(func(context.Context) (kafka.Message, error)); ok {
+		return returnFunc(ctx)
+	}
+	if returnFunc, ok := ret.Get(0).(func(context.Context) kafka.Message); ok {
+		r0 = returnFunc(ctx)
+	} else {
+		r0 = ret.Get(0).(kafka.Message)
+	}
+	if returnFunc, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = returnFunc(ctx)
+	} else {
+		r1 = ret.Error(1)
+	}
+	return r0, r1
+}
+
+// MockReader_FetchMessage_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'FetchMessage'
+type MockReader_FetchMessage_Call struct {
+	*mock.Call
+}
+
+// FetchMessage is a helper method to define mock.On call
+//   - ctx context.Context
+func (_e *MockReader_Expecter) FetchMessage(ctx interface{}) *MockReader_FetchMessage_Call {
+	return &MockReader_FetchMessage_Call{Call: _e.mock.On("FetchMessage", ctx)}
+}
+
+func (_c *MockReader_FetchMessage_Call) Run(run func(ctx context.Context)) *MockReader_FetchMessage_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 context.Context
+		if args[0] != nil {
+			arg0 = args[0].(context.Context)
+		}
+		run(
+			arg0,
+		)
+	})
+	return _c
+}
+
+func (_c *MockReader_FetchMessage_Call) Return(message kafka.Message, err error) *MockReader_FetchMessage_Call {
+	_c.Call.Return(message, err)
+	return _c
+}
+
+func (_c *MockReader_FetchMessage_Call) RunAndReturn(run func(ctx context.Context) (kafka.Message, error)) *MockReader_FetchMessage_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Lag provides a mock function for the type MockReader
 func (_mock *MockReader) Lag() int64 {
 	ret := _mock.Called()
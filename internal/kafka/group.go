@@ -0,0 +1,343 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrGroupReaderClosed = errors.New("group reader closed")
+	ErrRebalance         = errors.New("error handling rebalance")
+)
+
+// KeyBalancer assigns messages to partitions by a murmur2 hash of their key, the same as the Java
+// and kafka-python producers. Every topic keyed by device ID must be written with it, so that a
+// device is on the same partition of every topic with the same partition count
+var KeyBalancer kafka.Balancer = &kafka.Murmur2Balancer{}
+
+// PartitionFor returns the partition KeyBalancer assigns key to, in a topic of count partitions
+func PartitionFor(key string, count int) int {
+	partitions := make([]int, count)
+	for i := range partitions {
+		partitions[i] = i
+	}
+	return KeyBalancer.Balance(kafka.Message{Key: []byte(key)}, partitions...)
+}
+
+// RebalanceListener is notified when the partitions assigned to a GroupReader change. Both are
+// called from FetchMessage, so never concurrently with processing of a fetched message, and
+// before any message of the new assignment is returned
+type RebalanceListener interface {
+	PartitionsAssigned(ctx context.Context, partitions []int) error
+	PartitionsRevoked(ctx context.Context, partitions []int)
+}
+
+type GroupReaderConfig struct {
+	Brokers  string
+	GroupID  string
+	Topic    string
+	Listener RebalanceListener
+	// CommitInterval is how often offsets of read messages are committed
+	CommitInterval time.Duration
+}
+
+// rebalance is a change of the partitions assigned to this member of the group
+type rebalance struct {
+	revoked  []int
+	assigned []int
+}
+
+// groupEvent is either a rebalance or a message, of a generation of the group
+type groupEvent struct {
+	generation int32
+	rebalance  *rebalance
+	message    kafka.Message
+}
+
+// GroupReader is a consumer group reader that notifies a RebalanceListener of assignment changes,
+// which kafka.Reader does not expose. Each assigned partition is read by its own partition reader
+// for as long as the generation lasts. Implements Reader
+type GroupReader struct {
+	topic          string
+	brokers        string
+	listener       RebalanceListener
+	commitInterval time.Duration
+	group          *kafka.ConsumerGroup
+	err            error
+
+	events chan groupEvent
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// pending is a rebalance whose listener failed, retried on the next fetch so that no message
+	// of the new assignment is returned before the listener has succeeded
+	pending *groupEvent
+
+	mu         sync.Mutex
+	generation int32
+	// offsets are the next offsets to commit per partition, in the current generation
+	offsets map[int]int64
+	dirty   bool
+}
+
+func NewGroupReader(cfg GroupReaderConfig) *GroupReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &GroupReader{
+		topic:          cfg.Topic,
+		brokers:        cfg.Brokers,
+		listener:       cfg.Listener,
+		commitInterval: cfg.CommitInterval,
+		events:         make(chan groupEvent),
+		cancel:         cancel,
+		done:           make(chan struct{}),
+		offsets:        make(map[int]int64),
+	}
+	if r.commitInterval <= 0 {
+		r.commitInterval = time.Second
+	}
+	r.group, r.err = kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:          cfg.GroupID,
+		Brokers:     []string{cfg.Brokers},
+		Topics:      []string{cfg.Topic},
+		StartOffset: kafka.FirstOffset,
+	})
+	if r.err != nil {
+		close(r.done)
+		return r
+	}
+	go r.run(ctx)
+	return r
+}
+
+// run joins every generation of the group in turn, and reads its assigned partitions
+func (r *GroupReader) run(ctx context.Context) {
+	defer close(r.done)
+	owned := make(map[int]bool)
+	for {
+		gen, err := r.group.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, kafka.ErrGroupClosed) {
+				return
+			}
+			slog.ErrorContext(ctx, "Error joining consumer group generation", "topic", r.topic, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		assignments := gen.Assignments[r.topic]
+		assigned := make(map[int]bool, len(assignments))
+		for _, a := range assignments {
+			assigned[a.ID] = true
+		}
+		event := groupEvent{
+			generation: gen.ID,
+			rebalance: &rebalance{
+				revoked:  difference(owned, assigned),
+				assigned: difference(assigned, owned),
+			},
+		}
+		owned = assigned
+		slog.InfoContext(ctx, "Consumer group generation joined",
+			"topic", r.topic,
+			"generation", gen.ID,
+			"partitions", difference(assigned, nil),
+		)
+		select {
+		case r.events <- event:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, a := range assignments {
+			gen.Start(func(genCtx context.Context) {
+				r.consume(genCtx, gen.ID, a)
+			})
+		}
+		gen.Start(func(genCtx context.Context) {
+			r.commitLoop(genCtx, gen)
+		})
+	}
+}
+
+// consume reads one assigned partition until the generation ends
+func (r *GroupReader) consume(ctx context.Context, generation int32, a kafka.PartitionAssignment) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{r.brokers},
+		Topic:     r.topic,
+		Partition: a.ID,
+	})
+	defer reader.Close()
+	reader.SetOffset(a.Offset)
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "Error reading partition", "topic", r.topic, "partition", a.ID, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case r.events <- groupEvent{generation: generation, message: m}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// commitLoop commits offsets every commit interval, and once more when the generation ends
+func (r *GroupReader) commitLoop(ctx context.Context, gen *kafka.Generation) {
+	ticker := time.NewTicker(r.commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.commit(ctx, gen)
+			return
+		case <-ticker.C:
+			r.commit(ctx, gen)
+		}
+	}
+}
+
+func (r *GroupReader) commit(ctx context.Context, gen *kafka.Generation) {
+	r.mu.Lock()
+	if r.generation != gen.ID || !r.dirty {
+		r.mu.Unlock()
+		return
+	}
+	offsets := make(map[int]int64, len(r.offsets))
+	for partition, offset := range r.offsets {
+		offsets[partition] = offset
+	}
+	r.dirty = false
+	r.mu.Unlock()
+
+	if err := gen.CommitOffsets(map[string]map[int]int64{r.topic: offsets}); err != nil {
+		slog.ErrorContext(ctx, "Error committing offsets", "topic", r.topic, "generation", gen.ID, "error", err)
+	}
+}
+
+// FetchMessage returns the next message of the current generation. Rebalances are handed to the
+// listener as they arrive, and messages of earlier generations are dropped, as their partitions
+// are read again from the last committed offset
+func (r *GroupReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	const fn = "GroupReader:FetchMessage"
+	if r.err != nil {
+		return kafka.Message{}, fmt.Errorf("%s:%w", fn, r.err)
+	}
+	for {
+		var event groupEvent
+		if r.pending != nil {
+			event = *r.pending
+			r.pending = nil
+		} else {
+			select {
+			case <-ctx.Done():
+				return kafka.Message{}, fmt.Errorf("%s:%w", fn, ctx.Err())
+			case e, ok := <-r.events:
+				if !ok {
+					return kafka.Message{}, fmt.Errorf("%s:%w", fn, ErrGroupReaderClosed)
+				}
+				event = e
+			}
+		}
+
+		if event.rebalance != nil {
+			if err := r.rebalance(ctx, &event); err != nil {
+				r.pending = &event
+				return kafka.Message{}, fmt.Errorf("%s:%w", fn, err)
+			}
+			continue
+		}
+		r.mu.Lock()
+		current := r.generation
+		r.mu.Unlock()
+		if event.generation != current {
+			continue
+		}
+		return event.message, nil
+	}
+}
+
+func (r *GroupReader) rebalance(ctx context.Context, event *groupEvent) error {
+	if len(event.rebalance.revoked) > 0 {
+		slog.InfoContext(ctx, "Partitions revoked", "topic", r.topic, "partitions", event.rebalance.revoked)
+		r.listener.PartitionsRevoked(ctx, event.rebalance.revoked)
+		// Not repeated if the assignment is retried
+		event.rebalance.revoked = nil
+	}
+
+	r.mu.Lock()
+	if r.generation != event.generation {
+		r.generation = event.generation
+		r.offsets = make(map[int]int64)
+		r.dirty = false
+	}
+	r.mu.Unlock()
+
+	if len(event.rebalance.assigned) > 0 {
+		slog.InfoContext(ctx, "Partitions assigned", "topic", r.topic, "partitions", event.rebalance.assigned)
+		if err := r.listener.PartitionsAssigned(ctx, event.rebalance.assigned); err != nil {
+			return fmt.Errorf("%w:%w", ErrRebalance, err)
+		}
+	}
+	return nil
+}
+
+// ReadMessage fetches the next message and marks it to be committed
+func (r *GroupReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	m, err := r.FetchMessage(ctx)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return m, r.CommitMessages(ctx, m)
+}
+
+// CommitMessages marks messages to be committed with the next commit of the generation
+func (r *GroupReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range msgs {
+		if m.Offset+1 > r.offsets[m.Partition] {
+			r.offsets[m.Partition] = m.Offset + 1
+			r.dirty = true
+		}
+	}
+	return nil
+}
+
+// Lag is not tracked across partitions, and is always -1, as for a kafka.Reader in a group
+func (r *GroupReader) Lag() int64 {
+	return -1
+}
+
+func (r *GroupReader) Close() error {
+	r.cancel()
+	var err error
+	if r.group != nil {
+		err = r.group.Close()
+	}
+	<-r.done
+	return err
+}
+
+// difference returns the partitions in a that are not in b, sorted
+func difference(a, b map[int]bool) []int {
+	var partitions []int
+	for partition := range a {
+		if !b[partition] {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Ints(partitions)
+	return partitions
+}
@@ -0,0 +1,168 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGroupReader(listener RebalanceListener, events ...groupEvent) *GroupReader {
+	r := &GroupReader{
+		topic:    "topic",
+		listener: listener,
+		events:   make(chan groupEvent, len(events)),
+		offsets:  make(map[int]int64),
+	}
+	for _, e := range events {
+		r.events <- e
+	}
+	close(r.events)
+	return r
+}
+
+func Test_GroupReader_FetchMessage(t *testing.T) {
+	message := func(generation int32, partition int, offset int64) groupEvent {
+		return groupEvent{generation: generation, message: kafka.Message{Partition: partition, Offset: offset}}
+	}
+	assign := func(generation int32, revoked, assigned []int) groupEvent {
+		return groupEvent{generation: generation, rebalance: &rebalance{revoked: revoked, assigned: assigned}}
+	}
+
+	cases := []struct {
+		name             string
+		setupListener    func() RebalanceListener
+		inputEvents      []groupEvent
+		expectedMessages []kafka.Message
+	}{
+		{
+			name: "happy path - assignment before messages",
+			setupListener: func() RebalanceListener {
+				listener := NewMockRebalanceListener(t)
+				listener.EXPECT().PartitionsAssigned(mock.Anything, []int{0, 1}).Return(nil).Once()
+				return listener
+			},
+			inputEvents: []groupEvent{
+				assign(1, nil, []int{0, 1}),
+				message(1, 0, 5),
+				message(1, 1, 7),
+			},
+			expectedMessages: []kafka.Message{
+				{Partition: 0, Offset: 5},
+				{Partition: 1, Offset: 7},
+			},
+		},
+		{
+			name: "happy path - rebalance revokes and assigns, stale messages dropped",
+			setupListener: func() RebalanceListener {
+				listener := NewMockRebalanceListener(t)
+				listener.EXPECT().PartitionsAssigned(mock.Anything, []int{0, 1}).Return(nil).Once()
+				listener.EXPECT().PartitionsRevoked(mock.Anything, []int{1}).Once()
+				listener.EXPECT().PartitionsAssigned(mock.Anything, []int{2}).Return(nil).Once()
+				return listener
+			},
+			inputEvents: []groupEvent{
+				assign(1, nil, []int{0, 1}),
+				message(1, 0, 5),
+				assign(2, []int{1}, []int{2}),
+				// Buffered before the rebalance was handled
+				message(1, 1, 8),
+				message(2, 2, 3),
+			},
+			expectedMessages: []kafka.Message{
+				{Partition: 0, Offset: 5},
+				{Partition: 2, Offset: 3},
+			},
+		},
+		{
+			name: "happy path - rebalance keeps every partition",
+			setupListener: func() RebalanceListener {
+				listener := NewMockRebalanceListener(t)
+				listener.EXPECT().PartitionsAssigned(mock.Anything, []int{0}).Return(nil).Once()
+				return listener
+			},
+			inputEvents: []groupEvent{
+				assign(1, nil, []int{0}),
+				assign(2, nil, nil),
+				message(2, 0, 1),
+			},
+			expectedMessages: []kafka.Message{
+				{Partition: 0, Offset: 1},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestGroupReader(tt.setupListener(), tt.inputEvents...)
+			for _, expected := range tt.expectedMessages {
+				m, err := r.FetchMessage(context.Background())
+				require.NoError(t, err)
+				assert.Equal(t, expected, m)
+			}
+			_, err := r.FetchMessage(context.Background())
+			assert.ErrorIs(t, err, ErrGroupReaderClosed)
+		})
+	}
+}
+
+func Test_GroupReader_FetchMessage_AssignmentRetried(t *testing.T) {
+	listener := NewMockRebalanceListener(t)
+	listener.EXPECT().PartitionsRevoked(mock.Anything, []int{0}).Once()
+	listener.EXPECT().PartitionsAssigned(mock.Anything, []int{1}).Return(errors.New("failed")).Once()
+	listener.EXPECT().PartitionsAssigned(mock.Anything, []int{1}).Return(nil).Once()
+
+	r := newTestGroupReader(listener,
+		groupEvent{generation: 2, rebalance: &rebalance{revoked: []int{0}, assigned: []int{1}}},
+		groupEvent{generation: 2, message: kafka.Message{Partition: 1, Offset: 4}},
+	)
+
+	// No message of the new assignment is returned until the listener succeeds
+	_, err := r.FetchMessage(context.Background())
+	assert.ErrorIs(t, err, ErrRebalance)
+
+	m, err := r.FetchMessage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, kafka.Message{Partition: 1, Offset: 4}, m)
+}
+
+func Test_GroupReader_ReadMessage(t *testing.T) {
+	listener := NewMockRebalanceListener(t)
+	listener.EXPECT().PartitionsAssigned(mock.Anything, []int{0, 1}).Return(nil).Once()
+	listener.EXPECT().PartitionsRevoked(mock.Anything, []int{1}).Once()
+
+	r := newTestGroupReader(listener,
+		groupEvent{generation: 1, rebalance: &rebalance{assigned: []int{0, 1}}},
+		groupEvent{generation: 1, message: kafka.Message{Partition: 0, Offset: 5}},
+		groupEvent{generation: 1, message: kafka.Message{Partition: 1, Offset: 9}},
+		groupEvent{generation: 2, rebalance: &rebalance{revoked: []int{1}}},
+	)
+
+	for range 2 {
+		_, err := r.ReadMessage(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, map[int]int64{0: 6, 1: 10}, r.offsets)
+	assert.True(t, r.dirty)
+
+	// Offsets of an earlier generation are not committed in the next one
+	_, err := r.ReadMessage(context.Background())
+	assert.ErrorIs(t, err, ErrGroupReaderClosed)
+	assert.Equal(t, map[int]int64{}, r.offsets)
+	assert.False(t, r.dirty)
+}
+
+func Test_PartitionFor(t *testing.T) {
+	for _, key := range []string{"device-1", "device-2", "a", ""} {
+		partition := PartitionFor(key, 6)
+		assert.GreaterOrEqual(t, partition, 0)
+		assert.Less(t, partition, 6)
+		// The same key always maps to the same partition
+		assert.Equal(t, partition, PartitionFor(key, 6))
+	}
+	assert.Equal(t, 0, PartitionFor("device-1", 1))
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	HeaderEventID         = "event_id"
+	HeaderProducer        = "producer"
+	HeaderServiceVersion  = "service_version"
+	HeaderIngestTime      = "ingest_time"
+	HeaderSourceTopic     = "source_topic"
+	HeaderSourcePartition = "source_partition"
+	HeaderSourceOffset    = "source_offset"
+)
+
+// ServiceVersion is stamped on every produced message. Set at build time with
+// -ldflags "-X sr-backend-home-assessment/internal/kafka.ServiceVersion=<version>"
+var ServiceVersion = "dev"
+
+// Metadata is the standard set of headers on every message produced by the pipeline. The event
+// ID, ingest time and source are set once, when an event enters the pipeline, and are kept as
+// the event moves downstream. The producer and service version are those of the last hop
+type Metadata struct {
+	EventID         string
+	Producer        string
+	ServiceVersion  string
+	IngestTime      time.Time
+	SourceTopic     string
+	SourcePartition int
+	SourceOffset    int64
+}
+
+// NewMetadata creates metadata for an event entering the pipeline from the source message
+func NewMetadata(producer string, source kafka.Message) Metadata {
+	return Metadata{
+		EventID:         uuid.NewString(),
+		Producer:        producer,
+		ServiceVersion:  ServiceVersion,
+		IngestTime:      time.Now().UTC(),
+		SourceTopic:     source.Topic,
+		SourcePartition: source.Partition,
+		SourceOffset:    source.Offset,
+	}
+}
+
+// Propagate returns the metadata headers for a message produced from the source message. If
+// the source message has no metadata, e.g. it was produced before headers were added, new
+// metadata is created from it
+func Propagate(producer string, source kafka.Message) []kafka.Header {
+	md, ok := ParseMetadata(source.Headers)
+	if !ok {
+		return NewMetadata(producer, source).Headers()
+	}
+	md.Producer = producer
+	md.ServiceVersion = ServiceVersion
+	return md.Headers()
+}
+
+func (m Metadata) Headers() []kafka.Header {
+	return []kafka.Header{
+		{Key: HeaderEventID, Value: []byte(m.EventID)},
+		{Key: HeaderProducer, Value: []byte(m.Producer)},
+		{Key: HeaderServiceVersion, Value: []byte(m.ServiceVersion)},
+		{Key: HeaderIngestTime, Value: []byte(m.IngestTime.Format(time.RFC3339Nano))},
+		{Key: HeaderSourceTopic, Value: []byte(m.SourceTopic)},
+		{Key: HeaderSourcePartition, Value: []byte(strconv.Itoa(m.SourcePartition))},
+		{Key: HeaderSourceOffset, Value: []byte(strconv.FormatInt(m.SourceOffset, 10))},
+	}
+}
+
+// ParseMetadata reads the metadata headers of a message. Returns false if the message has no
+// event ID header
+func ParseMetadata(headers []kafka.Header) (Metadata, bool) {
+	var md Metadata
+	for _, h := range headers {
+		value := string(h.Value)
+		switch h.Key {
+		case HeaderEventID:
+			md.EventID = value
+		case HeaderProducer:
+			md.Producer = value
+		case HeaderServiceVersion:
+			md.ServiceVersion = value
+		case HeaderIngestTime:
+			md.IngestTime, _ = time.Parse(time.RFC3339Nano, value)
+		case HeaderSourceTopic:
+			md.SourceTopic = value
+		case HeaderSourcePartition:
+			md.SourcePartition, _ = strconv.Atoi(value)
+		case HeaderSourceOffset:
+			md.SourceOffset, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return md, md.EventID != ""
+}
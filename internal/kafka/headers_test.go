@@ -0,0 +1,75 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Propagate(t *testing.T) {
+	upstream := Metadata{
+		EventID:         "event123",
+		Producer:        "cleaner-worker",
+		ServiceVersion:  "v0.0.1",
+		IngestTime:      time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		SourceTopic:     "device-events",
+		SourcePartition: 2,
+		SourceOffset:    42,
+	}
+
+	cases := []struct {
+		name           string
+		inputMsg       kafka.Message
+		expectedSource Metadata
+	}{
+		{
+			name: "upstream metadata kept",
+			inputMsg: kafka.Message{
+				Topic:     "device_events_cleaned",
+				Partition: 0,
+				Offset:    7,
+				Headers:   upstream.Headers(),
+			},
+			expectedSource: upstream,
+		},
+		{
+			name: "no upstream metadata - created from message",
+			inputMsg: kafka.Message{
+				Topic:     "device_events_cleaned",
+				Partition: 1,
+				Offset:    7,
+			},
+			expectedSource: Metadata{
+				SourceTopic:     "device_events_cleaned",
+				SourcePartition: 1,
+				SourceOffset:    7,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			md, ok := ParseMetadata(Propagate("packer-worker", tt.inputMsg))
+			assert.True(t, ok)
+			assert.Equal(t, "packer-worker", md.Producer)
+			assert.Equal(t, ServiceVersion, md.ServiceVersion)
+			assert.Equal(t, tt.expectedSource.SourceTopic, md.SourceTopic)
+			assert.Equal(t, tt.expectedSource.SourcePartition, md.SourcePartition)
+			assert.Equal(t, tt.expectedSource.SourceOffset, md.SourceOffset)
+			if tt.expectedSource.EventID != "" {
+				assert.Equal(t, tt.expectedSource.EventID, md.EventID)
+				assert.Equal(t, tt.expectedSource.IngestTime, md.IngestTime)
+			} else {
+				assert.NotEmpty(t, md.EventID)
+				assert.False(t, md.IngestTime.IsZero())
+			}
+		})
+	}
+}
+
+func Test_ParseMetadata_NoHeaders(t *testing.T) {
+	_, ok := ParseMetadata(nil)
+	assert.False(t, ok)
+}
@@ -28,6 +28,15 @@ type DeviceEvent struct {
 	EventType string `json:"event_type"`
 }
 
+// DeviceSession is the value of a sessions topic record: the time a device spent present, from a
+// device_enter to the following device_exit. Timestamps are Unix epoch milliseconds
+type DeviceSession struct {
+	DeviceID       string `json:"device_id"`
+	Start          int64  `json:"start"`
+	End            int64  `json:"end"`
+	DurationMillis int64  `json:"duration_ms"`
+}
+
 type Schema struct {
 	Type     string  `json:"type"`
 	Name     string  `json:"name"`
@@ -42,6 +51,8 @@ type Field struct {
 
 type Reader interface {
 	ReadMessage(ctx context.Context) (kafka.Message, error)
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
 	Close() error
 	Lag() int64
 }
@@ -0,0 +1,85 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrListOffsets = errors.New("error listing offsets")
+)
+
+// PartitionOffsets is the range of offsets held by a partition. End is the high watermark, the
+// offset the next message written to the partition will get, so a partition is empty when
+// First == End
+type PartitionOffsets struct {
+	Partition int
+	First     int64
+	End       int64
+}
+
+type OffsetLister interface {
+	ListPartitionOffsets(ctx context.Context, topic string) ([]PartitionOffsets, error)
+}
+
+// Client lists topic metadata and offsets from the brokers
+type Client struct {
+	client *kafka.Client
+}
+
+func NewClient(brokers string) *Client {
+	return &Client{
+		client: &kafka.Client{Addr: kafka.TCP(brokers)},
+	}
+}
+
+// ListPartitionOffsets returns the first and high watermark offsets of every partition of a topic,
+// sorted by partition
+func (c *Client) ListPartitionOffsets(ctx context.Context, topic string) ([]PartitionOffsets, error) {
+	const fn = "Client:ListPartitionOffsets"
+	meta, err := c.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrListOffsets, err)
+	}
+	var requests []kafka.OffsetRequest
+	for _, t := range meta.Topics {
+		if t.Name != topic {
+			continue
+		}
+		if t.Error != nil {
+			return nil, fmt.Errorf("%s:%w:%w", fn, ErrListOffsets, t.Error)
+		}
+		for _, p := range t.Partitions {
+			requests = append(requests, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+		}
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("%s:%w:topic %q has no partitions", fn, ErrListOffsets, topic)
+	}
+
+	resp, err := c.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrListOffsets, err)
+	}
+	offsets := make([]PartitionOffsets, 0, len(resp.Topics[topic]))
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("%s:%w:partition %d:%w", fn, ErrListOffsets, p.Partition, p.Error)
+		}
+		offsets = append(offsets, PartitionOffsets{
+			Partition: p.Partition,
+			First:     p.FirstOffset,
+			End:       p.LastOffset,
+		})
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i].Partition < offsets[j].Partition
+	})
+	return offsets, nil
+}
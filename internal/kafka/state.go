@@ -0,0 +1,131 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrDecodeState = errors.New("error decoding state record")
+)
+
+// DeviceState is the value of a compacted topic record: the current state of a device, built by
+// the Packer from every event of the device. Timestamps are Unix epoch milliseconds
+type DeviceState struct {
+	DeviceID string `json:"device_id"`
+	// Present is true between a device_enter and the following device_exit
+	Present       bool   `json:"present"`
+	LastEvent     string `json:"last_event"`
+	LastTimestamp int64  `json:"last_timestamp"`
+	// EnteredAt is the enter of the current visit, nil if the device is not present
+	EnteredAt *int64 `json:"entered_at,omitempty"`
+	// LastExitAt is the exit of the last completed visit, nil if there was none
+	LastExitAt  *int64 `json:"last_exit_at,omitempty"`
+	TotalVisits int64  `json:"total_visits"`
+	// DwellMillis is the time spent present over every completed visit
+	DwellMillis int64 `json:"dwell_ms"`
+}
+
+// StateFromEvent returns the state of a device known only by its last event, without any visit
+// history
+func StateFromEvent(event DeviceEvent) DeviceState {
+	state := DeviceState{
+		DeviceID:      event.DeviceID,
+		Present:       event.EventType == DeviceEnter,
+		LastEvent:     event.EventType,
+		LastTimestamp: event.Timestamp,
+	}
+	timestamp := event.Timestamp
+	if state.Present {
+		state.EnteredAt = &timestamp
+	} else {
+		state.LastExitAt = &timestamp
+	}
+	return state
+}
+
+// Correct returns the state with its last event set by hand to event, for a state corrected
+// rather than built from events. The visit count, the dwell time and, for an enter, the last
+// exit are kept, so a correction does not erase the history of the device
+func (s DeviceState) Correct(event DeviceEvent) DeviceState {
+	next := StateFromEvent(event)
+	next.TotalVisits = s.TotalVisits
+	next.DwellMillis = s.DwellMillis
+	if next.Present {
+		next.LastExitAt = s.LastExitAt
+	}
+	return next
+}
+
+// Apply returns the state after event. An enter while present means the exit of the previous
+// visit was missed: a new visit is started without adding dwell time for the previous one. An
+// exit while not present only moves the last exit
+func (s DeviceState) Apply(event DeviceEvent) DeviceState {
+	next := s
+	next.DeviceID = event.DeviceID
+	next.LastEvent = event.EventType
+	next.LastTimestamp = event.Timestamp
+	timestamp := event.Timestamp
+	switch event.EventType {
+	case DeviceEnter:
+		next.Present = true
+		next.EnteredAt = &timestamp
+		next.TotalVisits++
+	case DeviceExit:
+		if s.Present && s.EnteredAt != nil {
+			next.DwellMillis += max(timestamp-*s.EnteredAt, 0)
+		}
+		next.Present = false
+		next.EnteredAt = nil
+		next.LastExitAt = &timestamp
+	}
+	return next
+}
+
+// DecodeState decodes the value of a compacted topic record. Records written before the Packer
+// built state records hold the last event of the device, in a StructuredConnectRecord, and are
+// read as the state of StateFromEvent
+func DecodeState(value []byte) (DeviceState, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(value, &probe); err != nil {
+		return DeviceState{}, fmt.Errorf("%w:%w", ErrDecodeState, err)
+	}
+	if _, ok := probe["payload"]; ok {
+		var record StructuredConnectRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return DeviceState{}, fmt.Errorf("%w:%w", ErrDecodeState, err)
+		}
+		return StateFromEvent(record.Payload), nil
+	}
+	var state DeviceState
+	if err := json.Unmarshal(value, &state); err != nil {
+		return DeviceState{}, fmt.Errorf("%w:%w", ErrDecodeState, err)
+	}
+	return state, nil
+}
+
+// NewStateRecord returns a compacted topic record that sets the state of a device, with new
+// metadata from producer. eventID replaces the generated event ID if not empty
+func NewStateRecord(producer string, state DeviceState, eventID string) (kafka.Message, error) {
+	out, err := json.Marshal(state)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	md := NewMetadata(producer, kafka.Message{})
+	if eventID != "" {
+		md.EventID = eventID
+	}
+	return kafka.Message{
+		Key:     []byte(state.DeviceID),
+		Value:   out,
+		Headers: md.Headers(),
+	}, nil
+}
+
+// NewTombstone returns a record with a null value, which removes key from a compacted topic
+func NewTombstone(key string) kafka.Message {
+	return kafka.Message{Key: []byte(key)}
+}
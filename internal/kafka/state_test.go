@@ -0,0 +1,192 @@
+package worker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DeviceState_Apply(t *testing.T) {
+	at := func(timestamp int64) *int64 { return &timestamp }
+	event := func(eventType string, timestamp int64) DeviceEvent {
+		return DeviceEvent{DeviceID: "device123", EventType: eventType, Timestamp: timestamp}
+	}
+
+	cases := []struct {
+		name          string
+		inputEvents   []DeviceEvent
+		expectedState DeviceState
+	}{
+		{
+			name:        "visit in progress",
+			inputEvents: []DeviceEvent{event(DeviceEnter, 10)},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				Present:       true,
+				LastEvent:     DeviceEnter,
+				LastTimestamp: 10,
+				EnteredAt:     at(10),
+				TotalVisits:   1,
+			},
+		},
+		{
+			name:        "completed visits accumulate dwell",
+			inputEvents: []DeviceEvent{event(DeviceEnter, 10), event(DeviceExit, 25), event(DeviceEnter, 30), event(DeviceExit, 35)},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				LastEvent:     DeviceExit,
+				LastTimestamp: 35,
+				LastExitAt:    at(35),
+				TotalVisits:   2,
+				DwellMillis:   20,
+			},
+		},
+		{
+			name:        "missed exit starts a new visit without dwell",
+			inputEvents: []DeviceEvent{event(DeviceEnter, 10), event(DeviceEnter, 20)},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				Present:       true,
+				LastEvent:     DeviceEnter,
+				LastTimestamp: 20,
+				EnteredAt:     at(20),
+				TotalVisits:   2,
+			},
+		},
+		{
+			name:        "exit without enter",
+			inputEvents: []DeviceEvent{event(DeviceExit, 10)},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				LastEvent:     DeviceExit,
+				LastTimestamp: 10,
+				LastExitAt:    at(10),
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var state DeviceState
+			for _, e := range tt.inputEvents {
+				state = state.Apply(e)
+			}
+			assert.Equal(t, tt.expectedState, state)
+		})
+	}
+}
+
+func Test_DeviceState_Correct(t *testing.T) {
+	at := func(timestamp int64) *int64 { return &timestamp }
+	history := DeviceState{
+		DeviceID:      "device123",
+		LastEvent:     DeviceExit,
+		LastTimestamp: 35,
+		LastExitAt:    at(35),
+		TotalVisits:   2,
+		DwellMillis:   20,
+	}
+
+	cases := []struct {
+		name          string
+		inputState    DeviceState
+		inputEvent    DeviceEvent
+		expectedState DeviceState
+	}{
+		{
+			name:       "enter - history kept",
+			inputState: history,
+			inputEvent: DeviceEvent{DeviceID: "device123", EventType: DeviceEnter, Timestamp: 40},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				Present:       true,
+				LastEvent:     DeviceEnter,
+				LastTimestamp: 40,
+				EnteredAt:     at(40),
+				LastExitAt:    at(35),
+				TotalVisits:   2,
+				DwellMillis:   20,
+			},
+		},
+		{
+			name:       "exit - history kept, last exit moved",
+			inputState: history,
+			inputEvent: DeviceEvent{DeviceID: "device123", EventType: DeviceExit, Timestamp: 30},
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				LastEvent:     DeviceExit,
+				LastTimestamp: 30,
+				LastExitAt:    at(30),
+				TotalVisits:   2,
+				DwellMillis:   20,
+			},
+		},
+		{
+			name:          "unknown device - same as StateFromEvent",
+			inputEvent:    DeviceEvent{DeviceID: "device123", EventType: DeviceEnter, Timestamp: 40},
+			expectedState: StateFromEvent(DeviceEvent{DeviceID: "device123", EventType: DeviceEnter, Timestamp: 40}),
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedState, tt.inputState.Correct(tt.inputEvent))
+		})
+	}
+}
+
+func Test_DecodeState(t *testing.T) {
+	enteredAt := int64(10)
+	state := DeviceState{
+		DeviceID:      "device123",
+		Present:       true,
+		LastEvent:     DeviceEnter,
+		LastTimestamp: 10,
+		EnteredAt:     &enteredAt,
+		TotalVisits:   3,
+		DwellMillis:   100,
+	}
+	stateBytes, _ := json.Marshal(state)
+	legacyBytes, _ := json.Marshal(StructuredConnectRecord{
+		Schema:  StructuredSchema,
+		Payload: DeviceEvent{DeviceID: "device123", EventType: DeviceEnter, Timestamp: 10},
+	})
+
+	cases := []struct {
+		name          string
+		inputValue    []byte
+		expectedState DeviceState
+		expectedErr   error
+	}{
+		{
+			name:          "state record",
+			inputValue:    stateBytes,
+			expectedState: state,
+		},
+		{
+			name:       "record of the last event",
+			inputValue: legacyBytes,
+			expectedState: DeviceState{
+				DeviceID:      "device123",
+				Present:       true,
+				LastEvent:     DeviceEnter,
+				LastTimestamp: 10,
+				EnteredAt:     &enteredAt,
+			},
+		},
+		{
+			name:        "invalid JSON",
+			inputValue:  []byte("not-a-json"),
+			expectedErr: ErrDecodeState,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := DecodeState(tt.inputValue)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedState, state)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package cleaner
+
+import (
+	"sync"
+	"time"
+)
+
+// activeDevices remembers the devices the registry found not retired, for ttl, so the registry is
+// not queried for every event. A device retired meanwhile is rejected once its entry expires. With
+// a zero ttl nothing is remembered. The zero value is ready to use
+type activeDevices struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	now       func() time.Time
+	checkedAt map[string]time.Time
+	sweptAt   time.Time
+}
+
+func (a *activeDevices) clock() time.Time {
+	if a.now == nil {
+		return time.Now()
+	}
+	return a.now()
+}
+
+// contains returns true if the device was found not retired less than ttl ago
+func (a *activeDevices) contains(deviceID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	checkedAt, ok := a.checkedAt[deviceID]
+	return ok && a.clock().Sub(checkedAt) < a.ttl
+}
+
+// add remembers that the device was just found not retired. Expired entries are dropped once per
+// ttl, so only the devices seen in the last ttl are held
+func (a *activeDevices) add(deviceID string) {
+	if a.ttl <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock()
+	if a.checkedAt == nil {
+		a.checkedAt = make(map[string]time.Time)
+	}
+	if now.Sub(a.sweptAt) >= a.ttl {
+		for id, checkedAt := range a.checkedAt {
+			if now.Sub(checkedAt) >= a.ttl {
+				delete(a.checkedAt, id)
+			}
+		}
+		a.sweptAt = now
+	}
+	a.checkedAt[deviceID] = now
+}
@@ -0,0 +1,29 @@
+package cleaner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_activeDevices(t *testing.T) {
+	now := time.UnixMilli(0)
+	a := activeDevices{ttl: time.Minute, now: func() time.Time { return now }}
+
+	a.add("device123")
+	assert.True(t, a.contains("device123"))
+	assert.False(t, a.contains("device456"))
+
+	now = now.Add(time.Minute)
+	assert.False(t, a.contains("device123"), "entry should expire after ttl")
+
+	a.add("device456")
+	assert.NotContains(t, a.checkedAt, "device123", "expired entries should be swept")
+}
+
+func Test_activeDevices_NoTTL(t *testing.T) {
+	var a activeDevices
+	a.add("device123")
+	assert.False(t, a.contains("device123"))
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"sr-backend-home-assessment/internal/cache"
 	"sr-backend-home-assessment/internal/worker"
+	"time"
 
 	k "sr-backend-home-assessment/internal/kafka"
 
@@ -17,14 +19,37 @@ import (
 var (
 	ErrReadMessage    = errors.New("error reading message")
 	ErrWriteMessage   = errors.New("error writing message")
+	ErrCommitMessage  = errors.New("error committing message")
 	ErrJSONParse      = errors.New("error parsing JSON")
 	ErrDuplicateEvent = errors.New("duplicate event")
+	ErrStaleEvent     = errors.New("stale event")
+	ErrRedelivered    = errors.New("redelivered event")
 	ErrInvalidEvent   = errors.New("invalid event")
+	ErrReserveEvent   = errors.New("error reserving event in cache")
+	ErrRetiredDevice  = errors.New("device retired")
+	ErrCheckRetired   = errors.New("error checking if device is retired")
 )
 
+const (
+	workerName = "cleaner-worker"
+	// maxReserveAttempts bounds the validate and compare-and-set loop, which would otherwise spin
+	// if the cache is failing every update
+	maxReserveAttempts = 10
+)
+
+// decodedFormats counts consumed messages per input format, served at /debug/vars
+var decodedFormats = expvar.NewMap("cleaner_decoded_formats")
+
 type deviceCache interface {
 	Get(string) (cache.DeviceState, bool)
-	Set(string, cache.DeviceState)
+	CompareAndSet(string, cache.DeviceState, cache.DeviceState) bool
+	Reserve(string, cache.DeviceState, cache.DeviceState) bool
+	Settle(string)
+}
+
+// deviceRegistry knows which devices have been decommissioned
+type deviceRegistry interface {
+	IsRetired(context.Context, string) (bool, error)
 }
 
 type Config struct {
@@ -33,31 +58,59 @@ type Config struct {
 	ConsumerTopic   string
 	PublisherTopic  string
 	Cache           deviceCache
+	// Rebalance, if set, is notified of the partitions assigned to this instance, so that a
+	// partition aware cache only holds the devices of those partitions
+	Rebalance k.RebalanceListener
+	// Registry, if set, is checked for every device, and events of retired devices are rejected.
+	// A device retired by another replica may still be in the cache, so the cache is not trusted
+	Registry deviceRegistry
+	// RetiredCheckTTL is how long a device found not retired is trusted before the registry is
+	// checked again, so a retired device is rejected at most RetiredCheckTTL after retirement. Zero
+	// checks the registry for every event
+	RetiredCheckTTL time.Duration
 }
 
 type Cleaner struct {
-	worker *worker.Worker
-	reader k.Reader
-	writer k.Writer
-	cache  deviceCache
+	worker   *worker.Worker
+	reader   k.Reader
+	writer   k.Writer
+	cache    deviceCache
+	registry deviceRegistry
+	recent   recentIDs
+	active   activeDevices
+	// pending holds a fetched message until it is both handled and committed, so a message that
+	// failed on the cache, the registry or the writer is retried from here
+	pending *kafka.Message
 }
 
 func New(cfg Config) *Cleaner {
 	cleaner := &Cleaner{
-		reader: kafka.NewReader(kafka.ReaderConfig{
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{cfg.Brokers},
+			Topic:    cfg.PublisherTopic,
+			Balancer: k.KeyBalancer,
+		}),
+		cache:    cfg.Cache,
+		registry: cfg.Registry,
+		active:   activeDevices{ttl: cfg.RetiredCheckTTL},
+	}
+	if cfg.Rebalance != nil {
+		cleaner.reader = k.NewGroupReader(k.GroupReaderConfig{
+			Brokers:  cfg.Brokers,
+			GroupID:  cfg.ConsumerGroupID,
+			Topic:    cfg.ConsumerTopic,
+			Listener: cfg.Rebalance,
+		})
+	} else {
+		cleaner.reader = kafka.NewReader(kafka.ReaderConfig{
 			Brokers: []string{cfg.Brokers},
 			GroupID: cfg.ConsumerGroupID,
 			Topic:   cfg.ConsumerTopic,
-		}),
-		writer: kafka.NewWriter(kafka.WriterConfig{
-			Brokers: []string{cfg.Brokers},
-			Topic:   cfg.PublisherTopic,
-		}),
-		cache: cfg.Cache,
+		})
 	}
 
 	cleaner.worker = worker.New(worker.Config{
-		Name:      "cleaner-worker",
+		Name:      workerName,
 		Processor: cleaner,
 	})
 	return cleaner
@@ -73,27 +126,64 @@ func (c *Cleaner) Close(ctx context.Context) {
 	c.writer.Close()
 }
 
-// Auto-commit active
+// Forget drops the recent event IDs of the given devices, once the cache has evicted them
+func (c *Cleaner) Forget(deviceIDs []string) {
+	c.recent.remove(deviceIDs)
+}
+
+// Manual commit, offsets are committed only after the event is published or deliberately skipped,
+// so an event that fails on the cache, the registry or the writer is retried, not dropped
 func (c *Cleaner) ProcessMessage(ctx context.Context) error {
 	const fn = "Cleaner:ProcessMessage"
-	m, err := c.reader.ReadMessage(ctx)
-	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+	if c.pending == nil {
+		m, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+		}
+		c.pending = &m
+	}
+
+	if err := c.handle(ctx, *c.pending); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
 	}
-	var payload k.DeviceEvent
-	if err := json.Unmarshal(m.Value, &payload); err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+	if err := c.reader.CommitMessages(ctx, *c.pending); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrCommitMessage, err)
+	}
+	c.pending = nil
+	return nil
+}
+
+// handle publishes the cleaned event of m, or skips m if it is invalid. Returns an error only if m
+// must be retried
+func (c *Cleaner) handle(ctx context.Context, m kafka.Message) error {
+	decoded, err := decodeEvent(m)
+	if err != nil {
+		decodedFormats.Add(FormatInvalid, 1)
+		slog.InfoContext(ctx, "Invalid message, skipping",
+			"error", err,
+			"partition", m.Partition,
+			"offset", m.Offset,
+		)
+		return nil
 	}
+	decodedFormats.Add(decoded.Format, 1)
+	payload := decoded.Event
 
-	if err := c.validateEvent(payload); err != nil {
+	previous, next, err := c.reserveEvent(ctx, payload, decoded.ID)
+	if errors.Is(err, ErrReserveEvent) || errors.Is(err, ErrCheckRetired) {
+		return err
+	}
+	if err != nil {
 		slog.InfoContext(ctx, "Invalid event, skipping",
 			"error", err,
 			"device_id", payload.DeviceID,
 			"event_type", payload.EventType,
 			"timestamp", payload.Timestamp,
+			"event_id", decoded.ID,
 		)
 		return nil
 	}
+	defer c.cache.Settle(payload.DeviceID)
 
 	record := k.StructuredConnectRecord{
 		Schema:  k.StructuredSchema,
@@ -101,31 +191,91 @@ func (c *Cleaner) ProcessMessage(ctx context.Context) error {
 	}
 	out, err := json.Marshal(record)
 	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+		return fmt.Errorf("%w:%w", ErrJSONParse, err)
+	}
+	// Keep the producer's event ID, so the event can be traced and deduplicated downstream
+	md := k.NewMetadata(workerName, m)
+	if decoded.ID != "" {
+		md.EventID = decoded.ID
 	}
-	err = c.writer.WriteMessages(ctx, kafka.Message{Key: []byte(payload.DeviceID), Value: out})
+	err = c.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(payload.DeviceID),
+		Value:   out,
+		Headers: md.Headers(),
+	})
 	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrWriteMessage, err)
+		// Release the reservation, unless the device has moved on since
+		c.cache.CompareAndSet(payload.DeviceID, next, previous)
+		return fmt.Errorf("%w:%w", ErrWriteMessage, err)
 	}
+	if decoded.ID != "" {
+		c.recent.add(payload.DeviceID, decoded.ID)
+	}
+	slog.InfoContext(ctx, "Published cleaned message", "device_id", payload.DeviceID)
+	return nil
+}
 
-	// Set cache only after successful write
-	c.cache.Set(payload.DeviceID, cache.DeviceState{
+// reserveEvent validates the event and moves the device to its new state in the cache as one
+// step, so that concurrent events for the same device cannot both pass validation. If the device
+// changes between validation and the update, the event is validated again. Returns the state
+// before and after the event, so the reservation can be released if publishing fails. The
+// reservation must be settled once the event is published or released
+func (c *Cleaner) reserveEvent(ctx context.Context, payload k.DeviceEvent, eventID string) (cache.DeviceState, cache.DeviceState, error) {
+	next := cache.DeviceState{
 		LastEvent:         payload.EventType,
 		LastTimestampSeen: payload.Timestamp,
-	})
-	slog.InfoContext(ctx, "Published cleaned message", "device_id", payload.DeviceID)
-	return nil
+		LastEventID:       eventID,
+	}
+	for range maxReserveAttempts {
+		previous, err := c.validateEvent(ctx, payload, eventID)
+		if err != nil {
+			return cache.DeviceState{}, cache.DeviceState{}, err
+		}
+		if c.cache.Reserve(payload.DeviceID, previous, next) {
+			return previous, next, nil
+		}
+	}
+	return cache.DeviceState{}, cache.DeviceState{}, ErrReserveEvent
 }
 
-func (c *Cleaner) validateEvent(payload k.DeviceEvent) error {
+// validateEvent checks the event type, and the transition from the last event of the device, which
+// the event must be newer than.
+// eventID is the ID given to the event by its producer, if any. An event whose ID was accepted
+// recently for the device is a redelivery, and is dropped before its transition is checked.
+// The device is then looked up in the registry, unless it was found active recently, and rejected
+// if it is retired. Returns the state the event was validated against, the zero state if the
+// device is unknown
+func (c *Cleaner) validateEvent(ctx context.Context, payload k.DeviceEvent, eventID string) (cache.DeviceState, error) {
 	if payload.EventType != k.DeviceEnter && payload.EventType != k.DeviceExit {
-		return ErrInvalidEvent
+		return cache.DeviceState{}, ErrInvalidEvent
+	}
+	if eventID != "" && c.recent.contains(payload.DeviceID, eventID) {
+		return cache.DeviceState{}, ErrRedelivered
 	}
 	state, exists := c.cache.Get(payload.DeviceID)
 	if exists {
+		// The cache also holds the last ID, which catches a redelivery after a restart
+		if eventID != "" && eventID == state.LastEventID {
+			return cache.DeviceState{}, ErrRedelivered
+		}
 		if payload.EventType == state.LastEvent {
-			return ErrDuplicateEvent
+			return cache.DeviceState{}, ErrDuplicateEvent
+		}
+		// The Packer skips events no newer than the state of the device, so they are rejected
+		// here too, and the cache and the compacted topic end on the same event
+		if payload.Timestamp <= state.LastTimestampSeen {
+			return cache.DeviceState{}, ErrStaleEvent
 		}
 	}
-	return nil
+	if c.registry != nil && !c.active.contains(payload.DeviceID) {
+		retired, err := c.registry.IsRetired(ctx, payload.DeviceID)
+		if err != nil {
+			return cache.DeviceState{}, fmt.Errorf("%w:%w", ErrCheckRetired, err)
+		}
+		if retired {
+			return cache.DeviceState{}, ErrRetiredDevice
+		}
+		c.active.add(payload.DeviceID)
+	}
+	return state, nil
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"sr-backend-home-assessment/internal/cache"
 	k "sr-backend-home-assessment/internal/kafka"
 	"testing"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
@@ -14,168 +16,114 @@ import (
 )
 
 func Test_ProcessMessage(t *testing.T) {
+	event := k.DeviceEvent{
+		DeviceID:  "device123",
+		EventType: "device_enter",
+		Timestamp: 1,
+	}
+	eventBytes, _ := json.Marshal(event)
+	recordBytes, _ := json.Marshal(k.StructuredConnectRecord{
+		Schema:  k.StructuredSchema,
+		Payload: event,
+	})
+	exit := cache.DeviceState{
+		LastEvent:         "device_exit",
+		LastTimestampSeen: 0,
+	}
+	enter := cache.DeviceState{
+		LastEvent:         "device_enter",
+		LastTimestampSeen: 1,
+	}
+
 	cases := []struct {
-		name          string
-		inputMessage  func(string) kafka.Message
-		inputDeviceID string
-		setupCache    func(string) deviceCache
-		setupReader   func(kafka.Message) k.Reader
-		setupWriter   func(string) k.Writer
-		expectedErr   error
+		name         string
+		inputMessage kafka.Message
+		setupCache   func() deviceCache
+		setupReader  func(kafka.Message) k.Reader
+		setupWriter  func() k.Writer
+		expectedErr  error
 	}{
 		{
-			name: "valid message",
-			inputMessage: func(deviceID string) kafka.Message {
-				event := k.DeviceEvent{
-					DeviceID:  deviceID,
-					EventType: "device_enter",
-					Timestamp: 1,
-				}
-				data, _ := json.Marshal(event)
-				return kafka.Message{
-					Key:   []byte(event.DeviceID),
-					Value: data,
-				}
-			},
-			inputDeviceID: "device123",
-			setupCache: func(deviceID string) deviceCache {
+			name:         "valid message",
+			inputMessage: kafka.Message{Key: []byte("device123"), Value: eventBytes},
+			setupCache: func() deviceCache {
 				c := NewMockdeviceCache(t)
-				c.EXPECT().Get(deviceID).Return(cache.DeviceState{
-					LastEvent:         "device_exit",
-					LastTimestampSeen: 0,
-				}, true)
-				c.EXPECT().Set(deviceID, cache.DeviceState{
-					LastEvent:         "device_enter",
-					LastTimestampSeen: 1,
-				})
+				c.EXPECT().Get("device123").Return(exit, true)
+				c.EXPECT().Reserve("device123", exit, enter).Return(true)
+				c.EXPECT().Settle("device123")
 				return c
 			},
 			setupReader: func(inputMessage kafka.Message) k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(inputMessage, nil)
+				r.EXPECT().FetchMessage(mock.Anything).Return(inputMessage, nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
 				return r
 			},
-			setupWriter: func(deviceID string) k.Writer {
+			setupWriter: func() k.Writer {
 				w := k.NewMockWriter(t)
-				record := k.StructuredConnectRecord{
-					Schema: k.StructuredSchema,
-					Payload: k.DeviceEvent{
-						DeviceID:  deviceID,
-						EventType: "device_enter",
-						Timestamp: 1,
-					},
-				}
-				recordBytes, _ := json.Marshal(record)
 				w.EXPECT().WriteMessages(
 					mock.Anything,
-					[]kafka.Message{
-						{
-							Key:   []byte(deviceID),
-							Value: recordBytes,
-						},
-					},
+					matchMessages(kafka.Message{Key: []byte("device123"), Value: recordBytes}),
 				).Return(nil)
 				return w
 			},
 			expectedErr: nil,
 		},
 		{
-			name: "reader failed",
-			inputMessage: func(deviceID string) kafka.Message {
-				event := k.DeviceEvent{
-					DeviceID:  deviceID,
-					EventType: "device_enter",
-					Timestamp: 1,
-				}
-				data, _ := json.Marshal(event)
-				return kafka.Message{
-					Key:   []byte(event.DeviceID),
-					Value: data,
-				}
-			},
-			inputDeviceID: "device123",
-			setupCache: func(deviceID string) deviceCache {
+			name:         "reader failed",
+			inputMessage: kafka.Message{Key: []byte("device123"), Value: eventBytes},
+			setupCache: func() deviceCache {
 				return NewMockdeviceCache(t)
 			},
 			setupReader: func(inputMessage kafka.Message) k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(inputMessage, errors.New("failed"))
+				r.EXPECT().FetchMessage(mock.Anything).Return(inputMessage, errors.New("failed"))
 				return r
 			},
-			setupWriter: func(deviceID string) k.Writer {
+			setupWriter: func() k.Writer {
 				return k.NewMockWriter(t)
 			},
 			expectedErr: ErrReadMessage,
 		},
 		{
-			name: "invalid message JSON",
-			inputMessage: func(deviceID string) kafka.Message {
-				return kafka.Message{
-					Key:   []byte(deviceID),
-					Value: []byte("invalid-json"),
-				}
-			},
-			inputDeviceID: "device123",
-			setupCache: func(deviceID string) deviceCache {
+			name:         "invalid message JSON",
+			inputMessage: kafka.Message{Key: []byte("device123"), Value: []byte("invalid-json")},
+			setupCache: func() deviceCache {
 				return NewMockdeviceCache(t)
 			},
 			setupReader: func(inputMessage kafka.Message) k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(inputMessage, nil)
+				r.EXPECT().FetchMessage(mock.Anything).Return(inputMessage, nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
 				return r
 			},
-			setupWriter: func(deviceID string) k.Writer {
+			setupWriter: func() k.Writer {
 				return k.NewMockWriter(t)
 			},
-			expectedErr: ErrJSONParse,
+			expectedErr: nil,
 		},
 		{
-			name: "writer failed",
-			inputMessage: func(deviceID string) kafka.Message {
-				event := k.DeviceEvent{
-					DeviceID:  deviceID,
-					EventType: "device_enter",
-					Timestamp: 1,
-				}
-				data, _ := json.Marshal(event)
-				return kafka.Message{
-					Key:   []byte(event.DeviceID),
-					Value: data,
-				}
-			},
-			inputDeviceID: "device123",
-			setupCache: func(deviceID string) deviceCache {
+			name:         "writer failed",
+			inputMessage: kafka.Message{Key: []byte("device123"), Value: eventBytes},
+			setupCache: func() deviceCache {
 				c := NewMockdeviceCache(t)
-				c.EXPECT().Get(deviceID).Return(cache.DeviceState{
-					LastEvent:         "device_exit",
-					LastTimestampSeen: 0,
-				}, true)
+				c.EXPECT().Get("device123").Return(exit, true)
+				c.EXPECT().Reserve("device123", exit, enter).Return(true).Once()
+				// Reservation released after the failed write
+				c.EXPECT().CompareAndSet("device123", enter, exit).Return(true).Once()
+				c.EXPECT().Settle("device123").Once()
 				return c
 			},
 			setupReader: func(inputMessage kafka.Message) k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(inputMessage, nil)
+				r.EXPECT().FetchMessage(mock.Anything).Return(inputMessage, nil)
 				return r
 			},
-			setupWriter: func(deviceID string) k.Writer {
+			setupWriter: func() k.Writer {
 				w := k.NewMockWriter(t)
-				record := k.StructuredConnectRecord{
-					Schema: k.StructuredSchema,
-					Payload: k.DeviceEvent{
-						DeviceID:  deviceID,
-						EventType: "device_enter",
-						Timestamp: 1,
-					},
-				}
-				recordBytes, _ := json.Marshal(record)
 				w.EXPECT().WriteMessages(
 					mock.Anything,
-					[]kafka.Message{
-						{
-							Key:   []byte(deviceID),
-							Value: recordBytes,
-						},
-					},
+					matchMessages(kafka.Message{Key: []byte("device123"), Value: recordBytes}),
 				).Return(errors.New("failed"))
 				return w
 			},
@@ -185,9 +133,9 @@ func Test_ProcessMessage(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			cleaner := &Cleaner{
-				cache:  tt.setupCache(tt.inputDeviceID),
-				reader: tt.setupReader(tt.inputMessage(tt.inputDeviceID)),
-				writer: tt.setupWriter(tt.inputDeviceID),
+				cache:  tt.setupCache(),
+				reader: tt.setupReader(tt.inputMessage),
+				writer: tt.setupWriter(),
 			}
 			err := cleaner.ProcessMessage(context.Background())
 			assert.ErrorIs(t, err, tt.expectedErr)
@@ -195,12 +143,137 @@ func Test_ProcessMessage(t *testing.T) {
 	}
 }
 
+func Test_reserveEvent(t *testing.T) {
+	enter := k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 2}
+	exit := cache.DeviceState{LastEvent: "device_exit", LastTimestampSeen: 1}
+	next := cache.DeviceState{LastEvent: "device_enter", LastTimestampSeen: 2}
+
+	cases := []struct {
+		name             string
+		setupCache       func() deviceCache
+		expectedPrevious cache.DeviceState
+		expectedErr      error
+	}{
+		{
+			name: "unknown device reserved",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false)
+				c.EXPECT().Reserve("device123", cache.DeviceState{}, next).Return(true)
+				return c
+			},
+			expectedPrevious: cache.DeviceState{},
+		},
+		{
+			name: "concurrent update - revalidated and reserved",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false).Once()
+				c.EXPECT().Reserve("device123", cache.DeviceState{}, next).Return(false).Once()
+				c.EXPECT().Get("device123").Return(exit, true).Once()
+				c.EXPECT().Reserve("device123", exit, next).Return(true).Once()
+				return c
+			},
+			expectedPrevious: exit,
+		},
+		{
+			name: "concurrent update - revalidated and rejected",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false).Once()
+				c.EXPECT().Reserve("device123", cache.DeviceState{}, next).Return(false).Once()
+				c.EXPECT().Get("device123").Return(next, true).Once()
+				return c
+			},
+			expectedErr: ErrDuplicateEvent,
+		},
+		{
+			name: "cache failing every update - gives up",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false).Times(maxReserveAttempts)
+				c.EXPECT().Reserve("device123", cache.DeviceState{}, next).Return(false).Times(maxReserveAttempts)
+				return c
+			},
+			expectedErr: ErrReserveEvent,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := &Cleaner{
+				cache: tt.setupCache(),
+			}
+			previous, _, err := cleaner.reserveEvent(context.Background(), enter, "")
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedPrevious, previous)
+		})
+	}
+}
+
+func Test_ProcessMessage_FormatCounters(t *testing.T) {
+	formats := []struct {
+		format string
+		value  string
+	}{
+		{FormatFlat, `{"device_id":"device123","event_type":"heartbeat","timestamp":1}`},
+		{FormatConnectUnstructured, `{"payload":{"device_id":"device123","event_type":"heartbeat","timestamp":1}}`},
+		{FormatConnectStructured, `{"schema":{},"payload":{"device_id":"device123","event_type":"heartbeat","timestamp":1}}`},
+		{FormatInvalid, `not-a-json`},
+	}
+	for _, f := range formats {
+		t.Run(f.format, func(t *testing.T) {
+			before := counterValue(f.format)
+			r := k.NewMockReader(t)
+			r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{Value: []byte(f.value)}, nil)
+			r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+			cleaner := &Cleaner{
+				cache:  NewMockdeviceCache(t),
+				reader: r,
+				writer: k.NewMockWriter(t),
+			}
+			cleaner.ProcessMessage(context.Background())
+			assert.Equal(t, before+1, counterValue(f.format))
+		})
+	}
+}
+
+func counterValue(format string) int64 {
+	v, ok := decodedFormats.Get(format).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// matchMessages matches written messages on key and value, and checks that each message is
+// stamped with metadata headers by the cleaner
+func matchMessages(expected ...kafka.Message) interface{} {
+	return mock.MatchedBy(func(msgs []kafka.Message) bool {
+		if len(msgs) != len(expected) {
+			return false
+		}
+		for i, m := range msgs {
+			md, ok := k.ParseMetadata(m.Headers)
+			if !ok || md.Producer != workerName {
+				return false
+			}
+			if string(m.Key) != string(expected[i].Key) || string(m.Value) != string(expected[i].Value) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
 func Test_validateEvent(t *testing.T) {
 	cases := []struct {
-		name        string
-		inputEvent  k.DeviceEvent
-		setupCache  func(string) deviceCache
-		expectedErr error
+		name         string
+		inputEvent   k.DeviceEvent
+		inputEventID string
+		recentIDs    []string
+		setupCache   func(string) deviceCache
+		expectedErr  error
 	}{
 		{
 			name: "valid event",
@@ -248,6 +321,76 @@ func Test_validateEvent(t *testing.T) {
 			},
 			expectedErr: ErrDuplicateEvent,
 		},
+		{
+			name: "stale event",
+			inputEvent: k.DeviceEvent{
+				DeviceID:  "device123",
+				EventType: "device_enter",
+				Timestamp: 2,
+			},
+			setupCache: func(deviceID string) deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get(deviceID).Return(cache.DeviceState{
+					LastEvent:         "device_exit",
+					LastTimestampSeen: 2,
+				}, true)
+				return c
+			},
+			expectedErr: ErrStaleEvent,
+		},
+		{
+			name: "redelivered last event",
+			inputEvent: k.DeviceEvent{
+				DeviceID:  "device123",
+				EventType: "device_enter",
+				Timestamp: 1,
+			},
+			inputEventID: "event123",
+			setupCache: func(deviceID string) deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get(deviceID).Return(cache.DeviceState{
+					LastEvent:         "device_enter",
+					LastTimestampSeen: 1,
+					LastEventID:       "event123",
+				}, true)
+				return c
+			},
+			expectedErr: ErrRedelivered,
+		},
+		{
+			name: "redelivered event after the device moved on",
+			inputEvent: k.DeviceEvent{
+				DeviceID:  "device123",
+				EventType: "device_enter",
+				Timestamp: 1,
+			},
+			inputEventID: "event123",
+			recentIDs:    []string{"event123", "event124"},
+			setupCache: func(deviceID string) deviceCache {
+				return NewMockdeviceCache(t)
+			},
+			expectedErr: ErrRedelivered,
+		},
+		{
+			name: "new event ID",
+			inputEvent: k.DeviceEvent{
+				DeviceID:  "device123",
+				EventType: "device_enter",
+				Timestamp: 3,
+			},
+			inputEventID: "event125",
+			recentIDs:    []string{"event123", "event124"},
+			setupCache: func(deviceID string) deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get(deviceID).Return(cache.DeviceState{
+					LastEvent:         "device_exit",
+					LastTimestampSeen: 2,
+					LastEventID:       "event124",
+				}, true)
+				return c
+			},
+			expectedErr: nil,
+		},
 	}
 
 	for _, tt := range cases {
@@ -256,9 +399,118 @@ func Test_validateEvent(t *testing.T) {
 			cleaner := &Cleaner{
 				cache: tt.setupCache(tt.inputEvent.DeviceID),
 			}
-			err := cleaner.validateEvent(tt.inputEvent)
+			for _, id := range tt.recentIDs {
+				cleaner.recent.add(tt.inputEvent.DeviceID, id)
+			}
+			_, err := cleaner.validateEvent(context.Background(), tt.inputEvent, tt.inputEventID)
 			assert.ErrorIs(t, err, tt.expectedErr)
 		})
 	}
 
 }
+
+func Test_validateEvent_Registry(t *testing.T) {
+	enter := k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 1}
+
+	cases := []struct {
+		name          string
+		setupCache    func() deviceCache
+		setupRegistry func() deviceRegistry
+		recentActive  bool
+		expectedErr   error
+	}{
+		{
+			name: "cached device - not retired",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{LastEvent: "device_exit"}, true)
+				return c
+			},
+			setupRegistry: func() deviceRegistry {
+				r := NewMockdeviceRegistry(t)
+				r.EXPECT().IsRetired(mock.Anything, "device123").Return(false, nil)
+				return r
+			},
+		},
+		{
+			name: "cached device - retired by another replica",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{LastEvent: "device_exit"}, true)
+				return c
+			},
+			setupRegistry: func() deviceRegistry {
+				r := NewMockdeviceRegistry(t)
+				r.EXPECT().IsRetired(mock.Anything, "device123").Return(true, nil)
+				return r
+			},
+			expectedErr: ErrRetiredDevice,
+		},
+		{
+			name: "recently active device - registry not checked",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{LastEvent: "device_exit"}, true)
+				return c
+			},
+			setupRegistry: func() deviceRegistry { return NewMockdeviceRegistry(t) },
+			recentActive:  true,
+		},
+		{
+			name: "unknown device - not retired",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false)
+				return c
+			},
+			setupRegistry: func() deviceRegistry {
+				r := NewMockdeviceRegistry(t)
+				r.EXPECT().IsRetired(mock.Anything, "device123").Return(false, nil)
+				return r
+			},
+		},
+		{
+			name: "unknown device - retired",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false)
+				return c
+			},
+			setupRegistry: func() deviceRegistry {
+				r := NewMockdeviceRegistry(t)
+				r.EXPECT().IsRetired(mock.Anything, "device123").Return(true, nil)
+				return r
+			},
+			expectedErr: ErrRetiredDevice,
+		},
+		{
+			name: "registry failed",
+			setupCache: func() deviceCache {
+				c := NewMockdeviceCache(t)
+				c.EXPECT().Get("device123").Return(cache.DeviceState{}, false)
+				return c
+			},
+			setupRegistry: func() deviceRegistry {
+				r := NewMockdeviceRegistry(t)
+				r.EXPECT().IsRetired(mock.Anything, "device123").Return(false, errors.New("failed"))
+				return r
+			},
+			expectedErr: ErrCheckRetired,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cleaner := &Cleaner{
+				cache:    tt.setupCache(),
+				registry: tt.setupRegistry(),
+				active:   activeDevices{ttl: time.Minute},
+			}
+			if tt.recentActive {
+				cleaner.active.add("device123")
+			}
+			_, err := cleaner.validateEvent(context.Background(), enter, "")
+			assert.ErrorIs(t, err, tt.expectedErr)
+		})
+	}
+}
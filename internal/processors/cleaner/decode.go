@@ -0,0 +1,190 @@
+package cleaner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	FormatFlat                  = "flat"
+	FormatConnectUnstructured   = "connect_unstructured"
+	FormatConnectStructured     = "connect_structured"
+	FormatCloudEventsStructured = "cloudevents_structured"
+	FormatCloudEventsBinary     = "cloudevents_binary"
+	FormatInvalid               = "invalid"
+
+	// Field names of the Kafka Connect JSON envelope
+	connectPayload = "payload"
+	connectSchema  = "schema"
+
+	// Header names of the CloudEvents Kafka protocol binding
+	cloudEventsHeaderPrefix  = "ce_"
+	cloudEventsContentType   = "application/cloudevents+json"
+	headerContentType        = "content-type"
+	cloudEventsSpecVersion   = "specversion"
+	cloudEventsHeaderID      = cloudEventsHeaderPrefix + "id"
+	cloudEventsHeaderType    = cloudEventsHeaderPrefix + "type"
+	cloudEventsHeaderTime    = cloudEventsHeaderPrefix + "time"
+	cloudEventsHeaderSubject = cloudEventsHeaderPrefix + "subject"
+	cloudEventsHeaderVersion = cloudEventsHeaderPrefix + cloudEventsSpecVersion
+)
+
+var (
+	ErrInvalidCloudEvent = errors.New("invalid cloud event")
+)
+
+// decodedEvent is a raw message decoded into a device event. ID is the ID given to the event by
+// its producer, empty if the format has none
+type decodedEvent struct {
+	Event  k.DeviceEvent
+	ID     string
+	Format string
+}
+
+// cloudEvent is a structured mode CloudEvent. Only the attributes used by the Cleaner are decoded
+type cloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Time        string          `json:"time"`
+	Subject     string          `json:"subject"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// cloudEventData is the data of a device CloudEvent. The device ID may be in the data, or in the
+// subject attribute
+type cloudEventData struct {
+	DeviceID  string `json:"device_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// decodeEvent detects the format of a raw message and decodes it into a device event. Accepted
+// formats are binary mode CloudEvents (attributes in ce_ headers, data in the value), structured
+// mode CloudEvents, Kafka Connect envelopes with or without a schema, and the legacy flat
+// {device_id, event_type, timestamp} JSON
+func decodeEvent(m kafka.Message) (decodedEvent, error) {
+	const fn = "decodeEvent"
+	if attrs := cloudEventsHeaders(m.Headers); attrs[cloudEventsHeaderVersion] != "" {
+		ce := cloudEvent{
+			SpecVersion: attrs[cloudEventsHeaderVersion],
+			ID:          attrs[cloudEventsHeaderID],
+			Type:        attrs[cloudEventsHeaderType],
+			Time:        attrs[cloudEventsHeaderTime],
+			Subject:     attrs[cloudEventsHeaderSubject],
+			Data:        m.Value,
+		}
+		event, err := ce.deviceEvent(string(m.Key))
+		if err != nil {
+			return decodedEvent{}, fmt.Errorf("%s:%w", fn, err)
+		}
+		return decodedEvent{Event: event, ID: ce.ID, Format: FormatCloudEventsBinary}, nil
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(m.Value, &probe); err != nil {
+		return decodedEvent{}, fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+	}
+
+	if _, ok := probe[cloudEventsSpecVersion]; ok || strings.HasPrefix(headerValue(m.Headers, headerContentType), cloudEventsContentType) {
+		var ce cloudEvent
+		if err := json.Unmarshal(m.Value, &ce); err != nil {
+			return decodedEvent{}, fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+		}
+		event, err := ce.deviceEvent(string(m.Key))
+		if err != nil {
+			return decodedEvent{}, fmt.Errorf("%s:%w", fn, err)
+		}
+		return decodedEvent{Event: event, ID: ce.ID, Format: FormatCloudEventsStructured}, nil
+	}
+
+	if _, ok := probe[connectPayload]; ok {
+		if _, ok := probe[connectSchema]; ok {
+			var record k.StructuredConnectRecord
+			if err := json.Unmarshal(m.Value, &record); err != nil {
+				return decodedEvent{}, fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+			}
+			return decodedEvent{Event: record.Payload, Format: FormatConnectStructured}, nil
+		}
+		var record k.UnstructuredConnectRecord
+		if err := json.Unmarshal(m.Value, &record); err != nil {
+			return decodedEvent{}, fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+		}
+		return decodedEvent{Event: record.Payload, Format: FormatConnectUnstructured}, nil
+	}
+
+	var event k.DeviceEvent
+	if err := json.Unmarshal(m.Value, &event); err != nil {
+		return decodedEvent{}, fmt.Errorf("%s:%w:%w", fn, ErrJSONParse, err)
+	}
+	return decodedEvent{Event: event, Format: FormatFlat}, nil
+}
+
+// deviceEvent maps a CloudEvent onto a device event. The event type is the last dot separated
+// segment of the type attribute, so both "device_enter" and "com.acme.device_enter" map to
+// device_enter. The device ID falls back from the data, to the subject, to the message key
+func (ce cloudEvent) deviceEvent(key string) (k.DeviceEvent, error) {
+	if ce.ID == "" || ce.Type == "" {
+		return k.DeviceEvent{}, fmt.Errorf("%w:missing id or type", ErrInvalidCloudEvent)
+	}
+
+	var data cloudEventData
+	if len(ce.Data) > 0 && string(ce.Data) != "null" {
+		if err := json.Unmarshal(ce.Data, &data); err != nil {
+			return k.DeviceEvent{}, fmt.Errorf("%w:%w", ErrJSONParse, err)
+		}
+	}
+
+	event := k.DeviceEvent{
+		DeviceID:  data.DeviceID,
+		EventType: ce.Type[strings.LastIndex(ce.Type, ".")+1:],
+		Timestamp: data.Timestamp,
+	}
+	if event.DeviceID == "" {
+		event.DeviceID = ce.Subject
+	}
+	if event.DeviceID == "" {
+		event.DeviceID = key
+	}
+	if event.DeviceID == "" {
+		return k.DeviceEvent{}, fmt.Errorf("%w:missing device id", ErrInvalidCloudEvent)
+	}
+
+	if ce.Time != "" {
+		t, err := time.Parse(time.RFC3339, ce.Time)
+		if err != nil {
+			return k.DeviceEvent{}, fmt.Errorf("%w:%w", ErrInvalidCloudEvent, err)
+		}
+		event.Timestamp = t.UnixMilli()
+	}
+	if event.Timestamp == 0 {
+		return k.DeviceEvent{}, fmt.Errorf("%w:missing time", ErrInvalidCloudEvent)
+	}
+	return event, nil
+}
+
+// cloudEventsHeaders returns the ce_ prefixed headers of a message
+func cloudEventsHeaders(headers []kafka.Header) map[string]string {
+	attrs := make(map[string]string)
+	for _, h := range headers {
+		if strings.HasPrefix(h.Key, cloudEventsHeaderPrefix) {
+			attrs[h.Key] = string(h.Value)
+		}
+	}
+	return attrs
+}
+
+func headerValue(headers []kafka.Header, key string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Key, key) {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
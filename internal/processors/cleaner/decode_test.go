@@ -0,0 +1,166 @@
+package cleaner
+
+import (
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_decodeEvent(t *testing.T) {
+	cases := []struct {
+		name          string
+		inputMsg      kafka.Message
+		expectedEvent decodedEvent
+		expectedErr   error
+	}{
+		{
+			name: "legacy flat",
+			inputMsg: kafka.Message{
+				Value: []byte(`{"device_id":"device123","event_type":"device_enter","timestamp":1700000000000}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 1700000000000},
+				Format: FormatFlat,
+			},
+		},
+		{
+			name: "connect unstructured envelope",
+			inputMsg: kafka.Message{
+				Value: []byte(`{"payload":{"device_id":"device123","event_type":"device_exit","timestamp":1700000000000}}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 1700000000000},
+				Format: FormatConnectUnstructured,
+			},
+		},
+		{
+			name: "connect structured envelope",
+			inputMsg: kafka.Message{
+				Value: []byte(`{
+					"schema": {"type":"struct","name":"DeviceUpdate","optional":false,"fields":[
+						{"field":"timestamp","type":"int64"},
+						{"field":"device_id","type":"string"},
+						{"field":"event_type","type":"string"}
+					]},
+					"payload": {"device_id":"device123","event_type":"device_enter","timestamp":1700000000000}
+				}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 1700000000000},
+				Format: FormatConnectStructured,
+			},
+		},
+		{
+			name: "connect envelope with invalid payload",
+			inputMsg: kafka.Message{
+				Value: []byte(`{"payload":"not-an-event"}`),
+			},
+			expectedErr: ErrJSONParse,
+		},
+		{
+			name: "cloudevents structured mode",
+			inputMsg: kafka.Message{
+				Value: []byte(`{
+					"specversion": "1.0",
+					"id": "event123",
+					"source": "/gateways/1",
+					"type": "com.acme.device_enter",
+					"time": "2023-11-14T22:13:20Z",
+					"datacontenttype": "application/json",
+					"data": {"device_id": "device123"}
+				}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 1700000000000},
+				ID:     "event123",
+				Format: FormatCloudEventsStructured,
+			},
+		},
+		{
+			name: "cloudevents structured mode - device ID from subject",
+			inputMsg: kafka.Message{
+				Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/cloudevents+json; charset=UTF-8")}},
+				Value: []byte(`{
+					"specversion": "1.0",
+					"id": "event123",
+					"type": "device_exit",
+					"subject": "device123",
+					"time": "2023-11-14T22:13:20Z"
+				}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 1700000000000},
+				ID:     "event123",
+				Format: FormatCloudEventsStructured,
+			},
+		},
+		{
+			name: "cloudevents binary mode",
+			inputMsg: kafka.Message{
+				Key: []byte("device123"),
+				Headers: []kafka.Header{
+					{Key: "ce_specversion", Value: []byte("1.0")},
+					{Key: "ce_id", Value: []byte("event123")},
+					{Key: "ce_source", Value: []byte("/gateways/1")},
+					{Key: "ce_type", Value: []byte("com.acme.device_exit")},
+					{Key: "ce_time", Value: []byte("2023-11-14T22:13:20Z")},
+					{Key: "content-type", Value: []byte("application/json")},
+				},
+				Value: []byte(`{"device_id":"device123"}`),
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 1700000000000},
+				ID:     "event123",
+				Format: FormatCloudEventsBinary,
+			},
+		},
+		{
+			name: "cloudevents binary mode - device ID from key",
+			inputMsg: kafka.Message{
+				Key: []byte("device123"),
+				Headers: []kafka.Header{
+					{Key: "ce_specversion", Value: []byte("1.0")},
+					{Key: "ce_id", Value: []byte("event123")},
+					{Key: "ce_type", Value: []byte("device_enter")},
+					{Key: "ce_time", Value: []byte("2023-11-14T22:13:20Z")},
+				},
+			},
+			expectedEvent: decodedEvent{
+				Event:  k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 1700000000000},
+				ID:     "event123",
+				Format: FormatCloudEventsBinary,
+			},
+		},
+		{
+			name: "cloudevents missing id",
+			inputMsg: kafka.Message{
+				Value: []byte(`{"specversion":"1.0","type":"device_enter","time":"2023-11-14T22:13:20Z","subject":"device123"}`),
+			},
+			expectedErr: ErrInvalidCloudEvent,
+		},
+		{
+			name: "cloudevents invalid time",
+			inputMsg: kafka.Message{
+				Value: []byte(`{"specversion":"1.0","id":"event123","type":"device_enter","time":"yesterday","subject":"device123"}`),
+			},
+			expectedErr: ErrInvalidCloudEvent,
+		},
+		{
+			name: "invalid JSON",
+			inputMsg: kafka.Message{
+				Value: []byte("not-a-json"),
+			},
+			expectedErr: ErrJSONParse,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeEvent(tt.inputMsg)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedEvent, decoded)
+		})
+	}
+}
@@ -37,6 +37,69 @@ func (_m *MockdeviceCache) EXPECT() *MockdeviceCache_Expecter {
 	return &MockdeviceCache_Expecter{mock: &_m.Mock}
 }
 
+// CompareAndSet provides a mock function for the type MockdeviceCache
+func (_mock *MockdeviceCache) CompareAndSet(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState) bool {
+	ret := _mock.Called(s, deviceState, deviceState1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for CompareAndSet")
+	}
+
+	var r0 bool
+	if returnFunc, ok := ret.Get(0).(func(string, cache.DeviceState, cache.DeviceState) bool); ok {
+		r0 = returnFunc(s, deviceState, deviceState1)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+	return r0
+}
+
+// MockdeviceCache_CompareAndSet_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CompareAndSet'
+type MockdeviceCache_CompareAndSet_Call struct {
+	*mock.Call
+}
+
+// CompareAndSet is a helper method to define mock.On call
+//   - s string
+//   - deviceState cache.DeviceState
+//   - deviceState1 cache.DeviceState
+func (_e *MockdeviceCache_Expecter) CompareAndSet(s interface{}, deviceState interface{}, deviceState1 interface{}) *MockdeviceCache_CompareAndSet_Call {
+	return &MockdeviceCache_CompareAndSet_Call{Call: _e.mock.On("CompareAndSet", s, deviceState, deviceState1)}
+}
+
+func (_c *MockdeviceCache_CompareAndSet_Call) Run(run func(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState)) *MockdeviceCache_CompareAndSet_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 string
+		if args[0] != nil {
+			arg0 = args[0].(string)
+		}
+		var arg1 cache.DeviceState
+		if args[1] != nil {
+			arg1 = args[1].(cache.DeviceState)
+		}
+		var arg2 cache.DeviceState
+		if args[2] != nil {
+			arg2 = args[2].(cache.DeviceState)
+		}
+		run(
+			arg0,
+			arg1,
+			arg2,
+		)
+	})
+	return _c
+}
+
+func (_c *MockdeviceCache_CompareAndSet_Call) Return(b bool) *MockdeviceCache_CompareAndSet_Call {
+	_c.Call.Return(b)
+	return _c
+}
+
+func (_c *MockdeviceCache_CompareAndSet_Call) RunAndReturn(run func(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState) bool) *MockdeviceCache_CompareAndSet_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Get provides a mock function for the type MockdeviceCache
 func (_mock *MockdeviceCache) Get(s string) (cache.DeviceState, bool) {
 	ret := _mock.Called(s)
@@ -97,25 +160,37 @@ func (_c *MockdeviceCache_Get_Call) RunAndReturn(run func(s string) (cache.Devic
 	return _c
 }
 
-// Set provides a mock function for the type MockdeviceCache
-func (_mock *MockdeviceCache) Set(s string, deviceState cache.DeviceState) {
-	_mock.Called(s, deviceState)
-	return
+// Reserve provides a mock function for the type MockdeviceCache
+func (_mock *MockdeviceCache) Reserve(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState) bool {
+	ret := _mock.Called(s, deviceState, deviceState1)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Reserve")
+	}
+
+	var r0 bool
+	if returnFunc, ok := ret.Get(0).(func(string, cache.DeviceState, cache.DeviceState) bool); ok {
+		r0 = returnFunc(s, deviceState, deviceState1)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+	return r0
 }
 
-// MockdeviceCache_Set_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Set'
-type MockdeviceCache_Set_Call struct {
+// MockdeviceCache_Reserve_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Reserve'
+type MockdeviceCache_Reserve_Call struct {
 	*mock.Call
 }
 
-// Set is a helper method to define mock.On call
+// Reserve is a helper method to define mock.On call
 //   - s string
 //   - deviceState cache.DeviceState
-func (_e *MockdeviceCache_Expecter) Set(s interface{}, deviceState interface{}) *MockdeviceCache_Set_Call {
-	return &MockdeviceCache_Set_Call{Call: _e.mock.On("Set", s, deviceState)}
+//   - deviceState1 cache.DeviceState
+func (_e *MockdeviceCache_Expecter) Reserve(s interface{}, deviceState interface{}, deviceState1 interface{}) *MockdeviceCache_Reserve_Call {
+	return &MockdeviceCache_Reserve_Call{Call: _e.mock.On("Reserve", s, deviceState, deviceState1)}
 }
 
-func (_c *MockdeviceCache_Set_Call) Run(run func(s string, deviceState cache.DeviceState)) *MockdeviceCache_Set_Call {
+func (_c *MockdeviceCache_Reserve_Call) Run(run func(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState)) *MockdeviceCache_Reserve_Call {
 	_c.Call.Run(func(args mock.Arguments) {
 		var arg0 string
 		if args[0] != nil {
@@ -125,20 +200,65 @@ func (_c *MockdeviceCache_Set_Call) Run(run func(s string, deviceState cache.Dev
 		if args[1] != nil {
 			arg1 = args[1].(cache.DeviceState)
 		}
+		var arg2 cache.DeviceState
+		if args[2] != nil {
+			arg2 = args[2].(cache.DeviceState)
+		}
 		run(
 			arg0,
 			arg1,
+			arg2,
+		)
+	})
+	return _c
+}
+
+func (_c *MockdeviceCache_Reserve_Call) Return(b bool) *MockdeviceCache_Reserve_Call {
+	_c.Call.Return(b)
+	return _c
+}
+
+func (_c *MockdeviceCache_Reserve_Call) RunAndReturn(run func(s string, deviceState cache.DeviceState, deviceState1 cache.DeviceState) bool) *MockdeviceCache_Reserve_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Settle provides a mock function for the type MockdeviceCache
+func (_mock *MockdeviceCache) Settle(s string) {
+	_mock.Called(s)
+	return
+}
+
+// MockdeviceCache_Settle_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Settle'
+type MockdeviceCache_Settle_Call struct {
+	*mock.Call
+}
+
+// Settle is a helper method to define mock.On call
+//   - s string
+func (_e *MockdeviceCache_Expecter) Settle(s interface{}) *MockdeviceCache_Settle_Call {
+	return &MockdeviceCache_Settle_Call{Call: _e.mock.On("Settle", s)}
+}
+
+func (_c *MockdeviceCache_Settle_Call) Run(run func(s string)) *MockdeviceCache_Settle_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		var arg0 string
+		if args[0] != nil {
+			arg0 = args[0].(string)
+		}
+		run(
+			arg0,
 		)
 	})
 	return _c
 }
 
-func (_c *MockdeviceCache_Set_Call) Return() *MockdeviceCache_Set_Call {
+func (_c *MockdeviceCache_Settle_Call) Return() *MockdeviceCache_Settle_Call {
 	_c.Call.Return()
 	return _c
 }
 
-func (_c *MockdeviceCache_Set_Call) RunAndReturn(run func(s string, deviceState cache.DeviceState)) *MockdeviceCache_Set_Call {
+func (_c *MockdeviceCache_Settle_Call) RunAndReturn(run func(s string)) *MockdeviceCache_Settle_Call {
 	_c.Run(run)
 	return _c
 }
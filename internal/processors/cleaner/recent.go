@@ -0,0 +1,47 @@
+package cleaner
+
+import (
+	"slices"
+	"sync"
+)
+
+// recentIDsPerDevice is how many accepted event IDs are remembered per device. Redeliveries come
+// shortly after the original, so a handful covers them
+const recentIDsPerDevice = 8
+
+// recentIDs remembers the IDs of the last events accepted for each device, so an event redelivered
+// after the device has moved on is still dropped. The zero value is ready to use
+type recentIDs struct {
+	mu  sync.Mutex
+	ids map[string][]string
+}
+
+func (r *recentIDs) contains(deviceID, eventID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Contains(r.ids[deviceID], eventID)
+}
+
+// add records eventID for the device, forgetting the oldest ID once the device has
+// recentIDsPerDevice of them
+func (r *recentIDs) add(deviceID, eventID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ids == nil {
+		r.ids = make(map[string][]string)
+	}
+	ids := r.ids[deviceID]
+	if len(ids) == recentIDsPerDevice {
+		ids = slices.Delete(ids, 0, 1)
+	}
+	r.ids[deviceID] = append(ids, eventID)
+}
+
+// remove forgets every ID of the given devices
+func (r *recentIDs) remove(deviceIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, deviceID := range deviceIDs {
+		delete(r.ids, deviceID)
+	}
+}
@@ -0,0 +1,32 @@
+package cleaner
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_recentIDs(t *testing.T) {
+	var r recentIDs
+	for i := range recentIDsPerDevice + 1 {
+		r.add("device123", fmt.Sprintf("event%d", i))
+	}
+
+	assert.False(t, r.contains("device123", "event0"), "oldest ID should be forgotten")
+	for i := 1; i <= recentIDsPerDevice; i++ {
+		assert.True(t, r.contains("device123", fmt.Sprintf("event%d", i)))
+	}
+	assert.False(t, r.contains("device456", "event1"), "IDs should be kept per device")
+}
+
+func Test_recentIDs_remove(t *testing.T) {
+	var r recentIDs
+	r.add("device123", "event1")
+	r.add("device456", "event2")
+
+	r.remove([]string{"device123"})
+	assert.False(t, r.contains("device123", "event1"))
+	assert.True(t, r.contains("device456", "event2"))
+	assert.NotContains(t, r.ids, "device123", "removed devices should not be kept")
+}
@@ -2,10 +2,13 @@ package packer
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"sr-backend-home-assessment/internal/worker"
+	"time"
 
 	k "sr-backend-home-assessment/internal/kafka"
 
@@ -13,38 +16,85 @@ import (
 )
 
 var (
-	ErrReadMessage  = errors.New("error reading message")
-	ErrWriteMessage = errors.New("error writing message")
+	ErrReadMessage   = errors.New("error reading message")
+	ErrWriteMessage  = errors.New("error writing message")
+	ErrRouteMessage  = errors.New("error writing routed message")
+	ErrCommitMessage = errors.New("error committing message")
+	ErrParseMessage  = errors.New("error parsing JSON")
+	ErrHydrateStates = errors.New("error hydrating device states")
 )
 
+const (
+	workerName = "packer-worker"
+	// idleTimeout is how long hydration waits for the next message of a partition that has not
+	// reached its end offset before giving up
+	idleTimeout = time.Second * 30
+)
+
+// routeStats counts the records matched by each route, served at /debug/vars
+var routeStats = expvar.NewMap("packer_routes")
+
 type Config struct {
 	Brokers         string
 	ConsumerGroupID string
 	ConsumerTopic   string
 	PublisherTopic  string
+	// Routes copy the published records, or the events they are built from, to more topics, see
+	// Route
+	Routes []Route
 }
 
+// Packer builds the state of every device from its cleaned events, and publishes it to the
+// compacted topic, so the compacted topic holds a materialized view of the current state of
+// every device. Each state is built from the previous state of the device, as read back from the
+// compacted topic by States. The input and the compacted topic are fixed; routes only add
+// outputs, each a copy of the state record or of the cleaned event, see Route
 type Packer struct {
 	worker *worker.Worker
 	reader k.Reader
+	// writer writes to the topic set on each message
 	writer k.Writer
+	routes []Route
+	topic  string
+	states *States
+	// pending holds a fetched message until all of its records are written and it is committed,
+	// so a failed message is retried from here
+	pending *pendingMessage
+}
+
+// pendingMessage is a fetched message and the progress of its writes
+type pendingMessage struct {
+	message kafka.Message
+	// published is true once the compacted topic record is written, or the message skipped
+	published bool
+	// routed are the records routed from the message, written after the compacted topic record
+	routed []kafka.Message
 }
 
 func New(cfg Config) *Packer {
 	packer := &Packer{
-		reader: kafka.NewReader(kafka.ReaderConfig{
-			Brokers: []string{cfg.Brokers},
-			GroupID: cfg.ConsumerGroupID,
-			Topic:   cfg.ConsumerTopic,
-		}),
 		writer: kafka.NewWriter(kafka.WriterConfig{
-			Brokers: []string{cfg.Brokers},
+			Brokers:  []string{cfg.Brokers},
+			Balancer: k.KeyBalancer,
+		}),
+		routes: cfg.Routes,
+		topic:  cfg.PublisherTopic,
+		states: NewStates(StatesConfig{
+			Brokers: cfg.Brokers,
 			Topic:   cfg.PublisherTopic,
 		}),
 	}
+	// A device is on the same partition of the cleaned and the compacted topics, which are keyed
+	// by device ID and have the same partition count, so the assigned partitions are owned in both
+	packer.reader = k.NewGroupReader(k.GroupReaderConfig{
+		Brokers:  cfg.Brokers,
+		GroupID:  cfg.ConsumerGroupID,
+		Topic:    cfg.ConsumerTopic,
+		Listener: packer,
+	})
 
 	packer.worker = worker.New(worker.Config{
-		Name:      "packer-worker",
+		Name:      workerName,
 		Processor: packer,
 	})
 	return packer
@@ -60,17 +110,159 @@ func (p *Packer) Close(ctx context.Context) {
 	p.writer.Close()
 }
 
-// Auto-commit active
+// State returns the current state of a device, as last published to the compacted topic
+func (p *Packer) State(deviceID string) (k.DeviceState, bool) {
+	return p.states.State(deviceID)
+}
+
+// Hydrate reads the compacted topic, so the Packer builds on the states it published before it
+// was restarted, see States.Hydrate.
+// Blocking operation
+func (p *Packer) Hydrate(ctx context.Context, maxWait time.Duration) error {
+	return p.states.Hydrate(ctx, maxWait)
+}
+
+// Follow keeps reading the compacted topic after Hydrate, see States.Follow.
+// Blocking operation
+func (p *Packer) Follow(ctx context.Context) {
+	p.states.Follow(ctx)
+}
+
+// PartitionsAssigned waits until the records published to the assigned partitions, e.g. by the
+// replica that owned them before, are applied, so the Packer builds on the latest states
+func (p *Packer) PartitionsAssigned(ctx context.Context, partitions []int) error {
+	return p.states.own(ctx, partitions)
+}
+
+func (p *Packer) PartitionsRevoked(ctx context.Context, partitions []int) {
+	p.states.disown(partitions)
+}
+
+// Manual commit, offsets are committed only after every record of a message is written. Each
+// event moves its device to a new state, which is published to the compacted topic in place of the
+// event. An event no newer than the current state of its device, e.g. a redelivered one, is
+// skipped, so it is not counted twice. A tombstone, a message with a null value, is forwarded as a
+// tombstone, so that a decommissioned device is removed from the compacted topic and from every
+// routed topic. The routed records are written once the compacted topic record is, and a failed
+// write of them is retried alone, so a routed topic is never ahead of the compacted topic
 func (p *Packer) ProcessMessage(ctx context.Context) error {
 	const fn = "Packer:ProcessMessage"
-	m, err := p.reader.ReadMessage(ctx)
-	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+	if p.pending == nil {
+		m, err := p.reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+		}
+		p.pending = &pendingMessage{message: m}
 	}
-	err = p.writer.WriteMessages(ctx, kafka.Message{Key: m.Key, Value: m.Value})
-	if err != nil {
-		return fmt.Errorf("%s:%w:%w", fn, ErrWriteMessage, err)
+
+	if !p.pending.published {
+		routed, err := p.publish(ctx, p.pending.message)
+		if err != nil {
+			return fmt.Errorf("%s:%w", fn, err)
+		}
+		p.pending.routed = routed
+		p.pending.published = true
+	}
+	if len(p.pending.routed) > 0 {
+		if err := p.writer.WriteMessages(ctx, p.pending.routed...); err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrRouteMessage, err)
+		}
+	}
+	if err := p.reader.CommitMessages(ctx, p.pending.message); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrCommitMessage, err)
 	}
-	slog.InfoContext(ctx, "Published packed message", "device_id", string(m.Key))
+	p.pending = nil
 	return nil
 }
+
+// publish writes the record built from m to the compacted topic, and returns the records routed
+// from it, to be written next
+func (p *Packer) publish(ctx context.Context, m kafka.Message) ([]kafka.Message, error) {
+	p.states.updateMu.Lock()
+	defer p.states.updateMu.Unlock()
+	if m.Value == nil {
+		record := kafka.Message{
+			Topic:   p.topic,
+			Key:     m.Key,
+			Headers: k.Propagate(workerName, m),
+		}
+		if err := p.writer.WriteMessages(ctx, record); err != nil {
+			return nil, fmt.Errorf("%w:%w", ErrWriteMessage, err)
+		}
+		p.states.delete(string(m.Key))
+		slog.InfoContext(ctx, "Published tombstone", "device_id", string(m.Key))
+		return p.route(ctx, m, "", record), nil
+	}
+
+	var record k.StructuredConnectRecord
+	if err := json.Unmarshal(m.Value, &record); err != nil {
+		slog.InfoContext(ctx, "Invalid record, skipping",
+			"error", err,
+			"partition", m.Partition,
+			"offset", m.Offset,
+		)
+		return nil, nil
+	}
+	event := record.Payload
+	previous, exists := p.states.State(event.DeviceID)
+	if exists && event.Timestamp <= previous.LastTimestamp {
+		slog.InfoContext(ctx, "Stale event, skipping",
+			"device_id", event.DeviceID,
+			"timestamp", event.Timestamp,
+			"last_timestamp", previous.LastTimestamp,
+		)
+		return nil, nil
+	}
+	next := previous.Apply(event)
+	out, err := json.Marshal(next)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrParseMessage, err)
+	}
+	state := kafka.Message{
+		Topic:   p.topic,
+		Key:     m.Key,
+		Value:   out,
+		Headers: k.Propagate(workerName, m),
+	}
+	if err := p.writer.WriteMessages(ctx, state); err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrWriteMessage, err)
+	}
+	p.states.set(next)
+	slog.InfoContext(ctx, "Published device state", "device_id", event.DeviceID, "present", next.Present)
+	return p.route(ctx, m, event.EventType, state), nil
+}
+
+// route returns a copy of the state record, or of source, the message it was built from, for
+// every topic of every route matched by source. A route whose value cannot be projected is
+// skipped, as retrying would not make it projectable
+func (p *Packer) route(ctx context.Context, source kafka.Message, eventType string, state kafka.Message) []kafka.Message {
+	var records []kafka.Message
+	for _, r := range p.routes {
+		if !r.matches(source, eventType, state.Value == nil) {
+			continue
+		}
+		value := state.Value
+		if r.Value == RouteEvent {
+			value = source.Value
+		}
+		value, err := r.project(value)
+		if err != nil {
+			slog.ErrorContext(ctx, "Invalid routed value, skipping",
+				"route", r.Name,
+				"device_id", string(source.Key),
+				"error", err,
+			)
+			continue
+		}
+		for _, topic := range r.Topics {
+			records = append(records, kafka.Message{
+				Topic:   topic,
+				Key:     state.Key,
+				Value:   value,
+				Headers: state.Headers,
+			})
+		}
+		routeStats.Add(r.Name, 1)
+	}
+	return records
+}
@@ -2,6 +2,7 @@ package packer
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	k "sr-backend-home-assessment/internal/kafka"
 	"testing"
@@ -9,84 +10,334 @@ import (
 	"github.com/segmentio/kafka-go"
 	"github.com/stretchr/testify/assert"
 	mock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
+// record returns the message of value on topic, keyed by its device ID: a cleaned event record for
+// a k.DeviceEvent, a compacted topic record for a k.DeviceState
+func record(topic string, value interface{}) kafka.Message {
+	var deviceID string
+	switch v := value.(type) {
+	case k.DeviceEvent:
+		deviceID = v.DeviceID
+		value = k.StructuredConnectRecord{Schema: k.StructuredSchema, Payload: v}
+	case k.DeviceState:
+		deviceID = v.DeviceID
+	}
+	data, _ := json.Marshal(value)
+	return kafka.Message{Topic: topic, Key: []byte(deviceID), Value: data}
+}
+
 func Test_ProcessMessage(t *testing.T) {
+	at := func(timestamp int64) *int64 { return &timestamp }
+	present := k.DeviceState{
+		DeviceID:      "device123",
+		Present:       true,
+		LastEvent:     "device_enter",
+		LastTimestamp: 10,
+		EnteredAt:     at(10),
+		TotalVisits:   1,
+	}
+	exited := k.DeviceState{
+		DeviceID:      "device123",
+		Present:       false,
+		LastEvent:     "device_exit",
+		LastTimestamp: 25,
+		LastExitAt:    at(25),
+		TotalVisits:   1,
+		DwellMillis:   15,
+	}
+
 	cases := []struct {
-		name        string
-		setupReader func(kafka.Message) k.Reader
-		setupWriter func(kafka.Message) k.Writer
-		inputMsg    kafka.Message
-		expectedErr error
+		name           string
+		setupReader    func() k.Reader
+		setupWriter    func() k.Writer
+		initialStates  map[string]k.DeviceState
+		expectedErr    error
+		expectedStates map[string]k.DeviceState
 	}{
 		{
-			name: "valid message",
-			inputMsg: kafka.Message{
-				Key:   []byte("device123"),
-				Value: []byte("payload"),
+			name: "first event of a device",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 10}), nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("", present))).Return(nil)
+				return w
 			},
-			setupReader: func(msg kafka.Message) k.Reader {
+			initialStates:  map[string]k.DeviceState{},
+			expectedStates: map[string]k.DeviceState{"device123": present},
+		},
+		{
+			name: "exit ends the visit",
+			setupReader: func() k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(msg, nil)
+				r.EXPECT().FetchMessage(mock.Anything).Return(record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 25}), nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
 				return r
 			},
-			setupWriter: func(msg kafka.Message) k.Writer {
+			setupWriter: func() k.Writer {
 				w := k.NewMockWriter(t)
-				w.EXPECT().WriteMessages(
-					mock.Anything,
-					[]kafka.Message{msg},
-				).Return(nil)
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("", exited))).Return(nil)
 				return w
 			},
-			expectedErr: nil,
+			initialStates:  map[string]k.DeviceState{"device123": present},
+			expectedStates: map[string]k.DeviceState{"device123": exited},
 		},
 		{
-			name: "reader failed",
-			inputMsg: kafka.Message{
-				Key:   []byte("device123"),
-				Value: []byte("payload"),
+			name: "upstream metadata propagated",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 10})
+				m.Headers = k.Metadata{
+					EventID:      "event123",
+					Producer:     "cleaner-worker",
+					SourceTopic:  "device-events",
+					SourceOffset: 42,
+				}.Headers()
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				expected := record("", present)
+				expected.Headers = k.Metadata{EventID: "event123"}.Headers()
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(expected)).Return(nil)
+				return w
+			},
+			initialStates:  map[string]k.DeviceState{},
+			expectedStates: map[string]k.DeviceState{"device123": present},
+		},
+		{
+			name: "stale event skipped",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 10}), nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+				return r
 			},
-			setupReader: func(msg kafka.Message) k.Reader {
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			initialStates:  map[string]k.DeviceState{"device123": present},
+			expectedStates: map[string]k.DeviceState{"device123": present},
+		},
+		{
+			name: "tombstone forwarded",
+			setupReader: func() k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(msg, errors.New("failed to read"))
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{Key: []byte("device123")}, nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
 				return r
 			},
-			setupWriter: func(msg kafka.Message) k.Writer {
-				return k.NewMockWriter(t)
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(kafka.Message{Key: []byte("device123")})).Return(nil)
+				return w
+			},
+			initialStates:  map[string]k.DeviceState{"device123": present},
+			expectedStates: map[string]k.DeviceState{},
+		},
+		{
+			name: "invalid message JSON",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{Key: []byte("device123"), Value: []byte("not-a-json")}, nil)
+				r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+				return r
 			},
-			expectedErr: ErrReadMessage,
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			initialStates:  map[string]k.DeviceState{},
+			expectedStates: map[string]k.DeviceState{},
 		},
 		{
-			name: "writer failed",
-			inputMsg: kafka.Message{
-				Key:   []byte("device123"),
-				Value: []byte("payload"),
+			name: "reader failed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{}, errors.New("failed to read"))
+				return r
 			},
-			setupReader: func(msg kafka.Message) k.Reader {
+			setupWriter:    func() k.Writer { return k.NewMockWriter(t) },
+			initialStates:  map[string]k.DeviceState{},
+			expectedErr:    ErrReadMessage,
+			expectedStates: map[string]k.DeviceState{},
+		},
+		{
+			name: "writer failed - state unchanged",
+			setupReader: func() k.Reader {
 				r := k.NewMockReader(t)
-				r.EXPECT().ReadMessage(mock.Anything).Return(msg, nil)
+				r.EXPECT().FetchMessage(mock.Anything).Return(record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_exit", Timestamp: 25}), nil)
 				return r
 			},
-			setupWriter: func(msg kafka.Message) k.Writer {
+			setupWriter: func() k.Writer {
 				w := k.NewMockWriter(t)
-				w.EXPECT().WriteMessages(
-					mock.Anything,
-					[]kafka.Message{msg},
-				).Return(errors.New("failed to write"))
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("", exited))).Return(errors.New("failed to write"))
 				return w
 			},
-			expectedErr: ErrWriteMessage,
+			initialStates:  map[string]k.DeviceState{"device123": present},
+			expectedErr:    ErrWriteMessage,
+			expectedStates: map[string]k.DeviceState{"device123": present},
 		},
 	}
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			packer := &Packer{
-				reader: tt.setupReader(tt.inputMsg),
-				writer: tt.setupWriter(tt.inputMsg),
+				reader: tt.setupReader(),
+				writer: tt.setupWriter(),
+				states: &States{byDevice: tt.initialStates},
 			}
 			err := packer.ProcessMessage(context.Background())
 			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedStates, packer.states.byDevice)
 		})
 	}
 }
+
+func Test_ProcessMessage_Routes(t *testing.T) {
+	routes := []Route{
+		{Name: "berlin", KeyPattern: "^berlin-", Topics: []string{"berlin_compacted"}},
+		{Name: "enters", EventTypes: []string{"device_enter"}, Topics: []string{"enters", "enters_copy"}, Fields: []string{"device_id", "present"}},
+		{Name: "cleaner", Headers: map[string]string{k.HeaderProducer: "cleaner-worker"}, Topics: []string{"cleaned_by_cleaner"}},
+		{Name: "lyon", KeyPattern: "^lyon-", Value: RouteEvent, Topics: []string{"lyon_events"}},
+	}
+	for i := range routes {
+		require.NoError(t, routes[i].compile())
+	}
+	at := func(timestamp int64) *int64 { return &timestamp }
+	berlin := k.DeviceState{DeviceID: "berlin-1", Present: true, LastEvent: "device_enter", LastTimestamp: 10, EnteredAt: at(10), TotalVisits: 1}
+	paris := k.DeviceState{DeviceID: "paris-1", LastEvent: "device_exit", LastTimestamp: 10, LastExitAt: at(10)}
+	lyon := k.DeviceState{DeviceID: "lyon-1", LastEvent: "device_exit", LastTimestamp: 10, LastExitAt: at(10)}
+	lyonExit := k.DeviceEvent{DeviceID: "lyon-1", EventType: "device_exit", Timestamp: 10}
+	projected := []byte(`{"device_id":"berlin-1","present":true}`)
+
+	cases := []struct {
+		name     string
+		input    kafka.Message
+		eventID  string
+		expected []kafka.Message
+	}{
+		{
+			name:  "key and event type routes",
+			input: record("", k.DeviceEvent{DeviceID: "berlin-1", EventType: "device_enter", Timestamp: 10}),
+			expected: []kafka.Message{
+				record("compacted", berlin),
+				record("berlin_compacted", berlin),
+				{Topic: "enters", Key: []byte("berlin-1"), Value: projected},
+				{Topic: "enters_copy", Key: []byte("berlin-1"), Value: projected},
+			},
+		},
+		{
+			name:     "header route",
+			input:    record("", k.DeviceEvent{DeviceID: "paris-1", EventType: "device_exit", Timestamp: 10}),
+			eventID:  "event123",
+			expected: []kafka.Message{record("compacted", paris), record("cleaned_by_cleaner", paris)},
+		},
+		{
+			name:     "event route",
+			input:    record("", lyonExit),
+			expected: []kafka.Message{record("compacted", lyon), record("lyon_events", lyonExit)},
+		},
+		{
+			name:  "tombstone ignores event types",
+			input: kafka.Message{Key: []byte("berlin-1")},
+			expected: []kafka.Message{
+				{Topic: "compacted", Key: []byte("berlin-1")},
+				{Topic: "berlin_compacted", Key: []byte("berlin-1")},
+				{Topic: "enters", Key: []byte("berlin-1")},
+				{Topic: "enters_copy", Key: []byte("berlin-1")},
+			},
+		},
+		{
+			name:     "no route matched",
+			input:    record("", k.DeviceEvent{DeviceID: "paris-1", EventType: "device_exit", Timestamp: 10}),
+			expected: []kafka.Message{record("compacted", paris)},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.eventID != "" {
+				tt.input.Headers = k.Metadata{EventID: tt.eventID, Producer: "cleaner-worker"}.Headers()
+				for i := range tt.expected {
+					tt.expected[i].Headers = k.Metadata{EventID: tt.eventID}.Headers()
+				}
+			}
+			r := k.NewMockReader(t)
+			r.EXPECT().FetchMessage(mock.Anything).Return(tt.input, nil)
+			r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil)
+			w := k.NewMockWriter(t)
+			w.EXPECT().WriteMessages(mock.Anything, matchMessages(tt.expected[0])).Return(nil).Once()
+			if len(tt.expected) > 1 {
+				w.EXPECT().WriteMessages(mock.Anything, matchMessages(tt.expected[1:]...)).Return(nil).Once()
+			}
+
+			packer := &Packer{
+				reader: r,
+				writer: w,
+				routes: routes,
+				topic:  "compacted",
+				states: &States{byDevice: map[string]k.DeviceState{}},
+			}
+			require.NoError(t, packer.ProcessMessage(context.Background()))
+		})
+	}
+}
+
+func Test_ProcessMessage_RetryRoutes(t *testing.T) {
+	routes := []Route{{Name: "all", Topics: []string{"copy"}}}
+	require.NoError(t, routes[0].compile())
+	enteredAt := int64(10)
+	state := k.DeviceState{DeviceID: "device123", Present: true, LastEvent: "device_enter", LastTimestamp: 10, EnteredAt: &enteredAt, TotalVisits: 1}
+
+	r := k.NewMockReader(t)
+	r.EXPECT().FetchMessage(mock.Anything).Return(record("", k.DeviceEvent{DeviceID: "device123", EventType: "device_enter", Timestamp: 10}), nil).Once()
+	r.EXPECT().CommitMessages(mock.Anything, mock.Anything).Return(nil).Once()
+	w := k.NewMockWriter(t)
+	w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("compacted", state))).Return(nil).Once()
+	w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("copy", state))).Return(errors.New("failed to write")).Once()
+	w.EXPECT().WriteMessages(mock.Anything, matchMessages(record("copy", state))).Return(nil).Once()
+
+	packer := &Packer{
+		reader: r,
+		writer: w,
+		routes: routes,
+		topic:  "compacted",
+		states: &States{byDevice: map[string]k.DeviceState{}},
+	}
+	// The state record is written and applied once, only the routed record is written again
+	assert.ErrorIs(t, packer.ProcessMessage(context.Background()), ErrRouteMessage)
+	assert.Equal(t, map[string]k.DeviceState{"device123": state}, packer.states.byDevice)
+	require.NoError(t, packer.ProcessMessage(context.Background()))
+	assert.Nil(t, packer.pending)
+}
+
+// matchMessages matches written messages on key and value, and checks that each message carries
+// the event ID of its source message
+func matchMessages(expected ...kafka.Message) interface{} {
+	return mock.MatchedBy(func(msgs []kafka.Message) bool {
+		if len(msgs) != len(expected) {
+			return false
+		}
+		for i, m := range msgs {
+			md, ok := k.ParseMetadata(m.Headers)
+			if !ok || md.Producer != workerName {
+				return false
+			}
+			if src, ok := k.ParseMetadata(expected[i].Headers); ok && src.EventID != md.EventID {
+				return false
+			}
+			if m.Topic != expected[i].Topic || string(m.Key) != string(expected[i].Key) || string(m.Value) != string(expected[i].Value) {
+				return false
+			}
+			// A tombstone must stay a tombstone, not become an empty value
+			if (m.Value == nil) != (expected[i].Value == nil) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,136 @@
+package packer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrLoadRoutes   = errors.New("error loading routes")
+	ErrProjectValue = errors.New("error projecting value")
+)
+
+const (
+	// RouteState routes the device state record published to the compacted topic
+	RouteState = "state"
+	// RouteEvent routes the cleaned event the state record was built from, as read by the Packer
+	RouteEvent = "event"
+)
+
+// Route sends a copy of every published record that matches all of its conditions to each of its
+// topics. An empty condition matches any record. Routes only add outputs to the Packer: they
+// match the messages of its input topic, and are written after the compacted topic record
+type Route struct {
+	Name string `json:"name"`
+	// KeyPattern is a regular expression matched against the record key, i.e. the device ID
+	KeyPattern string `json:"key_pattern,omitempty"`
+	// EventTypes matches records built from an event of one of these types
+	EventTypes []string `json:"event_types,omitempty"`
+	// Headers matches records whose source message carries each of these headers with its value
+	Headers map[string]string `json:"headers,omitempty"`
+	Topics  []string          `json:"topics"`
+	// Value is the routed value, RouteState if empty or RouteEvent. A tombstone is routed as a
+	// tombstone either way
+	Value string `json:"value,omitempty"`
+	// Fields projects the routed value onto these top-level fields; the whole value is sent if empty
+	Fields []string `json:"fields,omitempty"`
+
+	key *regexp.Regexp
+}
+
+type routesFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// LoadRoutes reads the routes of the Packer from a JSON file of the form {"routes": [...]}
+func LoadRoutes(path string) ([]Route, error) {
+	const fn = "LoadRoutes"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrLoadRoutes, err)
+	}
+	var file routesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s:%w:%w", fn, ErrLoadRoutes, err)
+	}
+	for i := range file.Routes {
+		if err := file.Routes[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s:%w:%w", fn, ErrLoadRoutes, err)
+		}
+	}
+	return file.Routes, nil
+}
+
+// compile validates the route and compiles its key pattern
+func (r *Route) compile() error {
+	if len(r.Topics) == 0 {
+		return fmt.Errorf("route %q has no topics", r.Name)
+	}
+	if r.Value != "" && r.Value != RouteState && r.Value != RouteEvent {
+		return fmt.Errorf("route %q has an unknown value %q", r.Name, r.Value)
+	}
+	if r.KeyPattern == "" {
+		return nil
+	}
+	key, err := regexp.Compile(r.KeyPattern)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", r.Name, err)
+	}
+	r.key = key
+	return nil
+}
+
+// matches is true if the record built from source, with eventType, matches the route. A
+// tombstone has no event type, and is matched on key and headers only, so a removed device is
+// removed from every topic it was routed to
+func (r Route) matches(source kafka.Message, eventType string, tombstone bool) bool {
+	if r.key != nil && !r.key.Match(source.Key) {
+		return false
+	}
+	if !tombstone && len(r.EventTypes) > 0 && !slices.Contains(r.EventTypes, eventType) {
+		return false
+	}
+	for key, value := range r.Headers {
+		if !hasHeader(source.Headers, key, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// project returns the value restricted to the fields of the route. A tombstone stays a tombstone
+func (r Route) project(value []byte) ([]byte, error) {
+	if value == nil || len(r.Fields) == 0 {
+		return value, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrProjectValue, err)
+	}
+	projected := make(map[string]json.RawMessage, len(r.Fields))
+	for _, field := range r.Fields {
+		if v, ok := fields[field]; ok {
+			projected[field] = v
+		}
+	}
+	out, err := json.Marshal(projected)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrProjectValue, err)
+	}
+	return out, nil
+}
+
+func hasHeader(headers []kafka.Header, key, value string) bool {
+	for _, h := range headers {
+		if h.Key == key && string(h.Value) == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadRoutes(t *testing.T) {
+	cases := []struct {
+		name        string
+		content     string
+		expectedErr error
+		expectedLen int
+	}{
+		{
+			name:        "valid routes",
+			content:     `{"routes": [{"name": "berlin", "key_pattern": "^berlin-", "topics": ["berlin_compacted"]}, {"name": "all", "topics": ["copy"]}]}`,
+			expectedLen: 2,
+		},
+		{
+			name:        "no routes",
+			content:     `{"routes": []}`,
+			expectedLen: 0,
+		},
+		{
+			name:        "invalid JSON",
+			content:     `not-a-json`,
+			expectedErr: ErrLoadRoutes,
+		},
+		{
+			name:        "invalid key pattern",
+			content:     `{"routes": [{"name": "bad", "key_pattern": "(", "topics": ["copy"]}]}`,
+			expectedErr: ErrLoadRoutes,
+		},
+		{
+			name:        "event route",
+			content:     `{"routes": [{"name": "events", "value": "event", "topics": ["events_copy"]}]}`,
+			expectedLen: 1,
+		},
+		{
+			name:        "unknown route value",
+			content:     `{"routes": [{"name": "bad", "value": "session", "topics": ["copy"]}]}`,
+			expectedErr: ErrLoadRoutes,
+		},
+		{
+			name:        "route without topics",
+			content:     `{"routes": [{"name": "nowhere"}]}`,
+			expectedErr: ErrLoadRoutes,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+			routes, err := LoadRoutes(path)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Len(t, routes, tt.expectedLen)
+		})
+	}
+}
+
+func Test_Route_project(t *testing.T) {
+	cases := []struct {
+		name     string
+		fields   []string
+		value    []byte
+		expected []byte
+	}{
+		{
+			name:     "fields kept",
+			fields:   []string{"device_id", "present", "missing"},
+			value:    []byte(`{"device_id":"a","present":true,"total_visits":3}`),
+			expected: []byte(`{"device_id":"a","present":true}`),
+		},
+		{
+			name:     "whole value without fields",
+			value:    []byte(`{"device_id":"a","present":true}`),
+			expected: []byte(`{"device_id":"a","present":true}`),
+		},
+		{
+			name:     "tombstone kept",
+			fields:   []string{"device_id"},
+			value:    nil,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Route{Fields: tt.fields}.project(tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
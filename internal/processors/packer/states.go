@@ -0,0 +1,279 @@
+package packer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrCatchUp = errors.New("error catching up with the compacted topic")
+)
+
+const (
+	// catchUpTimeout is how long an assignment waits for the compacted topic to be followed up to
+	// its end offsets
+	catchUpTimeout = time.Second * 30
+	// catchUpInterval is how often the followed offsets are checked while catching up
+	catchUpInterval = time.Millisecond * 100
+)
+
+type StatesConfig struct {
+	Brokers string
+	// Topic is the compacted topic the states are read from
+	Topic string
+}
+
+// States is the current state of every device, read back from the compacted topic. Hydrate reads
+// the topic up to its end offsets, and Follow keeps reading it, so the records written by other
+// producers, such as the corrections of the admin API and of the consistency checker, and by
+// other Packer replicas, are applied as they are written. Safe for concurrent use
+type States struct {
+	topic   string
+	offsets k.OffsetLister
+	// newReader returns a reader of one partition of the compacted topic, starting at offset
+	newReader   func(partition int, offset int64) k.Reader
+	idleTimeout time.Duration
+
+	// updateMu serializes the update of a device by the Packer, from the read of its previous
+	// state to the publish of its next state, with the records being followed
+	updateMu sync.Mutex
+
+	mu       sync.RWMutex
+	byDevice map[string]k.DeviceState
+	// positions is the next offset to apply of every partition of the compacted topic
+	positions map[int]int64
+	// owned is the set of partitions this Packer publishes to. Its own records were applied
+	// before they were published, so they are skipped when followed
+	owned map[int]bool
+}
+
+func NewStates(cfg StatesConfig) *States {
+	return &States{
+		topic:   cfg.Topic,
+		offsets: k.NewClient(cfg.Brokers),
+		newReader: func(partition int, offset int64) k.Reader {
+			reader := kafka.NewReader(kafka.ReaderConfig{
+				Brokers:   []string{cfg.Brokers},
+				Topic:     cfg.Topic,
+				Partition: partition,
+			})
+			reader.SetOffset(offset)
+			return reader
+		},
+		idleTimeout: idleTimeout,
+		byDevice:    make(map[string]k.DeviceState),
+		positions:   make(map[int]int64),
+		owned:       make(map[int]bool),
+	}
+}
+
+// State returns the current state of a device, as last published to the compacted topic
+func (s *States) State(deviceID string) (k.DeviceState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.byDevice[deviceID]
+	return state, ok
+}
+
+func (s *States) set(state k.DeviceState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byDevice[state.DeviceID] = state
+}
+
+func (s *States) delete(deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byDevice, deviceID)
+}
+
+// Hydrate reads the compacted topic up to the end offset of every partition, where Follow then
+// resumes. The offsets are listed until the broker answers or maxWait is exceeded, as the broker
+// may not be ready yet.
+// Blocking operation
+func (s *States) Hydrate(ctx context.Context, maxWait time.Duration) error {
+	const fn = "States:Hydrate"
+	deadline := time.Now().Add(maxWait)
+	var partitions []k.PartitionOffsets
+	var err error
+	for {
+		partitions, err = s.offsets.ListPartitionOffsets(ctx, s.topic)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return fmt.Errorf("%s:%w:%w", fn, ErrHydrateStates, err)
+		}
+		slog.InfoContext(ctx, "Broker not ready", "topic", s.topic, "error", err)
+		time.Sleep(time.Second)
+	}
+	for _, partition := range partitions {
+		if partition.End > partition.First {
+			if err := s.hydratePartition(ctx, partition); err != nil {
+				return fmt.Errorf("%s:%w:%w", fn, ErrHydrateStates, err)
+			}
+		}
+		s.mu.Lock()
+		s.positions[partition.Partition] = partition.End
+		s.mu.Unlock()
+	}
+	s.mu.RLock()
+	devices := len(s.byDevice)
+	s.mu.RUnlock()
+	slog.InfoContext(ctx, "Packer device states hydrated", "topic", s.topic, "devices", devices)
+	return nil
+}
+
+func (s *States) hydratePartition(ctx context.Context, partition k.PartitionOffsets) error {
+	reader := s.newReader(partition.Partition, partition.First)
+	defer reader.Close()
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, s.idleTimeout)
+		m, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("partition %d:%w", partition.Partition, err)
+		}
+		if err := s.applyRecord(m); err != nil {
+			return fmt.Errorf("partition %d offset %d:%w", partition.Partition, m.Offset, err)
+		}
+		if m.Offset+1 >= partition.End {
+			return nil
+		}
+	}
+}
+
+// applyRecord sets the state of a device from a compacted topic record, or removes the device for
+// a tombstone
+func (s *States) applyRecord(m kafka.Message) error {
+	if m.Value == nil {
+		s.delete(string(m.Key))
+		return nil
+	}
+	state, err := k.DecodeState(m.Value)
+	if err != nil {
+		return err
+	}
+	s.set(state)
+	return nil
+}
+
+// Follow reads every partition of the compacted topic from where Hydrate stopped, and applies its
+// records, until ctx is done. Does nothing if the states were not hydrated.
+// Blocking operation
+func (s *States) Follow(ctx context.Context) {
+	s.mu.RLock()
+	positions := make(map[int]int64, len(s.positions))
+	for partition, offset := range s.positions {
+		positions[partition] = offset
+	}
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for partition, offset := range positions {
+		wg.Go(func() {
+			s.followPartition(ctx, partition, offset)
+		})
+	}
+	wg.Wait()
+}
+
+func (s *States) followPartition(ctx context.Context, partition int, offset int64) {
+	reader := s.newReader(partition, offset)
+	defer reader.Close()
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.ErrorContext(ctx, "Error following compacted topic", "topic", s.topic, "partition", partition, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := s.follow(m); err != nil {
+			slog.ErrorContext(ctx, "Invalid compacted topic record, skipping",
+				"partition", partition,
+				"offset", m.Offset,
+				"error", err,
+			)
+		}
+	}
+}
+
+// follow applies a record read by Follow, unless this Packer published it to a partition it owns
+func (s *States) follow(m kafka.Message) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.positions[m.Partition] = m.Offset + 1
+		s.mu.Unlock()
+	}()
+
+	s.mu.RLock()
+	owned := s.owned[m.Partition]
+	s.mu.RUnlock()
+	if md, ok := k.ParseMetadata(m.Headers); ok && md.Producer == workerName && owned {
+		return nil
+	}
+	return s.applyRecord(m)
+}
+
+// own waits until the given partitions of the compacted topic are followed up to their current
+// end offsets, so every record published to them before is applied, then marks them as owned
+func (s *States) own(ctx context.Context, partitions []int) error {
+	const fn = "States:own"
+	offsets, err := s.offsets.ListPartitionOffsets(ctx, s.topic)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrCatchUp, err)
+	}
+	assigned := make(map[int]bool, len(partitions))
+	for _, partition := range partitions {
+		assigned[partition] = true
+	}
+
+	deadline := time.Now().Add(catchUpTimeout)
+	for _, p := range offsets {
+		if !assigned[p.Partition] {
+			continue
+		}
+		for {
+			s.mu.RLock()
+			position := max(s.positions[p.Partition], p.First)
+			s.mu.RUnlock()
+			if position >= p.End {
+				break
+			}
+			if ctx.Err() != nil || time.Now().After(deadline) {
+				return fmt.Errorf("%s:%w:partition %d followed up to %d of %d", fn, ErrCatchUp, p.Partition, position, p.End)
+			}
+			time.Sleep(catchUpInterval)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, partition := range partitions {
+		s.owned[partition] = true
+	}
+	return nil
+}
+
+// disown marks the given partitions as no longer owned, so records published to them by the
+// Packer replica that now owns them are applied
+func (s *States) disown(partitions []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, partition := range partitions {
+		delete(s.owned, partition)
+	}
+}
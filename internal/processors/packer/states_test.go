@@ -0,0 +1,174 @@
+package packer
+
+import (
+	"context"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	mock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_States_Hydrate(t *testing.T) {
+	legacy := record("", k.DeviceEvent{DeviceID: "b", EventType: "device_enter", Timestamp: 5})
+	legacy.Offset = 1
+	state := record("", k.DeviceState{DeviceID: "a", LastEvent: "device_exit", LastTimestamp: 3, TotalVisits: 2})
+	state.Offset = 0
+	tombstone := kafka.Message{Key: []byte("c"), Offset: 3}
+
+	offsets := k.NewMockOffsetLister(t)
+	offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+		{Partition: 0, First: 0, End: 4},
+		{Partition: 1, First: 2, End: 2},
+	}, nil)
+	reader := k.NewMockReader(t)
+	reader.EXPECT().ReadMessage(mock.Anything).Return(state, nil).Once()
+	reader.EXPECT().ReadMessage(mock.Anything).Return(legacy, nil).Once()
+	reader.EXPECT().ReadMessage(mock.Anything).Return(tombstone, nil).Once()
+	reader.EXPECT().Close().Return(nil)
+
+	states := &States{
+		topic:   "topic",
+		offsets: offsets,
+		newReader: func(partition int, offset int64) k.Reader {
+			// The empty partition is not read
+			assert.Equal(t, 0, partition)
+			return reader
+		},
+		idleTimeout: time.Second,
+		byDevice: map[string]k.DeviceState{
+			"c": {DeviceID: "c", LastEvent: "device_enter"},
+		},
+		positions: map[int]int64{},
+	}
+	require.NoError(t, states.Hydrate(context.Background(), time.Second))
+
+	enteredAt := int64(5)
+	assert.Equal(t, map[string]k.DeviceState{
+		"a": {DeviceID: "a", LastEvent: "device_exit", LastTimestamp: 3, TotalVisits: 2},
+		"b": {DeviceID: "b", Present: true, LastEvent: "device_enter", LastTimestamp: 5, EnteredAt: &enteredAt},
+	}, states.byDevice)
+	// Followed from the end offsets
+	assert.Equal(t, map[int]int64{0: 4, 1: 2}, states.positions)
+}
+
+func Test_States_follow(t *testing.T) {
+	present := k.DeviceState{DeviceID: "device123", Present: true, LastEvent: "device_enter", LastTimestamp: 10, TotalVisits: 3}
+	corrected := k.DeviceState{DeviceID: "device123", LastEvent: "device_exit", LastTimestamp: 20, TotalVisits: 3}
+
+	cases := []struct {
+		name           string
+		inputMessage   kafka.Message
+		producer       string
+		owned          bool
+		expectedErr    bool
+		expectedStates map[string]k.DeviceState
+	}{
+		{
+			name:           "own record of an owned partition - skipped",
+			inputMessage:   record("", corrected),
+			producer:       workerName,
+			owned:          true,
+			expectedStates: map[string]k.DeviceState{"device123": present},
+		},
+		{
+			name:           "record of another replica - applied",
+			inputMessage:   record("", corrected),
+			producer:       workerName,
+			expectedStates: map[string]k.DeviceState{"device123": corrected},
+		},
+		{
+			name:           "correction of an owned partition - applied",
+			inputMessage:   record("", corrected),
+			producer:       "admin-api",
+			owned:          true,
+			expectedStates: map[string]k.DeviceState{"device123": corrected},
+		},
+		{
+			name:           "tombstone without metadata - applied",
+			inputMessage:   kafka.Message{Key: []byte("device123")},
+			owned:          true,
+			expectedStates: map[string]k.DeviceState{},
+		},
+		{
+			name:           "invalid record - skipped",
+			inputMessage:   kafka.Message{Key: []byte("device123"), Value: []byte("invalid-json")},
+			producer:       "admin-api",
+			expectedErr:    true,
+			expectedStates: map[string]k.DeviceState{"device123": present},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			states := &States{
+				byDevice:  map[string]k.DeviceState{"device123": present},
+				positions: map[int]int64{1: 7},
+				owned:     map[int]bool{1: tt.owned},
+			}
+			if tt.producer != "" {
+				tt.inputMessage.Headers = k.Metadata{EventID: "event123", Producer: tt.producer}.Headers()
+			}
+			tt.inputMessage.Partition = 1
+			tt.inputMessage.Offset = 7
+			err := states.follow(tt.inputMessage)
+			assert.Equal(t, tt.expectedErr, err != nil)
+			assert.Equal(t, tt.expectedStates, states.byDevice)
+			assert.Equal(t, int64(8), states.positions[1])
+		})
+	}
+}
+
+func Test_States_own(t *testing.T) {
+	cases := []struct {
+		name          string
+		positions     map[int]int64
+		expectedErr   error
+		expectedOwned map[int]bool
+	}{
+		{
+			name:          "followed up to the end offsets - owned",
+			positions:     map[int]int64{0: 5, 1: 2},
+			expectedOwned: map[int]bool{0: true},
+		},
+		{
+			name:          "behind the end offsets - not owned",
+			positions:     map[int]int64{0: 3, 1: 2},
+			expectedErr:   ErrCatchUp,
+			expectedOwned: map[int]bool{},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			offsets := k.NewMockOffsetLister(t)
+			offsets.EXPECT().ListPartitionOffsets(mock.Anything, "topic").Return([]k.PartitionOffsets{
+				{Partition: 0, First: 0, End: 5},
+				// Not assigned, so not waited for
+				{Partition: 1, First: 0, End: 9},
+			}, nil)
+			states := &States{
+				topic:     "topic",
+				offsets:   offsets,
+				positions: tt.positions,
+				owned:     map[int]bool{},
+			}
+			// Canceled, so an assignment behind the end offsets fails without waiting
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.expectedErr != nil {
+				cancel()
+			}
+			defer cancel()
+
+			err := states.own(ctx, []int{0})
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedOwned, states.owned)
+
+			states.disown([]int{0})
+			assert.Empty(t, states.owned)
+		})
+	}
+}
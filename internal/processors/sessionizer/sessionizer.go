@@ -0,0 +1,218 @@
+package sessionizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sr-backend-home-assessment/internal/db"
+	"sr-backend-home-assessment/internal/worker"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrReadMessage   = errors.New("error reading message")
+	ErrWriteMessage  = errors.New("error writing message")
+	ErrCommitMessage = errors.New("error committing message")
+	ErrStoreSession  = errors.New("error storing session")
+	ErrLoadSessions  = errors.New("error loading sessions")
+)
+
+const workerName = "sessionizer-worker"
+
+type repository interface {
+	OpenSession(context.Context, string, int64) error
+	CloseSession(context.Context, db.DeviceSession) error
+	DropOpenSessions(context.Context, string) error
+	LoadLatestSessions(context.Context) ([]db.DeviceSession, error)
+}
+
+type Config struct {
+	Brokers         string
+	ConsumerGroupID string
+	ConsumerTopic   string
+	PublisherTopic  string
+	DB              repository
+}
+
+// Sessionizer pairs each device_enter with the next device_exit of the same device, and publishes
+// the session they delimit to the sessions topic. Open sessions are stored in the DB as well as in
+// memory, so they survive a restart, see Hydrate
+type Sessionizer struct {
+	worker *worker.Worker
+	reader k.Reader
+	writer k.Writer
+	db     repository
+
+	// open holds the start of the open session of every present device
+	open map[string]int64
+	// ended holds the end of the last closed session of every absent device, so a redelivered
+	// enter or exit of that session is skipped
+	ended map[string]int64
+	// pending holds a fetched message until it is both handled and committed, so a failed message
+	// is retried from here
+	pending *kafka.Message
+}
+
+func New(cfg Config) *Sessionizer {
+	sessionizer := &Sessionizer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{cfg.Brokers},
+			GroupID: cfg.ConsumerGroupID,
+			Topic:   cfg.ConsumerTopic,
+		}),
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  []string{cfg.Brokers},
+			Topic:    cfg.PublisherTopic,
+			Balancer: k.KeyBalancer,
+		}),
+		db:    cfg.DB,
+		open:  make(map[string]int64),
+		ended: make(map[string]int64),
+	}
+
+	sessionizer.worker = worker.New(worker.Config{
+		Name:      workerName,
+		Processor: sessionizer,
+	})
+	return sessionizer
+}
+
+func (s *Sessionizer) Run(ctx context.Context) {
+	s.worker.Run(ctx)
+}
+
+func (s *Sessionizer) Close(ctx context.Context) {
+	slog.InfoContext(ctx, "Closing sessionizer resources...")
+	s.reader.Close()
+	s.writer.Close()
+}
+
+// Hydrate loads the latest session of every device stored in the DB, so a session opened before a
+// restart is closed by its exit after the restart, and the events of a session closed before the
+// restart are skipped when redelivered
+func (s *Sessionizer) Hydrate(ctx context.Context) error {
+	const fn = "Sessionizer:Hydrate"
+	sessions, err := s.db.LoadLatestSessions(ctx)
+	if err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrLoadSessions, err)
+	}
+	for _, session := range sessions {
+		if session.End == nil {
+			s.open[session.DeviceID] = session.Start
+		} else {
+			s.ended[session.DeviceID] = *session.End
+		}
+	}
+	slog.InfoContext(ctx, "Sessionizer sessions hydrated", "open", len(s.open), "closed", len(s.ended))
+	return nil
+}
+
+// Manual commit, offsets are committed only after the session is published and stored. An enter
+// opens a session, replacing the open session of the device if its exit was missed. An exit closes
+// the open session; an exit without one, e.g. a redelivered one, is skipped, and so is an enter no
+// newer than the end of the last closed session. A tombstone, for a decommissioned device, drops
+// its open session
+func (s *Sessionizer) ProcessMessage(ctx context.Context) error {
+	const fn = "Sessionizer:ProcessMessage"
+	if s.pending == nil {
+		m, err := s.reader.FetchMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrReadMessage, err)
+		}
+		s.pending = &m
+	}
+
+	if err := s.handle(ctx, *s.pending); err != nil {
+		return fmt.Errorf("%s:%w", fn, err)
+	}
+	if err := s.reader.CommitMessages(ctx, *s.pending); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrCommitMessage, err)
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *Sessionizer) handle(ctx context.Context, m kafka.Message) error {
+	if m.Value == nil {
+		deviceID := string(m.Key)
+		if err := s.db.DropOpenSessions(ctx, deviceID); err != nil {
+			return fmt.Errorf("%w:%w", ErrStoreSession, err)
+		}
+		delete(s.open, deviceID)
+		delete(s.ended, deviceID)
+		return nil
+	}
+
+	var record k.StructuredConnectRecord
+	if err := json.Unmarshal(m.Value, &record); err != nil {
+		slog.InfoContext(ctx, "Invalid record, skipping",
+			"error", err,
+			"partition", m.Partition,
+			"offset", m.Offset,
+		)
+		return nil
+	}
+	event := record.Payload
+	start, open := s.open[event.DeviceID]
+	end, ended := s.ended[event.DeviceID]
+
+	switch event.EventType {
+	case k.DeviceEnter:
+		if (open && event.Timestamp <= start) || (ended && event.Timestamp <= end) {
+			return nil
+		}
+		if err := s.db.OpenSession(ctx, event.DeviceID, event.Timestamp); err != nil {
+			return fmt.Errorf("%w:%w", ErrStoreSession, err)
+		}
+		s.open[event.DeviceID] = event.Timestamp
+		delete(s.ended, event.DeviceID)
+	case k.DeviceExit:
+		if !open || event.Timestamp < start {
+			slog.InfoContext(ctx, "Exit without open session, skipping",
+				"device_id", event.DeviceID,
+				"timestamp", event.Timestamp,
+			)
+			return nil
+		}
+		session := k.DeviceSession{
+			DeviceID:       event.DeviceID,
+			Start:          start,
+			End:            event.Timestamp,
+			DurationMillis: event.Timestamp - start,
+		}
+		// Published before it is stored: once stored as closed, the session is no longer open
+		// after a restart, and the redelivered exit would be skipped without publishing it
+		out, err := json.Marshal(session)
+		if err != nil {
+			return fmt.Errorf("%w:%w", ErrWriteMessage, err)
+		}
+		err = s.writer.WriteMessages(ctx, kafka.Message{
+			Key:     m.Key,
+			Value:   out,
+			Headers: k.Propagate(workerName, m),
+		})
+		if err != nil {
+			return fmt.Errorf("%w:%w", ErrWriteMessage, err)
+		}
+		if err := s.db.CloseSession(ctx, db.DeviceSession{
+			DeviceID:       session.DeviceID,
+			Start:          session.Start,
+			End:            &session.End,
+			DurationMillis: &session.DurationMillis,
+		}); err != nil {
+			return fmt.Errorf("%w:%w", ErrStoreSession, err)
+		}
+		delete(s.open, event.DeviceID)
+		s.ended[event.DeviceID] = session.End
+		slog.InfoContext(ctx, "Published device session",
+			"device_id", session.DeviceID,
+			"duration_ms", session.DurationMillis,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package sessionizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sr-backend-home-assessment/internal/db"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	mock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func eventMessage(deviceID, eventType string, timestamp int64) kafka.Message {
+	data, _ := json.Marshal(k.StructuredConnectRecord{
+		Schema: k.StructuredSchema,
+		Payload: k.DeviceEvent{
+			DeviceID:  deviceID,
+			EventType: eventType,
+			Timestamp: timestamp,
+		},
+	})
+	return kafka.Message{Key: []byte(deviceID), Value: data}
+}
+
+func Test_ProcessMessage(t *testing.T) {
+	enter := eventMessage("device123", "device_enter", 10)
+	exit := eventMessage("device123", "device_exit", 25)
+	end, duration := int64(25), int64(15)
+	closed := db.DeviceSession{DeviceID: "device123", Start: 10, End: &end, DurationMillis: &duration}
+	session, _ := json.Marshal(k.DeviceSession{DeviceID: "device123", Start: 10, End: 25, DurationMillis: 15})
+
+	cases := []struct {
+		name            string
+		setupReader     func() k.Reader
+		setupWriter     func() k.Writer
+		setupDB         func() repository
+		initialOpen     map[string]int64
+		initialEnded    map[string]int64
+		initialPending  *kafka.Message
+		expectedErr     error
+		expectedOpen    map[string]int64
+		expectedEnded   map[string]int64
+		expectedPending bool
+	}{
+		{
+			name: "enter opens a session",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(enter, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{enter}).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer { return k.NewMockWriter(t) },
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().OpenSession(mock.Anything, "device123", int64(10)).Return(nil)
+				return d
+			},
+			initialOpen:  map[string]int64{},
+			expectedOpen: map[string]int64{"device123": 10},
+		},
+		{
+			name: "exit closes and publishes the session",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(exit, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{exit}).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, mock.MatchedBy(func(msgs []kafka.Message) bool {
+					if len(msgs) != 1 {
+						return false
+					}
+					md, ok := k.ParseMetadata(msgs[0].Headers)
+					return ok && md.Producer == workerName &&
+						string(msgs[0].Key) == "device123" && string(msgs[0].Value) == string(session)
+				})).Return(nil)
+				return w
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().CloseSession(mock.Anything, closed).Return(nil)
+				return d
+			},
+			initialOpen:   map[string]int64{"device123": 10},
+			expectedOpen:  map[string]int64{},
+			expectedEnded: map[string]int64{"device123": 25},
+		},
+		{
+			name: "exit without open session skipped",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(exit, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{exit}).Return(nil)
+				return r
+			},
+			setupWriter:  func() k.Writer { return k.NewMockWriter(t) },
+			setupDB:      func() repository { return NewMockrepository(t) },
+			initialOpen:  map[string]int64{},
+			expectedOpen: map[string]int64{},
+		},
+		{
+			name: "enter while open replaces the session",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := eventMessage("device123", "device_enter", 30)
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{m}).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer { return k.NewMockWriter(t) },
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().OpenSession(mock.Anything, "device123", int64(30)).Return(nil)
+				return d
+			},
+			initialOpen:  map[string]int64{"device123": 10},
+			expectedOpen: map[string]int64{"device123": 30},
+		},
+		{
+			name: "redelivered enter skipped",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(enter, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{enter}).Return(nil)
+				return r
+			},
+			setupWriter:  func() k.Writer { return k.NewMockWriter(t) },
+			setupDB:      func() repository { return NewMockrepository(t) },
+			initialOpen:  map[string]int64{"device123": 10},
+			expectedOpen: map[string]int64{"device123": 10},
+		},
+		{
+			name: "enter after a closed session opens a session",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := eventMessage("device123", "device_enter", 30)
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{m}).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer { return k.NewMockWriter(t) },
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().OpenSession(mock.Anything, "device123", int64(30)).Return(nil)
+				return d
+			},
+			initialOpen:   map[string]int64{},
+			initialEnded:  map[string]int64{"device123": 25},
+			expectedOpen:  map[string]int64{"device123": 30},
+			expectedEnded: map[string]int64{},
+		},
+		{
+			name: "redelivered enter of a closed session skipped",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(enter, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{enter}).Return(nil)
+				return r
+			},
+			setupWriter:   func() k.Writer { return k.NewMockWriter(t) },
+			setupDB:       func() repository { return NewMockrepository(t) },
+			initialOpen:   map[string]int64{},
+			initialEnded:  map[string]int64{"device123": 25},
+			expectedOpen:  map[string]int64{},
+			expectedEnded: map[string]int64{"device123": 25},
+		},
+		{
+			name: "tombstone drops the open session",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := kafka.Message{Key: []byte("device123")}
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{m}).Return(nil)
+				return r
+			},
+			setupWriter: func() k.Writer { return k.NewMockWriter(t) },
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().DropOpenSessions(mock.Anything, "device123").Return(nil)
+				return d
+			},
+			initialOpen:  map[string]int64{"device123": 10},
+			expectedOpen: map[string]int64{},
+		},
+		{
+			name: "invalid message JSON skipped",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := kafka.Message{Key: []byte("device123"), Value: []byte("not-a-json")}
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{m}).Return(nil)
+				return r
+			},
+			setupWriter:  func() k.Writer { return k.NewMockWriter(t) },
+			setupDB:      func() repository { return NewMockrepository(t) },
+			initialOpen:  map[string]int64{},
+			expectedOpen: map[string]int64{},
+		},
+		{
+			name: "reader failed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{}, errors.New("failed to read"))
+				return r
+			},
+			setupWriter:  func() k.Writer { return k.NewMockWriter(t) },
+			setupDB:      func() repository { return NewMockrepository(t) },
+			initialOpen:  map[string]int64{},
+			expectedErr:  ErrReadMessage,
+			expectedOpen: map[string]int64{},
+		},
+		{
+			name: "DB failed after publishing - message kept and session left open",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(exit, nil)
+				return r
+			},
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, mock.Anything).Return(nil)
+				return w
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().CloseSession(mock.Anything, closed).Return(errors.New("db down"))
+				return d
+			},
+			initialOpen:     map[string]int64{"device123": 10},
+			expectedErr:     ErrStoreSession,
+			expectedOpen:    map[string]int64{"device123": 10},
+			expectedPending: true,
+		},
+		{
+			name:        "writer failed - message kept and session left open",
+			setupReader: func() k.Reader { return k.NewMockReader(t) },
+			setupWriter: func() k.Writer {
+				w := k.NewMockWriter(t)
+				w.EXPECT().WriteMessages(mock.Anything, mock.Anything).Return(errors.New("failed to write"))
+				return w
+			},
+			setupDB:         func() repository { return NewMockrepository(t) },
+			initialOpen:     map[string]int64{"device123": 10},
+			initialPending:  &exit,
+			expectedErr:     ErrWriteMessage,
+			expectedOpen:    map[string]int64{"device123": 10},
+			expectedPending: true,
+		},
+		{
+			name: "commit failed - message kept",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(enter, nil)
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{enter}).Return(errors.New("failed to commit"))
+				return r
+			},
+			setupWriter: func() k.Writer { return k.NewMockWriter(t) },
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().OpenSession(mock.Anything, "device123", int64(10)).Return(nil)
+				return d
+			},
+			initialOpen:     map[string]int64{},
+			expectedErr:     ErrCommitMessage,
+			expectedOpen:    map[string]int64{"device123": 10},
+			expectedPending: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.initialEnded == nil {
+				tt.initialEnded = map[string]int64{}
+			}
+			if tt.expectedEnded == nil {
+				tt.expectedEnded = tt.initialEnded
+			}
+			sessionizer := &Sessionizer{
+				reader:  tt.setupReader(),
+				writer:  tt.setupWriter(),
+				db:      tt.setupDB(),
+				open:    tt.initialOpen,
+				ended:   tt.initialEnded,
+				pending: tt.initialPending,
+			}
+			err := sessionizer.ProcessMessage(context.Background())
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedOpen, sessionizer.open)
+			assert.Equal(t, tt.expectedEnded, sessionizer.ended)
+			assert.Equal(t, tt.expectedPending, sessionizer.pending != nil)
+		})
+	}
+}
+
+func Test_Hydrate(t *testing.T) {
+	end, duration := int64(25), int64(15)
+	d := NewMockrepository(t)
+	d.EXPECT().LoadLatestSessions(mock.Anything).Return([]db.DeviceSession{
+		{DeviceID: "a", Start: 10},
+		{DeviceID: "b", Start: 20},
+		{DeviceID: "c", Start: 10, End: &end, DurationMillis: &duration},
+	}, nil)
+
+	sessionizer := &Sessionizer{db: d, open: map[string]int64{}, ended: map[string]int64{}}
+	require.NoError(t, sessionizer.Hydrate(context.Background()))
+	assert.Equal(t, map[string]int64{"a": 10, "b": 20}, sessionizer.open)
+	assert.Equal(t, map[string]int64{"c": 25}, sessionizer.ended)
+}
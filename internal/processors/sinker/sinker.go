@@ -0,0 +1,171 @@
+package sinker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sr-backend-home-assessment/internal/db"
+	"sr-backend-home-assessment/internal/worker"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	ErrReadMessage   = errors.New("error reading message")
+	ErrInsertEvents  = errors.New("error inserting events")
+	ErrCommitMessage = errors.New("error committing message")
+)
+
+type repository interface {
+	InsertEvents(context.Context, []db.DeviceEvent) (int64, error)
+}
+
+type Config struct {
+	Brokers         string
+	ConsumerGroupID string
+	ConsumerTopic   string
+	BatchSize       int
+	BatchTimeout    time.Duration
+	DB              repository
+}
+
+// Sinker writes cleaned events to the database in batches. It is a native alternative to the
+// Kafka Connect JDBC sink connector
+type Sinker struct {
+	worker       *worker.Worker
+	reader       k.Reader
+	db           repository
+	batchSize    int
+	batchTimeout time.Duration
+
+	// pending holds a fetched batch until it is both written to the DB and committed. The reader
+	// does not redeliver fetched messages, so a failed batch is retried from here
+	pending []kafka.Message
+}
+
+func New(cfg Config) *Sinker {
+	sinker := &Sinker{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{cfg.Brokers},
+			GroupID: cfg.ConsumerGroupID,
+			Topic:   cfg.ConsumerTopic,
+		}),
+		db:           cfg.DB,
+		batchSize:    cfg.BatchSize,
+		batchTimeout: cfg.BatchTimeout,
+	}
+	if sinker.batchSize <= 0 {
+		sinker.batchSize = 500
+	}
+	if sinker.batchTimeout <= 0 {
+		sinker.batchTimeout = time.Second
+	}
+
+	sinker.worker = worker.New(worker.Config{
+		Name:      "sinker-worker",
+		Processor: sinker,
+	})
+	return sinker
+}
+
+func (s *Sinker) Run(ctx context.Context) {
+	s.worker.Run(ctx)
+}
+
+func (s *Sinker) Close(ctx context.Context) {
+	slog.InfoContext(ctx, "Closing sinker resources...")
+	s.reader.Close()
+}
+
+// Manual commit, offsets are committed only after the DB transaction commits
+func (s *Sinker) ProcessMessage(ctx context.Context) error {
+	const fn = "Sinker:ProcessMessage"
+	if len(s.pending) == 0 {
+		batch, err := s.fetchBatch(ctx)
+		if err != nil {
+			return fmt.Errorf("%s:%w", fn, err)
+		}
+		s.pending = batch
+	}
+
+	events := make([]db.DeviceEvent, 0, len(s.pending))
+	for _, m := range s.pending {
+		// Tombstones of decommissioned devices are for the compacted topic, events are kept
+		if m.Value == nil {
+			continue
+		}
+		var record k.StructuredConnectRecord
+		if err := json.Unmarshal(m.Value, &record); err != nil {
+			slog.InfoContext(ctx, "Invalid record, skipping",
+				"error", err,
+				"partition", m.Partition,
+				"offset", m.Offset,
+			)
+			continue
+		}
+		event := db.DeviceEvent{
+			DeviceID:  record.Payload.DeviceID,
+			EventType: record.Payload.EventType,
+			Timestamp: record.Payload.Timestamp,
+		}
+		if md, ok := k.ParseMetadata(m.Headers); ok {
+			partition := int32(md.SourcePartition)
+			event.EventID = &md.EventID
+			event.SourceTopic = &md.SourceTopic
+			event.SourcePartition = &partition
+			event.SourceOffset = &md.SourceOffset
+		}
+		events = append(events, event)
+	}
+
+	inserted := int64(0)
+	if len(events) > 0 {
+		var err error
+		inserted, err = s.db.InsertEvents(ctx, events)
+		if err != nil {
+			return fmt.Errorf("%s:%w:%w", fn, ErrInsertEvents, err)
+		}
+	}
+
+	if err := s.reader.CommitMessages(ctx, s.pending...); err != nil {
+		return fmt.Errorf("%s:%w:%w", fn, ErrCommitMessage, err)
+	}
+	slog.InfoContext(ctx, "Sank cleaned messages",
+		"messages", len(s.pending),
+		"inserted", inserted,
+		"duplicates", int64(len(events))-inserted,
+	)
+	s.pending = nil
+	return nil
+}
+
+// fetchBatch blocks until one message is available, then keeps fetching until the batch is
+// full or the batch timeout has passed since the first message
+func (s *Sinker) fetchBatch(ctx context.Context) ([]kafka.Message, error) {
+	m, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w:%w", ErrReadMessage, err)
+	}
+	batch := []kafka.Message{m}
+
+	batchCtx, cancel := context.WithTimeout(ctx, s.batchTimeout)
+	defer cancel()
+	for len(batch) < s.batchSize {
+		m, err := s.reader.FetchMessage(batchCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			// Keep what has been fetched, it cannot be fetched again
+			slog.ErrorContext(ctx, "Error fetching message, flushing partial batch", "error", err)
+			break
+		}
+		batch = append(batch, m)
+	}
+	return batch, nil
+}
@@ -0,0 +1,231 @@
+package sinker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sr-backend-home-assessment/internal/db"
+	k "sr-backend-home-assessment/internal/kafka"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	mock "github.com/stretchr/testify/mock"
+)
+
+func recordMessage(deviceID, eventType string, timestamp, offset int64) kafka.Message {
+	record := k.StructuredConnectRecord{
+		Schema: k.StructuredSchema,
+		Payload: k.DeviceEvent{
+			DeviceID:  deviceID,
+			EventType: eventType,
+			Timestamp: timestamp,
+		},
+	}
+	data, _ := json.Marshal(record)
+	return kafka.Message{Key: []byte(deviceID), Value: data, Offset: offset}
+}
+
+func Test_ProcessMessage(t *testing.T) {
+	msgs := []kafka.Message{
+		recordMessage("device123", "device_enter", 1, 0),
+		recordMessage("device123", "device_exit", 2, 1),
+	}
+	events := []db.DeviceEvent{
+		{DeviceID: "device123", EventType: "device_enter", Timestamp: 1},
+		{DeviceID: "device123", EventType: "device_exit", Timestamp: 2},
+	}
+
+	cases := []struct {
+		name            string
+		setupReader     func() k.Reader
+		setupDB         func() repository
+		expectedErr     error
+		expectedPending int
+	}{
+		{
+			name: "batch written then committed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[1], nil).Once()
+				r.EXPECT().CommitMessages(mock.Anything, msgs).Return(nil)
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events).Return(int64(2), nil)
+				return d
+			},
+			expectedErr:     nil,
+			expectedPending: 0,
+		},
+		{
+			name: "lineage read from metadata headers",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				m := recordMessage("device123", "device_enter", 1, 0)
+				m.Headers = k.Metadata{
+					EventID:         "event123",
+					SourceTopic:     "device-events",
+					SourcePartition: 3,
+					SourceOffset:    42,
+				}.Headers()
+				r.EXPECT().FetchMessage(mock.Anything).Return(m, nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{}, context.DeadlineExceeded).Once()
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{m}).Return(nil)
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				eventID, topic, partition, offset := "event123", "device-events", int32(3), int64(42)
+				d.EXPECT().InsertEvents(mock.Anything, []db.DeviceEvent{{
+					DeviceID:        "device123",
+					EventType:       "device_enter",
+					Timestamp:       1,
+					EventID:         &eventID,
+					SourceTopic:     &topic,
+					SourcePartition: &partition,
+					SourceOffset:    &offset,
+				}}).Return(int64(1), nil)
+				return d
+			},
+			expectedErr:     nil,
+			expectedPending: 0,
+		},
+		{
+			name: "batch flushed on timeout",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{}, context.DeadlineExceeded).Once()
+				r.EXPECT().CommitMessages(mock.Anything, msgs[:1]).Return(nil)
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events[:1]).Return(int64(1), nil)
+				return d
+			},
+			expectedErr:     nil,
+			expectedPending: 0,
+		},
+		{
+			name: "invalid record skipped but committed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				bad := kafka.Message{Key: []byte("device123"), Value: []byte("not-a-json"), Offset: 1}
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(bad, nil).Once()
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{msgs[0], bad}).Return(nil)
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events[:1]).Return(int64(1), nil)
+				return d
+			},
+			expectedErr:     nil,
+			expectedPending: 0,
+		},
+		{
+			name: "tombstone skipped but committed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				tombstone := kafka.Message{Key: []byte("device123"), Offset: 1}
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(tombstone, nil).Once()
+				r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{msgs[0], tombstone}).Return(nil)
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events[:1]).Return(int64(1), nil)
+				return d
+			},
+			expectedErr:     nil,
+			expectedPending: 0,
+		},
+		{
+			name: "reader failed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(kafka.Message{}, errors.New("failed"))
+				return r
+			},
+			setupDB: func() repository {
+				return NewMockrepository(t)
+			},
+			expectedErr:     ErrReadMessage,
+			expectedPending: 0,
+		},
+		{
+			name: "insert failed - not committed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[1], nil).Once()
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events).Return(int64(0), errors.New("failed"))
+				return d
+			},
+			expectedErr:     ErrInsertEvents,
+			expectedPending: 2,
+		},
+		{
+			name: "commit failed",
+			setupReader: func() k.Reader {
+				r := k.NewMockReader(t)
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[0], nil).Once()
+				r.EXPECT().FetchMessage(mock.Anything).Return(msgs[1], nil).Once()
+				r.EXPECT().CommitMessages(mock.Anything, msgs).Return(errors.New("failed"))
+				return r
+			},
+			setupDB: func() repository {
+				d := NewMockrepository(t)
+				d.EXPECT().InsertEvents(mock.Anything, events).Return(int64(2), nil)
+				return d
+			},
+			expectedErr:     ErrCommitMessage,
+			expectedPending: 2,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			sinker := &Sinker{
+				reader:       tt.setupReader(),
+				db:           tt.setupDB(),
+				batchSize:    2,
+				batchTimeout: time.Millisecond * 10,
+			}
+			err := sinker.ProcessMessage(context.Background())
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Len(t, sinker.pending, tt.expectedPending)
+		})
+	}
+}
+
+func Test_ProcessMessage_RetriesPendingBatch(t *testing.T) {
+	msg := recordMessage("device123", "device_enter", 1, 0)
+	events := []db.DeviceEvent{{DeviceID: "device123", EventType: "device_enter", Timestamp: 1}}
+
+	r := k.NewMockReader(t)
+	r.EXPECT().CommitMessages(mock.Anything, []kafka.Message{msg}).Return(nil)
+	d := NewMockrepository(t)
+	d.EXPECT().InsertEvents(mock.Anything, events).Return(int64(0), nil)
+
+	// A pending batch is retried without fetching, already inserted events count as duplicates
+	sinker := &Sinker{
+		reader:  r,
+		db:      d,
+		pending: []kafka.Message{msg},
+	}
+	err := sinker.ProcessMessage(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, sinker.pending)
+}
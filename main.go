@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -9,25 +12,63 @@ import (
 	"os/signal"
 	"sr-backend-home-assessment/internal/api"
 	"sr-backend-home-assessment/internal/cache"
+	"sr-backend-home-assessment/internal/connect"
 	"sr-backend-home-assessment/internal/db"
 	"sr-backend-home-assessment/internal/processors/cleaner"
 	"sr-backend-home-assessment/internal/processors/packer"
+	"sr-backend-home-assessment/internal/processors/sessionizer"
+	"sr-backend-home-assessment/internal/processors/sinker"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
+
+	k "sr-backend-home-assessment/internal/kafka"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/segmentio/kafka-go"
 	"github.com/spf13/viper"
 )
 
+const (
+	DBSinkConnect = "connect"
+	DBSinkNative  = "native"
+
+	CacheBackendLocal = "local"
+	CacheBackendRedis = "redis"
+)
+
 type Config struct {
-	DBUser                                 string `mapstructure:"DB_USER"`
-	DBPassword                             string `mapstructure:"DB_PASSWORD"`
-	DBName                                 string `mapstructure:"DB_NAME"`
-	KafkaBroker                            string `mapstructure:"KAFKA_BROKER"`
-	KafkaDeviceEventsTopic                 string `mapstructure:"KAFKA_DEVICE_EVENTS_TOPIC"`
-	KafkaDeviceEventsCleanedTopic          string `mapstructure:"KAFKA_DEVICE_EVENTS_CLEANED_TOPIC"`
-	KafkaDeviceEventsCleanedCompactedTopic string `mapstructure:"KAFKA_DEVICE_EVENTS_CLEANED_COMPACTED_TOPIC"`
-	MigrationsPath                         string `mapstructure:"MIGRATIONS_PATH"`
+	DBUser                                 string        `mapstructure:"DB_USER"`
+	DBPassword                             string        `mapstructure:"DB_PASSWORD"`
+	DBName                                 string        `mapstructure:"DB_NAME"`
+	KafkaBroker                            string        `mapstructure:"KAFKA_BROKER"`
+	KafkaDeviceEventsTopic                 string        `mapstructure:"KAFKA_DEVICE_EVENTS_TOPIC"`
+	KafkaDeviceEventsCleanedTopic          string        `mapstructure:"KAFKA_DEVICE_EVENTS_CLEANED_TOPIC"`
+	KafkaDeviceEventsCleanedCompactedTopic string        `mapstructure:"KAFKA_DEVICE_EVENTS_CLEANED_COMPACTED_TOPIC"`
+	KafkaDeviceSessionsTopic               string        `mapstructure:"KAFKA_DEVICE_SESSIONS_TOPIC"`
+	MigrationsPath                         string        `mapstructure:"MIGRATIONS_PATH"`
+	DBMigrationMode                        string        `mapstructure:"DB_MIGRATION_MODE"`
+	DBCompressAfter                        time.Duration `mapstructure:"DB_COMPRESS_AFTER"`
+	DBRetainFor                            time.Duration `mapstructure:"DB_RETAIN_FOR"`
+	DebugAddr                              string        `mapstructure:"DEBUG_ADDR"`
+	KafkaConnectURL                        string        `mapstructure:"KAFKA_CONNECT_URL"`
+	KafkaConnectConnectorConfigPath        string        `mapstructure:"KAFKA_CONNECT_CONNECTOR_CONFIG_PATH"`
+	PackerRoutesPath                       string        `mapstructure:"PACKER_ROUTES_PATH"`
+	CleanerRetiredCheckTTL                 time.Duration `mapstructure:"CLEANER_RETIRED_CHECK_TTL"`
+	DBSink                                 string        `mapstructure:"DB_SINK"`
+	CacheBackend                           string        `mapstructure:"CACHE_BACKEND"`
+	RedisAddr                              string        `mapstructure:"REDIS_ADDR"`
+	RedisHydrate                           bool          `mapstructure:"REDIS_HYDRATE"`
+	CacheHydrationSource                   string        `mapstructure:"CACHE_HYDRATION_SOURCE"`
+	CacheSnapshotPath                      string        `mapstructure:"CACHE_SNAPSHOT_PATH"`
+	CacheSnapshotInterval                  time.Duration `mapstructure:"CACHE_SNAPSHOT_INTERVAL"`
+	CachePartitionAware                    bool          `mapstructure:"CACHE_PARTITION_AWARE"`
+	CacheEvictionTTL                       time.Duration `mapstructure:"CACHE_EVICTION_TTL"`
+	CacheEvictionInterval                  time.Duration `mapstructure:"CACHE_EVICTION_INTERVAL"`
+	ConsistencyCheckInterval               time.Duration `mapstructure:"CONSISTENCY_CHECK_INTERVAL"`
+	ConsistencyCheckGrace                  time.Duration `mapstructure:"CONSISTENCY_CHECK_GRACE"`
+	ConsistencyAutoRepair                  bool          `mapstructure:"CONSISTENCY_AUTO_REPAIR"`
 }
 
 func loadConfig() (Config, error) {
@@ -43,6 +84,166 @@ func loadConfig() (Config, error) {
 	return config, nil
 }
 
+func dbConnString(config Config) string {
+	return fmt.Sprintf("postgres://%s:%s@postgres:5432/%s?sslmode=disable", config.DBUser, config.DBPassword, config.DBName)
+}
+
+// checkConsistency runs one consistency check between the compacted topic, the DB, and the Redis
+// cache if it is the configured backend, prints the report, and exits non-zero if any mismatch
+// is left unrepaired. The local cache lives in the service, and is checked by its scheduled job
+func checkConsistency(ctx context.Context, config Config, args []string) {
+	flags := flag.NewFlagSet("check-consistency", flag.ExitOnError)
+	repair := flags.Bool("repair", config.ConsistencyAutoRepair, "repair mismatches, taking the DB as the source of truth")
+	flags.Parse(args)
+
+	db, err := db.Init(ctx, db.Config{
+		ConnString:     dbConnString(config),
+		MigrationsPath: config.MigrationsPath,
+		MigrationMode:  config.DBMigrationMode,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	checkerConfig := cache.CheckerConfig{
+		Brokers:        config.KafkaBroker,
+		CompactedTopic: config.KafkaDeviceEventsCleanedCompactedTopic,
+		DB:             db,
+		Repair:         *repair,
+		Grace:          config.ConsistencyCheckGrace,
+	}
+	switch config.CacheBackend {
+	case CacheBackendRedis:
+		redisCache := cache.NewRedis(cache.RedisConfig{
+			Addr: config.RedisAddr,
+		})
+		defer redisCache.Close()
+		checkerConfig.Cache = redisCache
+	default:
+		checkerConfig.EvictionTTL = config.CacheEvictionTTL
+	}
+	if *repair {
+		// Repairs start from the states published by the Packer, to keep their visit history
+		states := packer.NewStates(packer.StatesConfig{
+			Brokers: config.KafkaBroker,
+			Topic:   config.KafkaDeviceEventsCleanedCompactedTopic,
+		})
+		if err := states.Hydrate(ctx, time.Second*30); err != nil {
+			panic(err)
+		}
+		checkerConfig.States = states
+	}
+	checker := cache.NewChecker(checkerConfig)
+	defer checker.Close()
+
+	report, err := checker.Check(ctx)
+	if err != nil {
+		panic(err)
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	out.Encode(report)
+	if len(report.Mismatches) > report.Repaired {
+		os.Exit(1)
+	}
+}
+
+// migrateDB runs one migration operation: up, down N, goto V, force V or version. With -dry-run,
+// the migrations that up, down or goto would run are printed instead
+func migrateDB(ctx context.Context, config Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migrations that would run, without running them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: migrate [-dry-run] up | down N | goto V | force V | version")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	// arg parses the operation's argument, exiting with the usage if it is missing, invalid or
+	// below min
+	arg := func(min int) int {
+		if flags.NArg() != 2 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		n, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || n < min {
+			flags.Usage()
+			os.Exit(2)
+		}
+		return n
+	}
+
+	mg, err := db.NewMigrator(db.Config{
+		ConnString:     dbConnString(config),
+		MigrationsPath: config.MigrationsPath,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer mg.Close()
+
+	// Migrations run under the migration lock, so they do not race with a replica starting up
+	var steps []db.Step
+	var run func() error
+	switch op := flags.Arg(0); {
+	case op == "version":
+		version, dirty, err := mg.Version()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("version %d, dirty %t, latest %d\n", version, dirty, mg.Latest())
+		return
+	case op == "force":
+		if *dryRun {
+			panic(fmt.Errorf("force does not support -dry-run"))
+		}
+		// -1 forces the database to no migration
+		version := arg(-1)
+		run = func() error { return mg.Force(ctx, version) }
+	case op == "up" && *dryRun:
+		steps, err = mg.PlanUp()
+	case op == "up":
+		run = func() error { return mg.Up(ctx) }
+	case op == "down" && *dryRun:
+		steps, err = mg.PlanDown(arg(1))
+	case op == "down":
+		n := arg(1)
+		run = func() error { return mg.Down(ctx, n) }
+	case op == "goto" && *dryRun:
+		steps, err = mg.PlanGoto(uint(arg(1)))
+	case op == "goto":
+		version := uint(arg(1))
+		run = func() error { return mg.Goto(ctx, version) }
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if run != nil {
+		err = mg.Lock(ctx, run)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if *dryRun {
+		if len(steps) == 0 {
+			fmt.Println("no migrations to run")
+		}
+		for _, step := range steps {
+			fmt.Println(step)
+		}
+		return
+	}
+	version, dirty, err := mg.Version()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("version %d, dirty %t\n", version, dirty)
+}
+
 func main() {
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})))
 
@@ -51,66 +252,264 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	slog.InfoContext(ctx, "Starting service...")
-
 	config, err := loadConfig()
 	if err != nil {
 		panic(fmt.Errorf("failed to load configuration: %w", err))
 	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-consistency":
+			checkConsistency(ctx, config, os.Args[2:])
+		case "migrate":
+			migrateDB(ctx, config, os.Args[2:])
+		default:
+			panic(fmt.Errorf("unknown command %q", os.Args[1]))
+		}
+		return
+	}
+
+	slog.InfoContext(ctx, "Starting service...")
 
-	// Setup API and DB
+	// Setup API and DB, then reconcile the compression and retention policies with the config
+	storagePolicies := db.StoragePolicies{
+		CompressAfter: config.DBCompressAfter,
+		RetainFor:     config.DBRetainFor,
+	}
 	db, err := db.Init(ctx, db.Config{
-		ConnString:     fmt.Sprintf("postgres://%s:%s@postgres:5432/%s?sslmode=disable", config.DBUser, config.DBPassword, config.DBName),
+		ConnString:     dbConnString(config),
 		MigrationsPath: config.MigrationsPath,
+		MigrationMode:  config.DBMigrationMode,
 	})
 	if err != nil {
 		panic(err)
 	}
-	api := api.New(api.Config{
-		DB: db,
-	})
-
+	if err := db.ApplyStoragePolicies(ctx, storagePolicies); err != nil {
+		panic(err)
+	}
 	r := chi.NewRouter()
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
-	r.Post("/timeline", api.CreateDeviceTimeline)
-	r.Get("/timeline/{device_id}", api.GetDeviceTimeline)
 
-	// Setup event cleaner
-	cache := cache.New(cache.Config{
-		Brokers:       config.KafkaBroker,
-		ConsumerTopic: config.KafkaDeviceEventsCleanedCompactedTopic,
-	})
-	cache.Hydrate(ctx)
-	slog.InfoContext(ctx, "Cache hydrated with initial data")
-	cache.Dump()
-	wCleaner := cleaner.New(cleaner.Config{
+	// Setup DB sink, either the Kafka Connect connector reconciler or the native sinker
+	var connector *connect.Client
+	var wSinker *sinker.Sinker
+	switch config.DBSink {
+	case DBSinkNative:
+		wSinker = sinker.New(sinker.Config{
+			Brokers:         config.KafkaBroker,
+			ConsumerGroupID: "sinker-group",
+			ConsumerTopic:   config.KafkaDeviceEventsCleanedTopic,
+			DB:              db,
+		})
+	case DBSinkConnect, "":
+		connectorDef, err := connect.LoadConnectorDefinition(config.KafkaConnectConnectorConfigPath)
+		if err != nil {
+			panic(err)
+		}
+		connector = connect.New(connect.Config{
+			URL:       config.KafkaConnectURL,
+			Connector: connectorDef,
+		})
+		r.Get("/health/connect", connector.HealthCheck)
+	default:
+		panic(fmt.Errorf("unknown DB_SINK %q, must be %q or %q", config.DBSink, DBSinkConnect, DBSinkNative))
+	}
+
+	// Setup event cleaner, with either the local cache or the Redis cache shared by all replicas
+	cleanerConfig := cleaner.Config{
 		Brokers:         config.KafkaBroker,
 		ConsumerGroupID: "cleaner-group",
 		ConsumerTopic:   config.KafkaDeviceEventsTopic,
 		PublisherTopic:  config.KafkaDeviceEventsCleanedTopic,
-		Cache:           cache,
+		Registry:        db,
+		RetiredCheckTTL: config.CleanerRetiredCheckTTL,
+	}
+	// The Redis cache is shared by every replica, so only the local cache is partition aware
+	partitionAware := config.CachePartitionAware && config.CacheBackend != CacheBackendRedis
+	stateCache := cache.New(cache.Config{
+		Brokers:       config.KafkaBroker,
+		ConsumerTopic: config.KafkaDeviceEventsCleanedCompactedTopic,
+		// Snapshots are only kept up to date by the local cache, with Redis they are loaded once
+		SnapshotPath:     config.CacheSnapshotPath,
+		SnapshotInterval: config.CacheSnapshotInterval,
+		PartitionAware:   partitionAware,
+		EvictionTTL:      config.CacheEvictionTTL,
+		EvictionInterval: config.CacheEvictionInterval,
 	})
+	var redisCache *cache.RedisCache
+	apiConfig := api.Config{DB: db}
+	switch config.CacheBackend {
+	case CacheBackendRedis:
+		redisCache = cache.NewRedis(cache.RedisConfig{
+			Addr: config.RedisAddr,
+		})
+		if config.RedisHydrate {
+			if err := stateCache.HydrateFrom(ctx, config.CacheHydrationSource, db); err != nil {
+				panic(fmt.Errorf("failed to hydrate cache: %w", err))
+			}
+			if err := redisCache.Load(ctx, stateCache.Snapshot()); err != nil {
+				panic(err)
+			}
+			slog.InfoContext(ctx, "Redis cache hydrated with initial data")
+		}
+		cleanerConfig.Cache = redisCache
+		apiConfig.Cache = redisCache
+	case CacheBackendLocal, "":
+		cleanerConfig.Cache = stateCache
+		apiConfig.Cache = stateCache
+		if partitionAware {
+			// Hydrated from the compacted topic as partitions are assigned to the Cleaner
+			cleanerConfig.Rebalance = stateCache
+			break
+		}
+		if err := stateCache.HydrateFrom(ctx, config.CacheHydrationSource, db); err != nil {
+			panic(fmt.Errorf("failed to hydrate cache: %w", err))
+		}
+		slog.InfoContext(ctx, "Cache hydrated with initial data")
+		stateCache.Dump()
+	default:
+		panic(fmt.Errorf("unknown CACHE_BACKEND %q, must be %q or %q", config.CacheBackend, CacheBackendLocal, CacheBackendRedis))
+	}
+	wCleaner := cleaner.New(cleanerConfig)
 
-	wPacker := packer.New(packer.Config{
+	// Setup packer, which builds on the device states read back from the compacted topic, and
+	// routes them to more topics if configured
+	packerConfig := packer.Config{
 		Brokers:         config.KafkaBroker,
 		ConsumerGroupID: "packer-group",
 		ConsumerTopic:   config.KafkaDeviceEventsCleanedTopic,
 		PublisherTopic:  config.KafkaDeviceEventsCleanedCompactedTopic,
+	}
+	if config.PackerRoutesPath != "" {
+		routes, err := packer.LoadRoutes(config.PackerRoutesPath)
+		if err != nil {
+			panic(err)
+		}
+		packerConfig.Routes = routes
+	}
+	wPacker := packer.New(packerConfig)
+	if err := wPacker.Hydrate(ctx, time.Second*30); err != nil {
+		panic(fmt.Errorf("failed to hydrate packer: %w", err))
+	}
+
+	// Setup sessionizer, which resumes the sessions left open in the DB
+	wSessionizer := sessionizer.New(sessionizer.Config{
+		Brokers:         config.KafkaBroker,
+		ConsumerGroupID: "sessionizer-group",
+		ConsumerTopic:   config.KafkaDeviceEventsCleanedTopic,
+		PublisherTopic:  config.KafkaDeviceSessionsTopic,
+		DB:              db,
+	})
+	if err := wSessionizer.Hydrate(ctx); err != nil {
+		panic(fmt.Errorf("failed to hydrate sessionizer: %w", err))
+	}
+
+	// Setup API, with the admin API over the Cleaner's cache, and device states from the Packer
+	compactedWriter := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  []string{config.KafkaBroker},
+		Topic:    config.KafkaDeviceEventsCleanedCompactedTopic,
+		Balancer: k.KeyBalancer,
+	})
+	cleanedWriter := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  []string{config.KafkaBroker},
+		Topic:    config.KafkaDeviceEventsCleanedTopic,
+		Balancer: k.KeyBalancer,
 	})
+	apiConfig.Compacted = compactedWriter
+	apiConfig.Cleaned = cleanedWriter
+	apiConfig.States = wPacker
+	api := api.New(apiConfig)
+	r.Post("/timeline", api.CreateDeviceTimeline)
+	r.Get("/timeline/{device_id}", api.GetDeviceTimeline)
+	r.Get("/timeline/{device_id}/sessions", api.GetDeviceSessions)
+	r.Get("/stats/{device_id}", api.GetDeviceStats)
+	r.Get("/devices/{device_id}/state", api.GetDeviceState)
+	r.Put("/devices/{device_id}", api.RegisterDevice)
+	r.Delete("/devices/{device_id}", api.DeleteDevice)
+	r.Route("/admin/cache", func(r chi.Router) {
+		r.Get("/", api.ListCache)
+		r.Get("/{device_id}", api.GetCacheEntry)
+		r.Put("/{device_id}", api.PutCacheEntry)
+		r.Delete("/{device_id}", api.DeleteCacheEntry)
+	})
+	r.Get("/admin/storage", api.GetStorageStats)
+
+	// Setup consistency checks between the Cleaner's cache, the compacted topic, and the DB. A
+	// partition aware cache only holds some devices, so only the topic and the DB are checked
+	checkerConfig := cache.CheckerConfig{
+		Brokers:        config.KafkaBroker,
+		CompactedTopic: config.KafkaDeviceEventsCleanedCompactedTopic,
+		DB:             db,
+		Repair:         config.ConsistencyAutoRepair,
+		Interval:       config.ConsistencyCheckInterval,
+		Grace:          config.ConsistencyCheckGrace,
+		States:         wPacker,
+	}
+	if !partitionAware {
+		checkerConfig.Cache = apiConfig.Cache
+	}
+	if cleanerConfig.Cache == stateCache {
+		checkerConfig.EvictionTTL = config.CacheEvictionTTL
+	}
+	checker := cache.NewChecker(checkerConfig)
 
-	// Run waitgroups for cleaner, mover, and REST API
+	// Run waitgroups for cleaner, packer and sessionizer, DB sink, and REST API
 	wg1 := sync.WaitGroup{}
 	wg2 := sync.WaitGroup{}
 	wg3 := sync.WaitGroup{}
+	wg4 := sync.WaitGroup{}
+	wg5 := sync.WaitGroup{}
 	wg1.Go(func() {
 		wCleaner.Run(ctx)
 	})
 	wg2.Go(func() {
 		wPacker.Run(ctx)
 	})
+	wg2.Go(func() {
+		wPacker.Follow(ctx)
+	})
+	wg2.Go(func() {
+		wSessionizer.Run(ctx)
+	})
+	wg4.Go(func() {
+		if wSinker != nil {
+			wSinker.Run(ctx)
+		} else {
+			connector.Run(ctx)
+		}
+	})
+	if cleanerConfig.Cache == stateCache {
+		wg5.Go(func() {
+			stateCache.RunSnapshots(ctx)
+		})
+		// The Cleaner's recent event IDs of evicted devices are dropped with them
+		stateCache.OnEvict(wCleaner.Forget)
+		wg5.Go(func() {
+			stateCache.RunEviction(ctx)
+		})
+	}
+	if config.ConsistencyCheckInterval > 0 {
+		wg5.Go(func() {
+			checker.Run(ctx)
+		})
+	}
+	wg5.Go(func() {
+		db.RunStatsRefresh(ctx)
+	})
+	// The expvar counters, with the command line and memory stats, are served on their own
+	// listener, which is not published outside the container
+	if config.DebugAddr != "" {
+		debug := http.NewServeMux()
+		debug.Handle("/debug/vars", expvar.Handler())
+		wg3.Go(func() {
+			slog.InfoContext(ctx, "Debug HTTP server listening", "addr", config.DebugAddr)
+			if err := http.ListenAndServe(config.DebugAddr, debug); err != nil {
+				slog.ErrorContext(ctx, "Debug HTTP server error", "error", err)
+			}
+		})
+	}
 	wg3.Go(func() {
 		slog.InfoContext(ctx, "HTTP server listening on :8080")
 		if err := http.ListenAndServe(":8080", r); err != nil {
@@ -127,8 +526,26 @@ func main() {
 	wg1.Wait()
 	wg2.Wait()
 	wg3.Wait()
+	wg4.Wait()
+	wg5.Wait()
 
 	wCleaner.Close(ctx)
 	wPacker.Close(ctx)
+	wSessionizer.Close(ctx)
+	if wSinker != nil {
+		wSinker.Close(ctx)
+	}
+	// The stats buckets written since the last refresh are not persisted, so they are refreshed
+	// once the writers are closed
+	if err := db.RefreshStats(context.Background()); err != nil {
+		slog.ErrorContext(ctx, "Error refreshing stats of backfilled events", "error", err)
+	}
+	stateCache.Close()
+	compactedWriter.Close()
+	cleanedWriter.Close()
+	checker.Close()
+	if redisCache != nil {
+		redisCache.Close()
+	}
 
 }
@@ -13,6 +13,7 @@ DATA_FILE = "events.json"
 
 producer = KafkaProducer(
     bootstrap_servers=[KAFKA_BROKER],
+    key_serializer=lambda k: k.encode("utf-8"),
     value_serializer=lambda v: json.dumps(v).encode("utf-8"),
     acks="all",
     retries=3,
@@ -71,7 +72,8 @@ if __name__ == "__main__":
         e["timestamp"] = current_time
         del e["_ts"]
 
-        producer.send(TOPIC, value=e)
+        # Key by device ID, so each device stays on one partition
+        producer.send(TOPIC, key=e["device_id"], value=e)
         print(
             f"→ Sent device={e['device_id']} event={e['event_type']} @ {datetime.fromtimestamp(current_time/1000.0).isoformat()}"
         )
@@ -36,8 +36,9 @@ func main() {
 
 	// Set up Kafka writer
 	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "device-events",
+		Brokers:  []string{"localhost:9092"},
+		Topic:    "device-events",
+		Balancer: &kafka.Murmur2Balancer{},
 	})
 	defer writer.Close()
 
@@ -63,7 +64,10 @@ func main() {
 			fmt.Printf("failed to marshal event: %v\n", err)
 			continue
 		}
+		// Key by device ID, so each device stays on one partition
+		deviceID, _ := event["device_id"].(string)
 		msg := kafka.Message{
+			Key:   []byte(deviceID),
 			Value: value,
 		}
 		// Ensure the result of append is used